@@ -0,0 +1,101 @@
+package ircclient
+
+// Aliases are shorthand names for commands, e.g. "q" for "quote". An alias
+// may include arguments ("hi" for "say #mett hi"), which are put in front of
+// the ones given by the user. Aliases from section Alias of the config file
+// are registered when the client is created.
+
+import (
+	"errors"
+	"strings"
+)
+
+// Registers alias as another name for command, which may be followed by
+// arguments. Commands registered by plugins take precedence over aliases of
+// the same name. Aliases can't point to other aliases.
+func (ic *IRCClient) RegisterAlias(alias, command string) error {
+	fields := strings.Fields(command)
+	if alias == "" || strings.ContainsAny(alias, " \t") {
+		return errors.New("Invalid alias: " + alias)
+	}
+	if len(fields) == 0 {
+		return errors.New("Empty command for alias " + alias)
+	}
+	if ic.hasHandler(alias) {
+		return errors.New(alias + " is a command")
+	}
+	ic.registry.Lock()
+	defer ic.registry.Unlock()
+	if fields[0] == alias {
+		return errors.New("Alias " + alias + " points to itself")
+	}
+	if _, ok := ic.aliases[fields[0]]; ok {
+		return errors.New(fields[0] + " is an alias itself")
+	}
+	for a, target := range ic.aliases {
+		if strings.Fields(target)[0] == alias && a != alias {
+			return errors.New("Alias " + a + " points to " + alias)
+		}
+	}
+	if ic.aliases == nil {
+		ic.aliases = make(map[string]string)
+	}
+	ic.aliases[alias] = strings.Join(fields, " ")
+	return nil
+}
+
+// Removes alias, registered with RegisterAlias()
+func (ic *IRCClient) UnregisterAlias(alias string) error {
+	ic.registry.Lock()
+	defer ic.registry.Unlock()
+	if _, ok := ic.aliases[alias]; !ok {
+		return errors.New("No such alias: " + alias)
+	}
+	delete(ic.aliases, alias)
+	return nil
+}
+
+// Returns all aliases with the commands they stand for
+func (ic *IRCClient) Aliases() map[string]string {
+	ic.registry.RLock()
+	defer ic.registry.RUnlock()
+	aliases := make(map[string]string, len(ic.aliases))
+	for a, c := range ic.aliases {
+		aliases[a] = c
+	}
+	return aliases
+}
+
+// Registers the aliases in section Alias of the config file
+func (ic *IRCClient) loadAliases() {
+	for _, alias := range ic.GetOptions("Alias") {
+		if err := ic.RegisterAlias(alias, ic.GetStringOption("Alias", alias)); err != nil {
+			logWarnf("ignoring alias from config file: %v", err)
+		}
+	}
+}
+
+// Returns the command alias stands for and the arguments to put in front of
+// the user's. ok is false if command isn't an alias or a plugin has
+// registered it as a command.
+func (ic *IRCClient) resolveAlias(command string) (target string, args []string, ok bool) {
+	if ic.hasHandler(command) {
+		return "", nil, false
+	}
+	ic.registry.RLock()
+	alias, ok := ic.aliases[command]
+	ic.registry.RUnlock()
+	if !ok {
+		return "", nil, false
+	}
+	fields := strings.Fields(alias)
+	return fields[0], fields[1:], true
+}
+
+// Returns whether command has a handler registered for its exact name
+func (ic *IRCClient) hasHandler(command string) bool {
+	ic.registry.RLock()
+	defer ic.registry.RUnlock()
+	_, ok := ic.activeHandler(ic.handlers[command])
+	return ok
+}
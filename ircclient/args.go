@@ -0,0 +1,251 @@
+package ircclient
+
+// Parsing of command arguments beyond the whitespace splitting of
+// ParseCommand(), see IRCCommand.ParseArgs():
+//
+//   .remind --private 2d12h "call mom" now
+//
+// has the flag private (value "") and the arguments "2d12h", "call mom" and
+// "now". Double quotes group words, \" and \\ inside them stand for " and \.
+// Flags are written --name or --name=value; everything after "--" is an
+// argument.
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The arguments of a command, see IRCCommand.ParseArgs()
+type CommandArgs struct {
+	// Positional arguments, without quotes
+	Args []string
+	// --name=value options, "" for flags without value
+	Flags map[string]string
+	// The arguments as sent and the offset of each positional one in it,
+	// see Rest()
+	text   string
+	starts []int
+	client *IRCClient
+}
+
+// Returns the arguments of the command, split into positional arguments and
+// --flag=value options
+func (c *IRCCommand) ParseArgs() *CommandArgs {
+	text := c.text
+	if text == "" && len(c.Args) > 0 {
+		// built without ParseCommand(), e.g. by a plugin
+		text = strings.Join(c.Args, " ")
+	}
+	a := &CommandArgs{Args: make([]string, 0), Flags: make(map[string]string), text: text, client: c.client}
+	flags := true
+	for i := 0; i < len(text); {
+		if text[i] == ' ' || text[i] == '\t' {
+			i++
+			continue
+		}
+		start := i
+		var tok string
+		tok, i = nextToken(text, i)
+		switch {
+		case flags && text[start:i] == "--":
+			flags = false
+		case flags && strings.HasPrefix(text[start:i], "--"):
+			kv := strings.SplitN(tok[2:], "=", 2)
+			if len(kv) == 2 {
+				a.Flags[kv[0]] = kv[1]
+			} else {
+				a.Flags[kv[0]] = ""
+			}
+		default:
+			a.Args = append(a.Args, tok)
+			a.starts = append(a.starts, start)
+		}
+	}
+	return a
+}
+
+// Reads the token starting at text[i], returns it without quotes and the
+// offset after it. A quote without a closing one is taken literally.
+func nextToken(text string, i int) (string, int) {
+	var tok []byte
+	for i < len(text) && text[i] != ' ' && text[i] != '\t' {
+		if text[i] != '"' || closingQuote(text, i+1) < 0 {
+			tok = append(tok, text[i])
+			i++
+			continue
+		}
+		end := closingQuote(text, i+1)
+		for j := i + 1; j < end; j++ {
+			if text[j] == '\\' && (text[j+1] == '"' || text[j+1] == '\\') {
+				j++
+			}
+			tok = append(tok, text[j])
+		}
+		i = end + 1
+	}
+	return string(tok), i
+}
+
+// Returns the offset of the first unescaped quote in text from i, -1 if
+// there is none
+func closingQuote(text string, i int) int {
+	for ; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
+
+// Returns the number of positional arguments
+func (a *CommandArgs) Len() int {
+	return len(a.Args)
+}
+
+// Returns the positional argument i (counting from 0), "" if it's missing
+func (a *CommandArgs) Arg(i int) string {
+	if i < 0 || i >= len(a.Args) {
+		return ""
+	}
+	return a.Args[i]
+}
+
+// Returns the text from positional argument i on, exactly as sent (with
+// quotes and whitespace), e.g. for messages. Empty if there are fewer
+// arguments.
+func (a *CommandArgs) Rest(i int) string {
+	if i < 0 || i >= len(a.starts) {
+		return ""
+	}
+	return strings.TrimRight(a.text[a.starts[i]:], " \t")
+}
+
+// Returns the value of flag name, ok is false if it wasn't given
+func (a *CommandArgs) Flag(name string) (value string, ok bool) {
+	value, ok = a.Flags[name]
+	return
+}
+
+func (a *CommandArgs) get(i int) (string, error) {
+	if i < 0 || i >= len(a.Args) {
+		return "", fmt.Errorf("missing argument %d", i+1)
+	}
+	return a.Args[i], nil
+}
+
+// Returns positional argument i as a number
+func (a *CommandArgs) Int(i int) (int, error) {
+	s, err := a.get(i)
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return n, nil
+}
+
+// Returns positional argument i as a duration, see ParseDuration()
+func (a *CommandArgs) Duration(i int) (time.Duration, error) {
+	s, err := a.get(i)
+	if err != nil {
+		return 0, err
+	}
+	return ParseDuration(s)
+}
+
+// Returns positional argument i if it's a channel name
+func (a *CommandArgs) Channel(i int) (string, error) {
+	s, err := a.get(i)
+	if err != nil {
+		return "", err
+	}
+	var ok bool
+	if a.client != nil {
+		ok = a.client.IsChannelName(s)
+	} else {
+		// the default CHANTYPES
+		ok = s != "" && strings.IndexByte("#&", s[0]) >= 0 && !strings.ContainsAny(s, " ,\x07")
+	}
+	if !ok {
+		return "", fmt.Errorf("%q is not a channel", s)
+	}
+	return s, nil
+}
+
+// Returns positional argument i if it's a valid nick, see ValidNick()
+func (a *CommandArgs) Nick(i int) (string, error) {
+	s, err := a.get(i)
+	if err != nil {
+		return "", err
+	}
+	if !ValidNick(s) {
+		return "", fmt.Errorf("%q is not a nick", s)
+	}
+	return s, nil
+}
+
+// Returns the value of flag name as a number, def if the flag wasn't given
+func (a *CommandArgs) IntFlag(name string, def int) (int, error) {
+	s, ok := a.Flags[name]
+	if !ok {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("--%s: %q is not a number", name, s)
+	}
+	return n, nil
+}
+
+// Returns the value of flag name as a duration, def if the flag wasn't
+// given
+func (a *CommandArgs) DurationFlag(name string, def time.Duration) (time.Duration, error) {
+	s, ok := a.Flags[name]
+	if !ok {
+		return def, nil
+	}
+	d, err := ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("--%s: %v", name, err)
+	}
+	return d, nil
+}
+
+// Like time.ParseDuration(), but also accepts days, e.g. "2d12h"
+func ParseDuration(s string) (time.Duration, error) {
+	var days int
+	if i := strings.IndexByte(s, 'd'); i >= 0 {
+		var err error
+		if days, err = strconv.Atoi(s[:i]); err != nil {
+			return 0, errors.New("invalid duration " + strconv.Quote(s))
+		}
+		s = s[i+1:]
+		if s == "" {
+			return time.Duration(days) * 24 * time.Hour, nil
+		}
+	}
+	d, err := time.ParseDuration(s)
+	return time.Duration(days)*24*time.Hour + d, err
+}
+
+// Returns whether nick consists of the characters allowed in nicknames
+func ValidNick(nick string) bool {
+	for i, c := range nick {
+		switch {
+		case c >= 'A' && c <= '}':
+			// letters and []\`_^{|}
+		case i > 0 && (c >= '0' && c <= '9' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return nick != ""
+}
@@ -2,26 +2,91 @@ package ircclient
 
 import (
 	"fmt"
+	"log"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
 )
 
+// Entries starting with this are services account names rather than
+// hostmasks, e.g. "account/alice". Their access survives changes of the
+// user's host, but is only granted if the server tells us the account (see
+// UserInfo.Account).
+const account_prefix = "account/"
+
+// Returns the key of the entry for mask in the auth database, limited to
+// channel unless it's empty. Channel entries are stored as "<mask>
+// <channel>", masks can't contain spaces.
+func authKey(mask, channel string) string {
+	if channel == "" {
+		return mask
+	}
+	return mask + " " + channel
+}
+
+// Splits a key of the auth database into mask and channel, which is empty
+// for entries valid in all channels
+func splitAuthKey(key string) (mask, channel string) {
+	if i := strings.LastIndex(key, " "); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+	return key, ""
+}
+
 type authPlugin struct {
-	ic *IRCClient
+	ic    *IRCClient
+	store AuthStore
+	// Compiled hostmasks, nil for masks that don't compile
+	cache map[string]*regexp.Regexp
+	sync.Mutex
 }
 
 func (a *authPlugin) Register(cl *IRCClient) {
 	a.ic = cl
-	options := a.ic.GetOptions("Auth")
-	for _, mask := range options {
-		if _, err := regexp.Compile(mask); err != nil {
-			panic(err)
+	a.cache = make(map[string]*regexp.Regexp)
+	a.store = &configAuthStore{cl}
+	switch backend := a.ic.GetStringOption("Auth", backend_option); backend {
+	case "", "file":
+	case "sqlite":
+		file := a.ic.GetStringOption("Auth", dbfile_option)
+		if file == "" {
+			file = "auth.db"
+			log.Println("added default auth dbfile value of \"" + file + "\" to config file")
+			a.ic.SetStringOption("Auth", dbfile_option, file)
+		}
+		store, err := newSqliteAuthStore(file, a.store)
+		if err != nil {
+			logErrorf("unable to open auth database %s, using the masks in the config file: %v", file, err)
+			break
+		}
+		a.store = store
+	default:
+		logErrorf("unknown auth backend %q, using the masks in the config file", backend)
+	}
+	if a.ic.GetStringOption("Auth", anchor_option) == "" {
+		log.Println("Note: auth masks are now anchored at both ends, i.e. they have to match " +
+			"the whole hostmask. Check your masks or set \"" + anchor_option + ": false\" in section Auth " +
+			"to keep the old substring matching.")
+		a.ic.SetStringOption("Auth", anchor_option, "true")
+	}
+	// Compile all masks now, so invalid ones are reported on startup
+	for key := range a.entries() {
+		if mask, _ := splitAuthKey(key); !strings.HasPrefix(mask, account_prefix) {
+			a.compile(mask)
 		}
 	}
 	a.ic.RegisterCommandHandler("mya", 0, 0, a)
 	a.ic.RegisterCommandHandler("myaccess", 0, 0, a)
 	a.ic.RegisterCommandHandler("addaccess", 2, 400, a)
 	a.ic.RegisterCommandHandler("delaccess", 1, 400, a)
+	a.ic.RegisterCommandHandler("whoami", 0, 0, a)
+	a.ic.RegisterCommandHandler("access", 1, 400, a)
+	// Don't tell the whole channel who has which access
+	for _, cmd := range []string{"mya", "myaccess", "addaccess", "delaccess", "whoami", "access"} {
+		a.ic.SetReplyMode(cmd, ReplyModePrivate)
+	}
 }
 
 func (a *authPlugin) String() string {
@@ -33,9 +98,13 @@ func (a *authPlugin) Usage(cmd string) string {
 	case "myaccess", "mya":
 		return cmd + ": tells you what access-level (i.e. permissions) you have"
 	case "addaccess":
-		return "addaccess <hostmask> <level>: adds access-level <level> for hostmask <hostmask>"
+		return "addaccess <hostmask|" + account_prefix + "account> <level> [#channel]: adds access-level <level> for hostmask <hostmask> or services account <account>, only in #channel if given"
 	case "delaccess":
-		return "delaccess <hostmask>: removes access-level for hostmask <hostmask>"
+		return "delaccess <hostmask|" + account_prefix + "account> [#channel]: removes access-level for hostmask <hostmask> or services account <account> (in #channel)"
+	case "whoami":
+		return "whoami: tells you your hostmask, account, access-level in this channel and the entry granting it"
+	case "access":
+		return "access <nick|nick!user@host> [#channel]: tells you the access-level of a user (in #channel) and the entry granting it"
 	}
 	// shouldn't be a problem, this usage isn't called unless we're registered for it
 	return ""
@@ -46,7 +115,11 @@ func (a *authPlugin) ProcessLine(msg *IRCMessage) {
 }
 
 func (a *authPlugin) Unregister() {
-	// Empty
+	a.Lock()
+	defer a.Unlock()
+	if err := a.store.Close(); err != nil {
+		logErrorf("closing auth store: %v", err)
+	}
 }
 
 func (a *authPlugin) Info() string {
@@ -56,7 +129,7 @@ func (a *authPlugin) Info() string {
 func (a *authPlugin) ProcessCommand(cmd *IRCCommand) {
 	switch cmd.Command {
 	case "myaccess", "mya":
-		level := a.GetAccessLevel(cmd.Source)
+		level := a.accessLevel(cmd.Source, cmd.Account, cmd.Target)
 		slevel := fmt.Sprintf("%d", level)
 		if level == 500 {
 			a.ic.Reply(cmd, "Your access level is over 9000")
@@ -65,29 +138,44 @@ func (a *authPlugin) ProcessCommand(cmd *IRCCommand) {
 		}
 
 	case "addaccess":
-		if _, err := regexp.Compile(cmd.Args[0]); err != nil {
-			a.ic.Reply(cmd, "Error: Unable to compile regexp: "+err.Error())
+		channel := ""
+		if len(cmd.Args) > 2 {
+			channel = cmd.Args[2]
+		}
+		userLevel := a.accessLevel(cmd.Source, cmd.Account, channel)
+		targetLevel, _, err := a.getStore().Get(authKey(cmd.Args[0], channel))
+		if err != nil {
+			a.ic.Reply(cmd, "Error: "+err.Error())
 			return
 		}
-
-		userLevel := a.GetAccessLevel(cmd.Source)
-		targetLevel, _ := a.ic.GetIntOption("Auth", cmd.Args[0])
 		newLevel, err := strconv.Atoi(cmd.Args[1])
 		if err != nil {
 			a.ic.Reply(cmd, "Error: "+err.Error())
+			return
 		}
 
 		if userLevel < newLevel || userLevel <= targetLevel {
 			a.ic.Reply(cmd, "You are not authorized to do this")
 			return
 		}
-		a.SetAccessLevel(cmd.Args[0], newLevel)
+		if err := a.SetChannelAccessLevel(cmd.Args[0], channel, newLevel); err != nil {
+			a.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
 		a.ic.Reply(cmd, "Permissions granted")
 
 	case "delaccess":
-		level := a.GetAccessLevel(cmd.Source)
-		dlevel, err := a.ic.GetIntOption("Auth", cmd.Args[0])
+		channel := ""
+		if len(cmd.Args) > 1 {
+			channel = cmd.Args[1]
+		}
+		level := a.accessLevel(cmd.Source, cmd.Account, channel)
+		dlevel, ok, err := a.getStore().Get(authKey(cmd.Args[0], channel))
 		if err != nil {
+			a.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		if !ok {
 			a.ic.Reply(cmd, "Mask not found")
 			return
 		}
@@ -96,29 +184,217 @@ func (a *authPlugin) ProcessCommand(cmd *IRCCommand) {
 			a.ic.Reply(cmd, "Can't remove mask: Has higher privileges than you")
 			return
 		}
-		a.DelAccessLevel(cmd.Args[0])
+		if err := a.DelAccessLevel(authKey(cmd.Args[0], channel)); err != nil {
+			a.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
 		a.ic.Reply(cmd, "Successfully removed mask")
+
+	case "whoami":
+		a.ic.Reply(cmd, a.describe(cmd.Source, cmd.Account, cmd.Target))
+
+	case "access":
+		host := cmd.Args[0]
+		account := ""
+		channel := ""
+		if len(cmd.Args) > 1 {
+			channel = cmd.Args[1]
+		}
+		if !strings.ContainsAny(host, "!@") {
+			// It's a nick, we need the full hostmask
+			u, ok := a.ic.LookupUser(host)
+			if !ok {
+				a.ic.Reply(cmd, "Unable to find out the hostmask of "+host)
+				return
+			}
+			host = u.Nick + "!" + u.Ident + "@" + u.Host
+			account = u.Account
+		}
+		a.ic.Reply(cmd, a.describe(host, account, channel))
 	}
 }
 
-func (a *authPlugin) SetAccessLevel(host string, level int) {
-	a.ic.SetIntOption("Auth", host, level)
+// Returns a human-readable description of the access level of host, logged
+// in to account (empty if unknown), in channel (a nick or empty for none)
+func (a *authPlugin) describe(host, account, channel string) string {
+	if account == "" {
+		account = a.knownAccount(host)
+	}
+	who := host
+	if account != "" {
+		who += " (account " + account + ")"
+	}
+	in := ""
+	if a.ic.IsChannelName(channel) {
+		in = " in " + channel
+	}
+	level, key := a.match(host, account, channel)
+	if key == "" {
+		return who + " has no access entry" + in + " (level 0)"
+	}
+	if mask, ch := splitAuthKey(key); ch != "" {
+		key = mask + " in " + ch
+	}
+	return fmt.Sprintf("%s has access level %d%s (granted by %s)", who, level, in, key)
 }
 
-func (a *authPlugin) DelAccessLevel(mask string) {
-	a.ic.RemoveOption("Auth", mask)
+func (a *authPlugin) getStore() AuthStore {
+	a.Lock()
+	defer a.Unlock()
+	return a.store
 }
 
-func (a *authPlugin) GetAccessLevel(host string) int {
-	options := a.ic.GetOptions("Auth")
-	maxaccess := 0
-	for _, mask := range options {
-		if match, _ := regexp.MatchString(mask, host); match == true {
-			newaccess, _ := a.ic.GetIntOption("Auth", mask)
-			if newaccess > maxaccess {
-				maxaccess = newaccess
-			}
+// Replaces the auth store, closing the old one
+func (a *authPlugin) setStore(store AuthStore) error {
+	a.Lock()
+	old := a.store
+	a.store = store
+	a.Unlock()
+	return old.Close()
+}
+
+// Returns all masks in the auth database with their access levels
+func (a *authPlugin) entries() map[string]int {
+	entries, err := a.getStore().Entries()
+	if err != nil {
+		logErrorf("unable to read auth database: %v", err)
+		return map[string]int{}
+	}
+	return entries
+}
+
+// Returns the regular expression actually used for mask. Unless disabled
+// using the anchor option, masks have to match the whole hostmask, so a
+// mask without ^ at the beginning and $ at the end is anchored at both.
+func (a *authPlugin) pattern(mask string) string {
+	if !a.ic.GetBoolOption("Auth", anchor_option, true) {
+		return mask
+	}
+	if strings.HasPrefix(mask, "^") || strings.HasSuffix(mask, "$") {
+		return mask
+	}
+	return "^(?:" + mask + ")$"
+}
+
+// Returns the compiled mask, compiling and caching it if necessary. Returns
+// nil if mask is not a valid regular expression.
+func (a *authPlugin) compile(mask string) *regexp.Regexp {
+	pattern := a.pattern(mask)
+	a.Lock()
+	defer a.Unlock()
+	re, ok := a.cache[pattern]
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			logWarnf("ignoring invalid auth mask %q: %v", mask, err)
+			re = nil
+		}
+		a.cache[pattern] = re
+	}
+	return re
+}
+
+func (a *authPlugin) SetAccessLevel(host string, level int) error {
+	return a.SetChannelAccessLevel(host, "", level)
+}
+
+// Sets the access level of host in channel, in all channels if channel is
+// empty
+func (a *authPlugin) SetChannelAccessLevel(host, channel string, level int) error {
+	if isReservedAuthOption(host) {
+		return fmt.Errorf("%q is reserved", host)
+	}
+	if strings.Contains(host, " ") {
+		return fmt.Errorf("masks can't contain spaces")
+	}
+	if channel != "" && !a.ic.IsChannelName(channel) {
+		return fmt.Errorf("%q is not a channel", channel)
+	}
+	if strings.HasPrefix(host, account_prefix) {
+		if strings.ContainsAny(host[len(account_prefix):], "!@*") || host == account_prefix {
+			return fmt.Errorf("invalid account name %q", host[len(account_prefix):])
+		}
+		return a.getStore().Set(authKey(host, channel), level)
+	}
+	pattern := a.pattern(host)
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("unable to compile regexp: %v", err)
+	}
+	if err := a.getStore().Set(authKey(host, channel), level); err != nil {
+		return err
+	}
+	a.Lock()
+	a.cache[pattern] = re
+	a.Unlock()
+	return nil
+}
+
+// Deletes the entry with the given key, see authKey()
+func (a *authPlugin) DelAccessLevel(key string) error {
+	if err := a.getStore().Del(key); err != nil {
+		return err
+	}
+	mask, _ := splitAuthKey(key)
+	a.Lock()
+	delete(a.cache, a.pattern(mask))
+	a.Unlock()
+	return nil
+}
+
+// Returns the highest access level of all entries matching host, or the
+// account of host's nick if it's known, in all channels or in channel
+func (a *authPlugin) GetAccessLevel(host, channel string) int {
+	return a.accessLevel(host, "", channel)
+}
+
+// Same as GetAccessLevel(), but with the account the user is logged in to,
+// e.g. from the account tag. If account is empty, the known account of
+// host's nick is used.
+func (a *authPlugin) accessLevel(host, account, channel string) int {
+	if account == "" {
+		account = a.knownAccount(host)
+	}
+	level, _ := a.match(host, account, channel)
+	return level
+}
+
+// Returns the account of the nick in host as far as chanstate knows it
+func (a *authPlugin) knownAccount(host string) string {
+	cs, ok := a.ic.GetPlugin("chanstate").(*chanStatePlugin)
+	if !ok {
+		return ""
+	}
+	return cs.knownAccount(strings.SplitN(host, "!", 2)[0])
+}
+
+// Returns the highest access level of all masks matching host or entries
+// for account (may be empty), either for all channels or for channel, and
+// the key of the entry granting it (the first in lexical order if several
+// entries grant the same level). key is empty if no entry matches.
+func (a *authPlugin) match(host, account, channel string) (level int, key string) {
+	entries := a.entries()
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		m, ch := splitAuthKey(k)
+		if ch != "" && (channel == "" || a.ic.CanonChannel(ch) != a.ic.CanonChannel(channel)) {
+			continue
+		}
+		var matches bool
+		if strings.HasPrefix(m, account_prefix) {
+			matches = account != "" && a.ic.CanonNick(m[len(account_prefix):]) == a.ic.CanonNick(account)
+		} else {
+			re := a.compile(m)
+			matches = re != nil && re.MatchString(host)
+		}
+		if matches && (entries[k] > level || key == "") {
+			level, key = entries[k], k
 		}
 	}
-	return maxaccess
+	return
 }
@@ -0,0 +1,166 @@
+package ircclient
+
+import (
+	"database/sql"
+	"log"
+	_ "modernc.org/sqlite"
+)
+
+// Options in section Auth that aren't masks
+const (
+	// see authPlugin.pattern()
+	anchor_option = "anchor"
+	// "file" (the default) or "sqlite"
+	backend_option = "backend"
+	// path of the database for the sqlite backend
+	dbfile_option = "dbfile"
+)
+
+var reserved_auth_options = []string{anchor_option, backend_option, dbfile_option}
+
+// Storage of the auth database, mapping hostmasks (regular expressions) to
+// access levels. See IRCClient.SetAuthStore().
+type AuthStore interface {
+	// Returns all masks with their access levels
+	Entries() (map[string]int, error)
+	// Returns the access level of mask, ok is false if there is no such mask
+	Get(mask string) (level int, ok bool, err error)
+	Set(mask string, level int) error
+	Del(mask string) error
+	Close() error
+}
+
+func isReservedAuthOption(option string) bool {
+	for _, o := range reserved_auth_options {
+		if o == option {
+			return true
+		}
+	}
+	return false
+}
+
+// Stores the masks in section Auth of the config file
+type configAuthStore struct {
+	ic *IRCClient
+}
+
+func (s *configAuthStore) Entries() (map[string]int, error) {
+	entries := make(map[string]int)
+	for _, opt := range s.ic.GetOptions("Auth") {
+		if isReservedAuthOption(opt) {
+			continue
+		}
+		entries[opt], _ = s.ic.GetIntOption("Auth", opt)
+	}
+	return entries, nil
+}
+
+func (s *configAuthStore) Get(mask string) (int, bool, error) {
+	if isReservedAuthOption(mask) {
+		return 0, false, nil
+	}
+	level, err := s.ic.GetIntOption("Auth", mask)
+	if err != nil {
+		return 0, false, nil
+	}
+	return level, true, nil
+}
+
+func (s *configAuthStore) Set(mask string, level int) error {
+	s.ic.SetIntOption("Auth", mask, level)
+	return nil
+}
+
+func (s *configAuthStore) Del(mask string) error {
+	s.ic.RemoveOption("Auth", mask)
+	return nil
+}
+
+func (s *configAuthStore) Close() error {
+	return nil
+}
+
+// Stores the masks in an SQLite database
+type sqliteAuthStore struct {
+	db *sql.DB
+}
+
+// Opens the database in file, creating it if necessary. If the database is
+// new, the masks from migrate (if non-nil) are copied into it.
+func newSqliteAuthStore(file string, migrate AuthStore) (*sqliteAuthStore, error) {
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, err
+	}
+	var exists int
+	err = db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type = 'table' AND name = 'auth'").Scan(&exists)
+	if err == nil && exists == 0 {
+		_, err = db.Exec("CREATE TABLE auth (mask TEXT PRIMARY KEY, level INTEGER NOT NULL)")
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	s := &sqliteAuthStore{db}
+	if exists == 0 && migrate != nil {
+		entries, err := migrate.Entries()
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		for mask, level := range entries {
+			if err := s.Set(mask, level); err != nil {
+				db.Close()
+				return nil, err
+			}
+		}
+		if len(entries) > 0 {
+			log.Printf("migrated %d auth masks to %s, the masks in section Auth are ignored from now on", len(entries), file)
+		}
+	}
+	return s, nil
+}
+
+func (s *sqliteAuthStore) Entries() (map[string]int, error) {
+	rows, err := s.db.Query("SELECT mask, level FROM auth")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := make(map[string]int)
+	for rows.Next() {
+		var mask string
+		var level int
+		if err := rows.Scan(&mask, &level); err != nil {
+			return nil, err
+		}
+		entries[mask] = level
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteAuthStore) Get(mask string) (int, bool, error) {
+	var level int
+	err := s.db.QueryRow("SELECT level FROM auth WHERE mask = ?", mask).Scan(&level)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	return level, true, nil
+}
+
+func (s *sqliteAuthStore) Set(mask string, level int) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO auth (mask, level) VALUES (?, ?)", mask, level)
+	return err
+}
+
+func (s *sqliteAuthStore) Del(mask string) error {
+	_, err := s.db.Exec("DELETE FROM auth WHERE mask = ?", mask)
+	return err
+}
+
+func (s *sqliteAuthStore) Close() error {
+	return s.db.Close()
+}
@@ -3,34 +3,20 @@ package ircclient
 // Handles basic IRC protocol messages (like PING)
 
 import (
-	"log"
-	"time"
+	"strings"
+	"sync"
 )
 
 type basicProtocol struct {
-	ic          *IRCClient
-	chanTimeout chan *IRCMessage
+	ic *IRCClient
+	// The last complete MOTD and the one currently being received
+	motd     string
+	motdBuf  []string
+	motdLock sync.Mutex
 }
 
 func (bp *basicProtocol) Register(cl *IRCClient) {
 	bp.ic = cl
-	bp.chanTimeout = make(chan *IRCMessage)
-
-	// start pinging routine
-	go func() {
-		for {
-			time.Sleep(2 * time.Minute)
-			bp.ic.SendLine("PING :" + bp.ic.GetStringOption("Server", "nick"))
-
-			select {
-			case <-bp.chanTimeout:
-			case <-time.After(20 * time.Second):
-				log.Println("Ping timeout")
-				bp.ic.Disconnect("Ping timeout")
-			}
-
-		}
-	}()
 }
 
 func (bp *basicProtocol) String() string {
@@ -46,16 +32,56 @@ func (bp *basicProtocol) ProcessLine(msg *IRCMessage) {
 	switch msg.Command {
 	case "PING":
 		if len(msg.Args) != 1 {
-			log.Printf("WARNING: Invalid PING received")
+			logWarnf("invalid PING received")
 		}
 		bp.ic.SendLine("PONG :" + msg.Args[0])
-	case "PONG":
-		bp.chanTimeout <- msg
+	case RPL_WELCOME:
+		// New connection, don't report the old server's MOTD
+		bp.motdLock.Lock()
+		bp.motd = ""
+		bp.motdBuf = nil
+		bp.motdLock.Unlock()
+	case RPL_MOTDSTART:
+		bp.motdLock.Lock()
+		bp.motdBuf = make([]string, 0)
+		bp.motdLock.Unlock()
+	case RPL_MOTD:
+		if len(msg.Args) == 0 {
+			return
+		}
+		bp.motdLock.Lock()
+		bp.motdBuf = append(bp.motdBuf, strings.TrimPrefix(msg.Args[0], "- "))
+		bp.motdLock.Unlock()
+	case RPL_ENDOFMOTD:
+		bp.motdLock.Lock()
+		bp.motd = strings.Join(bp.motdBuf, "\n")
+		bp.motdBuf = nil
+		bp.motdLock.Unlock()
+	case ERR_NOMOTD:
+		bp.motdLock.Lock()
+		bp.motd = ""
+		bp.motdBuf = nil
+		bp.motdLock.Unlock()
 	}
 }
+
+// Returns the last MOTD received from the server, lines separated by "\n"
+func (bp *basicProtocol) getMOTD() string {
+	bp.motdLock.Lock()
+	defer bp.motdLock.Unlock()
+	return bp.motd
+}
+
 func (bp *basicProtocol) Unregister() {
 }
 
+func (bp *basicProtocol) OnReconnectReset() {
+	bp.motdLock.Lock()
+	bp.motd = ""
+	bp.motdBuf = nil
+	bp.motdLock.Unlock()
+}
+
 func (bp *basicProtocol) Info() string {
 	return "basic irc protocol (e.g. PING), implemented as plugin."
 }
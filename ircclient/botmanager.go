@@ -0,0 +1,228 @@
+package ircclient
+
+// Runs the bot on several networks from one config file. The networks are
+// listed in section Networks (the values are ignored):
+//
+//	[Networks]
+//	eosin: on
+//	libera: on
+//
+// Each network gets its own IRCClient. Its options are looked up in
+// "<section>@<network>" first and in the plain section otherwise, so
+// section Server can hold what is the same everywhere (ident, trigger, ...)
+// and Server@libera the host and nick for Libera. Changes made by a client
+// (e.g. joined channels) go to its own sections; options of the plain
+// sections apply to all networks and can only be changed there.
+// Without section Networks, there is a single client using the plain
+// sections, like one created by NewIRCClient(). Online restarts (see
+// Upgrade()) only work for single clients. Addresses to listen on (options
+// named "listen", e.g. Metrics/listen or the web servers of plugins) have to
+// differ between the networks, as in:
+//
+//	[Dashboard@eosin]
+//	listen: localhost:8091
+//	[Dashboard@libera]
+//	listen: localhost:8191
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Runs one IRCClient per network, see NewBotManager()
+type BotManager struct {
+	networks []string
+	clients  map[string]*IRCClient
+	// name -> number of networks a shared plugin is registered with
+	shared map[string]int
+	sync.Mutex
+}
+
+// Creates the clients for the networks in configfile. They don't connect
+// until Run() is called, so plugins can be registered first.
+func NewBotManager(configfile string) *BotManager {
+	cp := NewConfigPlugin(configfile)
+	networks, _ := cp.Conf.Options("Networks")
+	sort.Strings(networks)
+	if len(networks) == 0 {
+		networks = []string{""}
+	}
+	m := &BotManager{networks: networks, clients: make(map[string]*IRCClient), shared: make(map[string]int)}
+	for _, network := range networks {
+		ic := newIRCClient(cp.forNetwork(network), network)
+		ic.manager = m
+		for _, x := range []string{"host", "nick", "ident", "realname"} {
+			if ic.GetStringOption("Server", x) == "" {
+				log.Fatal("Error while parsing config: option " + x + " not found for network " + network)
+			}
+		}
+		m.clients[network] = ic
+	}
+	return m
+}
+
+// Returns the names of the networks, sorted. A single network without
+// section Networks has the name "".
+func (m *BotManager) Networks() []string {
+	return append([]string(nil), m.networks...)
+}
+
+// Returns the client of network, nil if there is no such network
+func (m *BotManager) Client(network string) *IRCClient {
+	return m.clients[network]
+}
+
+// Registers one instance of a plugin with all networks. Its Register() is
+// called once per network and it has to reply through the client that
+// received a line or command (IRCCommand.Client(), Event.Network), so most
+// plugins want an instance per network instead, see RegisterPerNetwork().
+// Unregister() is called once, when the plugin has been unregistered from
+// the last network.
+func (m *BotManager) RegisterPlugin(p Plugin) error {
+	for _, network := range m.networks {
+		if err := m.clients[network].RegisterPlugin(&sharedPlugin{p, m}); err != nil {
+			return errors.New(network + ": " + err.Error())
+		}
+		m.Lock()
+		m.shared[p.String()]++
+		m.Unlock()
+	}
+	return nil
+}
+
+// Registers a new instance of a plugin, made by f, with every network
+func (m *BotManager) RegisterPerNetwork(f PluginFactory) error {
+	for _, network := range m.networks {
+		if err := m.clients[network].RegisterPlugin(f()); err != nil {
+			return errors.New(network + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+// Subscribes fn to topic on all networks, see IRCClient.Subscribe(). The
+// network is in the Network field of the events built from lines.
+func (m *BotManager) Subscribe(topic string, fn func(data interface{})) (unsubscribe func()) {
+	var unsubscribes []func()
+	for _, network := range m.networks {
+		unsubscribes = append(unsubscribes, m.clients[network].Subscribe(topic, fn))
+	}
+	return func() {
+		for _, u := range unsubscribes {
+			u()
+		}
+	}
+}
+
+// Shuts all networks down gracefully on SIGTERM and SIGINT and reloads the
+// config file on SIGHUP, see IRCClient.HandleSignals()
+func (m *BotManager) HandleSignals() {
+	for _, network := range m.networks {
+		m.clients[network].handleShutdownSignals()
+	}
+	// the file is shared, reloading it once tells all networks
+	m.clients[m.networks[0]].handleHangup()
+}
+
+// Connects to all networks and processes their lines until every network
+// has been shut down. A network whose connection is lost reconnects, see
+// IRCClient.Run(). Returns ErrQuit, or the first other error. Refuses to
+// connect if networks would listen on the same address, see checkListen().
+func (m *BotManager) Run() error {
+	if err := m.checkListen(); err != nil {
+		return err
+	}
+	errs := make(chan error, len(m.networks))
+	for _, network := range m.networks {
+		go func(network string, ic *IRCClient) {
+			err := ic.Run()
+			if err != nil && err != ErrQuit {
+				logErrorf("network %s: %v", network, err)
+				err = errors.New(network + ": " + err.Error())
+			}
+			errs <- err
+		}(network, m.clients[network])
+	}
+	var first error
+	for range m.networks {
+		if err := <-errs; err != nil && err != ErrQuit && first == nil {
+			first = err
+		}
+	}
+	if first == nil {
+		return ErrQuit
+	}
+	return first
+}
+
+// Returns an error if two networks have the same value for an option named
+// "listen". Only one of them would get the address, the plugins of the other
+// one merely log that.
+func (m *BotManager) checkListen() error {
+	if len(m.networks) < 2 {
+		return nil
+	}
+	var sections []string
+	seen := make(map[string]bool)
+	for _, s := range m.clients[m.networks[0]].GetSections() {
+		s = strings.SplitN(s, "@", 2)[0]
+		if !seen[s] {
+			seen[s] = true
+			sections = append(sections, s)
+		}
+	}
+	sort.Strings(sections)
+	for _, section := range sections {
+		// address -> network
+		used := make(map[string]string)
+		for _, network := range m.networks {
+			addr := m.clients[network].GetStringOption(section, "listen")
+			if addr == "" {
+				continue
+			}
+			if other, ok := used[addr]; ok {
+				return fmt.Errorf("networks %s and %s both listen on %s, set %s/listen for each network in section %s@<network>", other, network, addr, section, section)
+			}
+			used[addr] = network
+		}
+	}
+	return nil
+}
+
+// Returns the name of the network the client is connected to, see
+// BotManager. Empty for a client created by NewIRCClient().
+func (ic *IRCClient) Network() string {
+	return ic.network
+}
+
+// A plugin registered with several networks, see BotManager.RegisterPlugin()
+type sharedPlugin struct {
+	Plugin
+	m *BotManager
+}
+
+func (s *sharedPlugin) Unregister() {
+	s.m.Lock()
+	s.m.shared[s.String()]--
+	last := s.m.shared[s.String()] == 0
+	s.m.Unlock()
+	if last {
+		s.Plugin.Unregister()
+	}
+}
+
+func (s *sharedPlugin) ProcessDisconnect(reason error) {
+	if h, ok := s.Plugin.(DisconnectHandler); ok {
+		h.ProcessDisconnect(reason)
+	}
+}
+
+func (s *sharedPlugin) OnReconnectReset() {
+	if h, ok := s.Plugin.(ReconnectHandler); ok {
+		h.OnReconnectReset()
+	}
+}
@@ -0,0 +1,204 @@
+package ircclient
+
+// IRCv3 capability negotiation during connection registration. Capabilities
+// are requested if the server supports them; servers that don't know CAP
+// simply ignore it and register us as usual. With cap-notify, the server may
+// offer (CAP NEW) or withdraw (CAP DEL) capabilities later on, see
+// RequestCapability().
+
+import (
+	"sort"
+	"strings"
+)
+
+// Capabilities the bot requests if available, plugins may add more with
+// RequestCapability()
+var default_caps = []string{"account-notify", "account-tag", "cap-notify", "extended-join", "message-tags", "server-time"}
+
+// State of the negotiation on the current connection, see Connect()
+type capNegotiation struct {
+	// capabilities offered by the server, collected from (multi-line) CAP LS
+	// and CAP NEW. Protected by IRCClient.stateLock.
+	available map[string]bool
+	// CAP END has been sent, registration goes on. Protected by
+	// IRCClient.stateLock.
+	ended bool
+	// acknowledged capabilities whose CapHandler hasn't finished yet, CAP
+	// END waits for them. Protected by IRCClient.stateLock.
+	pending map[string]bool
+}
+
+// Called in the connection loop when the capability it has been registered
+// for with HandleCapability() has been acknowledged during registration. CAP
+// END is delayed until done is called, so the handler can e.g. authenticate
+// with SASL first. The handler must not block; done may be called from any
+// goroutine, more than once.
+type CapHandler func(done func())
+
+// Processes a CAP reply from the server. During registration, CAP END is sent
+// once all wanted capabilities have been acknowledged or refused. Afterwards,
+// newly offered capabilities are requested if wanted and the events
+// "cap_new" and "cap_del" are published with the capability names as
+// []string.
+func (cn *capNegotiation) process(ic *IRCClient, msg *IRCMessage) {
+	// :server CAP nick LS [*] :cap1 cap2=value
+	if len(msg.Args) < 2 {
+		return
+	}
+	caps := strings.Fields(msg.Args[len(msg.Args)-1])
+	names := make([]string, len(caps))
+	for i, c := range caps {
+		names[i] = strings.SplitN(c, "=", 2)[0]
+	}
+	switch strings.ToUpper(msg.Args[0]) {
+	case "LS":
+		ic.stateLock.Lock()
+		if cn.available == nil {
+			cn.available = make(map[string]bool)
+		}
+		for _, c := range names {
+			cn.available[c] = true
+		}
+		ic.stateLock.Unlock()
+		if len(msg.Args) > 2 && msg.Args[1] == "*" {
+			// more to come
+			return
+		}
+		if cn.request(ic) {
+			return
+		}
+	case "ACK":
+		ic.stateLock.Lock()
+		handlers := make(map[string]CapHandler)
+		for _, c := range caps {
+			if strings.HasPrefix(c, "-") {
+				delete(ic.caps, c[1:])
+				continue
+			}
+			ic.caps[c] = true
+			if h, ok := ic.capHandlers[c]; ok && !cn.ended {
+				if cn.pending == nil {
+					cn.pending = make(map[string]bool)
+				}
+				cn.pending[c] = true
+				handlers[c] = h
+			}
+		}
+		ic.stateLock.Unlock()
+		for c, h := range handlers {
+			h(cn.doneFunc(ic, c))
+		}
+	case "NAK":
+		// The server refused the request as a whole, go on without
+	case "NEW":
+		ic.stateLock.Lock()
+		if cn.available == nil {
+			cn.available = make(map[string]bool)
+		}
+		for _, c := range names {
+			cn.available[c] = true
+		}
+		ic.stateLock.Unlock()
+		cn.request(ic)
+		ic.Publish("cap_new", names)
+		return
+	case "DEL":
+		ic.stateLock.Lock()
+		for _, c := range names {
+			delete(cn.available, c)
+			delete(ic.caps, c)
+		}
+		ic.stateLock.Unlock()
+		ic.Publish("cap_del", names)
+		return
+	default:
+		return
+	}
+	cn.end(ic)
+}
+
+// Sends CAP END unless it has been sent already or a CapHandler is still
+// running
+func (cn *capNegotiation) end(ic *IRCClient) {
+	ic.stateLock.Lock()
+	if cn.ended || len(cn.pending) > 0 {
+		ic.stateLock.Unlock()
+		return
+	}
+	cn.ended = true
+	conn := ic.conn
+	ic.stateLock.Unlock()
+	conn.Output <- "CAP END"
+}
+
+// Returns the done function passed to the CapHandler of capability name. It
+// does nothing once we've reconnected.
+func (cn *capNegotiation) doneFunc(ic *IRCClient, name string) func() {
+	return func() {
+		ic.stateLock.Lock()
+		_, ok := cn.pending[name]
+		delete(cn.pending, name)
+		current := ic.capNeg == cn
+		ic.stateLock.Unlock()
+		if ok && current {
+			cn.end(ic)
+		}
+	}
+}
+
+// Requests the wanted capabilities that are available but not enabled yet.
+// Returns whether a request has been sent.
+func (cn *capNegotiation) request(ic *IRCClient) bool {
+	ic.stateLock.Lock()
+	req := make([]string, 0, len(ic.wantedCaps))
+	for c := range ic.wantedCaps {
+		if cn.available[c] && !ic.caps[c] {
+			req = append(req, c)
+		}
+	}
+	ic.stateLock.Unlock()
+	if len(req) == 0 {
+		return false
+	}
+	sort.Strings(req)
+	ic.conn.Output <- "CAP REQ :" + strings.Join(req, " ")
+	return true
+}
+
+// Asks for the capability name (e.g. "sasl" or "account-notify"). Usually
+// called from a plugin's Register(), so the capability is requested during
+// registration. If the server offers it later (CAP NEW), it is requested
+// then; if it's available right now, it's requested immediately.
+func (ic *IRCClient) RequestCapability(name string) {
+	ic.stateLock.Lock()
+	ic.wantedCaps[name] = true
+	cn := ic.capNeg
+	registered := cn != nil && cn.ended
+	ic.stateLock.Unlock()
+	if registered {
+		cn.request(ic)
+	}
+}
+
+// Requests the capability name like RequestCapability() and calls h when it
+// is acknowledged during registration, see CapHandler. Passing a nil h
+// removes the handler (the capability stays wanted).
+func (ic *IRCClient) HandleCapability(name string, h CapHandler) {
+	ic.stateLock.Lock()
+	if h == nil {
+		delete(ic.capHandlers, name)
+		ic.stateLock.Unlock()
+		return
+	}
+	ic.capHandlers[name] = h
+	ic.stateLock.Unlock()
+	ic.RequestCapability(name)
+}
+
+// Returns whether the capability name (e.g. "server-time") has been
+// negotiated with the server
+func (ic *IRCClient) HasCap(name string) bool {
+	ic.stateLock.Lock()
+	defer ic.stateLock.Unlock()
+	return ic.caps[name]
+}
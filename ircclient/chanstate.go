@@ -0,0 +1,799 @@
+package ircclient
+
+// Keeps track of the channels the bot is in, their topics and modes, their
+// members and the members' status (op, voice) in each channel. Hostmasks,
+// accounts and away status of the members are synced using WHO on join and
+// periodically.
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// How often all channels are re-synced using WHO
+	who_interval = 10 * time.Minute
+	// Minimum delay between two WHOs, so large channels don't flood us off
+	who_delay = 2 * time.Second
+	// Give up waiting for the end of a WHO reply after this time
+	who_timeout = 30 * time.Second
+	// Token to recognize replies to our own WHOX queries
+	whox_token = "152"
+	// Give up waiting for a WHOIS reply after this time
+	whois_timeout = 10 * time.Second
+	// How long WHOIS results are reused, unless Server/whoisttl (in
+	// seconds) is set
+	default_whois_ttl = time.Minute
+)
+
+// Channel mode types as in ISUPPORT CHANMODES, used if the server doesn't
+// send it: list modes, modes that always take a parameter, modes that take
+// one only when set and modes without parameter
+const default_chanmodes = "beI,k,l,imnpst"
+
+// Information about a user sharing a channel with the bot, see
+// IRCClient.GetUserInfo(). Fields that aren't known yet are empty.
+type UserInfo struct {
+	Nick     string
+	Ident    string
+	Host     string
+	Realname string
+	// Services account, known from WHOX, extended-join, account-notify or
+	// the account tag if the server supports them
+	Account string
+	Away    bool
+}
+
+// Information about a channel the bot is in, see IRCClient.GetChannels()
+type ChannelInfo struct {
+	Name       string
+	Topic      string
+	TopicSetBy string
+	TopicTime  time.Time
+	// Channel modes with their parameters, e.g. "+klnt key 10". Empty
+	// until the server has told us.
+	Modes string
+	// Number of members, including the bot
+	Users int
+}
+
+type channelState struct {
+	name string
+	// canonical nick -> set of member modes, e.g. "o" or "ov"
+	members map[string]string
+	topic   string
+	topicBy string
+	topicAt time.Time
+	// channel mode -> parameter ("" for modes without one), list modes
+	// like bans aren't tracked
+	modes map[byte]string
+}
+
+type chanStatePlugin struct {
+	ic       *IRCClient
+	channels map[string]*channelState
+	// canonical nick -> user, for all users in any of our channels
+	users map[string]*UserInfo
+	sync.RWMutex
+
+	// WHO queue, pending contains the canonical names of queued channels
+	whoQueue chan string
+	whoDone  chan string
+	pending  map[string]bool
+	quit     chan bool
+
+	// canonical nick -> callers waiting for the reply to a WHOIS
+	whois map[string][]chan *UserInfo
+	// canonical nick -> recent WHOIS result
+	whoisCache map[string]cachedWhois
+}
+
+type cachedWhois struct {
+	info UserInfo
+	at   time.Time
+}
+
+func (cs *chanStatePlugin) Register(cl *IRCClient) {
+	cs.ic = cl
+	cs.channels = make(map[string]*channelState)
+	cs.users = make(map[string]*UserInfo)
+	cs.whoQueue = make(chan string, 100)
+	cs.whoDone = make(chan string, 1)
+	cs.pending = make(map[string]bool)
+	cs.whois = make(map[string][]chan *UserInfo)
+	cs.whoisCache = make(map[string]cachedWhois)
+	cs.quit = make(chan bool)
+	go cs.whoLoop()
+}
+
+func (cs *chanStatePlugin) String() string {
+	return "chanstate"
+}
+
+func (cs *chanStatePlugin) Info() string {
+	return "tracks channels, their members and member modes"
+}
+
+func (cs *chanStatePlugin) Usage(cmd string) string {
+	// stub, no commands here
+	return ""
+}
+
+func (cs *chanStatePlugin) ProcessCommand(cmd *IRCCommand) {
+}
+
+func (cs *chanStatePlugin) Unregister() {
+	close(cs.quit)
+	cs.OnReconnectReset()
+}
+
+// Forgets all channels and users and fails pending WHOIS lookups. The WHO
+// loop keeps running, queued WHOs for channels we left are skipped.
+func (cs *chanStatePlugin) OnReconnectReset() {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.channels = make(map[string]*channelState)
+	cs.users = make(map[string]*UserInfo)
+	cs.whoisCache = make(map[string]cachedWhois)
+	for nick := range cs.whois {
+		cs.whoisReply(nick, nil)
+	}
+}
+
+func (cs *chanStatePlugin) ProcessLine(msg *IRCMessage) {
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+	me := cs.ic.GetStringOption("Server", "nick")
+	// with account-tag, messages of users that aren't logged in have no tag
+	account, tagged := msg.Account()
+	tagged = tagged || (strings.Contains(msg.Source, "!") && cs.ic.HasCap("account-tag"))
+
+	cs.Lock()
+	defer cs.Unlock()
+
+	if u, ok := cs.users[cs.fold(nick)]; ok && tagged && msg.Command != "ACCOUNT" {
+		u.Account = account
+	}
+
+	switch msg.Command {
+	case RPL_WELCOME:
+		// New connection, we're not in any channel yet. Channels are only
+		// added on our own JOINs, not from the config.
+		cs.channels = make(map[string]*channelState)
+		cs.users = make(map[string]*UserInfo)
+		cs.whoisCache = make(map[string]cachedWhois)
+	case "JOIN":
+		if cs.fold(nick) == cs.fold(me) {
+			cs.channels[cs.fold(msg.Target)] = &channelState{name: msg.Target, members: make(map[string]string), modes: make(map[byte]string)}
+			cs.queueWho(msg.Target)
+			// don't block while holding the lock
+			go cs.ic.SendLine("MODE " + msg.Target)
+		}
+		if c := cs.channels[cs.fold(msg.Target)]; c != nil {
+			c.members[cs.fold(nick)] = ""
+			u := cs.user(nick)
+			if parts := strings.SplitN(msg.Source, "!", 2); len(parts) == 2 {
+				if uh := strings.SplitN(parts[1], "@", 2); len(uh) == 2 {
+					u.Ident, u.Host = uh[0], uh[1]
+				}
+			}
+			// extended-join: JOIN #channel account :realname
+			if len(msg.Args) >= 2 {
+				u.Account, u.Realname = msg.Args[0], msg.Args[1]
+				if u.Account == "*" {
+					u.Account = ""
+				}
+			}
+		}
+	case "ACCOUNT":
+		// account-notify: :nick!user@host ACCOUNT account, "*" on logout
+		if u, ok := cs.users[cs.fold(nick)]; ok {
+			u.Account = msg.Target
+			if u.Account == "*" {
+				u.Account = ""
+			}
+		}
+	case "PART":
+		cs.removeMember(msg.Target, nick, me)
+	case "KICK":
+		if len(msg.Args) > 0 {
+			cs.removeMember(msg.Target, msg.Args[0], me)
+		}
+	case "QUIT":
+		delete(cs.whoisCache, cs.fold(nick))
+		if cs.fold(nick) == cs.fold(me) {
+			cs.channels = make(map[string]*channelState)
+			cs.users = make(map[string]*UserInfo)
+			return
+		}
+		for _, c := range cs.channels {
+			delete(c.members, cs.fold(nick))
+		}
+		delete(cs.users, cs.fold(nick))
+	case "NICK":
+		delete(cs.whoisCache, cs.fold(nick))
+		delete(cs.whoisCache, cs.fold(msg.Target))
+		for _, c := range cs.channels {
+			if modes, ok := c.members[cs.fold(nick)]; ok {
+				delete(c.members, cs.fold(nick))
+				c.members[cs.fold(msg.Target)] = modes
+			}
+		}
+		if u, ok := cs.users[cs.fold(nick)]; ok {
+			delete(cs.users, cs.fold(nick))
+			u.Nick = msg.Target
+			cs.users[cs.fold(msg.Target)] = u
+		}
+	case RPL_NAMREPLY:
+		// :server 353 me = #channel :@op +voice user
+		if len(msg.Args) < 3 {
+			return
+		}
+		c := cs.channels[cs.fold(msg.Args[1])]
+		if c == nil {
+			return
+		}
+		for _, name := range strings.Fields(msg.Args[2]) {
+			modes := ""
+			for len(name) > 0 && cs.prefixMode(name[0]) != 0 {
+				modes += string(cs.prefixMode(name[0]))
+				name = name[1:]
+			}
+			c.members[cs.fold(name)] = modes
+			cs.user(name)
+		}
+	case RPL_WHOREPLY:
+		// :server 352 me #channel ident host server nick flags :hopcount realname
+		if len(msg.Args) < 7 {
+			return
+		}
+		u := cs.whoReply(msg.Args[0], msg.Args[4], msg.Args[5])
+		if u == nil {
+			return
+		}
+		u.Ident, u.Host = msg.Args[1], msg.Args[2]
+		if hr := strings.SplitN(msg.Args[6], " ", 2); len(hr) == 2 {
+			u.Realname = hr[1]
+		}
+	case RPL_WHOSPCRPL:
+		// :server 354 me token #channel ident host nick flags account
+		if len(msg.Args) < 7 || msg.Args[0] != whox_token {
+			return
+		}
+		u := cs.whoReply(msg.Args[1], msg.Args[4], msg.Args[5])
+		if u == nil {
+			return
+		}
+		u.Ident, u.Host = msg.Args[2], msg.Args[3]
+		if msg.Args[6] != "0" {
+			u.Account = msg.Args[6]
+		} else {
+			u.Account = ""
+		}
+	case RPL_ENDOFWHO:
+		if len(msg.Args) > 0 {
+			select {
+			case cs.whoDone <- cs.fold(msg.Args[0]):
+			default:
+			}
+		}
+	case RPL_WHOISUSER:
+		// :server 311 me nick ident host * :realname
+		if len(msg.Args) < 5 {
+			return
+		}
+		u := &UserInfo{Nick: msg.Args[0], Ident: msg.Args[1], Host: msg.Args[2], Realname: msg.Args[4]}
+		if known, ok := cs.users[cs.fold(u.Nick)]; ok {
+			known.Ident, known.Host, known.Realname = u.Ident, u.Host, u.Realname
+		}
+		// the account may follow, waiters get the reply at RPL_ENDOFWHOIS
+		cs.whoisCache[cs.fold(u.Nick)] = cachedWhois{*u, time.Now()}
+	case RPL_WHOISACCOUNT:
+		// :server 330 me nick account :is logged in as
+		if len(msg.Args) < 2 {
+			return
+		}
+		if c, ok := cs.whoisCache[cs.fold(msg.Args[0])]; ok {
+			c.info.Account = msg.Args[1]
+			cs.whoisCache[cs.fold(msg.Args[0])] = c
+		}
+		if known, ok := cs.users[cs.fold(msg.Args[0])]; ok {
+			known.Account = msg.Args[1]
+		}
+	case RPL_ENDOFWHOIS:
+		// :server 318 me nick :End of /WHOIS list
+		if len(msg.Args) == 0 {
+			return
+		}
+		if c, ok := cs.whoisCache[cs.fold(msg.Args[0])]; ok {
+			info := c.info
+			cs.whoisReply(msg.Args[0], &info)
+		}
+	case ERR_NOSUCHNICK:
+		// :server 401 me nick :No such nick/channel
+		// RPL_ENDOFWHOIS without RPL_WHOISUSER isn't taken as failure, as
+		// lines may be processed out of order.
+		if len(msg.Args) > 0 {
+			cs.whoisReply(msg.Args[0], nil)
+		}
+	case "MODE":
+		c := cs.channels[cs.fold(msg.Target)]
+		if c == nil || len(msg.Args) == 0 {
+			return
+		}
+		cs.applyModes(c, msg.Args[0], msg.Args[1:])
+	case RPL_CHANNELMODEIS:
+		// :server 324 me #channel +ntk key
+		if len(msg.Args) < 2 {
+			return
+		}
+		if c := cs.channels[cs.fold(msg.Args[0])]; c != nil {
+			c.modes = make(map[byte]string)
+			cs.applyModes(c, msg.Args[1], msg.Args[2:])
+		}
+	case "TOPIC":
+		// :nick!user@host TOPIC #channel :new topic
+		if c := cs.channels[cs.fold(msg.Target)]; c != nil {
+			c.topic, c.topicBy, c.topicAt = "", nick, msg.Timestamp()
+			if len(msg.Args) > 0 {
+				c.topic = msg.Args[0]
+			}
+		}
+	case RPL_TOPIC:
+		// :server 332 me #channel :topic
+		if len(msg.Args) < 2 {
+			return
+		}
+		if c := cs.channels[cs.fold(msg.Args[0])]; c != nil {
+			c.topic = msg.Args[1]
+		}
+	case RPL_NOTOPIC:
+		if len(msg.Args) < 1 {
+			return
+		}
+		if c := cs.channels[cs.fold(msg.Args[0])]; c != nil {
+			c.topic, c.topicBy, c.topicAt = "", "", time.Time{}
+		}
+	case RPL_TOPICWHOTIME:
+		// :server 333 me #channel nick!user@host 1262304000
+		if len(msg.Args) < 3 {
+			return
+		}
+		if c := cs.channels[cs.fold(msg.Args[0])]; c != nil {
+			c.topicBy = strings.SplitN(msg.Args[1], "!", 2)[0]
+			if secs, err := strconv.ParseInt(msg.Args[2], 10, 64); err == nil {
+				c.topicAt = time.Unix(secs, 0)
+			}
+		}
+	}
+}
+
+// Returns the canonical form of a channel or nick name
+func (cs *chanStatePlugin) fold(name string) string {
+	return cs.ic.CanonChannel(name)
+}
+
+// Returns the user with the given nick, creating it if necessary. Must be
+// called with the lock held.
+func (cs *chanStatePlugin) user(nick string) *UserInfo {
+	u, ok := cs.users[cs.fold(nick)]
+	if !ok {
+		u = &UserInfo{Nick: nick}
+		cs.users[cs.fold(nick)] = u
+	}
+	return u
+}
+
+// Updates member modes and away status from a WHO reply and returns the
+// user, or nil if the user isn't in a channel we know. Must be called with
+// the lock held.
+func (cs *chanStatePlugin) whoReply(channel, nick, flags string) *UserInfo {
+	c := cs.channels[cs.fold(channel)]
+	if c == nil {
+		return nil
+	}
+	// flags: H (here) or G (gone), optionally *, then member prefixes
+	modes := ""
+	for i := 0; i < len(flags); i++ {
+		if m := cs.prefixMode(flags[i]); m != 0 {
+			modes += string(m)
+		}
+	}
+	c.members[cs.fold(nick)] = modes
+	u := cs.user(nick)
+	u.Away = strings.HasPrefix(flags, "G")
+	return u
+}
+
+// Must be called with the lock held
+func (cs *chanStatePlugin) removeMember(channel, nick, me string) {
+	if cs.fold(nick) == cs.fold(me) {
+		delete(cs.channels, cs.fold(channel))
+		cs.forgetUnknownUsers()
+		return
+	}
+	if c := cs.channels[cs.fold(channel)]; c != nil {
+		delete(c.members, cs.fold(nick))
+	}
+	cs.forgetUnknownUsers()
+}
+
+// Removes users that don't share any channel with us anymore. Must be
+// called with the lock held.
+func (cs *chanStatePlugin) forgetUnknownUsers() {
+	for key := range cs.users {
+		known := false
+		for _, c := range cs.channels {
+			if _, ok := c.members[key]; ok {
+				known = true
+				break
+			}
+		}
+		if !known {
+			delete(cs.users, key)
+		}
+	}
+}
+
+// Applies a mode string like "+o-v" with its parameters to the channel.
+// Must be called with the lock held.
+func (cs *chanStatePlugin) applyModes(c *channelState, modestr string, params []string) {
+	adding := true
+	for i := 0; i < len(modestr); i++ {
+		mode := modestr[i]
+		switch mode {
+		case '+':
+			adding = true
+			continue
+		case '-':
+			adding = false
+			continue
+		}
+		typ := cs.modeType(mode)
+		param := ""
+		if typ == 'A' || typ == 'B' || typ == 'P' || (typ == 'C' && adding) {
+			if len(params) == 0 {
+				return
+			}
+			param = params[0]
+			params = params[1:]
+		}
+
+		switch typ {
+		case 'A':
+			continue
+		case 'B', 'C', 'D':
+			if adding {
+				c.modes[mode] = param
+			} else {
+				delete(c.modes, mode)
+			}
+			continue
+		}
+		key := cs.fold(param)
+		modes, ok := c.members[key]
+		if !ok {
+			continue
+		}
+		modes = strings.Replace(modes, string(mode), "", -1)
+		if adding {
+			modes += string(mode)
+		}
+		c.members[key] = modes
+	}
+}
+
+// Returns the type of a channel mode: 'P' for member modes like o and v,
+// otherwise the type according to CHANMODES: 'A' for list modes (bans),
+// 'B' for modes that always have a parameter, 'C' for modes that have one
+// only when set and 'D' for modes without parameter
+func (cs *chanStatePlugin) modeType(mode byte) byte {
+	is, _ := cs.ic.GetPlugin("isupport").(*isupportPlugin)
+	if modes, _ := is.prefixes(); strings.IndexByte(modes, mode) >= 0 {
+		return 'P'
+	}
+	chanmodes, ok := cs.ic.GetISupport("CHANMODES")
+	if !ok {
+		chanmodes = default_chanmodes
+	}
+	for i, modes := range strings.SplitN(chanmodes, ",", 4) {
+		if strings.IndexByte(modes, mode) >= 0 {
+			return "ABCD"[i]
+		}
+	}
+	// unknown modes are most likely flags
+	return 'D'
+}
+
+// Returns the member mode for a prefix like '@' according to the server's
+// PREFIX, or 0 if prefix isn't one
+func (cs *chanStatePlugin) prefixMode(prefix byte) byte {
+	is, _ := cs.ic.GetPlugin("isupport").(*isupportPlugin)
+	modes, prefixes := is.prefixes()
+	if i := strings.IndexByte(prefixes, prefix); i >= 0 {
+		return modes[i]
+	}
+	return 0
+}
+
+// Queues a WHO for the channel, unless one is already pending. Must be
+// called with the lock held.
+func (cs *chanStatePlugin) queueWho(channel string) {
+	key := cs.fold(channel)
+	if cs.pending[key] {
+		return
+	}
+	select {
+	case cs.whoQueue <- channel:
+		cs.pending[key] = true
+	default:
+		// queue full, the periodic sync will catch up
+	}
+}
+
+// Sends the queued WHOs one at a time, waiting for each reply to finish
+// before sending the next, and periodically re-syncs all channels
+func (cs *chanStatePlugin) whoLoop() {
+	resync := time.NewTicker(who_interval)
+	defer resync.Stop()
+	for {
+		select {
+		case channel := <-cs.whoQueue:
+			cs.Lock()
+			delete(cs.pending, cs.fold(channel))
+			_, joined := cs.channels[cs.fold(channel)]
+			cs.Unlock()
+			if !joined {
+				continue
+			}
+
+			if _, whox := cs.ic.GetISupport("WHOX"); whox {
+				cs.ic.SendLine("WHO " + channel + " %tcuhnfa," + whox_token)
+			} else {
+				cs.ic.SendLine("WHO " + channel)
+			}
+		wait:
+			for {
+				select {
+				case done := <-cs.whoDone:
+					if done == cs.fold(channel) {
+						break wait
+					}
+				case <-time.After(who_timeout):
+					break wait
+				case <-cs.quit:
+					return
+				}
+			}
+			select {
+			case <-time.After(who_delay):
+			case <-cs.quit:
+				return
+			}
+		case <-resync.C:
+			cs.Lock()
+			for _, c := range cs.channels {
+				cs.queueWho(c.name)
+			}
+			cs.Unlock()
+		case <-cs.quit:
+			return
+		}
+	}
+}
+
+// Adds channels we're already in, e.g. after an online restart, and
+// requests their members, modes and topics, which a JOIN would have told us
+func (cs *chanStatePlugin) restore(channels []string) {
+	cs.Lock()
+	defer cs.Unlock()
+	for _, channel := range channels {
+		cs.channels[cs.fold(channel)] = &channelState{name: channel, members: make(map[string]string), modes: make(map[byte]string)}
+		cs.queueWho(channel)
+		go func(channel string) {
+			cs.ic.SendLine("MODE " + channel)
+			cs.ic.SendLine("TOPIC " + channel)
+		}(channel)
+	}
+}
+
+// Returns the names of all channels the bot is currently in, sorted
+func (cs *chanStatePlugin) channelNames() []string {
+	cs.RLock()
+	defer cs.RUnlock()
+	names := make([]string, 0, len(cs.channels))
+	for _, c := range cs.channels {
+		names = append(names, c.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns information about all channels the bot is in, sorted by name
+func (cs *chanStatePlugin) channelInfos() []ChannelInfo {
+	cs.RLock()
+	defer cs.RUnlock()
+	infos := make([]ChannelInfo, 0, len(cs.channels))
+	for _, c := range cs.channels {
+		infos = append(infos, c.info())
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// Returns information about channel, ok is false if the bot isn't in it
+func (cs *chanStatePlugin) channelInfo(channel string) (info ChannelInfo, ok bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	c := cs.channels[cs.fold(channel)]
+	if c == nil {
+		return ChannelInfo{}, false
+	}
+	return c.info(), true
+}
+
+// Must be called with the lock held
+func (c *channelState) info() ChannelInfo {
+	info := ChannelInfo{Name: c.name, Topic: c.topic, TopicSetBy: c.topicBy, TopicTime: c.topicAt, Users: len(c.members)}
+	if len(c.modes) > 0 {
+		letters := make([]string, 0, len(c.modes))
+		for m := range c.modes {
+			letters = append(letters, string(m))
+		}
+		sort.Strings(letters)
+		info.Modes = "+" + strings.Join(letters, "")
+		for _, m := range letters {
+			if param := c.modes[m[0]]; param != "" {
+				info.Modes += " " + param
+			}
+		}
+	}
+	return info
+}
+
+// Returns copies of the information about all members of channel, sorted by
+// nick
+func (cs *chanStatePlugin) channelUsers(channel string) []UserInfo {
+	cs.RLock()
+	defer cs.RUnlock()
+	c := cs.channels[cs.fold(channel)]
+	if c == nil {
+		return nil
+	}
+	users := make([]UserInfo, 0, len(c.members))
+	for key := range c.members {
+		if u, ok := cs.users[key]; ok {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Nick < users[j].Nick })
+	return users
+}
+
+// Returns a copy of the information about nick, if nick is in channel
+func (cs *chanStatePlugin) userInfo(channel, nick string) (UserInfo, bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	c := cs.channels[cs.fold(channel)]
+	if c == nil {
+		return UserInfo{}, false
+	}
+	if _, ok := c.members[cs.fold(nick)]; !ok {
+		return UserInfo{}, false
+	}
+	u, ok := cs.users[cs.fold(nick)]
+	if !ok {
+		return UserInfo{Nick: nick}, true
+	}
+	return *u, true
+}
+
+// Hands the result of a WHOIS to everyone waiting for it. u is nil if the
+// nick doesn't exist. Must be called with the lock held.
+func (cs *chanStatePlugin) whoisReply(nick string, u *UserInfo) {
+	for _, c := range cs.whois[cs.fold(nick)] {
+		c <- u
+	}
+	delete(cs.whois, cs.fold(nick))
+}
+
+// Returns how long WHOIS results are cached
+func (cs *chanStatePlugin) whoisTTL() time.Duration {
+	if secs, err := cs.ic.GetIntOption("Server", "whoisttl"); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second
+	}
+	return default_whois_ttl
+}
+
+// Returns the services account of nick if it's known from a channel we
+// share or a recent WHOIS, without asking the server
+func (cs *chanStatePlugin) knownAccount(nick string) string {
+	key := cs.fold(nick)
+	ttl := cs.whoisTTL()
+	cs.RLock()
+	defer cs.RUnlock()
+	if u, ok := cs.users[key]; ok {
+		return u.Account
+	}
+	if c, ok := cs.whoisCache[key]; ok && time.Since(c.at) < ttl {
+		return c.info.Account
+	}
+	return ""
+}
+
+// Returns a copy of the information about nick if it shares a channel with
+// the bot and its hostmask is known, without sending a WHOIS
+func (cs *chanStatePlugin) knownUser(nick string) (UserInfo, bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	if u, ok := cs.users[cs.fold(nick)]; ok && u.Host != "" {
+		return *u, true
+	}
+	return UserInfo{}, false
+}
+
+// Returns a copy of the information about nick. If nick doesn't share a
+// channel with the bot or its hostmask isn't known yet, a WHOIS is sent and
+// this function blocks until the reply arrives or whois_timeout passes.
+// Concurrent lookups of the same nick share a single WHOIS, its result is
+// reused for whoisTTL().
+func (cs *chanStatePlugin) lookupUser(nick string) (UserInfo, bool) {
+	key := cs.fold(nick)
+	ttl := cs.whoisTTL()
+	cs.Lock()
+	if u, ok := cs.users[key]; ok && u.Host != "" {
+		cs.Unlock()
+		return *u, true
+	}
+	if c, ok := cs.whoisCache[key]; ok {
+		if time.Since(c.at) < ttl {
+			cs.Unlock()
+			return c.info, true
+		}
+		delete(cs.whoisCache, key)
+	}
+	reply := make(chan *UserInfo, 1)
+	cs.whois[key] = append(cs.whois[key], reply)
+	first := len(cs.whois[key]) == 1
+	cs.Unlock()
+
+	if first {
+		cs.ic.SendLine("WHOIS " + nick)
+	}
+	select {
+	case u := <-reply:
+		if u == nil {
+			return UserInfo{}, false
+		}
+		return *u, true
+	case <-time.After(whois_timeout):
+	case <-cs.quit:
+	}
+
+	cs.Lock()
+	defer cs.Unlock()
+	waiting := cs.whois[key]
+	for i, c := range waiting {
+		if c == reply {
+			cs.whois[key] = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(cs.whois[key]) == 0 {
+		delete(cs.whois, key)
+	}
+	return UserInfo{}, false
+}
+
+// Returns whether nick holds the given member mode (e.g. 'o') in channel
+func (cs *chanStatePlugin) hasMode(channel, nick string, mode byte) bool {
+	cs.RLock()
+	defer cs.RUnlock()
+	c := cs.channels[cs.fold(channel)]
+	if c == nil {
+		return false
+	}
+	return strings.IndexByte(c.members[cs.fold(nick)], mode) >= 0
+}
@@ -0,0 +1,139 @@
+package ircclient
+
+// Helpers sending the common IRC commands, so plugins don't have to build
+// protocol lines themselves. Parameters are checked, so a nick or channel
+// from user input can't smuggle further parameters or lines into the
+// command; texts are split (messages) or cut (reasons, topics) to the
+// server's limits.
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Returns an error unless s can be sent as a middle parameter, i.e. it's
+// not empty, doesn't start with ':' and contains no spaces or line breaks
+func checkParam(what, s string) error {
+	if s == "" || s[0] == ':' || strings.ContainsAny(s, " \r\n\x00") {
+		return fmt.Errorf("invalid %s %q", what, s)
+	}
+	return nil
+}
+
+func (ic *IRCClient) checkChannel(channel string) error {
+	if !ic.IsChannelName(channel) {
+		return fmt.Errorf("invalid channel %q", channel)
+	}
+	return nil
+}
+
+// Cuts text to max bytes (if max is positive) without splitting a UTF-8
+// character
+func cutText(text string, max int) string {
+	if max <= 0 || len(text) <= max {
+		return text
+	}
+	for max > 0 && !utf8.RuneStart(text[max]) {
+		max--
+	}
+	return text[:max]
+}
+
+// Sends message to target as an action ("/me"), split like Privmsg()
+func (ic *IRCClient) Action(target, message string) error {
+	return ic.sendCTCP("PRIVMSG", target, "ACTION", message)
+}
+
+// Joins channel, using key unless it's empty
+func (ic *IRCClient) Join(channel, key string) error {
+	if err := ic.checkChannel(channel); err != nil {
+		return err
+	}
+	if key == "" {
+		return ic.SendLine("JOIN " + channel)
+	}
+	if err := checkParam("key", key); err != nil {
+		return err
+	}
+	return ic.SendLine("JOIN " + channel + " " + key)
+}
+
+// Leaves channel, with reason unless it's empty
+func (ic *IRCClient) Part(channel, reason string) error {
+	if err := ic.checkChannel(channel); err != nil {
+		return err
+	}
+	if reason == "" {
+		return ic.SendLine("PART " + channel)
+	}
+	return ic.SendLine("PART " + channel + " :" + reason)
+}
+
+// Kicks nick from channel. reason is cut to the server's KICKLEN, the
+// server uses the nick instead if it's empty.
+func (ic *IRCClient) Kick(channel, nick, reason string) error {
+	if err := ic.checkChannel(channel); err != nil {
+		return err
+	}
+	if err := checkParam("nick", nick); err != nil {
+		return err
+	}
+	if reason == "" {
+		return ic.SendLine("KICK " + channel + " " + nick)
+	}
+	return ic.SendLine("KICK " + channel + " " + nick + " :" + cutText(reason, ic.ServerInfo().KickLen))
+}
+
+// Changes the modes of target (a channel or the bot), e.g.
+// Mode("#mett", "+ov", "alice", "bob")
+func (ic *IRCClient) Mode(target, modes string, params ...string) error {
+	if err := checkParam("target", target); err != nil {
+		return err
+	}
+	if err := checkParam("modes", modes); err != nil {
+		return err
+	}
+	for _, p := range params {
+		if err := checkParam("mode parameter", p); err != nil {
+			return err
+		}
+	}
+	return ic.SendLine(strings.Join(append([]string{"MODE", target, modes}, params...), " "))
+}
+
+// Sets the topic of channel, cut to the server's TOPICLEN. An empty topic
+// removes it.
+func (ic *IRCClient) Topic(channel, topic string) error {
+	if err := ic.checkChannel(channel); err != nil {
+		return err
+	}
+	return ic.SendLine("TOPIC " + channel + " :" + cutText(topic, ic.ServerInfo().TopicLen))
+}
+
+// Changes the bot's nick
+func (ic *IRCClient) Nick(nick string) error {
+	if !ValidNick(nick) {
+		return fmt.Errorf("invalid nick %q", nick)
+	}
+	return ic.SendLine("NICK " + nick)
+}
+
+// Asks the server about nick, see LookupUser() for the parsed reply
+func (ic *IRCClient) Whois(nick string) error {
+	if err := checkParam("nick", nick); err != nil {
+		return err
+	}
+	return ic.SendLine("WHOIS " + nick)
+}
+
+// Invites nick to channel
+func (ic *IRCClient) Invite(nick, channel string) error {
+	if err := checkParam("nick", nick); err != nil {
+		return err
+	}
+	if err := ic.checkChannel(channel); err != nil {
+		return err
+	}
+	return ic.SendLine("INVITE " + nick + " " + channel)
+}
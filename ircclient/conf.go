@@ -1,28 +1,110 @@
 package ircclient
 
 // This plugin manages a common config-file pointer
-// and the locks on it.
+// and the locks on it. The format of the file depends on its extension:
+// .toml and .yaml/.yml files are read with the treeConfig backend, all
+// others as INI files, see ConfigBackend.
 
 import (
+	"errors"
 	"github.com/robfig/config"
+	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 	"unicode/utf8"
 )
 
+const (
+	// Time SaveConfig() waits for more changes before writing
+	config_save_delay = 2 * time.Second
+	// Changes nobody asked to save are written after this at the latest
+	config_save_interval = 5 * time.Minute
+)
+
+// Options containing one of these strings (or all options of a section
+// containing one, e.g. ChannelKeys) are not shown by the get and options
+// commands
+var sensitiveOptions = []string{"pass", "secret", "token", "key", "proxy"}
+
+// The options in memory and their file format. Options are strings in
+// sections; String() falls back to section DEFAULT. Implemented by
+// *config.Config for INI files and treeConfig for TOML and YAML files.
+type ConfigBackend interface {
+	Sections() []string
+	HasSection(section string) bool
+	AddSection(section string) bool
+	Options(section string) ([]string, error)
+	HasOption(section, option string) bool
+	String(section, option string) (string, error)
+	// Replaces the value if the option exists
+	AddOption(section, option, value string) bool
+	RemoveOption(section, option string) bool
+	WriteFile(filename string, perm os.FileMode, header string) error
+}
+
+// Returns the format for filename, see readConfigFile()
+func configFormat(filename string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".toml":
+		return format_toml
+	case ".yaml", ".yml":
+		return format_yaml
+	}
+	return "ini"
+}
+
+// Reads filename in the format of its extension
+func readConfigFile(filename string) (ConfigBackend, error) {
+	if format := configFormat(filename); format != "ini" {
+		return readTreeConfig(filename, format)
+	}
+	return config.ReadDefault(filename)
+}
+
+// Returns an empty config in the format for filename
+func newConfigBackend(filename string) ConfigBackend {
+	if format := configFormat(filename); format != "ini" {
+		return newTreeConfig(format)
+	}
+	return config.NewDefault()
+}
+
 type ConfigPlugin struct {
-	ic       *IRCClient
+	ic *IRCClient
+	// The network whose sections are preferred, see BotManager. Empty for
+	// a single client.
+	network string
+	*configFile
+}
+
+// The config file, shared by the clients of a BotManager
+type configFile struct {
 	filename string
-	Conf     *config.Config
+	Conf     ConfigBackend
+	// The clients using the file, told about reloads
+	clients []*IRCClient
+	// Unset environment variables and unreadable files already warned
+	// about, see value()
+	warned map[string]bool
+	// Changes not written yet, see changed() and requestSave()
+	dirty, saveRequested bool
+	saveTimer            *time.Timer
+	saveAt               time.Time
+	// Of the last write
+	saveErr error
 	// Operations to the Config structure should be atomic
 	sync.Mutex
 }
 
 func NewConfigPlugin(filename string) *ConfigPlugin {
-	c, ok := config.ReadDefault(filename)
-	if ok != nil {
-		c = config.NewDefault()
+	c, ok := readConfigFile(filename)
+	if os.IsNotExist(ok) {
+		c = newConfigBackend(filename)
 		c.AddSection("Server")
 		c.AddOption("Server", "host", "dpaulus.dyndns.org:6667")
 		c.AddOption("Server", "nick", "testbot")
@@ -35,28 +117,142 @@ func NewConfigPlugin(filename string) *ConfigPlugin {
 		log.Println("Note: A new default configuration file has been generated in " + filename + ". Please edit it to suit your needs and restart the bot then")
 		os.Exit(1)
 	}
-	for _, x := range []string{"host", "nick", "ident", "realname"} {
-		_, err := c.String("Server", x)
-		if err != nil {
-			log.Fatal("Error while parsing config: " + err.Error())
+	if ok != nil {
+		log.Fatal("Error while reading config: " + ok.Error())
+	}
+	if err := checkConfig(c); err != nil {
+		log.Fatal("Error while parsing config: " + err.Error())
+	}
+	return &ConfigPlugin{configFile: &configFile{filename: filename, Conf: c, warned: make(map[string]bool)}}
+}
+
+// Returns an error if required options are missing
+func checkConfig(c ConfigBackend) error {
+	if networks, _ := c.Options("Networks"); len(networks) == 0 {
+		// checked per network by NewBotManager() otherwise
+		for _, x := range []string{"host", "nick", "ident", "realname"} {
+			if _, err := c.String("Server", x); err != nil {
+				return errors.New("option " + x + " not found in section Server")
+			}
 		}
 	}
 	trigger, err := c.String("Server", "trigger")
 	if err != nil {
-		log.Fatal(err)
+		return errors.New("option trigger not found in section Server")
 	}
 	if utf8.RuneCountInString(trigger) != 1 {
-		log.Fatal("Trigger must be exactly one unicode rune long")
+		return errors.New("trigger must be exactly one unicode rune long")
+	}
+	return nil
+}
+
+// Returns the value of option like GetStringOption(): the one in the
+// section of our network, in section or in section DEFAULT, the first one
+// set. Instead of the option, "<option>_file" may name a file holding the
+// value (without the newline at its end), e.g. a secret of a container, so
+// it's not in the world-readable config file. ${VAR} in values and file
+// names is replaced with environment variable VAR, ${VAR:-text} gives text
+// if it's unset or empty, $${ a literal ${. Returns false if the option
+// isn't set. cp must be locked.
+func (cp *ConfigPlugin) value(section, option string) (string, bool) {
+	for _, s := range []string{cp.scoped(section), section, config.DEFAULT_SECTION} {
+		if cp.Conf.HasOption(s, option) {
+			v, _ := cp.Conf.String(s, option)
+			return cp.expandEnv(v), true
+		}
+		if cp.Conf.HasOption(s, option+"_file") {
+			filename, _ := cp.Conf.String(s, option+"_file")
+			return cp.readSecret(cp.expandEnv(filename)), true
+		}
+	}
+	return "", false
+}
+
+// Replaces ${VAR} and ${VAR:-text} in s, see value()
+func (cp *ConfigPlugin) expandEnv(s string) string {
+	if !strings.Contains(s, "${") {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "${")
+		if i < 0 {
+			break
+		}
+		if i > 0 && s[i-1] == '$' {
+			b.WriteString(s[:i-1] + "${")
+			s = s[i+2:]
+			continue
+		}
+		end := strings.IndexByte(s[i:], '}')
+		if end < 0 {
+			break
+		}
+		b.WriteString(s[:i])
+		name, def := s[i+2:i+end], ""
+		hasDefault := false
+		if j := strings.Index(name, ":-"); j >= 0 {
+			name, def, hasDefault = name[:j], name[j+2:], true
+		}
+		v, ok := os.LookupEnv(name)
+		if v == "" {
+			v = def
+			if !ok && !hasDefault && !cp.warned["$"+name] {
+				cp.warned["$"+name] = true
+				logWarnf("config: environment variable %s is not set", name)
+			}
+		}
+		b.WriteString(v)
+		s = s[i+end+1:]
 	}
-	return &ConfigPlugin{filename: filename, Conf: c}
+	b.WriteString(s)
+	return b.String()
+}
+
+// Returns the contents of the file holding an option, see value()
+func (cp *ConfigPlugin) readSecret(filename string) string {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		if !cp.warned[filename] {
+			cp.warned[filename] = true
+			logWarnf("config: %v", err)
+		}
+		return ""
+	}
+	return strings.TrimRight(string(data), "\r\n")
+}
+
+// Returns a config plugin for network, using the same config file
+func (cp *ConfigPlugin) forNetwork(network string) *ConfigPlugin {
+	return &ConfigPlugin{network: network, configFile: cp.configFile}
+}
+
+// Returns the section holding the options of section for our network,
+// "<section>@<network>"
+func (cp *ConfigPlugin) scoped(section string) string {
+	if cp.network == "" {
+		return section
+	}
+	return section + "@" + cp.network
 }
 
 func (cp *ConfigPlugin) Register(cl *IRCClient) {
 	cp.ic = cl
+	cp.Lock()
+	cp.clients = append(cp.clients, cl)
+	cp.Unlock()
 	cl.RegisterCommandHandler("version", 0, 0, cp)
 	cl.RegisterCommandHandler("source", 0, 0, cp)
 	cl.RegisterCommandHandler("writeconfig", 0, 400, cp)
 	cl.RegisterCommandHandler("loadconfig", 0, 400, cp)
+	cl.RegisterCommandHandler("rehash", 0, 400, cp)
+	cl.RegisterCommandHandler("migrateconfig", 1, 500, cp)
+	cl.RegisterCommandHandler("get", 2, 500, cp)
+	cl.RegisterCommandHandler("set", 3, 500, cp)
+	cl.RegisterCommandHandler("options", 1, 500, cp)
+	for _, cmd := range []string{"get", "set", "options"} {
+		cl.SetReplyMode(cmd, ReplyModePrivate)
+	}
 }
 
 func (cp *ConfigPlugin) String() string {
@@ -72,19 +268,147 @@ func (cp *ConfigPlugin) Usage(cmd string) string {
 	case "writeconfig":
 		return "writeconfig: writes in-memory config options to disk"
 	case "loadconfig":
-		return "loadconfig: loads config options into memory"
+		return "loadconfig: same as rehash"
+	case "rehash":
+		return "rehash: reloads the config file, discarding changes that haven't been written to disk"
+	case "migrateconfig":
+		return "migrateconfig <file>: writes the config to file (.toml, .yaml or .cfg for INI) and uses that file from now on"
+	case "get":
+		return "get <section> <option>: prints the value of a config option"
+	case "set":
+		return "set [-w] <section> <option> <value>: sets a config option, -w also writes the config to disk"
+	case "options":
+		return "options <section>: lists all options of a config section"
 	}
 	return ""
 }
 
+// Returns whether the option probably holds a password or the like, which
+// shouldn't be shown to users
+func IsSensitiveOption(section, option string) bool {
+	return isSensitive(section, option)
+}
+
+func isSensitive(section, option string) bool {
+	section, option = strings.ToLower(section), strings.ToLower(option)
+	for _, s := range sensitiveOptions {
+		if strings.Contains(section, s) || strings.Contains(option, s) {
+			return true
+		}
+	}
+	return false
+}
+
+// Marks the config as changed, it's written within config_save_interval.
+// cp must be locked.
+func (cp *ConfigPlugin) changed() {
+	cp.dirty = true
+	cp.scheduleSave(config_save_interval)
+}
+
+// Has the config written within config_save_delay, together with the
+// changes made until then. cp must be locked.
+func (cp *ConfigPlugin) requestSave() {
+	cp.saveRequested = true
+	cp.scheduleSave(config_save_delay)
+}
+
+// Makes sure the config is written within d. cp must be locked.
+func (cp *ConfigPlugin) scheduleSave(d time.Duration) {
+	at := time.Now().Add(d)
+	if cp.saveTimer != nil {
+		if !cp.saveAt.After(at) {
+			return
+		}
+		cp.saveTimer.Stop()
+	}
+	cp.saveAt = at
+	cp.saveTimer = time.AfterFunc(d, func() {
+		cp.Lock()
+		defer cp.Unlock()
+		if !cp.dirty && !cp.saveRequested {
+			// written in the meantime
+			return
+		}
+		if err := cp.write(); err != nil {
+			logErrorf("unable to write config: %v", err)
+			// tried again later, the changes are still there
+			cp.scheduleSave(config_save_interval)
+		}
+	})
+}
+
+// Writes the in-memory config to disk now. cp must be locked.
+func (cp *ConfigPlugin) write() error {
+	if cp.saveTimer != nil {
+		cp.saveTimer.Stop()
+		cp.saveTimer = nil
+	}
+	cp.saveErr = writeConfig(cp.Conf, cp.filename)
+	if cp.saveErr == nil {
+		cp.dirty, cp.saveRequested = false, false
+	}
+	return cp.saveErr
+}
+
+// See write()
+func (cp *ConfigPlugin) flush() error {
+	cp.Lock()
+	defer cp.Unlock()
+	return cp.write()
+}
+
+// Writes c to filename through a temporary file, so a crash while writing
+// leaves the old file instead of a part of the new one. Symlinks are
+// followed and the permissions of the old file kept.
+func writeConfig(c ConfigBackend, filename string) error {
+	if target, err := filepath.EvalSymlinks(filename); err == nil {
+		filename = target
+	}
+	perm := os.FileMode(0644)
+	if fi, err := os.Stat(filename); err == nil {
+		perm = fi.Mode().Perm()
+	}
+	tmp := filename + ".tmp"
+	// WriteFile() keeps the permissions of an existing file
+	os.Remove(tmp)
+	if err := c.WriteFile(tmp, perm, "IRC Bot Config"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	// on disk before it replaces the old file
+	f, err := os.Open(tmp)
+	if err == nil {
+		err = f.Sync()
+		f.Close()
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
 func (cp *ConfigPlugin) ProcessLine(msg *IRCMessage) {
 	// Empty
 }
 
 func (cp *ConfigPlugin) Unregister() {
 	cp.Lock()
-	cp.Conf.WriteFile(cp.filename, 0644, "IRC Bot Config")
-	cp.Unlock()
+	defer cp.Unlock()
+	if cp.dirty || cp.saveRequested {
+		if err := cp.write(); err != nil {
+			logErrorf("unable to write config: %v", err)
+		}
+	}
+	for i, c := range cp.clients {
+		if c == cp.ic {
+			cp.clients = append(cp.clients[:i], cp.clients[i+1:]...)
+			break
+		}
+	}
 }
 
 func (cp *ConfigPlugin) Info() string {
@@ -100,23 +424,254 @@ func (cp *ConfigPlugin) ProcessCommand(cmd *IRCCommand) {
 		cp.ic.Reply(cmd, cp.ic.GetStringOption("Info", "source"))
 	case "writeconfig":
 		cp.Lock()
-		err = cp.Conf.WriteFile(cp.filename, 0644, "IRC Bot Config")
+		err = cp.write()
 		if err != nil {
+			cp.Unlock()
 			cp.ic.Reply(cmd, "Error writing config: "+err.Error())
+			return
 		}
-		cp.Conf, err = config.ReadDefault(cp.filename)
+		c, err := readConfigFile(cp.filename)
 		if err != nil {
+			cp.Unlock()
 			cp.ic.Reply(cmd, "Error loading config: "+err.Error())
+			return
 		}
+		cp.Conf = c
 		cp.Unlock()
 		cp.ic.Reply(cmd, "Successfully flushed cached config entries")
-	case "loadconfig":
-		cp.Lock()
-		cp.Conf, err = config.ReadDefault(cp.filename)
+	case "loadconfig", "rehash":
+		changed, err := cp.reload()
 		if err != nil {
-			cp.ic.Reply(cmd, "Error loading config: "+err.Error())
+			cp.ic.Reply(cmd, "Error loading config, keeping the current one: "+err.Error())
+		} else if len(changed) == 0 {
+			cp.ic.Reply(cmd, "Config reloaded, nothing changed")
+		} else {
+			cp.ic.Reply(cmd, "Config reloaded, changed sections: "+strings.Join(changed, ", "))
+		}
+	case "migrateconfig":
+		if err := cp.ic.MigrateConfig(cmd.Args[0]); err != nil {
+			cp.ic.Reply(cmd, "Error migrating config: "+err.Error())
+			return
+		}
+		cp.ic.Reply(cmd, "Config written to "+cmd.Args[0]+", which is used from now on")
+	case "get":
+		value := cp.ic.GetStringOption(cmd.Args[0], cmd.Args[1])
+		if value == "" {
+			cp.ic.Reply(cmd, "Option not set")
+		} else if isSensitive(cmd.Args[0], cmd.Args[1]) {
+			cp.ic.Reply(cmd, cmd.Args[0]+"/"+cmd.Args[1]+" is set (value redacted)")
+		} else {
+			cp.ic.Reply(cmd, cmd.Args[0]+"/"+cmd.Args[1]+" = "+value)
+		}
+	case "set":
+		write := cmd.Args[0] == "-w"
+		args := cmd.Args
+		if write {
+			args = args[1:]
+			if len(args) < 3 {
+				cp.ic.Reply(cmd, cp.Usage("set"))
+				return
+			}
+		}
+		if strings.HasSuffix(args[1], "_file") {
+			// would show any file the bot can read with get
+			cp.ic.Reply(cmd, "Options naming files can only be set in the config file")
+			return
+		}
+		cp.ic.SetStringOption(args[0], args[1], strings.Join(args[2:], " "))
+		if !write {
+			cp.ic.Reply(cmd, "Option set")
+			return
+		}
+		if err := cp.flush(); err != nil {
+			cp.ic.Reply(cmd, "Option set, but error writing config: "+err.Error())
+			return
+		}
+		cp.ic.Reply(cmd, "Option set and written to disk")
+	case "options":
+		opts := cp.ic.GetOptions(cmd.Args[0])
+		if len(opts) == 0 {
+			cp.ic.Reply(cmd, "No options in section "+cmd.Args[0])
+			return
+		}
+		sort.Strings(opts)
+		for i, opt := range opts {
+			if isSensitive(cmd.Args[0], opt) {
+				opts[i] = opt + " (redacted)"
+			} else {
+				opts[i] = opt + "=" + cp.ic.GetStringOption(cmd.Args[0], opt)
+			}
+		}
+		cp.ic.Reply(cmd, strings.Join(opts, ", "))
+	}
+}
+
+// Re-reads the config file, see IRCClient.ReloadConfig()
+func (cp *ConfigPlugin) reload() ([]string, error) {
+	// what SaveConfig() was called for isn't lost
+	cp.Lock()
+	if cp.saveRequested {
+		if err := cp.write(); err != nil {
+			cp.Unlock()
+			return nil, err
+		}
+	}
+	cp.Unlock()
+	c, err := readConfigFile(cp.filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkConfig(c); err != nil {
+		return nil, err
+	}
+	cp.Lock()
+	changed := diffConfig(cp.Conf, c)
+	cp.Conf = c
+	// the changes in memory are gone
+	cp.dirty = false
+	if cp.saveTimer != nil {
+		cp.saveTimer.Stop()
+		cp.saveTimer = nil
+	}
+	clients := append([]*IRCClient(nil), cp.clients...)
+	cp.Unlock()
+	logInfof("reloaded config file %s, %d sections changed", cp.filename, len(changed))
+	if len(changed) == 0 {
+		return changed, nil
+	}
+	// shared plugins are registered with several clients, but are told
+	// only once
+	told := make(map[Plugin]bool)
+	for _, c := range clients {
+		c.configReloaded(changed, told)
+	}
+	return changed, nil
+}
+
+// Returns the sections (sorted) whose options differ between a and b,
+// including sections only one of them has
+func diffConfig(a, b ConfigBackend) []string {
+	sections := make(map[string]bool)
+	for _, s := range a.Sections() {
+		sections[s] = true
+	}
+	for _, s := range b.Sections() {
+		sections[s] = true
+	}
+	var changed []string
+	for s := range sections {
+		if !sameSection(a, b, s) {
+			changed = append(changed, s)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func sameSection(a, b ConfigBackend, section string) bool {
+	if a.HasSection(section) != b.HasSection(section) {
+		return false
+	}
+	optsA, _ := a.Options(section)
+	optsB, _ := b.Options(section)
+	if len(optsA) != len(optsB) {
+		return false
+	}
+	for _, o := range optsA {
+		if !b.HasOption(section, o) {
+			return false
+		}
+		va, _ := a.String(section, o)
+		vb, _ := b.String(section, o)
+		if va != vb {
+			return false
+		}
+	}
+	return true
+}
+
+// Re-reads the config file, replacing the options in memory; changes that
+// haven't been written (and SaveConfig() hasn't been called for) are lost.
+// If the file can't be read or required options are missing, the current
+// config is kept and an error returned. Returns the sections whose options changed, sorted, as
+// they are named in the file (e.g. "Server@libera"). Plugins implementing
+// ConfigReloadHandler are told about them, with a BotManager those of all
+// networks. Also called on SIGHUP, see HandleSignals(), and by the rehash
+// command. Settings of the connection (e.g. Server/host) only take effect
+// when reconnecting, new networks need a restart.
+func (ic *IRCClient) ReloadConfig() ([]string, error) {
+	cf, _ := ic.GetPlugin("conf").(*ConfigPlugin)
+	return cf.reload()
+}
+
+// Writes the config to filename, in the format of its extension (.toml,
+// .yaml or .yml, INI otherwise), and uses that file from now on, e.g. for
+// SaveConfig() and ReloadConfig(). The old file is left as it is. Comments
+// and the order of options may change, nested TOML and YAML values are
+// written as described in conftree.go.
+func (ic *IRCClient) MigrateConfig(filename string) error {
+	cf, _ := ic.GetPlugin("conf").(*ConfigPlugin)
+	cf.Lock()
+	defer cf.Unlock()
+	c := newConfigBackend(filename)
+	for _, s := range cf.Conf.Sections() {
+		c.AddSection(s)
+		opts, _ := cf.Conf.Options(s)
+		for _, o := range opts {
+			// Options() includes those of DEFAULT
+			if s == config.DEFAULT_SECTION || cf.Conf.HasOption(s, o) {
+				v, _ := cf.Conf.String(s, o)
+				c.AddOption(s, o, v)
+			}
+		}
+	}
+	if err := writeConfig(c, filename); err != nil {
+		return err
+	}
+	// read again, to use the file as it will be read next time
+	read, err := readConfigFile(filename)
+	if err != nil {
+		return err
+	}
+	logInfof("migrated config from %s to %s", cf.filename, filename)
+	cf.filename, cf.Conf = filename, read
+	cf.dirty, cf.saveRequested = false, false
+	return nil
+}
+
+// Returns whether section, as seen by this client, is among the changed
+// sections passed to ConfigReloadHandler, i.e. the plain section or the
+// one of our network (see BotManager)
+func (ic *IRCClient) ConfigChanged(changed []string, section string) bool {
+	cf, _ := ic.GetPlugin("conf").(*ConfigPlugin)
+	for _, s := range changed {
+		if s == section || s == cf.scoped(section) {
+			return true
+		}
+	}
+	return false
+}
+
+// Applies the changed options the client itself uses and tells the
+// plugins not in told about the reload
+func (ic *IRCClient) configReloaded(changed []string, told map[Plugin]bool) {
+	if ic.ConfigChanged(changed, "Server") {
+		ic.applyLogLevel()
+	}
+	plugins := ic.GetPlugins()
+	names := make([]string, 0, len(plugins))
+	for name := range plugins {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := plugins[name]
+		if s, ok := p.(*sharedPlugin); ok {
+			p = s.Plugin
+		}
+		if h, ok := p.(ConfigReloadHandler); ok && !told[p] {
+			told[p] = true
+			h.ConfigReloaded(changed)
 		}
-		cp.Unlock()
-		cp.ic.Reply(cmd, "Successfully loaded config entries")
 	}
 }
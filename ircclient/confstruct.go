@@ -0,0 +1,184 @@
+package ircclient
+
+// Reading a whole config section into a struct, see UnmarshalSection():
+//
+//	type feedConfig struct {
+//		Shortener string        `config:"shortener" default:"https://is.gd/..."`
+//		Interval  time.Duration `default:"15m"`
+//		Channels  []string      `config:"channels,required"`
+//	}
+//
+//	var c feedConfig
+//	err := ic.UnmarshalSection("Feeds", &c)
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+// Optional interface for the structs passed to UnmarshalSection(), to
+// check the values beyond their types
+type ConfigValidator interface {
+	Validate() error
+}
+
+// Fills the struct v points to with the options of section. The option of
+// a field is named by its tag `config:"name"`, otherwise it's the field's
+// name in lower case; `config:"-"` skips the field. `config:"name,required"`
+// makes the option mandatory. Tag `default:"value"` gives the value used if
+// the option isn't set, written like in the config file; without it, the
+// field keeps its value. Fields can be strings, booleans, integers, floats,
+// time.Duration and []string, parsed like GetBoolOption(),
+// GetDurationOption() and GetStringSliceOption() do. Invalid values leave
+// their fields at the default and the first error is returned, after the
+// other fields have been filled. If v implements ConfigValidator and all
+// options were valid, its Validate() is called last.
+func (ic *IRCClient) UnmarshalSection(section string, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("UnmarshalSection: need a pointer to a struct")
+	}
+	rv = rv.Elem()
+	t := rv.Type()
+	var firstErr error
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+		name, required := strings.ToLower(field.Name), false
+		if tag, ok := field.Tag.Lookup("config"); ok {
+			parts := strings.Split(tag, ",")
+			if parts[0] == "-" {
+				continue
+			}
+			if parts[0] != "" {
+				name = parts[0]
+			}
+			for _, p := range parts[1:] {
+				required = required || p == "required"
+			}
+		}
+
+		if def, ok := field.Tag.Lookup("default"); ok {
+			if err := setConfigField(rv.Field(i), def); err != nil {
+				return fmt.Errorf("UnmarshalSection: invalid default for %s: %v", field.Name, err)
+			}
+		}
+		value := ic.GetStringOption(section, name)
+		if value == "" {
+			if required && firstErr == nil {
+				firstErr = fmt.Errorf("option %s/%s is required", section, name)
+			}
+			continue
+		}
+		// parsed into a copy, so errors leave the default
+		parsed := reflect.New(field.Type).Elem()
+		if err := setConfigField(parsed, value); err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("%s/%s: %v", section, name, err)
+			}
+			continue
+		}
+		rv.Field(i).Set(parsed)
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+	if validator, ok := v.(ConfigValidator); ok {
+		if err := validator.Validate(); err != nil {
+			return fmt.Errorf("section %s: %v", section, err)
+		}
+	}
+	return nil
+}
+
+// Parses s into f according to its type
+func setConfigField(f reflect.Value, s string) error {
+	switch {
+	case f.Type() == durationType:
+		d, err := parseDurationValue(s)
+		if err != nil {
+			return err
+		}
+		f.SetInt(int64(d))
+	case f.Kind() == reflect.String:
+		f.SetString(s)
+	case f.Kind() == reflect.Bool:
+		b, err := parseBoolValue(s)
+		if err != nil {
+			return err
+		}
+		f.SetBool(b)
+	case f.Kind() >= reflect.Int && f.Kind() <= reflect.Int64:
+		n, err := strconv.ParseInt(strings.TrimSpace(s), 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid integer %q", s)
+		}
+		f.SetInt(n)
+	case f.Kind() >= reflect.Uint && f.Kind() <= reflect.Uint64:
+		n, err := strconv.ParseUint(strings.TrimSpace(s), 10, f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid unsigned integer %q", s)
+		}
+		f.SetUint(n)
+	case f.Kind() == reflect.Float32 || f.Kind() == reflect.Float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(s), f.Type().Bits())
+		if err != nil {
+			return fmt.Errorf("invalid number %q", s)
+		}
+		f.SetFloat(n)
+	case f.Kind() == reflect.Slice && f.Type().Elem().Kind() == reflect.String:
+		list := splitListValue(s)
+		values := reflect.MakeSlice(f.Type(), len(list), len(list))
+		for i, v := range list {
+			values.Index(i).SetString(v)
+		}
+		f.Set(values)
+	default:
+		return errors.New("unsupported type " + f.Type().String())
+	}
+	return nil
+}
+
+// See GetBoolOption()
+func parseBoolValue(s string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "true", "yes", "on", "1":
+		return true, nil
+	case "false", "no", "off", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %q", s)
+}
+
+// See GetDurationOption()
+func parseDurationValue(s string) (time.Duration, error) {
+	s = strings.TrimSpace(s)
+	if secs, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(secs * float64(time.Second)), nil
+	}
+	d, err := ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
+
+// See GetStringSliceOption()
+func splitListValue(s string) []string {
+	values := []string{}
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
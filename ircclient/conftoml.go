@@ -0,0 +1,513 @@
+package ircclient
+
+// Reads and writes TOML (https://toml.io) for the treeConfig backend.
+// Dates and times are kept as strings, some of the finer rules about
+// redefining tables aren't checked.
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+var tomlFloat = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+type tomlParser struct {
+	s    string
+	pos  int
+	line int
+	root *confNode
+	// Tables defined by a header, they can't be defined twice
+	defined map[*confNode]bool
+	// Tables (also inline ones) and lists that can't be extended
+	closed map[*confNode]bool
+}
+
+type tomlError struct {
+	line int
+	msg  string
+}
+
+func (e *tomlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+func parseTOML(s string) (root *confNode, err error) {
+	p := &tomlParser{s: s, line: 1, root: newConfMap(), defined: make(map[*confNode]bool), closed: make(map[*confNode]bool)}
+	// errors are passed up with panic, there are too many places to
+	// check them
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*tomlError)
+			if !ok {
+				panic(r)
+			}
+			root, err = nil, e
+		}
+	}()
+	p.parse()
+	return p.root, nil
+}
+
+func (p *tomlParser) fail(format string, args ...interface{}) {
+	panic(&tomlError{p.line, fmt.Sprintf(format, args...)})
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.s)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.s[p.pos]
+}
+
+func (p *tomlParser) next() byte {
+	c := p.s[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *tomlParser) expect(c byte) {
+	if p.peek() != c {
+		p.fail("expected %q", c)
+	}
+	p.next()
+}
+
+// Skips spaces and tabs
+func (p *tomlParser) skipSpace() {
+	for p.peek() == ' ' || p.peek() == '\t' {
+		p.next()
+	}
+}
+
+// Skips whitespace, newlines and comments, as in arrays
+func (p *tomlParser) skipAll() {
+	for {
+		p.skipSpace()
+		switch {
+		case p.peek() == '#':
+			p.skipComment()
+		case p.peek() == '\n':
+			p.next()
+		case strings.HasPrefix(p.s[p.pos:], "\r\n"):
+			p.next()
+			p.next()
+		default:
+			return
+		}
+	}
+}
+
+func (p *tomlParser) skipComment() {
+	for !p.eof() && p.peek() != '\n' {
+		p.next()
+	}
+}
+
+// Expects the end of the line, maybe after a comment
+func (p *tomlParser) endOfLine() {
+	p.skipSpace()
+	if p.peek() == '#' {
+		p.skipComment()
+	}
+	if strings.HasPrefix(p.s[p.pos:], "\r\n") {
+		p.next()
+	}
+	if !p.eof() && p.next() != '\n' {
+		p.fail("expected the end of the line")
+	}
+}
+
+func (p *tomlParser) parse() {
+	table := p.root
+	for {
+		p.skipAll()
+		if p.eof() {
+			return
+		}
+		if p.peek() == '[' {
+			table = p.header()
+		} else {
+			p.keyValue(table)
+		}
+		p.endOfLine()
+	}
+}
+
+// Parses [table] or [[list]], returns the table the following keys go to
+func (p *tomlParser) header() *confNode {
+	p.expect('[')
+	list := p.peek() == '['
+	if list {
+		p.next()
+	}
+	p.skipSpace()
+	keys := p.key()
+	p.expect(']')
+	if list {
+		p.expect(']')
+	}
+	parent := p.root
+	for _, k := range keys[:len(keys)-1] {
+		parent = p.subTable(parent, k, true)
+	}
+	last := keys[len(keys)-1]
+	if !list {
+		table := p.subTable(parent, last, false)
+		if p.defined[table] {
+			p.fail("table %s defined twice", strings.Join(keys, "."))
+		}
+		p.defined[table] = true
+		return table
+	}
+	l, ok := parent.fields[last]
+	if !ok {
+		l = &confNode{isList: true}
+		parent.set(last, l)
+	} else if !l.isList || p.closed[l] {
+		p.fail("%s is not a list of tables", strings.Join(keys, "."))
+	}
+	table := newConfMap()
+	l.items = append(l.items, table)
+	return table
+}
+
+// Returns the table key of parent, created if needed. For a list of
+// tables, that's the last one, if lists is set.
+func (p *tomlParser) subTable(parent *confNode, key string, lists bool) *confNode {
+	n, ok := parent.fields[key]
+	if !ok {
+		n = newConfMap()
+		parent.set(key, n)
+		return n
+	}
+	if lists && n.isList && !p.closed[n] && len(n.items) > 0 {
+		return n.items[len(n.items)-1]
+	}
+	if !n.isMap || p.closed[n] {
+		p.fail("%s is already defined", key)
+	}
+	return n
+}
+
+// Parses key = value into table
+func (p *tomlParser) keyValue(table *confNode) {
+	keys := p.key()
+	p.expect('=')
+	p.skipSpace()
+	for _, k := range keys[:len(keys)-1] {
+		table = p.subTable(table, k, false)
+		// defined with dotted keys, not by a header any more
+		p.defined[table] = true
+	}
+	value := p.value()
+	if !table.set(keys[len(keys)-1], value) {
+		p.fail("key %s defined twice", strings.Join(keys, "."))
+	}
+}
+
+// Parses a dotted key, followed by spaces
+func (p *tomlParser) key() []string {
+	var keys []string
+	for {
+		p.skipSpace()
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			if strings.HasPrefix(p.s[p.pos:], `"""`) || strings.HasPrefix(p.s[p.pos:], "'''") {
+				p.fail("multi-line strings can't be keys")
+			}
+			keys = append(keys, p.str())
+		case isBareKeyChar(c):
+			start := p.pos
+			for isBareKeyChar(p.peek()) {
+				p.next()
+			}
+			keys = append(keys, p.s[start:p.pos])
+		default:
+			p.fail("expected a key")
+		}
+		p.skipSpace()
+		if p.peek() != '.' {
+			return keys
+		}
+		p.next()
+	}
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+func (p *tomlParser) value() *confNode {
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		return &confNode{value: p.str()}
+	case c == '[':
+		return p.array()
+	case c == '{':
+		return p.inlineTable()
+	}
+	// numbers, booleans, dates and times
+	start := p.pos
+	for !p.eof() && !strings.ContainsRune(",]}#\r\n", rune(p.peek())) {
+		// dates and times may contain one space
+		if p.peek() == ' ' && !(p.pos+1 < len(p.s) && p.s[p.pos+1] >= '0' && p.s[p.pos+1] <= '9' && strings.Contains(p.s[start:p.pos], "-")) {
+			break
+		}
+		p.next()
+	}
+	token := p.s[start:p.pos]
+	switch token {
+	case "":
+		p.fail("expected a value")
+	case "true", "false", "inf", "+inf", "-inf", "nan", "+nan", "-nan":
+		return &confNode{value: token, bare: true}
+	}
+	clean := strings.Replace(token, "_", "", -1)
+	digits := strings.TrimLeft(clean, "+-")
+	leadingZero := len(digits) > 1 && digits[0] == '0' && digits[1] >= '0' && digits[1] <= '9'
+	if n, err := strconv.ParseInt(clean, 0, 64); err == nil && !leadingZero {
+		return &confNode{value: strconv.FormatInt(n, 10), bare: true}
+	}
+	if tomlFloat.MatchString(clean) && !leadingZero {
+		return &confNode{value: clean, bare: true}
+	}
+	if token[0] >= '0' && token[0] <= '9' && strings.ContainsAny(token, "-:") {
+		// date or time
+		return &confNode{value: token}
+	}
+	p.fail("invalid value %s", token)
+	return nil
+}
+
+func (p *tomlParser) array() *confNode {
+	p.expect('[')
+	n := &confNode{isList: true}
+	p.closed[n] = true
+	for {
+		p.skipAll()
+		if p.peek() == ']' {
+			p.next()
+			return n
+		}
+		n.items = append(n.items, p.value())
+		p.skipAll()
+		if p.peek() == ',' {
+			p.next()
+		} else if p.peek() != ']' {
+			p.fail("expected , or ] in array")
+		}
+	}
+}
+
+func (p *tomlParser) inlineTable() *confNode {
+	p.expect('{')
+	n := newConfMap()
+	p.skipSpace()
+	if p.peek() == '}' {
+		p.next()
+		p.closed[n] = true
+		return n
+	}
+	for {
+		p.keyValue(n)
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.next()
+			break
+		}
+		p.expect(',')
+		p.skipSpace()
+	}
+	// no tables can be added later, also not those of dotted keys
+	var closeAll func(n *confNode)
+	closeAll = func(n *confNode) {
+		p.closed[n] = true
+		for _, f := range n.fields {
+			if f.isMap {
+				closeAll(f)
+			}
+		}
+	}
+	closeAll(n)
+	return n
+}
+
+// Parses a basic or literal string, also multi-line ones
+func (p *tomlParser) str() string {
+	quote := p.next()
+	multi := strings.HasPrefix(p.s[p.pos:], string([]byte{quote, quote}))
+	if multi {
+		p.next()
+		p.next()
+		// a newline right after the quotes is left out
+		if strings.HasPrefix(p.s[p.pos:], "\r\n") {
+			p.next()
+		}
+		if p.peek() == '\n' {
+			p.next()
+		}
+	}
+	var b strings.Builder
+	for {
+		if p.eof() {
+			p.fail("unterminated string")
+		}
+		c := p.peek()
+		if c == quote {
+			if !multi {
+				p.next()
+				return b.String()
+			}
+			if strings.HasPrefix(p.s[p.pos:], strings.Repeat(string(quote), 3)) {
+				// up to two more quotes belong to the string
+				n := 3
+				for n < 5 && p.pos+n < len(p.s) && p.s[p.pos+n] == quote {
+					n++
+				}
+				b.WriteString(strings.Repeat(string(quote), n-3))
+				for i := 0; i < n; i++ {
+					p.next()
+				}
+				return b.String()
+			}
+		}
+		if c == '\n' && !multi {
+			p.fail("newline in string")
+		}
+		if c == '\\' && quote == '"' {
+			p.next()
+			p.escape(&b, multi)
+			continue
+		}
+		b.WriteByte(p.next())
+	}
+}
+
+// Handles the escape sequence after a backslash in a basic string
+func (p *tomlParser) escape(b *strings.Builder, multi bool) {
+	if p.eof() {
+		p.fail("unterminated string")
+	}
+	c := p.next()
+	switch c {
+	case 'b':
+		b.WriteByte('\b')
+	case 't':
+		b.WriteByte('\t')
+	case 'n':
+		b.WriteByte('\n')
+	case 'f':
+		b.WriteByte('\f')
+	case 'r':
+		b.WriteByte('\r')
+	case 'e':
+		b.WriteByte(0x1b)
+	case '"', '\\':
+		b.WriteByte(c)
+	case 'u', 'U', 'x':
+		digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[c]
+		if p.pos+digits > len(p.s) {
+			p.fail("invalid escape sequence")
+		}
+		r, err := strconv.ParseUint(p.s[p.pos:p.pos+digits], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			p.fail("invalid escape sequence")
+		}
+		p.pos += digits
+		b.WriteRune(rune(r))
+	case ' ', '\t', '\r', '\n':
+		// line ending backslash: the newline and whitespace after it are
+		// left out
+		if !multi {
+			p.fail("invalid escape sequence")
+		}
+		if c == ' ' || c == '\t' {
+			p.skipSpace()
+			if p.peek() != '\n' && !strings.HasPrefix(p.s[p.pos:], "\r\n") {
+				p.fail("invalid escape sequence")
+			}
+		}
+		p.skipAllSpace()
+	default:
+		p.fail("invalid escape sequence \\%c", c)
+	}
+}
+
+// Skips whitespace and newlines, but not comments
+func (p *tomlParser) skipAllSpace() {
+	for strings.ContainsRune(" \t\r\n", rune(p.peek())) && !p.eof() {
+		p.next()
+	}
+}
+
+// Writes the values of root, the sections are tables
+func writeTOML(root *confNode, header string) string {
+	var b strings.Builder
+	b.WriteString("# " + header + "\n")
+	// plain values first, they would belong to the last table otherwise
+	for _, k := range root.keys {
+		if n := root.fields[k]; !n.isMap {
+			writeTOMLValue(&b, []string{k}, n)
+		}
+	}
+	for _, k := range root.keys {
+		n := root.fields[k]
+		if !n.isMap {
+			continue
+		}
+		b.WriteString("\n[" + tomlKey(k) + "]\n")
+		for _, f := range n.keys {
+			writeTOMLValue(&b, []string{f}, n.fields[f])
+		}
+	}
+	return b.String()
+}
+
+// Writes key = value, tables as dotted keys
+func writeTOMLValue(b *strings.Builder, path []string, n *confNode) {
+	if n.isMap {
+		for _, k := range n.keys {
+			writeTOMLValue(b, appendPath(path, k), n.fields[k])
+		}
+		return
+	}
+	keys := make([]string, len(path))
+	for i, k := range path {
+		keys[i] = tomlKey(k)
+	}
+	b.WriteString(strings.Join(keys, ".") + " = ")
+	if n.isList {
+		values := make([]string, len(n.items))
+		for i, item := range n.items {
+			values[i] = quoteConfigString(item.value)
+		}
+		b.WriteString("[" + strings.Join(values, ", ") + "]\n")
+	} else if n.bare && isBareValue(n.value) {
+		b.WriteString(n.value + "\n")
+	} else {
+		b.WriteString(quoteConfigString(n.value) + "\n")
+	}
+}
+
+// Quotes key if it isn't a bare key
+func tomlKey(key string) string {
+	if key == "" {
+		return `""`
+	}
+	for i := 0; i < len(key); i++ {
+		if !isBareKeyChar(key[i]) {
+			return quoteConfigString(key)
+		}
+	}
+	return key
+}
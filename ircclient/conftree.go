@@ -0,0 +1,369 @@
+package ircclient
+
+// The ConfigBackend for TOML and YAML files (see conftoml.go and
+// confyaml.go). Their tables/mappings at the top are the sections, values
+// at the top go to section DEFAULT. Nested values are flattened into
+// options named by their keys joined with ".", items of lists holding
+// tables get their index as key. Lists of plain values become one option,
+// the values separated by commas (see GetStringSliceOption()):
+//
+//	[Feeds]
+//	channels = ["#mett", "#test"]
+//	[Feeds.heise]
+//	url = "https://heise.de/rss"
+//	[[Feeds.extra]]
+//	url = "https://example.com/feed"
+//
+// gives Feeds/channels "#mett, #test", Feeds/heise.url and
+// Feeds/extra.0.url. Options keep the keys they were read from, so they
+// are written back the same way, except lists of tables, which are written
+// as tables with numbered keys. Comments are lost when writing.
+
+import (
+	"errors"
+	"github.com/robfig/config"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	format_toml = "toml"
+	format_yaml = "yaml"
+)
+
+// Numbers written the same in TOML and YAML
+var bareNumber = regexp.MustCompile(`^[+-]?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+type treeConfig struct {
+	format   string
+	sections []*treeSection
+}
+
+type treeSection struct {
+	name    string
+	options []*treeOption
+}
+
+type treeOption struct {
+	// The keys leading to the value in the file, the option's name is
+	// them joined with "."
+	path  []string
+	value string
+	// The value was a list, written back as one
+	list bool
+	// The value was a number or boolean, written back without quotes
+	bare bool
+}
+
+// A parsed value of a TOML or YAML file
+type confNode struct {
+	// for plain values
+	value string
+	bare  bool
+	// for lists
+	isList bool
+	items  []*confNode
+	// for tables/mappings, keys in order
+	isMap  bool
+	keys   []string
+	fields map[string]*confNode
+}
+
+func newConfMap() *confNode {
+	return &confNode{isMap: true, fields: make(map[string]*confNode)}
+}
+
+// Adds a field to a table, returns false if the key already exists
+func (n *confNode) set(key string, value *confNode) bool {
+	if _, ok := n.fields[key]; ok {
+		return false
+	}
+	n.keys = append(n.keys, key)
+	n.fields[key] = value
+	return true
+}
+
+func newTreeConfig(format string) *treeConfig {
+	c := &treeConfig{format: format}
+	c.AddSection(config.DEFAULT_SECTION)
+	return c
+}
+
+// Reads a TOML or YAML file, depending on format
+func readTreeConfig(filename, format string) (*treeConfig, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var root *confNode
+	if format == format_toml {
+		root, err = parseTOML(string(data))
+	} else {
+		root, err = parseYAML(string(data))
+	}
+	if err != nil {
+		return nil, errors.New(filename + ": " + err.Error())
+	}
+	c := newTreeConfig(format)
+	for _, key := range root.keys {
+		n := root.fields[key]
+		if !n.isMap {
+			c.section(config.DEFAULT_SECTION).flatten([]string{key}, n)
+			continue
+		}
+		c.AddSection(key)
+		s := c.section(key)
+		for _, k := range n.keys {
+			s.flatten([]string{k}, n.fields[k])
+		}
+	}
+	return c, nil
+}
+
+// Adds the values of n as options, named by path
+func (s *treeSection) flatten(path []string, n *confNode) {
+	switch {
+	case n.isMap:
+		for _, k := range n.keys {
+			s.flatten(appendPath(path, k), n.fields[k])
+		}
+	case n.isList:
+		values := make([]string, 0, len(n.items))
+		for _, item := range n.items {
+			if item.isMap || item.isList {
+				values = nil
+				break
+			}
+			values = append(values, item.value)
+		}
+		if values != nil {
+			s.options = append(s.options, &treeOption{path: path, value: strings.Join(values, ", "), list: true})
+			return
+		}
+		for i, item := range n.items {
+			s.flatten(appendPath(path, strconv.Itoa(i)), item)
+		}
+	default:
+		s.options = append(s.options, &treeOption{path: path, value: n.value, bare: n.bare})
+	}
+}
+
+// Returns a copy of path with key added, so the paths of siblings don't
+// share their arrays
+func appendPath(path []string, key string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), key)
+}
+
+func (c *treeConfig) section(name string) *treeSection {
+	for _, s := range c.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+func (s *treeSection) option(name string) *treeOption {
+	for _, o := range s.options {
+		if strings.Join(o.path, ".") == name {
+			return o
+		}
+	}
+	return nil
+}
+
+func (c *treeConfig) Sections() []string {
+	names := make([]string, len(c.sections))
+	for i, s := range c.sections {
+		names[i] = s.name
+	}
+	return names
+}
+
+func (c *treeConfig) HasSection(section string) bool {
+	return c.section(section) != nil
+}
+
+func (c *treeConfig) AddSection(section string) bool {
+	if c.HasSection(section) {
+		return false
+	}
+	c.sections = append(c.sections, &treeSection{name: section})
+	return true
+}
+
+// Like the INI backend, the options of section DEFAULT are included
+func (c *treeConfig) Options(section string) ([]string, error) {
+	s := c.section(section)
+	if s == nil {
+		return nil, errors.New("section not found: " + section)
+	}
+	var names []string
+	seen := make(map[string]bool)
+	for _, sect := range []*treeSection{s, c.section(config.DEFAULT_SECTION)} {
+		for _, o := range sect.options {
+			name := strings.Join(o.path, ".")
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names, nil
+}
+
+func (c *treeConfig) HasOption(section, option string) bool {
+	s := c.section(section)
+	return s != nil && s.option(option) != nil
+}
+
+// Falls back to section DEFAULT, like the INI backend
+func (c *treeConfig) String(section, option string) (string, error) {
+	for _, name := range []string{section, config.DEFAULT_SECTION} {
+		if s := c.section(name); s != nil {
+			if o := s.option(option); o != nil {
+				return o.value, nil
+			}
+		}
+	}
+	return "", errors.New("option not found: " + section + "/" + option)
+}
+
+// Replaces the value of an existing option, keeping the way it's written.
+// Returns false in that case.
+func (c *treeConfig) AddOption(section, option, value string) bool {
+	c.AddSection(section)
+	s := c.section(section)
+	if o := s.option(option); o != nil {
+		o.value = value
+		return false
+	}
+	s.options = append(s.options, &treeOption{path: []string{option}, value: value})
+	return true
+}
+
+func (c *treeConfig) RemoveOption(section, option string) bool {
+	s := c.section(section)
+	if s == nil {
+		return false
+	}
+	for i, o := range s.options {
+		if strings.Join(o.path, ".") == option {
+			s.options = append(s.options[:i], s.options[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (c *treeConfig) WriteFile(filename string, perm os.FileMode, header string) error {
+	root := newConfMap()
+	for _, s := range c.sections {
+		if s.name == config.DEFAULT_SECTION {
+			s.unflatten(root)
+			continue
+		}
+		n := newConfMap()
+		s.unflatten(n)
+		if old, ok := root.fields[s.name]; ok && !old.isMap {
+			// a value of DEFAULT with the same name, can't be both
+			delete(root.fields, s.name)
+			root.keys = removeKey(root.keys, s.name)
+		}
+		root.set(s.name, n)
+	}
+	var out string
+	if c.format == format_toml {
+		out = writeTOML(root, header)
+	} else {
+		out = writeYAML(root, header)
+	}
+	return ioutil.WriteFile(filename, []byte(out), perm)
+}
+
+// Adds the options to the table n, nested as they were read
+func (s *treeSection) unflatten(n *confNode) {
+	for _, o := range s.options {
+		value := &confNode{value: o.value, bare: o.bare}
+		if o.list {
+			value = &confNode{isList: true}
+			for _, v := range splitListValue(o.value) {
+				value.items = append(value.items, &confNode{value: v})
+			}
+		}
+		table := n
+		path := o.path
+		for len(path) > 1 {
+			next, ok := table.fields[path[0]]
+			if !ok {
+				next = newConfMap()
+				table.set(path[0], next)
+			} else if !next.isMap {
+				// e.g. options "a" and "a.b", the rest of the path is
+				// written as one key
+				break
+			}
+			table, path = next, path[1:]
+		}
+		key := strings.Join(path, ".")
+		if old, ok := table.fields[key]; ok {
+			if !old.isMap {
+				// duplicate, replaced
+				table.fields[key] = value
+				continue
+			}
+			// a table of the same name: written as one key, the whole
+			// path in a single string
+			table, key = n, strings.Join(o.path, ".")
+		}
+		table.set(key, value)
+	}
+}
+
+func removeKey(keys []string, key string) []string {
+	for i, k := range keys {
+		if k == key {
+			return append(keys[:i:i], keys[i+1:]...)
+		}
+	}
+	return keys
+}
+
+// Quotes s for a TOML basic or YAML double-quoted string
+func quoteConfigString(s string) string {
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			b.WriteString(`\"`)
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				b.WriteString(`\u00`)
+				b.WriteString(strconv.FormatInt(int64(r)>>4, 16))
+				b.WriteString(strconv.FormatInt(int64(r)&0xf, 16))
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// Returns whether s is a number or boolean that can be written without
+// quotes
+func isBareValue(s string) bool {
+	return s == "true" || s == "false" || bareNumber.MatchString(s)
+}
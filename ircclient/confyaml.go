@@ -0,0 +1,549 @@
+package ircclient
+
+// Reads and writes YAML for the treeConfig backend. Only the part of YAML
+// that config files need is understood: block mappings and sequences,
+// flow mappings and sequences on one line, plain and quoted scalars and
+// literal (|) and folded (>) block scalars. Anchors, aliases, tags and
+// several documents in a file aren't supported.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type yamlLine struct {
+	num    int
+	indent int
+	// without the indentation, comments are removed when parsing
+	text string
+}
+
+type yamlParser struct {
+	lines []*yamlLine
+	pos   int
+}
+
+type yamlError struct {
+	line int
+	msg  string
+}
+
+func (e *yamlError) Error() string {
+	return fmt.Sprintf("line %d: %s", e.line, e.msg)
+}
+
+func parseYAML(s string) (root *confNode, err error) {
+	p := new(yamlParser)
+	for i, l := range strings.Split(strings.Replace(s, "\r\n", "\n", -1), "\n") {
+		text := strings.TrimLeft(l, " ")
+		if strings.HasPrefix(text, "\t") {
+			return nil, &yamlError{i + 1, "tabs can't be used for indentation"}
+		}
+		p.lines = append(p.lines, &yamlLine{num: i + 1, indent: len(l) - len(text), text: text})
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(*yamlError)
+			if !ok {
+				panic(r)
+			}
+			root, err = nil, e
+		}
+	}()
+	// the document start marker may be there
+	if l := p.current(); l != nil && l.indent == 0 && (l.text == "---" || strings.HasPrefix(l.text, "--- ")) {
+		p.pos++
+	}
+	root = newConfMap()
+	if l := p.current(); l != nil {
+		if l.indent != 0 {
+			p.fail(l, "unexpected indentation")
+		}
+		root = p.block(0)
+		if !root.isMap {
+			p.fail(l, "the document must be a mapping")
+		}
+	}
+	if l := p.current(); l != nil && l.text != "..." {
+		p.fail(l, "unexpected text")
+	}
+	return root, nil
+}
+
+func (p *yamlParser) fail(l *yamlLine, format string, args ...interface{}) {
+	panic(&yamlError{l.num, fmt.Sprintf(format, args...)})
+}
+
+// Returns the next line with content, nil at the end
+func (p *yamlParser) current() *yamlLine {
+	for ; p.pos < len(p.lines); p.pos++ {
+		l := p.lines[p.pos]
+		if text := stripYAMLComment(l.text); text != "" {
+			return l
+		}
+	}
+	return nil
+}
+
+// Parses the mapping or sequence starting at the current line
+func (p *yamlParser) block(indent int) *confNode {
+	l := p.current()
+	if isSequenceItem(l.text) {
+		return p.sequence(indent)
+	}
+	return p.mapping(indent)
+}
+
+func isSequenceItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+func (p *yamlParser) mapping(indent int) *confNode {
+	n := newConfMap()
+	for {
+		l := p.current()
+		if l == nil || l.indent < indent {
+			return n
+		}
+		if l.indent > indent {
+			p.fail(l, "unexpected indentation")
+		}
+		if isSequenceItem(l.text) {
+			p.fail(l, "expected a key, not a sequence item")
+		}
+		text := stripYAMLComment(l.text)
+		colon := mappingColon(text)
+		if colon < 0 {
+			if l.text == "..." || l.text == "---" {
+				return n
+			}
+			p.fail(l, "expected key: value")
+		}
+		keyText := strings.TrimSpace(text[:colon])
+		if keyText == "" {
+			p.fail(l, "empty key")
+		}
+		key := p.scalar(l, keyText).value
+		rest := strings.TrimSpace(text[colon+1:])
+		p.pos++
+		if !n.set(key, p.value(l, indent, rest, true)) {
+			p.fail(l, "key %s defined twice", key)
+		}
+	}
+}
+
+func (p *yamlParser) sequence(indent int) *confNode {
+	n := &confNode{isList: true}
+	for {
+		l := p.current()
+		if l == nil || l.indent < indent || !isSequenceItem(l.text) {
+			return n
+		}
+		if l.indent > indent {
+			p.fail(l, "unexpected indentation")
+		}
+		rest := strings.TrimLeft(l.text[1:], " ")
+		if rest != "" && stripYAMLComment(rest) != "" && (mappingColon(stripYAMLComment(rest)) >= 0 || isSequenceItem(rest)) {
+			// "- key: value", the mapping (or sequence) continues on the
+			// following lines with the indentation of key
+			l.indent += len(l.text) - len(rest)
+			l.text = rest
+			n.items = append(n.items, p.block(l.indent))
+			continue
+		}
+		p.pos++
+		n.items = append(n.items, p.value(l, indent, stripYAMLComment(rest), false))
+	}
+}
+
+// Parses the value after "key:" or "-" on line l, the text after it is
+// rest. Mapping values may be nested blocks on the following lines.
+func (p *yamlParser) value(l *yamlLine, indent int, rest string, inMapping bool) *confNode {
+	switch {
+	case rest == "":
+		next := p.current()
+		if next != nil && next.indent > indent {
+			return p.block(next.indent)
+		}
+		if next != nil && inMapping && next.indent == indent && isSequenceItem(next.text) {
+			// sequences in mappings needn't be indented
+			return p.sequence(indent)
+		}
+		// null
+		return &confNode{}
+	case rest[0] == '|' || rest[0] == '>':
+		return p.blockScalar(l, indent, rest)
+	}
+	return p.flow(l, rest)
+}
+
+// Parses a literal or folded block scalar, header is "|" or ">" with
+// chomping indicator
+func (p *yamlParser) blockScalar(l *yamlLine, indent int, header string) *confNode {
+	folded := header[0] == '>'
+	chomp := header[1:]
+	if chomp != "" && chomp != "-" && chomp != "+" {
+		p.fail(l, "unsupported block scalar header %s", header)
+	}
+	var lines []string
+	contentIndent := -1
+	for ; p.pos < len(p.lines); p.pos++ {
+		next := p.lines[p.pos]
+		if next.text == "" {
+			lines = append(lines, "")
+			continue
+		}
+		if next.indent <= indent {
+			break
+		}
+		if contentIndent < 0 {
+			contentIndent = next.indent
+		}
+		if next.indent < contentIndent {
+			p.fail(next, "block scalar less indented than its first line")
+		}
+		lines = append(lines, strings.Repeat(" ", next.indent-contentIndent)+next.text)
+	}
+	// trailing empty lines are subject to chomping
+	trailing := 0
+	for len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+		trailing++
+	}
+	var b strings.Builder
+	for i, line := range lines {
+		switch {
+		case i == 0:
+		case !folded || line == "" || lines[i-1] == "" || strings.HasPrefix(line, " ") || strings.HasPrefix(lines[i-1], " "):
+			b.WriteByte('\n')
+		default:
+			b.WriteByte(' ')
+		}
+		b.WriteString(line)
+	}
+	value := b.String()
+	if len(lines) > 0 {
+		switch chomp {
+		case "":
+			value += "\n"
+		case "+":
+			value += strings.Repeat("\n", trailing+1)
+		}
+	}
+	return &confNode{value: value}
+}
+
+// Parses a flow collection or scalar on one line
+func (p *yamlParser) flow(l *yamlLine, text string) *confNode {
+	if text[0] != '[' && text[0] != '{' {
+		return p.scalar(l, text)
+	}
+	f := &yamlFlow{p: p, l: l, s: text}
+	n := f.value()
+	f.skipSpace()
+	if f.pos < len(f.s) {
+		p.fail(l, "unexpected text after %c", text[0])
+	}
+	return n
+}
+
+// Parses a plain or quoted scalar
+func (p *yamlParser) scalar(l *yamlLine, text string) *confNode {
+	if text == "" {
+		// null
+		return &confNode{}
+	}
+	switch text[0] {
+	case '"', '\'':
+		value, end, err := unquoteYAML(text)
+		if err != nil {
+			p.fail(l, "%v", err)
+		}
+		if strings.TrimSpace(text[end:]) != "" {
+			p.fail(l, "unexpected text after quoted string")
+		}
+		return &confNode{value: value}
+	case '&', '*', '!':
+		p.fail(l, "anchors, aliases and tags aren't supported")
+	case '|', '>', '%', '@', '`':
+		p.fail(l, "unexpected %c", text[0])
+	}
+	switch text {
+	case "~", "null", "Null", "NULL":
+		return &confNode{}
+	case "true", "True", "TRUE":
+		return &confNode{value: "true", bare: true}
+	case "false", "False", "FALSE":
+		return &confNode{value: "false", bare: true}
+	}
+	if bareNumber.MatchString(text) {
+		return &confNode{value: text, bare: true}
+	}
+	return &confNode{value: text}
+}
+
+// Returns the position of the colon after the key of "key: value" or
+// "key:", -1 if text isn't like that
+func mappingColon(text string) int {
+	start := 0
+	if text != "" && (text[0] == '"' || text[0] == '\'') {
+		_, end, err := unquoteYAML(text)
+		if err != nil {
+			return -1
+		}
+		start = end
+	} else if text != "" && (text[0] == '[' || text[0] == '{') {
+		return -1
+	}
+	for i := start; i < len(text); i++ {
+		if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+			return i
+		}
+	}
+	return -1
+}
+
+// Removes a comment, i.e. # at the start or after a space, outside of
+// quotes
+func stripYAMLComment(text string) string {
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case quote == '\'' && c == '\'':
+			quote = 0
+		case quote == '"' && c == '\\':
+			i++
+		case quote == '"' && c == '"':
+			quote = 0
+		case quote != 0:
+		case (c == '"' || c == '\'') && (i == 0 || strings.IndexByte(" [{,:", text[i-1]) >= 0):
+			quote = c
+		case c == '#' && (i == 0 || text[i-1] == ' '):
+			return strings.TrimRight(text[:i], " ")
+		}
+	}
+	return strings.TrimRight(text, " ")
+}
+
+// Unquotes the single- or double-quoted string at the start of text,
+// returns the position after it
+func unquoteYAML(text string) (string, int, error) {
+	quote := text[0]
+	var b strings.Builder
+	for i := 1; i < len(text); i++ {
+		c := text[i]
+		switch {
+		case c == quote && quote == '\'' && i+1 < len(text) && text[i+1] == '\'':
+			b.WriteByte('\'')
+			i++
+		case c == quote:
+			return b.String(), i + 1, nil
+		case c == '\\' && quote == '"':
+			i++
+			if i == len(text) {
+				break
+			}
+			switch e := text[i]; e {
+			case '0':
+				b.WriteByte(0)
+			case 'a':
+				b.WriteByte('\a')
+			case 'b':
+				b.WriteByte('\b')
+			case 't':
+				b.WriteByte('\t')
+			case 'n':
+				b.WriteByte('\n')
+			case 'v':
+				b.WriteByte('\v')
+			case 'f':
+				b.WriteByte('\f')
+			case 'r':
+				b.WriteByte('\r')
+			case 'e':
+				b.WriteByte(0x1b)
+			case ' ', '"', '/', '\\':
+				b.WriteByte(e)
+			case 'x', 'u', 'U':
+				digits := map[byte]int{'x': 2, 'u': 4, 'U': 8}[e]
+				if i+digits >= len(text) {
+					return "", 0, fmt.Errorf("invalid escape sequence \\%c", e)
+				}
+				r, err := strconv.ParseUint(text[i+1:i+1+digits], 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", 0, fmt.Errorf("invalid escape sequence \\%c", e)
+				}
+				b.WriteRune(rune(r))
+				i += digits
+			default:
+				return "", 0, fmt.Errorf("invalid escape sequence \\%c", e)
+			}
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return "", 0, fmt.Errorf("unterminated string, quoted strings can't span lines")
+}
+
+// Parses [a, b] and {a: b}
+type yamlFlow struct {
+	p   *yamlParser
+	l   *yamlLine
+	s   string
+	pos int
+}
+
+func (f *yamlFlow) skipSpace() {
+	for f.pos < len(f.s) && f.s[f.pos] == ' ' {
+		f.pos++
+	}
+}
+
+func (f *yamlFlow) expect(c byte) {
+	f.skipSpace()
+	if f.pos >= len(f.s) || f.s[f.pos] != c {
+		f.p.fail(f.l, "expected %c", c)
+	}
+	f.pos++
+}
+
+func (f *yamlFlow) value() *confNode {
+	f.skipSpace()
+	if f.pos >= len(f.s) {
+		f.p.fail(f.l, "unexpected end of line")
+	}
+	switch f.s[f.pos] {
+	case '[':
+		n := &confNode{isList: true}
+		f.pos++
+		for !f.end(']') {
+			n.items = append(n.items, f.value())
+			f.separator(']')
+		}
+		return n
+	case '{':
+		n := newConfMap()
+		f.pos++
+		for !f.end('}') {
+			key := f.scalar(true).value
+			f.expect(':')
+			if !n.set(key, f.value()) {
+				f.p.fail(f.l, "key %s defined twice", key)
+			}
+			f.separator('}')
+		}
+		return n
+	}
+	return f.scalar(false)
+}
+
+// Returns true and skips the closing bracket if it follows
+func (f *yamlFlow) end(c byte) bool {
+	f.skipSpace()
+	if f.pos < len(f.s) && f.s[f.pos] == c {
+		f.pos++
+		return true
+	}
+	return false
+}
+
+// Expects a comma or the closing bracket (which is left)
+func (f *yamlFlow) separator(c byte) {
+	f.skipSpace()
+	if f.pos < len(f.s) && f.s[f.pos] == ',' {
+		f.pos++
+		return
+	}
+	if f.pos >= len(f.s) || f.s[f.pos] != c {
+		f.p.fail(f.l, "expected , or %c", c)
+	}
+}
+
+func (f *yamlFlow) scalar(key bool) *confNode {
+	f.skipSpace()
+	if f.pos < len(f.s) && (f.s[f.pos] == '"' || f.s[f.pos] == '\'') {
+		value, end, err := unquoteYAML(f.s[f.pos:])
+		if err != nil {
+			f.p.fail(f.l, "%v", err)
+		}
+		f.pos += end
+		return &confNode{value: value}
+	}
+	start := f.pos
+	for f.pos < len(f.s) && strings.IndexByte(",[]{}", f.s[f.pos]) < 0 {
+		if key && f.s[f.pos] == ':' && (f.pos+1 == len(f.s) || f.s[f.pos+1] == ' ') {
+			break
+		}
+		f.pos++
+	}
+	text := strings.TrimSpace(f.s[start:f.pos])
+	if text == "" {
+		f.p.fail(f.l, "expected a value")
+	}
+	return f.p.scalar(f.l, text)
+}
+
+// Writes the values of root as block mapping
+func writeYAML(root *confNode, header string) string {
+	var b strings.Builder
+	b.WriteString("# " + header + "\n")
+	for i, k := range root.keys {
+		n := root.fields[k]
+		if n.isMap && i > 0 {
+			// sections separated by an empty line
+			b.WriteByte('\n')
+		}
+		writeYAMLValue(&b, 0, k, n)
+	}
+	return b.String()
+}
+
+func writeYAMLValue(b *strings.Builder, indent int, key string, n *confNode) {
+	prefix := strings.Repeat(" ", indent) + yamlString(key, false) + ":"
+	switch {
+	case n.isMap:
+		if len(n.keys) == 0 {
+			b.WriteString(prefix + " {}\n")
+			return
+		}
+		b.WriteString(prefix + "\n")
+		for _, k := range n.keys {
+			writeYAMLValue(b, indent+2, k, n.fields[k])
+		}
+	case n.isList:
+		if len(n.items) == 0 {
+			b.WriteString(prefix + " []\n")
+			return
+		}
+		b.WriteString(prefix + "\n")
+		for _, item := range n.items {
+			b.WriteString(strings.Repeat(" ", indent+2) + "- " + yamlString(item.value, false) + "\n")
+		}
+	default:
+		b.WriteString(prefix + " " + yamlString(n.value, n.bare) + "\n")
+	}
+}
+
+// Returns s as plain scalar if that's possible, quoted otherwise. Numbers
+// and booleans are quoted unless bare is set.
+func yamlString(s string, bare bool) string {
+	if isBareValue(s) {
+		if bare {
+			return s
+		}
+		return quoteConfigString(s)
+	}
+	if s == "" || s != strings.TrimSpace(s) || strings.IndexByte("-?:,[]{}#&*!|>'\"%@`~", s[0]) >= 0 ||
+		strings.Contains(s, ": ") || strings.Contains(s, " #") || strings.HasSuffix(s, ":") ||
+		strings.ContainsAny(s, "\n\t\r\"\\") || !utf8.ValidString(s) {
+		return quoteConfigString(s)
+	}
+	switch strings.ToLower(s) {
+	case "null", "true", "false", "yes", "no", "on", "off", ".inf", "-.inf", ".nan":
+		return quoteConfigString(s)
+	}
+	return s
+}
@@ -0,0 +1,73 @@
+package ircclient
+
+// Cooldowns of command handlers, see HandlerOpts. Users are identified by
+// user@host, so changing the nick doesn't reset their cooldown.
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// Expired buckets are removed once there are this many
+const cooldown_prune = 1000
+
+type cooldowns struct {
+	// "<command> user <user@host>" or "<command> channel <channel>" -> end
+	// of the cooldown
+	until map[string]time.Time
+	sync.Mutex
+}
+
+// Returns how long c has to wait because of the cooldowns of h, or 0 if it
+// may be dispatched, in which case the cooldowns start over
+func (ic *IRCClient) cooldown(h handler, c *IRCCommand) time.Duration {
+	if h.Cooldown <= 0 && h.ChannelCooldown <= 0 {
+		return 0
+	}
+	// bucket -> its cooldown
+	buckets := make(map[string]time.Duration)
+	if h.Cooldown > 0 {
+		user := c.Source
+		if i := strings.Index(user, "!"); i >= 0 {
+			user = user[i+1:]
+		}
+		buckets[h.Command+" user "+strings.ToLower(user)] = h.Cooldown
+	}
+	if h.ChannelCooldown > 0 && ic.IsChannelName(c.Target) {
+		buckets[h.Command+" channel "+ic.CanonChannel(c.Target)] = h.ChannelCooldown
+	}
+
+	now := time.Now()
+	cd := &ic.cooldowns
+	cd.Lock()
+	defer cd.Unlock()
+	var wait time.Duration
+	for key := range buckets {
+		if left := cd.until[key].Sub(now); left > wait {
+			wait = left
+		}
+	}
+	if wait > 0 {
+		return wait
+	}
+	if cd.until == nil || len(cd.until) >= cooldown_prune {
+		cd.prune(now)
+	}
+	for key, d := range buckets {
+		cd.until[key] = now.Add(d)
+	}
+	return 0
+}
+
+// Removes the expired buckets. Must be called with the lock held.
+func (cd *cooldowns) prune(now time.Time) {
+	if cd.until == nil {
+		cd.until = make(map[string]time.Time)
+	}
+	for key, until := range cd.until {
+		if !until.After(now) {
+			delete(cd.until, key)
+		}
+	}
+}
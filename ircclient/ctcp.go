@@ -0,0 +1,225 @@
+package ircclient
+
+// CTCP (client-to-client protocol) messages are PRIVMSGs (requests) and
+// NOTICEs (replies) whose text is wrapped in \x01, e.g. "\x01VERSION\x01".
+// The ctcp plugin answers VERSION, PING, TIME, CLIENTINFO and SOURCE.
+// Replies are configured in section CTCP of the config file:
+//  - version (default "MettBot", followed by Info/version if that is set)
+//  - source (where to get the bot's code, SOURCE isn't answered without it)
+//  - any other CTCP command in lower case, answered with the option's value
+//    (e.g. finger)
+// Setting an option to "off" disables the reply, e.g. time = off.
+// All CTCP messages except ACTION are published as "CTCP" with a
+// *CTCPEvent; ACTIONs are published as messages, see MessageEvent.
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// At most this many CTCP replies are sent per ctcp_window, so CTCP floods
+// can't get the bot killed for flooding
+const (
+	ctcp_max_replies = 3
+	ctcp_window      = 10 * time.Second
+)
+
+const default_ctcp_version = "MettBot"
+
+// Published as "CTCP" for CTCP requests and replies other than ACTION
+type CTCPEvent struct {
+	Event
+	// Channel or our nick
+	Target string
+	// The CTCP command in upper case, e.g. "VERSION", and its parameters
+	Command string
+	Params  string
+	// Sent as NOTICE, i.e. a reply to one of our requests
+	Reply bool
+	// Sent to us instead of a channel
+	Private bool
+}
+
+// Returns the CTCP command (in upper case) and parameters of the message.
+// ok is false unless it's a PRIVMSG or NOTICE carrying a CTCP message.
+func (m *IRCMessage) CTCP() (command, params string, ok bool) {
+	if (m.Command != "PRIVMSG" && m.Command != "NOTICE") || len(m.Args) == 0 {
+		return "", "", false
+	}
+	text := m.Args[0]
+	if len(text) < 2 || text[0] != '\x01' {
+		return "", "", false
+	}
+	// the closing \x01 is optional
+	text = strings.TrimSuffix(text[1:], "\x01")
+	kv := strings.SplitN(text, " ", 2)
+	if kv[0] == "" {
+		return "", "", false
+	}
+	if len(kv) == 2 {
+		params = kv[1]
+	}
+	return strings.ToUpper(kv[0]), params, true
+}
+
+// Returns whether the message is an action ("/me")
+func (m *IRCMessage) IsAction() bool {
+	command, _, ok := m.CTCP()
+	return ok && m.Command == "PRIVMSG" && command == "ACTION"
+}
+
+// Sends the CTCP request command (e.g. "VERSION") with params (may be
+// empty) to target. Replies are published as "CTCP" events.
+func (ic *IRCClient) SendCTCP(target, command, params string) error {
+	return ic.sendCTCPMessage("PRIVMSG", target, command, params)
+}
+
+// Sends the reply to CTCP request command to target
+func (ic *IRCClient) SendCTCPReply(target, command, params string) error {
+	return ic.sendCTCPMessage("NOTICE", target, command, params)
+}
+
+func (ic *IRCClient) sendCTCPMessage(kind, target, command, params string) error {
+	if err := checkParam("CTCP command", command); err != nil {
+		return err
+	}
+	if strings.IndexByte(command, '\x01') >= 0 {
+		return errors.New("invalid CTCP command " + command)
+	}
+	command = strings.ToUpper(command)
+	if params == "" {
+		if err := checkParam("target", target); err != nil {
+			return err
+		}
+		return ic.SendLine(kind + " " + target + " :\x01" + command + "\x01")
+	}
+	return ic.sendCTCP(kind, target, command, strings.Replace(params, "\x01", "", -1))
+}
+
+type ctcpPlugin struct {
+	ic *IRCClient
+	// Times of the replies sent within the last ctcp_window
+	sent []time.Time
+	sync.Mutex
+}
+
+func (cp *ctcpPlugin) Register(cl *IRCClient) {
+	cp.ic = cl
+}
+
+func (cp *ctcpPlugin) String() string {
+	return "ctcp"
+}
+
+func (cp *ctcpPlugin) Info() string {
+	return "answers CTCP requests like VERSION and PING"
+}
+
+func (cp *ctcpPlugin) Usage(cmd string) string {
+	// stub, no commands here
+	return ""
+}
+
+func (cp *ctcpPlugin) ProcessCommand(cmd *IRCCommand) {
+}
+
+func (cp *ctcpPlugin) Unregister() {
+}
+
+func (cp *ctcpPlugin) OnReconnectReset() {
+}
+
+func (cp *ctcpPlugin) ProcessLine(msg *IRCMessage) {
+	// Never answer replies, that's how bots loop
+	if msg.Command != "PRIVMSG" || !strings.Contains(msg.Source, "!") {
+		return
+	}
+	command, params, ok := msg.CTCP()
+	if !ok || command == "ACTION" {
+		return
+	}
+	reply, ok := cp.reply(command, params)
+	if !ok {
+		logDebugf("not answering CTCP %s from %s", command, msg.Source)
+		return
+	}
+	if !cp.allow(time.Now()) {
+		logInfof("too many CTCP requests, not answering %s from %s", command, msg.Source)
+		return
+	}
+	nick, _, _ := ParseSource(msg.Source)
+	if err := cp.ic.SendCTCPReply(nick, command, reply); err != nil {
+		logWarnf("unable to answer CTCP %s: %v", command, err)
+	}
+}
+
+// Returns the reply to the CTCP request command, ok is false if it isn't
+// answered
+func (cp *ctcpPlugin) reply(command, params string) (reply string, ok bool) {
+	option := cp.ic.GetStringOption("CTCP", strings.ToLower(command))
+	if option == "off" {
+		return "", false
+	}
+	switch command {
+	case "VERSION":
+		if option != "" {
+			return option, true
+		}
+		if version := cp.ic.GetStringOption("Info", "version"); version != "" {
+			return default_ctcp_version + " " + version, true
+		}
+		return default_ctcp_version, true
+	case "PING":
+		return params, true
+	case "TIME":
+		return time.Now().Format(time.RFC1123Z), true
+	case "CLIENTINFO":
+		return strings.Join(cp.supported(), " "), true
+	}
+	// SOURCE and anything else only if configured
+	return option, option != ""
+}
+
+// Returns the CTCP commands that are answered, sorted
+func (cp *ctcpPlugin) supported() []string {
+	seen := map[string]bool{"ACTION": true, "CLIENTINFO": true}
+	candidates := []string{"PING", "SOURCE", "TIME", "VERSION"}
+	for _, option := range cp.ic.GetOptions("CTCP") {
+		candidates = append(candidates, strings.ToUpper(option))
+	}
+	for _, c := range candidates {
+		if seen[c] {
+			continue
+		}
+		if _, ok := cp.reply(c, ""); ok {
+			seen[c] = true
+		}
+	}
+	commands := make([]string, 0, len(seen))
+	for c := range seen {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+	return commands
+}
+
+// Returns whether another reply may be sent at now, and records it if so
+func (cp *ctcpPlugin) allow(now time.Time) bool {
+	cp.Lock()
+	defer cp.Unlock()
+	recent := cp.sent[:0]
+	for _, t := range cp.sent {
+		if now.Sub(t) < ctcp_window {
+			recent = append(recent, t)
+		}
+	}
+	cp.sent = recent
+	if len(cp.sent) >= ctcp_max_replies {
+		return false
+	}
+	cp.sent = append(cp.sent, now)
+	return true
+}
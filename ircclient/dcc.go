@@ -0,0 +1,614 @@
+package ircclient
+
+// DCC (direct client-to-client) connections bypass the IRC server:
+//  - DCC CHAT is a console for admins off-channel. Every line is handled
+//    like a command sent to the bot in query (the trigger is optional), the
+//    replies are sent back over the chat.
+//  - DCC SEND ships files, e.g. logs, to users. Files sent to the bot are
+//    refused.
+// Offers work actively (the offering side listens, the other one connects)
+// and passively (port 0 and a token in the offer, the other side listens and
+// answers with its address), for whichever side is behind NAT. Options in
+// section DCC of the config file:
+//  - ip (the address announced in offers, by default the local address of
+//    the connection to the server, which is wrong behind NAT)
+//  - ports (the range to listen on, e.g. 50000-50010, any port by default)
+//  - passive ("true" to make passive offers)
+//  - ratelimit (KiB/s per file transfer, unlimited by default)
+//  - minaccess (access level needed for chats and the dcc command, 400 by
+//    default)
+//  - senddir (the directory the dcc send command sends files from)
+//  - timeout (how long to wait for the other side, e.g. 2m, plain numbers
+//    are seconds, 60 by default)
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Used if DCC/timeout is invalid
+	default_dcc_timeout = 60 * time.Second
+	// Bytes of a file written at once
+	dcc_chunk_size = 4096
+	// Longest line accepted in a chat
+	dcc_max_line = 4096
+)
+
+// The options of section DCC
+type dccConfig struct {
+	IP        string        `config:"ip"`
+	Ports     string        `config:"ports"`
+	Passive   bool          `config:"passive"`
+	RateLimit int           `config:"ratelimit"`
+	MinAccess int           `config:"minaccess" default:"400"`
+	SendDir   string        `config:"senddir"`
+	Timeout   time.Duration `config:"timeout" default:"60"`
+}
+
+func (c *dccConfig) Validate() error {
+	if c.Timeout <= 0 {
+		return fmt.Errorf("timeout must be positive, not %v", c.Timeout)
+	}
+	if c.RateLimit < 0 {
+		return fmt.Errorf("ratelimit must not be negative, not %d", c.RateLimit)
+	}
+	return nil
+}
+
+// An open chat or file transfer
+type dccSession struct {
+	id int
+	// "CHAT" or "SEND <file>"
+	kind    string
+	nick    string
+	conn    net.Conn
+	started time.Time
+	// Lines written to chats may come from several commands at once
+	writeLock sync.Mutex
+}
+
+// Writes message to the chat, a line per line of message
+func (s *dccSession) writeLine(message string) {
+	s.writeLock.Lock()
+	defer s.writeLock.Unlock()
+	s.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	for _, line := range strings.Split(strings.Replace(message, "\r", "", -1), "\n") {
+		if _, err := io.WriteString(s.conn, line+"\n"); err != nil {
+			logDebugf("DCC %s with %s: %v", s.kind, s.nick, err)
+			return
+		}
+	}
+}
+
+// A passive offer waiting for the other side's address
+type dccOffer struct {
+	nick  string
+	start func(conn net.Conn)
+	timer *time.Timer
+}
+
+type dccPlugin struct {
+	ic *IRCClient
+	// Passive offers by token
+	pending map[string]*dccOffer
+	// Listeners of active offers, closed on Unregister()
+	listeners map[net.Listener]bool
+	sessions  map[int]*dccSession
+	nextID    int
+	sync.Mutex
+}
+
+func (d *dccPlugin) Register(cl *IRCClient) {
+	d.ic = cl
+	d.pending = make(map[string]*dccOffer)
+	d.listeners = make(map[net.Listener]bool)
+	d.sessions = make(map[int]*dccSession)
+	cl.RegisterCommandHandler("dcc", 1, d.config().MinAccess, d)
+}
+
+func (d *dccPlugin) String() string {
+	return "dcc"
+}
+
+func (d *dccPlugin) Info() string {
+	return "DCC chats and file transfers"
+}
+
+func (d *dccPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "dcc":
+		return "dcc chat|send <file>|list: offers you a DCC chat with the bot, sends you a file from the DCC directory or lists the open DCC connections"
+	}
+	return ""
+}
+
+func (d *dccPlugin) Unregister() {
+	d.Lock()
+	defer d.Unlock()
+	for token, o := range d.pending {
+		o.timer.Stop()
+		delete(d.pending, token)
+	}
+	for l := range d.listeners {
+		l.Close()
+	}
+	for _, s := range d.sessions {
+		s.conn.Close()
+	}
+}
+
+func (d *dccPlugin) ProcessCommand(cmd *IRCCommand) {
+	nick, _, _ := ParseSource(cmd.Source)
+	switch cmd.Args[0] {
+	case "chat":
+		if cmd.dcc != nil {
+			d.ic.Reply(cmd, "You are in a DCC chat already.")
+			return
+		}
+		if err := d.ic.OfferDCCChat(cmd.Source, cmd.Account); err != nil {
+			d.ic.Reply(cmd, "Unable to offer a DCC chat: "+err.Error())
+		}
+	case "send":
+		if len(cmd.Args) < 2 {
+			d.ic.Reply(cmd, d.Usage("dcc"))
+			return
+		}
+		dir := d.config().SendDir
+		name := cmd.Args[1]
+		if dir == "" {
+			d.ic.Reply(cmd, "No DCC directory configured.")
+			return
+		}
+		if name != filepath.Base(name) || name == "." || name == ".." {
+			d.ic.Reply(cmd, "Invalid file name: "+name)
+			return
+		}
+		if err := d.ic.SendFile(nick, filepath.Join(dir, name)); err != nil {
+			d.ic.Reply(cmd, "Unable to send "+name+": "+err.Error())
+		}
+	case "list":
+		d.Lock()
+		var list []string
+		for _, s := range d.sessions {
+			list = append(list, fmt.Sprintf("#%d %s with %s since %s", s.id, s.kind, s.nick, s.started.Format("15:04")))
+		}
+		d.Unlock()
+		if len(list) == 0 {
+			d.ic.Reply(cmd, "No open DCC connections.")
+			return
+		}
+		sort.Strings(list)
+		d.ic.Reply(cmd, strings.Join(list, ", "))
+	default:
+		d.ic.Reply(cmd, d.Usage("dcc"))
+	}
+}
+
+// Handles DCC offers from users and the answers to our passive offers
+func (d *dccPlugin) ProcessLine(msg *IRCMessage) {
+	if msg.Command != "PRIVMSG" || !strings.Contains(msg.Source, "!") {
+		return
+	}
+	command, params, ok := msg.CTCP()
+	if !ok || command != "DCC" {
+		return
+	}
+	nick, _, _ := ParseSource(msg.Source)
+	fields := dccFields(params)
+	if len(fields) < 4 {
+		logInfof("invalid DCC request from %s: %q", msg.Source, params)
+		return
+	}
+	typ, ip, port := strings.ToUpper(fields[0]), fields[2], fields[3]
+	var token string
+	switch {
+	case typ == "CHAT" && len(fields) >= 5:
+		token = fields[4]
+	case typ == "SEND" && len(fields) >= 6:
+		token = fields[5]
+	}
+
+	// the answer to one of our passive offers
+	if token != "" && port != "0" {
+		d.Lock()
+		o, ok := d.pending[token]
+		if ok && d.ic.CanonNick(o.nick) == d.ic.CanonNick(nick) {
+			o.timer.Stop()
+			delete(d.pending, token)
+		} else {
+			ok = false
+		}
+		d.Unlock()
+		if !ok {
+			logInfof("DCC %s from %s doesn't answer any of our offers", typ, msg.Source)
+			return
+		}
+		go d.connect(ip, port, o.start)
+		return
+	}
+
+	account, _ := msg.Account()
+	switch {
+	case typ != "CHAT":
+		logInfof("refusing DCC %s from %s", typ, msg.Source)
+	case !d.allowed(msg.Source, account):
+		logInfof("refusing DCC CHAT from %s: access level below %d", msg.Source, d.config().MinAccess)
+	case port == "0" && token != "":
+		// the user is behind NAT, we listen
+		chat := func(conn net.Conn) { d.chat(conn, msg.Source, account) }
+		if err := d.listenFor(nick, "CHAT chat", "", token, chat); err != nil {
+			logWarnf("unable to accept DCC CHAT from %s: %v", msg.Source, err)
+		}
+	default:
+		go d.connect(ip, port, func(conn net.Conn) { d.chat(conn, msg.Source, account) })
+	}
+}
+
+// Offers a DCC chat to the user with the hostmask source, logged in to
+// account (may be empty). The user needs the access level DCC/minaccess.
+func (ic *IRCClient) OfferDCCChat(source, account string) error {
+	d, ok := ic.GetPlugin("dcc").(*dccPlugin)
+	if !ok {
+		return errors.New("DCC is not available")
+	}
+	if !d.allowed(source, account) {
+		return fmt.Errorf("access level below %d", d.config().MinAccess)
+	}
+	nick, _, _ := ParseSource(source)
+	return d.offer(nick, "CHAT chat", "", func(conn net.Conn) { d.chat(conn, source, account) })
+}
+
+// Offers the file at path to nick by DCC SEND. The transfer itself runs in
+// the background, at most at DCC/ratelimit KiB/s.
+func (ic *IRCClient) SendFile(nick, path string) error {
+	d, ok := ic.GetPlugin("dcc").(*dccPlugin)
+	if !ok {
+		return errors.New("DCC is not available")
+	}
+	if err := checkParam("nick", nick); err != nil {
+		return err
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !fi.Mode().IsRegular() {
+		return errors.New(path + " is not a file")
+	}
+	// clients disagree on quoting, so there are no spaces
+	name := strings.Replace(filepath.Base(path), " ", "_", -1)
+	return d.offer(nick, "SEND "+name, strconv.FormatInt(fi.Size(), 10), func(conn net.Conn) {
+		d.sendFile(conn, nick, path, name, fi.Size())
+	})
+}
+
+// Makes an offer to nick, either active or passive depending on
+// DCC/passive. what is the type and argument (e.g. "CHAT chat"), size the
+// file size for SEND. start is called with the connection once it's there.
+func (d *dccPlugin) offer(nick, what, size string, start func(conn net.Conn)) error {
+	if !d.config().Passive {
+		return d.listenFor(nick, what, size, "", start)
+	}
+	token := dccToken()
+	ip := "0"
+	if addr, err := d.address(); err == nil {
+		ip = addr
+	}
+	d.Lock()
+	d.pending[token] = &dccOffer{nick: nick, start: start, timer: time.AfterFunc(d.timeout(), func() {
+		d.Lock()
+		delete(d.pending, token)
+		d.Unlock()
+		logInfof("DCC %s offer to %s timed out", what, nick)
+	})}
+	d.Unlock()
+	return d.ic.SendCTCP(nick, "DCC", strings.Join(nonEmpty(what, ip, "0", size, token), " "))
+}
+
+// Listens for nick to connect and sends the address to nick, with token if
+// it's the answer to a passive offer
+func (d *dccPlugin) listenFor(nick, what, size, token string, start func(conn net.Conn)) error {
+	ip, err := d.address()
+	if err != nil {
+		return err
+	}
+	l, err := d.listen()
+	if err != nil {
+		return err
+	}
+	d.Lock()
+	d.listeners[l] = true
+	d.Unlock()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	if err := d.ic.SendCTCP(nick, "DCC", strings.Join(nonEmpty(what, ip, port, size, token), " ")); err != nil {
+		d.closeListener(l)
+		return err
+	}
+	go func() {
+		// only the first connection is accepted
+		l.(*net.TCPListener).SetDeadline(time.Now().Add(d.timeout()))
+		conn, err := l.Accept()
+		d.closeListener(l)
+		if err != nil {
+			logInfof("DCC %s to %s not accepted: %v", what, nick, err)
+			return
+		}
+		start(conn)
+	}()
+	return nil
+}
+
+func (d *dccPlugin) closeListener(l net.Listener) {
+	l.Close()
+	d.Lock()
+	delete(d.listeners, l)
+	d.Unlock()
+}
+
+// Connects to the address from an offer and calls start with the
+// connection
+func (d *dccPlugin) connect(ip, port string, start func(conn net.Conn)) {
+	addr, err := parseDCCAddress(ip, port)
+	if err != nil {
+		logInfof("invalid DCC address: %v", err)
+		return
+	}
+	conn, err := net.DialTimeout("tcp", addr, d.timeout())
+	if err != nil {
+		logInfof("DCC connection to %s failed: %v", addr, err)
+		return
+	}
+	start(conn)
+}
+
+// Runs a chat until the connection is closed or the user loses access
+func (d *dccPlugin) chat(conn net.Conn, source, account string) {
+	nick, _, _ := ParseSource(source)
+	s := d.add("CHAT", nick, conn)
+	defer d.remove(s)
+	s.writeLine("Connected to " + d.ic.GetStringOption("Server", "nick") + ", commands work with or without the trigger.")
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 512), dcc_max_line)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !d.allowed(source, account) {
+			s.writeLine("Your access level is too low now, bye.")
+			return
+		}
+		msg := &IRCMessage{Source: source, Target: d.ic.GetStringOption("Server", "nick"), Command: "PRIVMSG", Args: []string{strings.TrimPrefix(line, d.ic.Trigger())}, Complete: line, Network: d.ic.network, received: time.Now()}
+		if account != "" {
+			msg.Tags = map[string]string{"account": account}
+		}
+		c := ParseCommand(msg)
+		if c == nil || c.Command == "" {
+			continue
+		}
+		c.dcc = s
+		d.ic.dispatchCommand(c)
+	}
+	if err := scanner.Err(); err != nil {
+		logDebugf("DCC CHAT with %s: %v", nick, err)
+	}
+}
+
+// Sends the file at path over conn, limited to DCC/ratelimit, and waits for
+// the receiver to acknowledge all of it
+func (d *dccPlugin) sendFile(conn net.Conn, nick, path, name string, size int64) {
+	s := d.add("SEND "+name, nick, conn)
+	defer d.remove(s)
+	f, err := os.Open(path)
+	if err != nil {
+		logWarnf("DCC SEND of %s to %s: %v", name, nick, err)
+		return
+	}
+	defer f.Close()
+
+	// Receivers acknowledge the bytes received so far as 32 bit number, they
+	// must be read while sending or both sides may block
+	acked := make(chan bool, 1)
+	go func() {
+		ack := make([]byte, 4)
+		for {
+			if _, err := io.ReadFull(conn, ack); err != nil {
+				return
+			}
+			if binary.BigEndian.Uint32(ack) == uint32(size) {
+				acked <- true
+				return
+			}
+		}
+	}()
+
+	rate := d.config().RateLimit
+	buf := make([]byte, dcc_chunk_size)
+	start := time.Now()
+	var sent int64
+	for sent < size {
+		n, err := f.Read(buf)
+		if n > 0 {
+			conn.SetWriteDeadline(time.Now().Add(d.timeout()))
+			if _, err := conn.Write(buf[:n]); err != nil {
+				logInfof("DCC SEND of %s to %s aborted after %d bytes: %v", name, nick, sent, err)
+				return
+			}
+			sent += int64(n)
+			if rate > 0 {
+				if ahead := time.Duration(sent*int64(time.Second)/int64(rate*1024)) - time.Since(start); ahead > 0 {
+					time.Sleep(ahead)
+				}
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			logWarnf("DCC SEND of %s to %s: %v", name, nick, err)
+			return
+		}
+	}
+	select {
+	case <-acked:
+		logInfof("DCC SEND of %s to %s done, %d bytes", name, nick, sent)
+	case <-time.After(d.timeout()):
+		logInfof("DCC SEND of %s to %s: no acknowledgement for %d bytes", name, nick, sent)
+	}
+}
+
+func (d *dccPlugin) add(kind, nick string, conn net.Conn) *dccSession {
+	d.Lock()
+	defer d.Unlock()
+	d.nextID++
+	s := &dccSession{id: d.nextID, kind: kind, nick: nick, conn: conn, started: time.Now()}
+	d.sessions[s.id] = s
+	logInfof("DCC %s with %s (%s) opened", kind, nick, conn.RemoteAddr())
+	return s
+}
+
+func (d *dccPlugin) remove(s *dccSession) {
+	s.conn.Close()
+	d.Lock()
+	delete(d.sessions, s.id)
+	d.Unlock()
+	logInfof("DCC %s with %s closed", s.kind, s.nick)
+}
+
+// Returns whether the user may open chats
+func (d *dccPlugin) allowed(source, account string) bool {
+	auth, ok := d.ic.GetPlugin("auth").(*authPlugin)
+	return ok && auth.accessLevel(source, account, "") >= d.config().MinAccess
+}
+
+// Reads section DCC, options with invalid values are at their defaults
+func (d *dccPlugin) config() *dccConfig {
+	c := new(dccConfig)
+	if err := d.ic.UnmarshalSection("DCC", c); err != nil {
+		logWarnf("DCC: %v", err)
+		if c.Timeout <= 0 {
+			c.Timeout = default_dcc_timeout
+		}
+		if c.RateLimit < 0 {
+			c.RateLimit = 0
+		}
+	}
+	return c
+}
+
+func (d *dccPlugin) timeout() time.Duration {
+	return d.config().Timeout
+}
+
+// Returns our address as announced in offers
+func (d *dccPlugin) address() (string, error) {
+	if ip := d.config().IP; ip != "" {
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return "", fmt.Errorf("invalid DCC/ip %q", ip)
+		}
+		return dccIP(parsed), nil
+	}
+	if conn := d.ic.connection(); conn != nil && conn.conn != nil {
+		if addr, ok := conn.conn.LocalAddr().(*net.TCPAddr); ok {
+			return dccIP(addr.IP), nil
+		}
+	}
+	return "", errors.New("own address unknown, set DCC/ip")
+}
+
+// Listens on the first free port of DCC/ports
+func (d *dccPlugin) listen() (net.Listener, error) {
+	ports := d.config().Ports
+	if ports == "" {
+		return net.Listen("tcp", ":0")
+	}
+	r := strings.SplitN(ports, "-", 2)
+	first, err := strconv.Atoi(r[0])
+	last := first
+	if err == nil && len(r) == 2 {
+		last, err = strconv.Atoi(r[1])
+	}
+	if err != nil || first <= 0 || last < first || last > 65535 {
+		return nil, fmt.Errorf("invalid DCC/ports %q", ports)
+	}
+	for port := first; port <= last; port++ {
+		if l, err := net.Listen("tcp", ":"+strconv.Itoa(port)); err == nil {
+			return l, nil
+		}
+	}
+	return nil, fmt.Errorf("no free port in %s", ports)
+}
+
+// Formats ip for offers: IPv4 addresses as number, IPv6 ones as usual
+func dccIP(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return strconv.FormatUint(uint64(binary.BigEndian.Uint32(v4)), 10)
+	}
+	return ip.String()
+}
+
+// Returns the host:port to connect to for the address from an offer
+func parseDCCAddress(ip, port string) (string, error) {
+	p, err := strconv.Atoi(port)
+	if err != nil || p <= 0 || p > 65535 {
+		return "", fmt.Errorf("invalid port %q", port)
+	}
+	if n, err := strconv.ParseUint(ip, 10, 32); err == nil {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		return net.JoinHostPort(net.IP(b).String(), port), nil
+	}
+	if net.ParseIP(ip) == nil {
+		return "", fmt.Errorf("invalid address %q", ip)
+	}
+	return net.JoinHostPort(ip, port), nil
+}
+
+// Splits the parameters of a DCC request, file names may be quoted
+func dccFields(params string) []string {
+	var fields []string
+	for i := 0; i < len(params); {
+		if params[i] == ' ' {
+			i++
+			continue
+		}
+		var tok string
+		tok, i = nextToken(params, i)
+		fields = append(fields, tok)
+	}
+	return fields
+}
+
+func dccToken() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func nonEmpty(s ...string) []string {
+	var ret []string
+	for _, x := range s {
+		if x != "" {
+			ret = append(ret, x)
+		}
+	}
+	return ret
+}
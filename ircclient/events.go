@@ -0,0 +1,54 @@
+package ircclient
+
+// A simple publish/subscribe bus for events between plugins, so a plugin can
+// react to another one (e.g. "karma_changed") without depending on it.
+
+type subscription struct {
+	id int
+	fn func(data interface{})
+}
+
+// Registers fn to be called with the data of every event published on topic.
+// Lines from the server are published with their command as topic, e.g.
+// "JOIN" with a *JoinEvent, see Event.
+// Returns a function that cancels the subscription, which plugins should call
+// from their Unregister().
+func (ic *IRCClient) Subscribe(topic string, fn func(data interface{})) (unsubscribe func()) {
+	ic.registry.Lock()
+	defer ic.registry.Unlock()
+	if ic.subscriptions == nil {
+		ic.subscriptions = make(map[string][]subscription)
+	}
+	ic.nextSubID++
+	id := ic.nextSubID
+	ic.subscriptions[topic] = append(ic.subscriptions[topic], subscription{id, fn})
+
+	return func() {
+		ic.registry.Lock()
+		defer ic.registry.Unlock()
+		subs := ic.subscriptions[topic]
+		for i, s := range subs {
+			if s.id == id {
+				ic.subscriptions[topic] = append(subs[:i:i], subs[i+1:]...)
+				break
+			}
+		}
+		if len(ic.subscriptions[topic]) == 0 {
+			delete(ic.subscriptions, topic)
+		}
+	}
+}
+
+// Calls the subscribers of topic with data. Like line handlers, each one runs
+// in its own goroutine, Publish() doesn't wait for them.
+func (ic *IRCClient) Publish(topic string, data interface{}) {
+	ic.registry.RLock()
+	subs := ic.subscriptions[topic]
+	ic.registry.RUnlock()
+	for _, s := range subs {
+		go func(fn func(data interface{})) {
+			defer ic.recoverPlugin(nil, "subscriber of event "+topic, nil)
+			fn(data)
+		}(s.fn)
+	}
+}
@@ -0,0 +1,138 @@
+package ircclient
+
+// mIRC formatting control codes as used in messages, and helpers to format
+// text with them:
+//
+//   ic.Privmsg("#mett", Bold("Mett")+" is "+Colored(ColorRed, "ready"))
+
+import (
+	"fmt"
+	"strings"
+)
+
+const (
+	FormatBold          = "\x02"
+	FormatColor         = "\x03"
+	FormatHexColor      = "\x04"
+	FormatReset         = "\x0f"
+	FormatMonospace     = "\x11"
+	FormatReverse       = "\x16"
+	FormatItalic        = "\x1d"
+	FormatStrikethrough = "\x1e"
+	FormatUnderline     = "\x1f"
+)
+
+// The 16 standard mIRC colors
+type Color int
+
+const (
+	ColorWhite Color = iota
+	ColorBlack
+	ColorBlue
+	ColorGreen
+	ColorRed
+	ColorBrown
+	ColorPurple
+	ColorOrange
+	ColorYellow
+	ColorLightGreen
+	ColorCyan
+	ColorLightCyan
+	ColorLightBlue
+	ColorPink
+	ColorGrey
+	ColorLightGrey
+)
+
+func Bold(s string) string {
+	return FormatBold + s + FormatBold
+}
+
+func Italic(s string) string {
+	return FormatItalic + s + FormatItalic
+}
+
+func Underline(s string) string {
+	return FormatUnderline + s + FormatUnderline
+}
+
+func Strikethrough(s string) string {
+	return FormatStrikethrough + s + FormatStrikethrough
+}
+
+func Monospace(s string) string {
+	return FormatMonospace + s + FormatMonospace
+}
+
+// Returns s in color fg. After s, the default color is used again (not the
+// one of surrounding colored text).
+func Colored(fg Color, s string) string {
+	return colorCode(fmt.Sprintf("%02d", fg), s)
+}
+
+// Returns s in color fg on background bg
+func ColoredBg(fg, bg Color, s string) string {
+	return colorCode(fmt.Sprintf("%02d,%02d", fg, bg), s)
+}
+
+// Two digit colors keep digits at the start of s from being taken as part
+// of the code, a comma after the foreground color needs an empty bold
+// toggle in between
+func colorCode(code, s string) string {
+	if !strings.Contains(code, ",") && strings.HasPrefix(s, ",") {
+		s = FormatBold + FormatBold + s
+	}
+	return FormatColor + code + s + FormatColor
+}
+
+// Removes all formatting control codes (bold, colors, ...) from s. Color
+// codes are removed with their parameters, e.g. "\x0304,12" or
+// "\x04FF0000". Incomplete color codes at the end of s are removed as far
+// as they go; digits following a complete color code are kept.
+func StripFormatting(s string) string {
+	if strings.IndexAny(s, "\x02\x03\x04\x0f\x11\x16\x1d\x1e\x1f") < 0 {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '\x02', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		case '\x03':
+			i += colorLen(s[i+1:], isDigit, 2)
+		case '\x04':
+			i += colorLen(s[i+1:], isHexDigit, 6)
+		default:
+			buf = append(buf, s[i])
+		}
+	}
+	return string(buf)
+}
+
+// Returns the length of the color parameters ("fg" or "fg,bg") at the
+// start of s, each made of at most max characters for which valid returns
+// true. A comma not followed by a background color isn't part of the code.
+func colorLen(s string, valid func(byte) bool, max int) int {
+	n := 0
+	for n < len(s) && n < max && valid(s[n]) {
+		n++
+	}
+	if n == 0 || n >= len(s) || s[n] != ',' {
+		return n
+	}
+	bg := 0
+	for n+1+bg < len(s) && bg < max && valid(s[n+1+bg]) {
+		bg++
+	}
+	if bg == 0 {
+		return n
+	}
+	return n + 1 + bg
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
@@ -0,0 +1,171 @@
+package ircclient
+
+// Online restart: the connection and the bot's state are handed over to a
+// fresh instance of the bot, see Upgrade() and RestoreState()
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// State of the connection passed to the new process. The file is removed by
+// RestoreState() once it has been read.
+type handoverState struct {
+	Nick     string
+	Channels []string
+	Caps     []string
+	ISupport map[string]string
+	// The server connected to and the index of the next one in Server/host
+	Server      string
+	ServerIndex int
+	// section -> option -> value, including changes not saved yet
+	Config map[string]map[string]string
+}
+
+// Collects the state of the current connection
+func (ic *IRCClient) handoverState() *handoverState {
+	st := &handoverState{
+		Nick:     ic.GetStringOption("Server", "nick"),
+		Channels: ic.JoinedChannels(),
+		ISupport: make(map[string]string),
+		Config:   make(map[string]map[string]string),
+	}
+	ic.stateLock.Lock()
+	st.Server, st.ServerIndex = ic.server, ic.serverIndex
+	for c := range ic.caps {
+		st.Caps = append(st.Caps, c)
+	}
+	ic.stateLock.Unlock()
+	sort.Strings(st.Caps)
+	if is, ok := ic.GetPlugin("isupport").(*isupportPlugin); ok {
+		is.RLock()
+		for k, v := range is.tokens {
+			st.ISupport[k] = v
+		}
+		is.RUnlock()
+	}
+	for _, section := range ic.GetSections() {
+		st.Config[section] = make(map[string]string)
+		for _, option := range ic.GetOptions(section) {
+			st.Config[section][option] = ic.GetStringOption(section, option)
+		}
+	}
+	return st
+}
+
+// Writes the state to a new temporary file, only readable by us as the
+// config may contain passwords, and returns its name
+func writeHandover(st *handoverState) (string, error) {
+	f, err := ioutil.TempFile("", "mettbot-handover")
+	if err != nil {
+		return "", err
+	}
+	if err := json.NewEncoder(f).Encode(st); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// Replaces the running process with a fresh instance of the bot (usually a
+// new binary) without disconnecting. The socket is inherited by the new
+// process, which gets its file descriptor and the name of a file holding the
+// current nick, joined channels, negotiated capabilities and config as
+// arguments; Connect() then calls RestoreState() instead of registering.
+// The plugins are unregistered before, so they can save their state. Only
+// returns if the new process couldn't be executed, the bot is unusable then.
+// Refused with several networks, only one connection could be handed over.
+func (ic *IRCClient) Upgrade() error {
+	if ic.manager != nil && len(ic.manager.networks) > 1 {
+		return errors.New("online restarts only work with a single network")
+	}
+	st := ic.handoverState()
+	socket := ic.GetSocket()
+	if socket == -1 {
+		return errors.New("unable to get socket")
+	}
+	file, err := writeHandover(st)
+	if err != nil {
+		syscall.Close(socket)
+		return err
+	}
+
+	ic.Shutdown()
+	// Give pending replies (e.g. to the upgrade command) a chance
+	deadline := time.Now().Add(quit_timeout)
+	for ic.OutboundQueueLen() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	progname := os.Args[0]
+	logInfof("upgrade: executing %s", progname)
+	err = syscall.Exec(progname, []string{progname, strconv.Itoa(socket), file}, os.Environ())
+	// exec normally doesn't return
+	os.Remove(file)
+	return err
+}
+
+// Restores the state written by Upgrade() from file, which is removed
+// afterwards. Called by Connect() if the bot has been started by Upgrade().
+// Channel members, topics and modes are requested from the server again.
+func (ic *IRCClient) RestoreState(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	os.Remove(file)
+	var st handoverState
+	if err := json.Unmarshal(data, &st); err != nil {
+		return err
+	}
+
+	for section, options := range st.Config {
+		for option, value := range options {
+			ic.SetStringOption(section, option, value)
+		}
+	}
+	if st.Nick != "" {
+		ic.SetStringOption("Server", "nick", st.Nick)
+	}
+	ic.stateLock.Lock()
+	ic.server, ic.serverIndex = st.Server, st.ServerIndex
+	ic.stateLock.Unlock()
+	if is, ok := ic.GetPlugin("isupport").(*isupportPlugin); ok {
+		is.Lock()
+		for k, v := range st.ISupport {
+			is.tokens[k] = v
+		}
+		is.Unlock()
+	}
+	ic.stateLock.Lock()
+	if ic.caps == nil {
+		ic.caps = make(map[string]bool)
+	}
+	if ic.capNeg == nil {
+		ic.capNeg = new(capNegotiation)
+	}
+	ic.capNeg.available = make(map[string]bool)
+	for _, c := range st.Caps {
+		ic.caps[c] = true
+		ic.capNeg.available[c] = true
+	}
+	// registration is long over
+	ic.capNeg.ended = true
+	ic.stateLock.Unlock()
+	if cs, ok := ic.GetPlugin("chanstate").(*chanStatePlugin); ok {
+		cs.restore(st.Channels)
+	}
+	logInfof("restored state: nick %s, %d channels, %d capabilities", st.Nick, len(st.Channels), len(st.Caps))
+	return nil
+}
@@ -0,0 +1,125 @@
+package ircclient
+
+// Messages from ignored users (e.g. abusive ones or other bots the bot would
+// loop with) are dropped before plugins or event subscribers see them. The
+// ignore list is kept in section Ignore of the config file, mapping
+// hostmasks (regular expressions, anchored at both ends unless they start
+// with ^ or end with $) and account/<name> entries to the date they were
+// added.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Only these are dropped, so the state of channels and users stays intact
+var ignored_commands = map[string]bool{"PRIVMSG": true, "NOTICE": true, "INVITE": true, "TAGMSG": true}
+
+// Compiled ignore masks, protected by its own lock
+type ignoreList struct {
+	// pattern -> compiled mask, nil for masks that don't compile
+	cache map[string]*regexp.Regexp
+	sync.Mutex
+}
+
+// Returns the regular expression actually used for the ignore mask
+func ignorePattern(mask string) string {
+	if strings.HasPrefix(mask, "^") || strings.HasSuffix(mask, "$") {
+		return mask
+	}
+	return "^(?:" + mask + ")$"
+}
+
+func (l *ignoreList) compile(mask string) *regexp.Regexp {
+	pattern := ignorePattern(mask)
+	l.Lock()
+	defer l.Unlock()
+	if l.cache == nil {
+		l.cache = make(map[string]*regexp.Regexp)
+	}
+	re, ok := l.cache[pattern]
+	if !ok {
+		var err error
+		re, err = regexp.Compile(pattern)
+		if err != nil {
+			logWarnf("invalid ignore mask %q: %v", mask, err)
+			re = nil
+		}
+		l.cache[pattern] = re
+	}
+	return re
+}
+
+// Ignores all messages from users matching maskOrAccount, a hostmask or
+// account/<name>. The config file is saved, the returned error is the one
+// of saving.
+func (ic *IRCClient) Ignore(maskOrAccount string) error {
+	if maskOrAccount == "" || strings.Contains(maskOrAccount, " ") {
+		return errors.New("masks can't be empty or contain spaces")
+	}
+	if strings.HasPrefix(maskOrAccount, account_prefix) {
+		if name := maskOrAccount[len(account_prefix):]; name == "" || strings.ContainsAny(name, "!@*") {
+			return fmt.Errorf("invalid account name %q", name)
+		}
+	} else if _, err := regexp.Compile(ignorePattern(maskOrAccount)); err != nil {
+		return fmt.Errorf("unable to compile regexp: %v", err)
+	}
+	ic.SetStringOption("Ignore", maskOrAccount, time.Now().Format("2006-01-02"))
+	return ic.FlushConfig()
+}
+
+// Removes maskOrAccount from the ignore list and saves the config file
+func (ic *IRCClient) Unignore(maskOrAccount string) error {
+	if ic.GetStringOption("Ignore", maskOrAccount) == "" {
+		return fmt.Errorf("%s is not ignored", maskOrAccount)
+	}
+	ic.RemoveOption("Ignore", maskOrAccount)
+	return ic.FlushConfig()
+}
+
+// Returns the ignored masks and accounts, sorted
+func (ic *IRCClient) Ignored() []string {
+	masks := ic.GetOptions("Ignore")
+	sort.Strings(masks)
+	return masks
+}
+
+// Returns whether messages from host, logged in to account (may be empty),
+// are ignored. If account is empty, the known account of host's nick is
+// used.
+func (ic *IRCClient) IsIgnored(host, account string) bool {
+	masks := ic.GetOptions("Ignore")
+	if len(masks) == 0 {
+		return false
+	}
+	if account == "" {
+		if cs, ok := ic.GetPlugin("chanstate").(*chanStatePlugin); ok {
+			account = cs.knownAccount(strings.SplitN(host, "!", 2)[0])
+		}
+	}
+	for _, m := range masks {
+		if strings.HasPrefix(m, account_prefix) {
+			if account != "" && ic.CanonNick(m[len(account_prefix):]) == ic.CanonNick(account) {
+				return true
+			}
+		} else if re := ic.ignores.compile(m); re != nil && re.MatchString(host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether msg is from an ignored user and must not be passed on.
+// Server messages are never ignored.
+func (ic *IRCClient) ignoredMessage(msg *IRCMessage) bool {
+	if !ignored_commands[msg.Command] || !strings.Contains(msg.Source, "!") {
+		return false
+	}
+	account, _ := msg.Account()
+	return ic.IsIgnored(msg.Source, account)
+}
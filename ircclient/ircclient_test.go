@@ -1,7 +1,24 @@
 package ircclient
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 var server_lines = []string{
@@ -14,12 +31,12 @@ var server_lines = []string{
 }
 
 var parsed_structs = []IRCMessage{
-	{"fu-berlin.de", "*", "020", []string{"Please wait while we process your connection."}, server_lines[0]},
-	{"fu-berlin.de", "osntauohe", "001", []string{"Welcome to the Internet Relay Network osntauohe!~osntauohe@176.99.114.122"}, server_lines[1]},
-	{"fu-berlin.de", "osntauohe", "042", []string{"276BAY2UY", "your unique ID"}, server_lines[2]},
-	{"fu-berlin.de", "osntauohe", "375", []string{"- fu-berlin.de Message of the Day - "}, server_lines[3]},
-	{"fu-berlin.de", "osntauohe", "372", []string{"- Willkommen auf dem IRCnet-Server der Freien Universitaet Berlin, ZEDAT"}, server_lines[4]},
-	{"fu-berlin.de", "osntauohe", "376", []string{"End of MOTD command."}, server_lines[5]},
+	{Source: "fu-berlin.de", Target: "*", Command: "020", Args: []string{"Please wait while we process your connection."}, Complete: server_lines[0]},
+	{Source: "fu-berlin.de", Target: "osntauohe", Command: "001", Args: []string{"Welcome to the Internet Relay Network osntauohe!~osntauohe@176.99.114.122"}, Complete: server_lines[1]},
+	{Source: "fu-berlin.de", Target: "osntauohe", Command: "042", Args: []string{"276BAY2UY", "your unique ID"}, Complete: server_lines[2]},
+	{Source: "fu-berlin.de", Target: "osntauohe", Command: "375", Args: []string{"- fu-berlin.de Message of the Day - "}, Complete: server_lines[3]},
+	{Source: "fu-berlin.de", Target: "osntauohe", Command: "372", Args: []string{"- Willkommen auf dem IRCnet-Server der Freien Universitaet Berlin, ZEDAT"}, Complete: server_lines[4]},
+	{Source: "fu-berlin.de", Target: "osntauohe", Command: "376", Args: []string{"End of MOTD command."}, Complete: server_lines[5]},
 }
 
 func ircMessage_deep_equals(m1, m2 *IRCMessage) bool {
@@ -49,6 +66,1498 @@ func TestParseServerLine(t *testing.T) {
 	}
 }
 
+const test_config = `[Server]
+host: localhost:6667
+nick: testbot
+ident: testbot
+realname: Test Bot
+trigger: .
+`
+
+// Returns a client that is not connected, using a temporary config file.
+// Lines sent by the client can be read from ic.conn.Output.
+func write_test_config(t *testing.T) string {
+	f, err := ioutil.TempFile("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(test_config)
+	f.Close()
+	return f.Name()
+}
+
+func new_test_client(t *testing.T) *IRCClient {
+	config := write_test_config(t)
+	ic := NewIRCClient(config)
+	ic.conn = NewircConn()
+	os.Remove(config)
+	return ic
+}
+
+// Plugin that reports every command it receives on a channel
+type commandRecorder struct {
+	commands chan *IRCCommand
+}
+
+func (r *commandRecorder) Register(cl *IRCClient) {
+	cl.RegisterCommandHandler("echo", 0, 0, r)
+}
+func (r *commandRecorder) String() string               { return "recorder" }
+func (r *commandRecorder) Info() string                 { return "" }
+func (r *commandRecorder) Usage(cmd string) string      { return "" }
+func (r *commandRecorder) ProcessLine(msg *IRCMessage)  {}
+func (r *commandRecorder) ProcessCommand(c *IRCCommand) { r.commands <- c }
+func (r *commandRecorder) Unregister()                  {}
+
+func TestLoopGuard(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+
+	ic.dispatchHandlers(":testbot!~testbot@localhost PRIVMSG #chan :.echo loop")
+	select {
+	case c := <-rec.commands:
+		t.Errorf("echoed self-message was dispatched: %#v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.echo hello")
+	select {
+	case <-rec.commands:
+	case <-time.After(time.Second):
+		t.Error("command from other user was not dispatched")
+	}
+
+	// nicks are compared by the server's case mapping, rfc1459 by default
+	ic.SetStringOption("Server", "nick", "test[bot]")
+	ic.dispatchHandlers(":TEST{bot}!~testbot@localhost PRIVMSG #chan :.echo loop")
+	select {
+	case c := <-rec.commands:
+		t.Errorf("echoed self-message was dispatched: %#v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+	ic.SetStringOption("Server", "nick", "testbot")
+
+	ic.SetLoopGuard(false)
+	ic.dispatchHandlers(":testbot!~testbot@localhost PRIVMSG #chan :.echo loop")
+	select {
+	case <-rec.commands:
+	case <-time.After(time.Second):
+		t.Error("self-message was not dispatched with loop guard disabled")
+	}
+}
+
+func TestLatin1Encoding(t *testing.T) {
+	c := NewircConn()
+	if err := c.SetEncoding("latin1"); err != nil {
+		t.Fatal(err)
+	}
+	if s := c.decode("PRIVMSG #mett :Gr\xfc\xdfe"); s != "PRIVMSG #mett :Grüße" {
+		t.Errorf("latin1 line decoded to %q", s)
+	}
+	if s := c.decode("PRIVMSG #mett :Grüße"); s != "PRIVMSG #mett :Grüße" {
+		t.Errorf("utf-8 line decoded to %q", s)
+	}
+	if s := c.encode("PRIVMSG #mett :Grüße ☃"); s != "PRIVMSG #mett :Gr\xfc\xdfe ?" {
+		t.Errorf("line encoded to %q", s)
+	}
+	if err := c.SetEncoding("klingon"); err == nil {
+		t.Error("unknown encoding accepted")
+	}
+}
+
+func TestPluginsImplementing(t *testing.T) {
+	ic := new_test_client(t)
+	ic.RegisterPlugin(&commandRecorder{make(chan *IRCCommand, 1)})
+
+	plugins := ic.PluginsImplementing((*DisconnectHandler)(nil))
+	if len(plugins) != 0 {
+		t.Errorf("found unexpected disconnect handlers: %v", plugins)
+	}
+	plugins = ic.PluginsImplementing((*Plugin)(nil))
+	if len(plugins) != len(ic.GetPlugins()) {
+		t.Errorf("got %d plugins, want %d", len(plugins), len(ic.GetPlugins()))
+	}
+	for i := 1; i < len(plugins); i++ {
+		if plugins[i-1].String() > plugins[i].String() {
+			t.Errorf("plugins not ordered by name: %s before %s", plugins[i-1], plugins[i])
+		}
+	}
+}
+
+// Plugin that records which lifecycle methods have been called
+type lifecycleRecorder struct {
+	commandRecorder
+	calls []string
+}
+
+func (r *lifecycleRecorder) String() string                 { return "lifecycle" }
+func (r *lifecycleRecorder) ProcessDisconnect(reason error) { r.calls = append(r.calls, "disconnect") }
+func (r *lifecycleRecorder) OnReconnectReset()              { r.calls = append(r.calls, "reset") }
+func (r *lifecycleRecorder) Unregister()                    { r.calls = append(r.calls, "unregister") }
+
+func TestReconnectReset(t *testing.T) {
+	ic := new_test_client(t)
+	rec := new(lifecycleRecorder)
+	ic.RegisterPlugin(rec)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	cs.ProcessLine(ParseServerLine(":testbot!~testbot@localhost JOIN #mett"))
+
+	// connection lost
+	close(ic.conn.Input)
+	ic.conn.Err <- errors.New("connection reset by peer")
+	if err := ic.InputLoop(); err == nil {
+		t.Error("InputLoop() returned no error")
+	}
+	if strings.Join(rec.calls, ",") != "disconnect,reset" {
+		t.Errorf("wrong calls after connection loss: %v", rec.calls)
+	}
+	if channels := ic.JoinedChannels(); len(channels) != 0 {
+		t.Errorf("channels not reset: %v", channels)
+	}
+	if ic.GetPlugin("lifecycle") == nil {
+		t.Error("plugin unregistered after connection loss")
+	}
+
+	rec.calls = nil
+	ic.Shutdown()
+	if strings.Join(rec.calls, ",") != "unregister" {
+		t.Errorf("wrong calls on shutdown: %v", rec.calls)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	ic := new_test_client(t)
+	got := make(chan interface{}, 2)
+	unsubscribe := ic.Subscribe("test_event", func(data interface{}) { got <- data })
+	ic.Subscribe("other_event", func(data interface{}) { got <- "other" })
+
+	ic.Publish("test_event", 42)
+	select {
+	case data := <-got:
+		if data != 42 {
+			t.Errorf("got %v, want 42", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber not called")
+	}
+
+	unsubscribe()
+	ic.Publish("test_event", 43)
+	select {
+	case data := <-got:
+		t.Errorf("unsubscribed handler got %v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestTypedEvents(t *testing.T) {
+	ic := new_test_client(t)
+	got := make(chan interface{}, 10)
+	for _, topic := range []string{"JOIN", "PRIVMSG", "KICK", "MODE", "366"} {
+		ic.Subscribe(topic, func(data interface{}) { got <- data })
+	}
+	lines := []string{
+		":alice!~al@alice.example JOIN #mett acc :Alice A.",
+		":alice!~al@alice.example PRIVMSG testbot :\x01ACTION waves\x01",
+		":op!~op@op.example KICK #mett alice :bye",
+		":op!~op@op.example MODE #mett +ov alice bob",
+		":server 366 testbot #mett :End of /NAMES list.",
+	}
+	for _, line := range lines {
+		ic.dispatchHandlers(line)
+		select {
+		case data := <-got:
+			switch e := data.(type) {
+			case *JoinEvent:
+				if e.Nick != "alice" || e.Ident != "~al" || e.Host != "alice.example" || e.Channel != "#mett" || e.Account != "acc" || e.Realname != "Alice A." {
+					t.Errorf("wrong join event %+v", e)
+				}
+			case *MessageEvent:
+				if !e.Action || !e.Private || e.Text != "waves" || e.ReplyTarget() != "alice" {
+					t.Errorf("wrong message event %+v", e)
+				}
+			case *KickEvent:
+				if e.Nick != "op" || e.Kicked != "alice" || e.Reason != "bye" {
+					t.Errorf("wrong kick event %+v", e)
+				}
+			case *ModeEvent:
+				if e.Target != "#mett" || e.Modes != "+ov" || strings.Join(e.Params, " ") != "alice bob" {
+					t.Errorf("wrong mode event %+v", e)
+				}
+			case *NumericEvent:
+				if e.Numeric != "366" || e.Nick != "server" || len(e.Args) != 2 || e.Args[0] != "#mett" {
+					t.Errorf("wrong numeric event %+v", e)
+				}
+			default:
+				t.Errorf("unexpected event %#v for %q", data, line)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("no event for %q", line)
+		}
+	}
+
+	ic.dispatchHandlers(":server NOTICE testbot :no subscribers")
+	select {
+	case data := <-got:
+		t.Errorf("unexpected event %#v", data)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// Plugin with usage texts in different styles
+type usagePlugin struct {
+	commandRecorder
+}
+
+func (u *usagePlugin) String() string { return "usage" }
+func (u *usagePlugin) Register(cl *IRCClient) {
+	cl.RegisterCommandHandler("add", 1, 0, u)
+	cl.RegisterCommandHandler("ht", 0, 0, u)
+	cl.RegisterCommandHandler("nousage", 0, 0, u)
+}
+func (u *usagePlugin) Usage(cmd string) string {
+	switch cmd {
+	case "add":
+		return "add <quote>: adds a quote"
+	case "ht":
+		return "prints the temperature"
+	}
+	return ""
+}
+
+func TestGetUsage(t *testing.T) {
+	ic := new_test_client(t)
+	ic.RegisterPlugin(new(usagePlugin))
+	if ic.Trigger() != "." {
+		t.Errorf("wrong trigger %q", ic.Trigger())
+	}
+	for cmd, want := range map[string]string{
+		"add":     ".add <quote>: adds a quote",
+		"ht":      ".ht: prints the temperature",
+		"nousage": "",
+		"missing": "no such command",
+	} {
+		if usage := ic.GetUsage(cmd); usage != want {
+			t.Errorf("usage of %s is %q, want %q", cmd, usage, want)
+		}
+	}
+	if !ic.IsCommand("add") || ic.IsCommand("missing") {
+		t.Error("IsCommand() is wrong")
+	}
+	ic.SetStringOption("Server", "trigger", "!")
+	if usage := ic.GetUsage("add"); usage != "!add <quote>: adds a quote" {
+		t.Errorf("usage %q doesn't use the new trigger", usage)
+	}
+}
+
+func TestMockServer(t *testing.T) {
+	srv := NewMockServer()
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, srv.Conn())
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+
+	srv.Send(":server 001 testbot :Welcome")
+	if err := ic.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Expect("USER ", time.Second); !ok {
+		t.Error("no USER sent during registration")
+	}
+	done := make(chan error)
+	go func() { done <- ic.InputLoop() }()
+
+	srv.Send(":alice!~alice@alice.example PRIVMSG #x :.echo #y hi")
+	select {
+	case c := <-rec.commands:
+		ic.SendLine("PRIVMSG " + c.Args[0] + " :" + c.Args[1])
+	case <-time.After(time.Second):
+		t.Fatal("command not dispatched")
+	}
+	if _, ok := srv.Expect("PRIVMSG #y :hi", time.Second); !ok {
+		t.Error("reply not sent")
+	}
+
+	srv.Close()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("InputLoop() returned no error")
+		}
+	case <-time.After(time.Second):
+		t.Error("InputLoop() didn't return after the connection was closed")
+	}
+	ic.Shutdown()
+}
+
+func TestSendBeforeConnect(t *testing.T) {
+	srv := NewMockServer()
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, srv.Conn())
+	ic.SetIntOption("Server", "sendqueue", 2)
+
+	for _, line := range []string{"PRIVMSG #x :early", "PRIVMSG #x :bird"} {
+		if err := ic.SendLine(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ic.SendLine("PRIVMSG #x :too much"); err != ErrSendQueueFull {
+		t.Errorf("got error %v with too many lines waiting", err)
+	}
+	if n := ic.OutboundQueueLen(); n != 2 {
+		t.Errorf("queue length is %d, want 2", n)
+	}
+	if fd := ic.GetSocket(); fd != -1 {
+		t.Errorf("got socket %d without connection", fd)
+	}
+
+	srv.Send(":server 001 testbot :Welcome")
+	if err := ic.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := srv.Expect("USER ", time.Second); !ok {
+		t.Error("no USER sent during registration")
+	}
+	for _, want := range []string{"PRIVMSG #x :early", "PRIVMSG #x :bird"} {
+		if line, ok := srv.Expect("PRIVMSG", time.Second); line != want || !ok {
+			t.Errorf("sent %q, want %q", line, want)
+		}
+	}
+	srv.Close()
+	ic.Shutdown()
+
+	// must not crash without connection
+	ic = new_test_client(t)
+	ic.conn = nil
+	ic.Disconnect("bye")
+}
+
+func TestChannelState(t *testing.T) {
+	ic := new_test_client(t)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	for _, line := range []string{
+		":testbot!~testbot@localhost JOIN #mett",
+		":server 353 testbot = #mett :testbot @alice +bob",
+		":alice!~alice@alice.example MODE #mett +o testbot",
+		":server 352 testbot #mett ~bob bob.example server bob G+ :0 Bob Mett",
+		":carol!~carol@carol.example JOIN :#mett",
+		":alice!~alice@alice.example MODE #mett -o+v alice alice",
+		":bob!~bob@bob.example NICK :bobby",
+	} {
+		cs.ProcessLine(ParseServerLine(line))
+	}
+
+	if !ic.IsChannelOp("#mett", "testbot") {
+		t.Error("bot should be op")
+	}
+	if ic.IsChannelOp("#MeTT", "alice") || !cs.hasMode("#mett", "ALICE", 'v') {
+		t.Error("alice should be voiced, but not op")
+	}
+	u, ok := ic.GetUserInfo("#mett", "bobby")
+	if !ok || u.Nick != "bobby" || u.Ident != "~bob" || u.Host != "bob.example" || !u.Away || u.Realname != "Bob Mett" {
+		t.Errorf("wrong info for bobby: %#v", u)
+	}
+	if _, ok := ic.GetUserInfo("#mett", "bob"); ok {
+		t.Error("bob should have been renamed")
+	}
+	u, ok = ic.GetUserInfo("#mett", "carol")
+	if !ok || u.Host != "carol.example" {
+		t.Errorf("wrong info for carol: %#v", u)
+	}
+
+	cs.ProcessLine(ParseServerLine(":alice!~alice@alice.example KICK #mett testbot :bye"))
+	if ic.IsChannelOp("#mett", "testbot") {
+		t.Error("channel should have been forgotten after kick")
+	}
+	if _, ok := ic.GetUserInfo("#mett", "carol"); ok {
+		t.Error("carol should have been forgotten after kick")
+	}
+}
+
+func TestJoinedChannels(t *testing.T) {
+	ic := new_test_client(t)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	joined := func(want ...string) {
+		got := ic.JoinedChannels()
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("joined %v, want %v", got, want)
+		}
+	}
+	for _, line := range []string{
+		":testbot!~testbot@localhost JOIN #mett",
+		":testbot!~testbot@localhost JOIN #b",
+		":testbot!~testbot@localhost JOIN #a",
+		":someone!~someone@localhost JOIN #c",
+		":testbot!~testbot@localhost PART #b",
+	} {
+		cs.ProcessLine(ParseServerLine(line))
+	}
+	joined("#a", "#mett")
+	cs.ProcessLine(ParseServerLine(":op!~op@localhost KICK #mett testbot :bye"))
+	joined("#a")
+	cs.ProcessLine(ParseServerLine(":testbot!~testbot@localhost QUIT :restart"))
+	joined()
+
+	cs.ProcessLine(ParseServerLine(":testbot!~testbot@localhost JOIN #a"))
+	cs.ProcessLine(ParseServerLine(":server 001 testbot :Welcome"))
+	joined()
+}
+
+func TestPreFilter(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+
+	order := ""
+	ic.RegisterPreFilter(func(cmd *IRCCommand) (bool, string) {
+		order += "1"
+		return true, ""
+	})
+	ic.RegisterPreFilter(func(cmd *IRCCommand) (bool, string) {
+		order += "2"
+		return len(cmd.Args) == 0 || cmd.Args[0] != "deny", "denied"
+	})
+
+	ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.echo deny")
+	select {
+	case c := <-rec.commands:
+		t.Errorf("denied command was dispatched: %#v", c)
+	case line := <-ic.conn.Output:
+		if line != "NOTICE #chan :denied" {
+			t.Errorf("unexpected reply %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Error("no reason sent for denied command")
+	}
+	if order != "12" {
+		t.Errorf("filters ran in order %q", order)
+	}
+
+	ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.echo allow")
+	select {
+	case <-rec.commands:
+	case <-time.After(time.Second):
+		t.Error("allowed command was not dispatched")
+	}
+}
+
+func TestMaintenance(t *testing.T) {
+	ic := new_test_client(t)
+	cf := ic.GetPlugin("conf").(*ConfigPlugin)
+	defer os.Remove(cf.filename)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	ic.SetAccessLevel(`admin!.*`, 500)
+
+	if err := ic.SetMaintenance(true, "back soon"); err != nil {
+		t.Fatal(err)
+	}
+	ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.echo")
+	select {
+	case c := <-rec.commands:
+		t.Errorf("command was dispatched in maintenance mode: %#v", c)
+	case line := <-ic.conn.Output:
+		if line != "NOTICE #chan :back soon" {
+			t.Errorf("unexpected reply %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Error("no maintenance message sent")
+	}
+	ic.dispatchHandlers(":admin!~admin@localhost PRIVMSG #chan :.echo")
+	select {
+	case <-rec.commands:
+	case <-time.After(time.Second):
+		t.Error("admin command was not dispatched in maintenance mode")
+	}
+
+	// the flag has to survive a restart
+	if on, msg := NewIRCClient(cf.filename).Maintenance(); !on || msg != "back soon" {
+		t.Errorf("maintenance mode not persisted: %v %q", on, msg)
+	}
+
+	ic.SetMaintenance(false, "")
+	ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.echo")
+	select {
+	case <-rec.commands:
+	case <-time.After(time.Second):
+		t.Error("command was not dispatched after maintenance")
+	}
+}
+
+func TestCommandPrefix(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	if err := ic.RegisterCommandPrefix("ec", 0, 0, rec); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.RegisterCommandPrefix("ec", 0, 0, rec); err == nil {
+		t.Error("prefix registered twice")
+	}
+	ic.RegisterCommandPrefix("ecc", 1, 0, rec)
+
+	for _, c := range []struct {
+		line, command string
+	}{
+		{".echo", "echo"},             // exact handler wins
+		{".ecstatic", "ecstatic"},     // prefix, command passed unchanged
+		{".eccentric x", "eccentric"}, // longest prefix
+	} {
+		ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :" + c.line)
+		select {
+		case cmd := <-rec.commands:
+			if cmd.Command != c.command {
+				t.Errorf("dispatched %q for %q", cmd.Command, c.line)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q was not dispatched", c.line)
+		}
+	}
+
+	// "ecc" requires a parameter
+	ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.eccentric")
+	select {
+	case cmd := <-rec.commands:
+		t.Errorf("dispatched %#v without parameter", cmd)
+	case <-ic.conn.Output:
+	case <-time.After(time.Second):
+		t.Error("no usage sent")
+	}
+
+	ic.UnregisterPlugin("recorder")
+	if _, ok := ic.lookupHandler("ecstatic"); ok {
+		t.Error("prefix handler left after unregistering")
+	}
+}
+
+// A commandRecorder with another name, so both can be registered
+type otherRecorder struct {
+	commandRecorder
+}
+
+func (r *otherRecorder) Register(cl *IRCClient) {
+	cl.RegisterCommandHandler("echo", 0, 0, r)
+}
+func (r *otherRecorder) String() string { return "other" }
+
+func TestCommandHandlers(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	other := &otherRecorder{commandRecorder{make(chan *IRCCommand, 1)}}
+	ic.RegisterPlugin(rec)
+	if err := ic.RegisterPlugin(other); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.RegisterCommandHandler("echo", 0, 0, other); err == nil {
+		t.Error("command registered twice by the same plugin")
+	}
+
+	expect := func(want Plugin) {
+		ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.echo")
+		var got Plugin
+		select {
+		case <-rec.commands:
+			got = rec
+		case <-other.commands:
+			got = other
+		case <-time.After(time.Second):
+			t.Error("not dispatched")
+			return
+		}
+		if got != want {
+			t.Errorf("dispatched to %s instead of %s", got.String(), want.String())
+		}
+	}
+	// the last registration wins
+	expect(other)
+
+	if err := ic.UnregisterCommandHandler("echo", other); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.UnregisterCommandHandler("echo", other); err == nil {
+		t.Error("handler unregistered twice")
+	}
+	expect(rec)
+
+	ic.RegisterCommandHandler("echo", 0, 0, other)
+	ic.UnregisterPlugin("other")
+	expect(rec)
+	n := 0
+	for range ic.IterHandlers() {
+		n++
+	}
+	if n != len(ic.handlers) {
+		t.Errorf("IterHandlers() returned %d handlers for %d commands", n, len(ic.handlers))
+	}
+}
+
+func TestReplyMode(t *testing.T) {
+	ic := new_test_client(t)
+	ic.RegisterPlugin(&commandRecorder{make(chan *IRCCommand, 1)})
+	inChannel := &IRCCommand{Source: "someone!~someone@localhost", Command: "echo", Target: "#chan"}
+	inQuery := &IRCCommand{Source: "someone!~someone@localhost", Command: "echo", Target: "testbot"}
+	for _, c := range []struct {
+		mode   int
+		config string
+		cmd    *IRCCommand
+		reply  string
+	}{
+		{ReplyModeAuto, "", inChannel, "NOTICE #chan :hi"},
+		{ReplyModeAuto, "", inQuery, "NOTICE someone :hi"},
+		{ReplyModePrivate, "", inChannel, "NOTICE someone :hi"},
+		{ReplyModeChannel, "", inChannel, "NOTICE #chan :hi"},
+		{ReplyModeChannel, "", inQuery, "NOTICE someone :hi"},
+		{ReplyModeAuto, "private", inChannel, "NOTICE someone :hi"},
+		{ReplyModePrivate, "auto", inChannel, "NOTICE #chan :hi"},
+	} {
+		if err := ic.SetReplyMode("echo", c.mode); err != nil {
+			t.Fatal(err)
+		}
+		ic.SetStringOption("Reply", "echo", c.config)
+		ic.Reply(c.cmd, "hi")
+		if line := <-ic.conn.Output; line != c.reply {
+			t.Errorf("mode %d, config %q: sent %q, want %q", c.mode, c.config, line, c.reply)
+		}
+	}
+	if err := ic.SetReplyMode("nosuchcommand", ReplyModePrivate); err == nil {
+		t.Error("reply mode set for unknown command")
+	}
+	// the server may relay queries with our nick in any case
+	ic.SetReplyMode("echo", ReplyModeAuto)
+	ic.SetStringOption("Reply", "echo", "")
+	ic.Reply(&IRCCommand{Source: "someone!~someone@localhost", Command: "echo", Target: "TestBot"}, "hi")
+	ic.ReplyMsg(&IRCMessage{Source: "someone!~someone@localhost", Command: "PRIVMSG", Target: "TestBot"}, "hi")
+	for i := 0; i < 2; i++ {
+		if line := <-ic.conn.Output; line != "NOTICE someone :hi" {
+			t.Errorf("reply to query sent as %q", line)
+		}
+	}
+}
+
+// Returns an ircConn connected to a local server, which sends everything it
+// receives on the returned channel and closes it when the client has closed
+// its side of the connection
+func new_test_conn(t *testing.T) (*ircConn, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := make(chan string, 10)
+	go func() {
+		defer l.Close()
+		c, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		r := bufio.NewReader(c)
+		for {
+			s, err := r.ReadString('\n')
+			if err != nil {
+				close(received)
+				return
+			}
+			received <- s
+		}
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic := NewircConn()
+	ic.conn = c.(*net.TCPConn)
+	ic.serve()
+	return ic, received
+}
+
+func TestQuitIsSentBeforeClose(t *testing.T) {
+	ic, received := new_test_conn(t)
+	ic.Output <- "PRIVMSG #mett :bye"
+	ic.Output <- "QUIT :Bye."
+	ic.Quit()
+
+	lines := make([]string, 0)
+	for s := range received {
+		lines = append(lines, s)
+	}
+	if len(lines) != 2 || lines[1] != "QUIT :Bye.\r\n" {
+		t.Errorf("server received %q before the connection was closed", lines)
+	}
+	if _, ok := <-ic.Input; ok {
+		t.Error("Input not closed after Quit()")
+	}
+}
+
+func TestFloodProtection(t *testing.T) {
+	// burst of 2, then one line every 50ms
+	tm := newthrottleIrcu(2, 1200)
+	start := time.Now()
+	tm.WaitSend("PRIVMSG #mett :1")
+	tm.WaitSend("PRIVMSG #mett :2")
+	if d := time.Since(start); d > 25*time.Millisecond {
+		t.Errorf("burst delayed by %v", d)
+	}
+	tm.WaitSend("PRIVMSG #mett :3")
+	tm.WaitSend("PRIVMSG #mett :4")
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("4 lines sent within %v", d)
+	}
+
+	tm = newthrottleIrcu(1, 0)
+	start = time.Now()
+	for i := 0; i < 100; i++ {
+		tm.WaitSend("PRIVMSG #mett :spam")
+	}
+	if d := time.Since(start); d > 25*time.Millisecond {
+		t.Errorf("unthrottled lines delayed by %v", d)
+	}
+}
+
+func TestAccessLevels(t *testing.T) {
+	ic := new_test_client(t)
+	for mask, level := range map[string]int{
+		`.*@evil`:             100,
+		`.*!~admin@.*`:        300,
+		`admin!.*`:            400,
+		`^root!`:              500,
+		`.*@trusted\.example`: 200,
+	} {
+		if err := ic.SetAccessLevel(mask, level); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ic.SetAccessLevel(`(unbalanced`, 100); err == nil {
+		t.Error("invalid mask accepted")
+	}
+
+	for host, level := range map[string]int{
+		"someone!~someone@evil":         100,
+		"someone!~someone@evil.example": 0,   // anchored, so no substring match
+		"admin!~admin@trusted.example":  400, // highest of all matching masks
+		"root!~root@anywhere":           500, // explicitly anchored at start only
+		"xroot!~root@anywhere":          0,
+		"nobody!~nobody@nowhere":        0,
+	} {
+		if l := ic.GetAccessLevel(host, ""); l != level {
+			t.Errorf("access level of %s is %d, want %d", host, l, level)
+		}
+	}
+
+	ic.SetStringOption("Auth", "anchor", "false")
+	if l := ic.GetAccessLevel("someone!~someone@evil.example", ""); l != 100 {
+		t.Errorf("unanchored access level is %d, want 100", l)
+	}
+}
+
+func TestChannelTopicModes(t *testing.T) {
+	ic := new_test_client(t)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	for _, line := range []string{
+		":testbot!~testbot@localhost JOIN #mett",
+		":server 332 testbot #mett :Mett ist toll",
+		":server 333 testbot #mett alice!~alice@alice.example 1262304000",
+		":server 353 testbot = #mett :testbot @alice bob",
+		":server 324 testbot #mett +ntl 10",
+		":alice!~alice@alice.example MODE #mett +kb-l key *!*@spam.example",
+	} {
+		cs.ProcessLine(ParseServerLine(line))
+	}
+
+	info, ok := ic.GetChannel("#METT")
+	if !ok || info.Name != "#mett" || info.Topic != "Mett ist toll" || info.TopicSetBy != "alice" || info.TopicTime.Unix() != 1262304000 || info.Users != 3 {
+		t.Errorf("wrong channel info: %#v", info)
+	}
+	if info.Modes != "+knt key" {
+		t.Errorf("wrong modes %q", info.Modes)
+	}
+	if channels := ic.GetChannels(); len(channels) != 1 || channels[0].Name != "#mett" {
+		t.Errorf("wrong channels: %#v", channels)
+	}
+
+	cs.ProcessLine(ParseServerLine(":bob!~bob@bob.example TOPIC #mett :Mett ist sehr toll"))
+	if info, _ := ic.GetChannel("#mett"); info.Topic != "Mett ist sehr toll" || info.TopicSetBy != "bob" {
+		t.Errorf("topic change not tracked: %#v", info)
+	}
+
+	users := ic.GetChannelUsers("#mett")
+	nicks := make([]string, len(users))
+	for i, u := range users {
+		nicks[i] = u.Nick
+	}
+	if strings.Join(nicks, " ") != "alice bob testbot" {
+		t.Errorf("wrong users %v", nicks)
+	}
+	if !ic.IsOnChannel("#mett", "BOB") || ic.IsOnChannel("#mett", "carol") || ic.IsOnChannel("#other", "bob") {
+		t.Error("IsOnChannel() is wrong")
+	}
+	if ic.GetChannelUsers("#other") != nil {
+		t.Error("got users of a channel the bot isn't in")
+	}
+}
+
+func TestLookupUser(t *testing.T) {
+	ic := new_test_client(t)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	cs.ProcessLine(ParseServerLine(":testbot!~testbot@localhost JOIN #mett"))
+	cs.ProcessLine(ParseServerLine(":alice!~alice@alice.example JOIN #mett"))
+
+	// known from the channel, no WHOIS needed
+	if u, ok := ic.LookupUser("Alice"); !ok || u.Host != "alice.example" {
+		t.Errorf("wrong info for alice: %#v", u)
+	}
+
+	type result struct {
+		u  UserInfo
+		ok bool
+	}
+	lookup := func(nick string, replies ...string) result {
+		res := make(chan result)
+		go func() {
+			u, ok := ic.LookupUser(nick)
+			res <- result{u, ok}
+		}()
+	wait:
+		for {
+			select {
+			case line := <-ic.conn.Output:
+				// skip the WHO sent on join
+				if line == "WHOIS "+nick {
+					break wait
+				}
+			case <-time.After(time.Second):
+				t.Fatal("no WHOIS sent")
+			}
+		}
+		for _, reply := range replies {
+			cs.ProcessLine(ParseServerLine(reply))
+		}
+		return <-res
+	}
+	if r := lookup("bob",
+		":server 311 testbot bob ~bob bob.example * :Bob Mett",
+		":server 330 testbot bob BobAccount :is logged in as",
+		":server 318 testbot bob :End of /WHOIS list"); !r.ok || r.u.Ident != "~bob" || r.u.Host != "bob.example" || r.u.Realname != "Bob Mett" || r.u.Account != "BobAccount" {
+		t.Errorf("wrong info for bob: %#v", r.u)
+	}
+	if r := lookup("nobody", ":server 401 testbot nobody :No such nick/channel"); r.ok {
+		t.Errorf("nobody was found: %#v", r.u)
+	}
+
+	ic.SetAccessLevel(`bob!.*`, 300)
+	ic.SetAccessLevel(`.*@bob\.example`, 300)
+	ap := ic.GetPlugin("auth").(*authPlugin)
+	if level, mask := ap.match("bob!~bob@bob.example", "", ""); level != 300 || mask != `.*@bob\.example` {
+		t.Errorf("matched %q with level %d", mask, level)
+	}
+	if level, mask := ap.match("carol!~carol@carol.example", "", ""); level != 0 || mask != "" {
+		t.Errorf("matched %q with level %d", mask, level)
+	}
+}
+
+func TestWhoisCache(t *testing.T) {
+	ic := new_test_client(t)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+
+	const lookups = 3
+	done := make(chan bool, lookups)
+	for i := 0; i < lookups; i++ {
+		go func() {
+			u, ok := ic.LookupUser("bob")
+			done <- ok && u.Host == "bob.example"
+		}()
+	}
+	select {
+	case line := <-ic.conn.Output:
+		if line != "WHOIS bob" {
+			t.Fatalf("expected WHOIS, got %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no WHOIS sent")
+	}
+	// wait until all lookups are queued
+	for {
+		cs.Lock()
+		n := len(cs.whois["bob"])
+		cs.Unlock()
+		if n == lookups {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cs.ProcessLine(ParseServerLine(":server 311 testbot bob ~bob bob.example * :Bob Mett"))
+	cs.ProcessLine(ParseServerLine(":server 318 testbot bob :End of /WHOIS list"))
+	for i := 0; i < lookups; i++ {
+		if !<-done {
+			t.Error("wrong lookup result")
+		}
+	}
+	select {
+	case line := <-ic.conn.Output:
+		t.Errorf("unexpected line %q", line)
+	default:
+	}
+
+	// cached
+	if u, ok := ic.LookupUser("Bob"); !ok || u.Host != "bob.example" {
+		t.Errorf("wrong cached info for bob: %#v", u)
+	}
+	select {
+	case line := <-ic.conn.Output:
+		t.Errorf("unexpected line %q", line)
+	default:
+	}
+
+	// a nick change invalidates the entry
+	cs.ProcessLine(ParseServerLine(":bob!~bob@bob.example NICK bobby"))
+	ic.SetIntOption("Server", "whoisttl", 0)
+	go ic.LookupUser("bob")
+	select {
+	case line := <-ic.conn.Output:
+		if line != "WHOIS bob" {
+			t.Errorf("expected WHOIS, got %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Error("no WHOIS sent after nick change")
+	}
+	cs.ProcessLine(ParseServerLine(":server 401 testbot bob :No such nick/channel"))
+}
+
+func TestMessageTags(t *testing.T) {
+	m := ParseServerLine(`@time=2011-10-19T16:40:51.620Z;msgid=a\sb\:c;+draft/flag :nick!~user@host PRIVMSG #mett :hi there`)
+	if m == nil || m.Source != "nick!~user@host" || m.Command != "PRIVMSG" || m.Target != "#mett" || len(m.Args) != 1 || m.Args[0] != "hi there" {
+		t.Fatalf("wrong parse result: %#v", m)
+	}
+	if m.Tags["msgid"] != "a b;c" || m.Tags["+draft/flag"] != "" {
+		t.Errorf("wrong tags: %#v", m.Tags)
+	}
+	if ts := m.Timestamp(); !ts.Equal(time.Date(2011, 10, 19, 16, 40, 51, 620000000, time.UTC)) {
+		t.Errorf("wrong server time %v", ts)
+	}
+
+	if _, ok := m.Account(); ok {
+		t.Error("account without account tag")
+	}
+
+	for tags, want := range map[string]string{
+		`v=a\\b`:   `a\b`,
+		`v=a\r\nb`: "a\r\nb",
+		`v=a\b`:    "ab", // unknown escape
+		`v=ab\`:    "ab", // trailing backslash
+		`v=1;v=2`:  "2",
+		`v=`:       "",
+		`x;v=a=b`:  "a=b",
+		`v=\:\s\:`: "; ;",
+	} {
+		m := ParseServerLine("@" + tags + " :server NOTICE * :hi")
+		if m == nil || m.Tags["v"] != want {
+			t.Errorf("tags %s parsed to %#v, want v=%q", tags, m, want)
+		}
+	}
+
+	m = ParseServerLine("@account=alice;time=x :alice!~alice@host PRIVMSG #mett :hi")
+	if account, ok := m.Account(); !ok || account != "alice" {
+		t.Errorf("wrong account %q", account)
+	}
+	before := time.Now()
+	m = ParseServerLine(":nick!~user@host PRIVMSG #mett :hi")
+	if m.Tags != nil {
+		t.Errorf("untagged line has tags: %#v", m.Tags)
+	}
+	if ts := m.Timestamp(); ts.Before(before) || ts.After(time.Now()) {
+		t.Errorf("receive time %v not set while parsing", ts)
+	}
+}
+
+func TestStripFormatting(t *testing.T) {
+	for in, out := range map[string]string{
+		"plain":                         "plain",
+		"\x02bold\x02 \x1fund\x0f":      "bold und",
+		"\x034red\x03 \x0304,12on blue": "red on blue",
+		"\x03123":                       "3", // at most two digits
+		"\x034,":                        ",", // comma without background
+		"\x034,x":                       ",x",
+		"\x03,12x":                      ",12x", // no foreground, no background
+		"\x04FF00aa,000000hex\x04":      "hex",
+		"\x04FF0":                       "", // truncated
+		"cut\x03":                       "cut",
+		"cut\x0312,":                    "cut,",
+	} {
+		if s := StripFormatting(in); s != out {
+			t.Errorf("StripFormatting(%q) = %q, want %q", in, s, out)
+		}
+	}
+	m := ParseServerLine(":nick!~user@host PRIVMSG #mett :\x02s/a/b/")
+	if p := m.PlainText(); p[0] != "s/a/b/" || m.Args[0] != "\x02s/a/b/" {
+		t.Errorf("wrong plain text %q of %q", p, m.Args)
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for got, want := range map[string]string{
+		Bold("b") + Italic("i") + Underline("u"):   "\x02b\x02\x1di\x1d\x1fu\x1f",
+		Strikethrough("s") + Monospace("m"):        "\x1es\x1e\x11m\x11",
+		Colored(ColorRed, "5 apples"):              "\x03045 apples\x03",
+		Colored(ColorRed, ",x"):                    "\x0304\x02\x02,x\x03",
+		ColoredBg(ColorLightGrey, ColorBlack, ","): "\x0315,01,\x03",
+	} {
+		if got != want {
+			t.Errorf("formatted %q, want %q", got, want)
+		}
+		if plain := StripFormatting(got); strings.ContainsAny(plain, "\x02\x03") || plain == "" {
+			t.Errorf("%q stripped to %q", got, plain)
+		}
+	}
+
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	ic.SetStringOption("Server", "stripformatting", "true")
+	ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG #chan :\x02.echo\x02 \x0304red")
+	select {
+	case c := <-rec.commands:
+		if len(c.Args) != 1 || c.Args[0] != "red" {
+			t.Errorf("arguments %q", c.Args)
+		}
+	case <-time.After(time.Second):
+		t.Error("formatted command was not dispatched")
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	defer SetLogLevel(LogLevel())
+
+	level, err := ParseLogLevel("WARN")
+	if err != nil || level != LogWarn {
+		t.Fatalf("parsed level %d, %v", level, err)
+	}
+	SetLogLevel(level)
+	logInfof("hidden")
+	logWarnf("shown")
+	if out := buf.String(); strings.Contains(out, "hidden") || !strings.Contains(out, "WARN: shown") {
+		t.Errorf("wrong log output %q", out)
+	}
+	if _, err := ParseLogLevel("verbose"); err == nil {
+		t.Error("invalid level accepted")
+	}
+
+	for line, redacted := range map[string]string{
+		"PASS secret":                                               "PASS ***",
+		"OPER bot secret":                                           "OPER bot ***",
+		"JOIN #a,#b secret":                                         "JOIN #a,#b ***",
+		"PRIVMSG NickServ :IDENTIFY secret":                         "PRIVMSG NickServ :IDENTIFY ***",
+		"PRIVMSG Q@CServe.quakenet.org :AUTH bot secret":            "PRIVMSG Q@CServe.quakenet.org :AUTH ***",
+		"PRIVMSG #mett :IDENTIFY secret":                            "PRIVMSG #mett :IDENTIFY secret",
+		":alice!a@host PRIVMSG testbot :IDENTIFY secret":            ":alice!a@host PRIVMSG testbot :IDENTIFY ***",
+		"@time=x :alice!a@host PRIVMSG testbot :AUTH a b":           "@time=x :alice!a@host PRIVMSG testbot :AUTH ***",
+		":alice!a@host PRIVMSG #mett :IDENTIFY secret":              ":alice!a@host PRIVMSG #mett :IDENTIFY secret",
+		":alice!a@host PRIVMSG #mett :!set Server sasl_pass secret": ":alice!a@host PRIVMSG #mett :!set Server sasl_pass ***",
+		":alice!a@host PRIVMSG #mett :testbot: SET Auth token a b":  ":alice!a@host PRIVMSG #mett :testbot: SET Auth token ***",
+		":alice!a@host PRIVMSG testbot :set Server nick mett":       ":alice!a@host PRIVMSG testbot :set Server nick mett",
+		"PRIVMSG #mett :!set Server proxy socks5://u:p@h":           "PRIVMSG #mett :!set Server proxy ***",
+	} {
+		if r := redactLine(line); r != redacted {
+			t.Errorf("redactLine(%q) = %q, want %q", line, r, redacted)
+		}
+	}
+}
+
+func TestCapNegotiation(t *testing.T) {
+	ic := new_test_client(t)
+	cn := new(capNegotiation)
+	expect := func(want string) {
+		select {
+		case line := <-ic.conn.Output:
+			if line != want {
+				t.Errorf("sent %q, want %q", line, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q not sent", want)
+		}
+	}
+	cn.process(ic, ParseServerLine(":server CAP * LS * :multi-prefix sasl=PLAIN,EXTERNAL"))
+	cn.process(ic, ParseServerLine(":server CAP * LS :server-time away-notify"))
+	expect("CAP REQ :server-time")
+	cn.process(ic, ParseServerLine(":server CAP * ACK :server-time"))
+	expect("CAP END")
+	if !ic.HasCap("server-time") || ic.HasCap("multi-prefix") {
+		t.Error("wrong capabilities negotiated")
+	}
+
+	ic = new_test_client(t)
+	cn = new(capNegotiation)
+	cn.process(ic, ParseServerLine(":server CAP * LS :multi-prefix"))
+	expect("CAP END")
+}
+
+func TestCapNotify(t *testing.T) {
+	ic := new_test_client(t)
+	ic.capNeg = new(capNegotiation)
+	expect := func(want string) {
+		select {
+		case line := <-ic.conn.Output:
+			if line != want {
+				t.Errorf("sent %q, want %q", line, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("%q not sent", want)
+		}
+	}
+	events := make(chan []string, 1)
+	ic.Subscribe("cap_new", func(data interface{}) { events <- data.([]string) })
+	ic.Subscribe("cap_del", func(data interface{}) { events <- data.([]string) })
+	expectEvent := func(want string) {
+		select {
+		case caps := <-events:
+			if strings.Join(caps, " ") != want {
+				t.Errorf("event for %v, want %s", caps, want)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("no event for %s", want)
+		}
+	}
+
+	ic.RequestCapability("sasl")
+	ic.dispatchHandlers(":server CAP * LS :cap-notify server-time")
+	expect("CAP REQ :cap-notify server-time")
+	ic.dispatchHandlers(":server CAP * ACK :cap-notify server-time")
+	expect("CAP END")
+
+	// sasl shows up after registration and is requested
+	ic.dispatchHandlers(":server CAP testbot NEW :sasl=PLAIN away-notify")
+	expect("CAP REQ :sasl")
+	expectEvent("sasl away-notify")
+	ic.dispatchHandlers(":server CAP testbot ACK :sasl")
+	if !ic.HasCap("sasl") {
+		t.Error("sasl not enabled after ACK")
+	}
+
+	ic.dispatchHandlers(":server CAP testbot DEL :sasl")
+	expectEvent("sasl")
+	if ic.HasCap("sasl") {
+		t.Error("sasl still enabled after DEL")
+	}
+
+	// wanted after registration and available: requested right away
+	ic.RequestCapability("away-notify")
+	expect("CAP REQ :away-notify")
+	select {
+	case line := <-ic.conn.Output:
+		t.Errorf("unexpected line %q", line)
+	default:
+	}
+}
+
+func TestCapHandler(t *testing.T) {
+	ic := new_test_client(t)
+	ic.capNeg = new(capNegotiation)
+	var done func()
+	ic.HandleCapability("sasl", func(d func()) {
+		ic.SendLine("AUTHENTICATE PLAIN")
+		done = d
+	})
+	ic.dispatchHandlers(":server CAP * LS :sasl=PLAIN")
+	if line := <-ic.conn.Output; line != "CAP REQ :sasl" {
+		t.Fatalf("sent %q, want CAP REQ", line)
+	}
+	ic.dispatchHandlers(":server CAP * ACK :sasl")
+	if line := <-ic.conn.Output; line != "AUTHENTICATE PLAIN" {
+		t.Fatalf("sent %q, want AUTHENTICATE", line)
+	}
+	select {
+	case line := <-ic.conn.Output:
+		t.Fatalf("sent %q before the handler is done", line)
+	default:
+	}
+	done()
+	done()
+	if line := <-ic.conn.Output; line != "CAP END" {
+		t.Errorf("sent %q, want CAP END", line)
+	}
+	select {
+	case line := <-ic.conn.Output:
+		t.Errorf("unexpected line %q", line)
+	default:
+	}
+}
+
+func TestSendPolicy(t *testing.T) {
+	ic := new_test_client(t)
+	ic.conn.Output = make(chan string, 2)
+	ic.SetStringOption("Server", "sendpolicy", "drop")
+	for i := 0; i < 2; i++ {
+		if err := ic.SendLine("PRIVMSG #mett :hi"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := ic.OutboundQueueLen(); n != 2 {
+		t.Errorf("queue length is %d, want 2", n)
+	}
+	if err := ic.SendLine("PRIVMSG #mett :dropped"); err != ErrSendQueueFull {
+		t.Errorf("got error %v when sending to a full queue", err)
+	}
+
+	ic.SetStringOption("Server", "sendpolicy", "block")
+	sent := make(chan bool)
+	go func() {
+		ic.SendLine("PRIVMSG #mett :blocked")
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("SendLine didn't block on a full queue")
+	case <-time.After(50 * time.Millisecond):
+	}
+	<-ic.conn.Output
+	select {
+	case <-sent:
+	case <-time.After(time.Second):
+		t.Error("SendLine still blocked after the queue drained")
+	}
+}
+
+func TestSqliteAuthStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dbfile := dir + "/auth.db"
+
+	ic := new_test_client(t)
+	ic.SetAccessLevel(`admin!.*`, 500)
+	store, err := newSqliteAuthStore(dbfile, &configAuthStore{ic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ic.SetAuthStore(store)
+	if l := ic.GetAccessLevel("admin!~admin@localhost", ""); l != 500 {
+		t.Errorf("migrated mask has level %d, want 500", l)
+	}
+	ic.SetAccessLevel(`user!.*`, 100)
+	if err := ic.DelAccessLevel(`admin!.*`); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	ic.SetIntOption("Auth", `ignored!.*`, 100) // not migrated again
+
+	store, err = newSqliteAuthStore(dbfile, &configAuthStore{ic})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	entries, err := store.Entries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[`user!.*`] != 100 {
+		t.Errorf("wrong entries after reopening: %v", entries)
+	}
+}
+
+func TestStorage(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ic := new_test_client(t)
+	ic.SetStringOption("Storage", "file", dir+"/storage.db")
+	quotes, err := ic.Storage("quotes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	counters, _ := ic.Storage("counters")
+	quotes.Put("1", "<mett> hi")
+	quotes.Put("2", "<mett> bye")
+	counters.Put("1", "42")
+	if v, ok, err := quotes.Get("1"); err != nil || !ok || v != "<mett> hi" {
+		t.Errorf("Get(1) = %q, %v, %v", v, ok, err)
+	}
+	if err := quotes.Delete("2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, _ := quotes.Get("2"); ok {
+		t.Error("deleted key still there")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := counters.Update("hits", func(value string, ok bool) (string, bool) {
+				n, _ := strconv.Atoi(value)
+				return strconv.Itoa(n + 1), true
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the data survives reopening, each namespace has its own keys
+	ic.closeStorage()
+	counters, err = ic.Storage("counters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make(map[string]string)
+	counters.Iterate(func(key, value string) bool {
+		entries[key] = value
+		return true
+	})
+	if len(entries) != 2 || entries["1"] != "42" || entries["hits"] != "20" {
+		t.Errorf("unexpected entries: %v", entries)
+	}
+	ic.closeStorage()
+}
+
+func TestCronSpec(t *testing.T) {
+	// a Monday
+	now := time.Date(2021, 3, 1, 10, 7, 30, 0, time.UTC)
+	for spec, want := range map[string]time.Time{
+		"* * * * *":          time.Date(2021, 3, 1, 10, 8, 0, 0, time.UTC),
+		"*/15 * * * *":       time.Date(2021, 3, 1, 10, 15, 0, 0, time.UTC),
+		"0 18 * * *":         time.Date(2021, 3, 1, 18, 0, 0, 0, time.UTC),
+		"30 9 * * 1-5":       time.Date(2021, 3, 2, 9, 30, 0, 0, time.UTC),
+		"0 0 * * 7":          time.Date(2021, 3, 7, 0, 0, 0, 0, time.UTC),
+		"0 12 15 * 3":        time.Date(2021, 3, 3, 12, 0, 0, 0, time.UTC), // day of month or week
+		"@monthly":           time.Date(2021, 4, 1, 0, 0, 0, 0, time.UTC),
+		"0 0 29 2 *":         time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC),
+		"5,10-20/5 10 1 3 *": time.Date(2021, 3, 1, 10, 10, 0, 0, time.UTC),
+	} {
+		s, err := parseCron(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+			continue
+		}
+		if next, ok := s.next(now); !ok || !next.Equal(want) {
+			t.Errorf("%q: next is %v, want %v", spec, next, want)
+		}
+	}
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 0 * *", "*/0 * * * *", "a * * * *"} {
+		if _, err := parseCron(spec); err == nil {
+			t.Errorf("%q accepted", spec)
+		}
+	}
+	if s, _ := parseCron("0 0 31 2 *"); s != nil {
+		if _, ok := s.next(now); ok {
+			t.Error("February 31st found")
+		}
+	}
+}
+
+func TestSchedule(t *testing.T) {
+	ic := new_test_client(t)
+	fired := make(chan string, 10)
+	ic.After(10*time.Millisecond, func() { fired <- "after" })
+	cancel := ic.After(10*time.Millisecond, func() { fired <- "cancelled" })
+	cancel()
+	if _, err := ic.Schedule("@every 5ms", func() { fired <- "every" }); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ic.Schedule("@every -1s", func() {}); err == nil {
+		t.Error("negative interval accepted")
+	}
+
+	got := make(map[string]int)
+	timeout := time.After(time.Second)
+	for got["after"] == 0 || got["every"] < 2 {
+		select {
+		case s := <-fired:
+			got[s]++
+		case <-timeout:
+			t.Fatalf("jobs didn't run: %v", got)
+		}
+	}
+	if got["cancelled"] > 0 || got["after"] > 1 {
+		t.Errorf("unexpected runs: %v", got)
+	}
+
+	ic.Shutdown()
+	time.Sleep(20 * time.Millisecond)
+	for len(fired) > 0 {
+		<-fired
+	}
+	select {
+	case s := <-fired:
+		t.Errorf("%s ran after Shutdown()", s)
+	case <-time.After(30 * time.Millisecond):
+	}
+}
+
+func TestCanonChannel(t *testing.T) {
+	ic := new_test_client(t)
+	is := ic.GetPlugin("isupport").(*isupportPlugin)
+	for _, c := range []struct {
+		mapping, name, canon string
+	}{
+		{"", "#Team[A]~", "#team{a}^"},
+		{"rfc1459", "#Team\\", "#team|"},
+		{"strict-rfc1459", "#Team[~]", "#team{~}"},
+		{"ascii", "#Team[~]", "#team[~]"},
+	} {
+		is.ProcessLine(ParseServerLine(":server 005 testbot CASEMAPPING=" + c.mapping + " :are supported"))
+		if canon := ic.CanonChannel(c.name); canon != c.canon {
+			t.Errorf("%s: canonical form of %s is %s, want %s", c.mapping, c.name, canon, c.canon)
+		}
+	}
+}
+
+func TestIsChannelName(t *testing.T) {
+	ic := new_test_client(t)
+	for name, want := range map[string]bool{
+		"#mett": true, "&local": true, "!abcde": false, "mett": false, "": false, "#a b": false, "#a,#b": false, "#a\x07": false,
+	} {
+		if ic.IsChannelName(name) != want {
+			t.Errorf("IsChannelName(%q) != %v", name, want)
+		}
+	}
+	is := ic.GetPlugin("isupport").(*isupportPlugin)
+	is.ProcessLine(ParseServerLine(":server 005 testbot CHANTYPES=#! :are supported"))
+	if ic.IsChannelName("&local") || !ic.IsChannelName("!abcde") {
+		t.Error("CHANTYPES not respected")
+	}
+}
+
+func TestServerInfo(t *testing.T) {
+	ic := new_test_client(t)
+	info := ic.ServerInfo()
+	if info.CaseMapping != "rfc1459" || info.Prefixes != "~&@%+" || info.ChanTypes != "#&" || info.ChanModes[0] != "beI" || info.NickLen != 0 {
+		t.Errorf("unexpected defaults: %#v", info)
+	}
+
+	is := ic.GetPlugin("isupport").(*isupportPlugin)
+	is.ProcessLine(ParseServerLine(":server 005 testbot NETWORK=Mett CASEMAPPING=ascii PREFIX=(ov)@+ CHANMODES=b,k,lf,mnt NICKLEN=15 :are supported"))
+	info = ic.ServerInfo()
+	if info.Network != "Mett" || info.CaseMapping != "ascii" || info.PrefixModes != "ov" || info.Prefixes != "@+" {
+		t.Errorf("tokens not parsed: %#v", info)
+	}
+	if info.ChanModes != [4]string{"b", "k", "lf", "mnt"} || info.NickLen != 15 || info.Tokens["NICKLEN"] != "15" {
+		t.Errorf("tokens not parsed: %#v", info)
+	}
+	if ic.CanonNick("[Mett]") != "[mett]" {
+		t.Errorf("CASEMAPPING=ascii not respected: %q", ic.CanonNick("[Mett]"))
+	}
+
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	if cs.prefixMode('@') != 'o' || cs.prefixMode('%') != 0 {
+		t.Error("PREFIX not respected")
+	}
+	if cs.modeType('f') != 'C' || cs.modeType('h') != 'D' {
+		t.Error("CHANMODES not respected")
+	}
+}
+
 //
 //func main() {
 //	fmt.Println("== ircmsg::ParseServerLine() ==")
@@ -62,3 +1571,1981 @@ func TestParseServerLine(t *testing.T) {
 //	ret := ircclient.ParseCommand(msg, '!')
 //	fmt.Printf("%#v", ret.Args)
 //}
+
+func TestMetrics(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :.echo hello")
+	<-rec.commands
+
+	m := ic.Metrics()
+	karma, err := m.NewCounter("karma_changes_total", "Karma \"changes\".", "direction")
+	if err != nil {
+		t.Fatal(err)
+	}
+	karma.Inc("up")
+	karma.Add(2, "up")
+	karma.Inc("down")
+	// registering again returns the same counter
+	if again, err := m.NewCounter("karma_changes_total", "", "direction"); err != nil {
+		t.Error(err)
+	} else {
+		again.Inc("down")
+	}
+	if _, err := m.NewGauge("karma_changes_total", ""); err == nil {
+		t.Error("registered a gauge with the name of a counter")
+	}
+	if _, err := m.NewCounter("bad-name", ""); err == nil {
+		t.Error("registered a metric with an invalid name")
+	}
+	users, _ := m.NewGauge("users", "Users.", "channel")
+	users.Set(5, `#a"b`)
+	users.Add(-1, `#a"b`)
+	h, _ := m.NewHistogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(3)
+
+	var buf bytes.Buffer
+	if err := m.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, want := range []string{
+		"# HELP karma_changes_total Karma \"changes\".\n# TYPE karma_changes_total counter\n" +
+			"karma_changes_total{direction=\"down\"} 2\nkarma_changes_total{direction=\"up\"} 3\n",
+		"users{channel=\"#a\\\"b\"} 4\n",
+		"latency_seconds_bucket{le=\"0.1\"} 1\nlatency_seconds_bucket{le=\"1\"} 2\nlatency_seconds_bucket{le=\"+Inf\"} 3\nlatency_seconds_sum 3.55\nlatency_seconds_count 3\n",
+		"mettbot_lines_received_total 1\n",
+		"mettbot_commands_total{plugin=\"recorder\",command=\"echo\"} 1\n",
+		"mettbot_handler_duration_seconds_count{plugin=\"recorder\",kind=\"command\"} 1\n",
+		"mettbot_send_queue_length 0\n",
+	} {
+		if !strings.Contains(out, want) {
+			t.Errorf("metrics don't contain %q:\n%s", want, out)
+		}
+	}
+}
+
+func TestRecentLines(t *testing.T) {
+	ic := new_test_client(t)
+	for i := 0; i < raw_log_size+10; i++ {
+		ic.dispatchHandlers(":someone!~someone@localhost PRIVMSG #chan :" + strconv.Itoa(i))
+	}
+	ic.rawLog.add(false, ":alice!a@host PRIVMSG #chan :!set Server pass secret")
+	ic.rawLog.add(true, "PRIVMSG NickServ :IDENTIFY secret")
+	lines := ic.RecentLines()
+	if len(lines) != raw_log_size {
+		t.Fatalf("got %d lines, want %d", len(lines), raw_log_size)
+	}
+	if lines[0].Line != ":someone!~someone@localhost PRIVMSG #chan :12" || lines[0].Sent {
+		t.Errorf("oldest line is %#v", lines[0])
+	}
+	if last := lines[len(lines)-1]; !last.Sent || strings.Contains(last.Line, "secret") {
+		t.Errorf("newest line is %#v", last)
+	}
+	if received := lines[len(lines)-2]; received.Sent || strings.Contains(received.Line, "secret") {
+		t.Errorf("received line is %#v", received)
+	}
+}
+
+// Plugin whose command handler blocks until release is closed
+type slowCommand struct {
+	started chan *IRCCommand
+	release chan bool
+}
+
+func (p *slowCommand) Register(cl *IRCClient) {
+	cl.RegisterCommandHandler("slow", 0, 0, p)
+}
+func (p *slowCommand) String() string              { return "slow" }
+func (p *slowCommand) Info() string                { return "" }
+func (p *slowCommand) Usage(cmd string) string     { return "" }
+func (p *slowCommand) ProcessLine(msg *IRCMessage) {}
+func (p *slowCommand) Unregister()                 {}
+func (p *slowCommand) ProcessCommand(cmd *IRCCommand) {
+	p.started <- cmd
+	<-p.release
+}
+
+func TestGracefulDisconnect(t *testing.T) {
+	srv := NewMockServer()
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, srv.Conn())
+	slow := &slowCommand{make(chan *IRCCommand, 2), make(chan bool)}
+	ic.RegisterPlugin(slow)
+
+	srv.Send(":server 001 testbot :Welcome")
+	if err := ic.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- ic.InputLoop() }()
+
+	srv.Send(":alice!~alice@alice.example PRIVMSG #x :.slow")
+	select {
+	case <-slow.started:
+	case <-time.After(time.Second):
+		t.Fatal("command not dispatched")
+	}
+
+	go ic.GracefulDisconnect("bye")
+	if _, ok := srv.Expect("QUIT ", 200*time.Millisecond); ok {
+		t.Error("QUIT sent while a command handler was running")
+	}
+	srv.Send(":alice!~alice@alice.example PRIVMSG #x :.slow")
+	time.Sleep(50 * time.Millisecond)
+	close(slow.release)
+	if _, ok := srv.Expect("QUIT :bye", time.Second); !ok {
+		t.Error("QUIT not sent after the command handler returned")
+	}
+	select {
+	case <-slow.started:
+		t.Error("command dispatched while shutting down")
+	default:
+	}
+	select {
+	case err := <-done:
+		if err != ErrQuit {
+			t.Errorf("InputLoop() returned %v, want ErrQuit", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("InputLoop() didn't return after disconnecting")
+	}
+}
+
+func TestRestoreState(t *testing.T) {
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, NewMockServer().Conn())
+	ic.SetStringOption("Server", "nick", "oldbot")
+	ic.SetStringOption("Test", "unsaved", "yes")
+	ic.caps = map[string]bool{"server-time": true}
+	ic.server, ic.serverIndex = "irc.example.com:6667", 1
+
+	st := ic.handoverState()
+	if st.Nick != "oldbot" || len(st.Caps) != 1 || st.Config["Test"]["unsaved"] != "yes" {
+		t.Errorf("unexpected state %+v", st)
+	}
+	// as if we had joined some channels
+	st.Nick = "newbot"
+	st.Channels = []string{"#x", "#y"}
+	st.ISupport["CHANTYPES"] = "#&"
+	file, err := writeHandover(st)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config2 := write_test_config(t)
+	defer os.Remove(config2)
+	ic2 := NewIRCClientWithConn(config2, NewMockServer().Conn())
+	if err := ic2.RestoreState(file); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("handover file not removed")
+	}
+	if nick := ic2.GetStringOption("Server", "nick"); nick != "newbot" {
+		t.Errorf("nick is %q, want newbot", nick)
+	}
+	if v := ic2.GetStringOption("Test", "unsaved"); v != "yes" {
+		t.Errorf("Test/unsaved is %q after restoring", v)
+	}
+	if !ic2.HasCap("server-time") {
+		t.Error("capability not restored")
+	}
+	if v, _ := ic2.GetISupport("CHANTYPES"); v != "#&" {
+		t.Errorf("CHANTYPES is %q after restoring", v)
+	}
+	if ch := ic2.JoinedChannels(); len(ch) != 2 || ch[0] != "#x" || ch[1] != "#y" {
+		t.Errorf("joined channels are %v after restoring", ch)
+	}
+	if s := ic2.GetStatus(); s.Server != "irc.example.com:6667" || ic2.serverIndex != 1 {
+		t.Errorf("server is %q (%d) after restoring", s.Server, ic2.serverIndex)
+	}
+	ic2.Shutdown()
+	ic.Shutdown()
+}
+
+// Plugin whose handlers panic
+type panicPlugin struct {
+	commandRecorder
+}
+
+func (p *panicPlugin) String() string { return "panic" }
+func (p *panicPlugin) Register(cl *IRCClient) {
+	cl.RegisterCommandHandler("boom", 0, 0, p)
+}
+func (p *panicPlugin) ProcessCommand(cmd *IRCCommand) {
+	panic("boom")
+}
+
+func TestPluginPanic(t *testing.T) {
+	srv := NewMockServer()
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, srv.Conn())
+	ic.SetIntOption("Server", "floodrate", 0)
+	ic.SetIntOption("Server", "maxpanics", 2)
+	ic.SetStringOption("Server", "adminchannel", "#admins")
+	ic.RegisterPlugin(new(panicPlugin))
+
+	srv.Send(":server 001 testbot :Welcome")
+	if err := ic.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	go ic.InputLoop()
+
+	srv.Send(":alice!~alice@alice.example PRIVMSG #x :.boom")
+	if _, ok := srv.Expect("PRIVMSG #admins :panic in plugin panic in ProcessCommand: boom", time.Second); !ok {
+		t.Error("panic not reported")
+	}
+	if _, ok := srv.Expect("NOTICE #x :Sorry, something went wrong.", time.Second); !ok {
+		t.Error("user not told about the failure")
+	}
+	if ic.PluginDisabled("panic") {
+		t.Error("plugin disabled after the first panic")
+	}
+
+	srv.Send(":alice!~alice@alice.example PRIVMSG #x :.boom")
+	if _, ok := srv.Expect("PRIVMSG #admins :plugin panic disabled after 2 panics", time.Second); !ok {
+		t.Error("disabling not reported")
+	}
+	if !ic.PluginDisabled("panic") {
+		t.Error("plugin still enabled after 2 panics")
+	}
+	if n := ic.PanicCount("panic"); n != 2 {
+		t.Errorf("got %d panics, want 2", n)
+	}
+	ic.Disconnect("bye")
+}
+
+// Plugin reporting the lines it gets, the first one only after release is
+// closed
+type lineRecorder struct {
+	commandRecorder
+	lines   chan string
+	release chan bool
+	first   bool
+}
+
+func (r *lineRecorder) String() string         { return "lines" }
+func (r *lineRecorder) Register(cl *IRCClient) {}
+func (r *lineRecorder) ProcessLine(msg *IRCMessage) {
+	if !r.first {
+		r.first = true
+		<-r.release
+	}
+	r.lines <- msg.Complete
+}
+
+func TestLineQueue(t *testing.T) {
+	ic := new_test_client(t)
+	ic.SetIntOption("Server", "linequeue", 3)
+	rec := &lineRecorder{lines: make(chan string, 10), release: make(chan bool)}
+	ic.RegisterPlugin(rec)
+
+	// the first line is being processed, three are queued, one is dropped
+	for i := 0; i < 5; i++ {
+		ic.dispatchHandlers(":server NOTICE testbot :" + strconv.Itoa(i))
+		if i == 0 {
+			time.Sleep(50 * time.Millisecond)
+		}
+	}
+	close(rec.release)
+	for i := 0; i < 4; i++ {
+		select {
+		case line := <-rec.lines:
+			if want := ":server NOTICE testbot :" + strconv.Itoa(i); line != want {
+				t.Errorf("got line %q, want %q", line, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("line %d not processed", i)
+		}
+	}
+	select {
+	case line := <-rec.lines:
+		t.Errorf("got line %q, which should have been dropped", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+	var buf bytes.Buffer
+	ic.Metrics().WriteText(&buf)
+	if !strings.Contains(buf.String(), `mettbot_lines_dropped_total{plugin="lines"} 1`) {
+		t.Errorf("dropped line not counted:\n%s", buf.String())
+	}
+	ic.UnregisterPlugin("lines")
+}
+
+func TestReplacePlugin(t *testing.T) {
+	ic := new_test_client(t)
+	old := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(old)
+	if err := ic.RegisterPlugin(&commandRecorder{make(chan *IRCCommand, 1)}); err == nil {
+		t.Error("plugin registered twice")
+	}
+	fresh := &commandRecorder{make(chan *IRCCommand, 1)}
+	if err := ic.ReplacePlugin(fresh); err != nil {
+		t.Fatal(err)
+	}
+	if ic.GetPlugin(fresh.String()) != fresh {
+		t.Error("plugin not replaced")
+	}
+	if h, ok := ic.lookupHandler("echo"); !ok || h.Handler != fresh {
+		t.Error("command not handled by the new plugin")
+	}
+	ic.UnregisterPlugin(fresh.String())
+	if _, ok := ic.lookupHandler("echo"); ok {
+		t.Error("command of the old plugin still handled")
+	}
+}
+
+// Registers and unregisters plugins while lines and commands are
+// dispatched, for the race detector
+func TestConcurrentRegistry(t *testing.T) {
+	ic := new_test_client(t)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			ic.dispatchHandlers(":alice!~alice@alice.example PRIVMSG #x :.echo hi")
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		p := &commandRecorder{make(chan *IRCCommand, 100)}
+		if i%2 == 0 {
+			ic.RegisterPlugin(p)
+		} else {
+			ic.ReplacePlugin(p)
+		}
+		ic.IterHandlers()
+		ic.UnregisterPlugin(p.String())
+	}
+	<-done
+}
+
+func TestDisablePlugin(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	lines := &lineRecorder{lines: make(chan string, 10), release: make(chan bool), first: true}
+	ic.RegisterPlugin(lines)
+
+	if err := ic.DisablePlugin("chanstate"); err == nil {
+		t.Error("core plugin disabled")
+	}
+	if err := ic.EnablePlugin("recorder"); err == nil {
+		t.Error("enabled plugin enabled again")
+	}
+	for _, name := range []string{"recorder", "lines"} {
+		if err := ic.DisablePlugin(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, ok := ic.lookupHandler("echo"); ok {
+		t.Error("command of disabled plugin still handled")
+	}
+	for h := range ic.IterHandlers() {
+		if h.Command == "echo" {
+			t.Error("handler of disabled plugin listed")
+		}
+	}
+	ic.dispatchHandlers(":server NOTICE testbot :disabled")
+	select {
+	case line := <-lines.lines:
+		t.Errorf("disabled plugin got line %q", line)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ic.EnablePlugin("recorder")
+	ic.EnablePlugin("lines")
+	if h, ok := ic.lookupHandler("echo"); !ok || h.Handler != rec {
+		t.Error("command not handled after enabling the plugin")
+	}
+	ic.dispatchHandlers(":server NOTICE testbot :enabled")
+	select {
+	case <-lines.lines:
+	case <-time.After(time.Second):
+		t.Error("enabled plugin got no line")
+	}
+}
+
+func TestJoinHolds(t *testing.T) {
+	ic := new_test_client(t)
+	ran := make(chan bool, 2)
+	ic.HoldJoins("auth")
+	ic.HoldJoins("hide")
+	ic.WhenJoinable(func() { ran <- true })
+	ic.ReleaseJoins("auth")
+	select {
+	case <-ran:
+		t.Fatal("ran before all holds were released")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ic.RemoveJoinHold("hide")
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("didn't run after all holds were released")
+	}
+
+	// closed again on a new connection
+	ic.stateLock.Lock()
+	ic.resetJoinHolds(false)
+	ic.stateLock.Unlock()
+	ic.WhenJoinable(func() { ran <- true })
+	select {
+	case <-ran:
+		t.Fatal("ran before the hold was released on the new connection")
+	case <-time.After(50 * time.Millisecond):
+	}
+	ic.ReleaseJoins("auth")
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("didn't run after the hold was released")
+	}
+}
+
+func TestAccountAccess(t *testing.T) {
+	ic := new_test_client(t)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	if err := ic.SetAccountAccess("Alice", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.SetAccountAccess("bad account", 300); err == nil {
+		t.Error("invalid account name accepted")
+	}
+
+	// unknown account
+	if l := ic.GetAccessLevel("alice!~alice@dyn-1.example", ""); l != 0 {
+		t.Errorf("access level %d without known account", l)
+	}
+	// from the account tag of the command
+	c := ParseCommand(ParseServerLine("@account=alice :alice!~alice@dyn-2.example PRIVMSG #mett :.echo"))
+	if c.Account != "alice" || ic.commandAccessLevel(c) != 300 {
+		t.Errorf("account %q has access level %d", c.Account, ic.commandAccessLevel(c))
+	}
+
+	// extended-join, account-notify and WHOIS
+	cs.ProcessLine(ParseServerLine(":testbot!~testbot@localhost JOIN #mett"))
+	cs.ProcessLine(ParseServerLine(":alice!~alice@dyn-3.example JOIN #mett alice :Alice"))
+	if l := ic.GetAccessLevel("alice!~alice@dyn-3.example", ""); l != 300 {
+		t.Errorf("access level %d after extended-join", l)
+	}
+	cs.ProcessLine(ParseServerLine(":alice!~alice@dyn-3.example ACCOUNT *"))
+	if l := ic.GetAccessLevel("alice!~alice@dyn-3.example", ""); l != 0 {
+		t.Errorf("access level %d after logout", l)
+	}
+	cs.ProcessLine(ParseServerLine(":alice!~alice@dyn-3.example ACCOUNT ALICE"))
+	if l := ic.GetAccessLevel("alice!~alice@dyn-3.example", ""); l != 300 {
+		t.Errorf("access level %d after login", l)
+	}
+	cs.ProcessLine(ParseServerLine(":server 311 testbot bob ~bob bob.example * :Bob"))
+	cs.ProcessLine(ParseServerLine(":server 330 testbot bob alice :is logged in as"))
+	ap := ic.GetPlugin("auth").(*authPlugin)
+	if level, mask := ap.match("bob!~bob@bob.example", ap.knownAccount("bob!~bob@bob.example"), ""); level != 300 || mask != "account/Alice" {
+		t.Errorf("matched %q with level %d after WHOIS", mask, level)
+	}
+	if err := ic.DelAccessLevel("account/Alice"); err != nil {
+		t.Fatal(err)
+	}
+	if l := ic.GetAccessLevel("alice!~alice@dyn-3.example", ""); l != 0 {
+		t.Errorf("access level %d after removing the entry", l)
+	}
+}
+
+func TestChannelAccess(t *testing.T) {
+	ic := new_test_client(t)
+	ic.SetAccessLevel(`alice!.*`, 100)
+	if err := ic.SetChannelAccessLevel(`alice!.*`, "#Foo", 300); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.SetChannelAccessLevel(`alice!.*`, "nochannel", 300); err == nil {
+		t.Error("entry for invalid channel accepted")
+	}
+	for channel, level := range map[string]int{"#foo": 300, "#bar": 100, "": 100, "testbot": 100} {
+		if l := ic.GetAccessLevel("alice!~alice@alice.example", channel); l != level {
+			t.Errorf("access level %d in %q, want %d", l, channel, level)
+		}
+	}
+	ap := ic.GetPlugin("auth").(*authPlugin)
+	if d := ap.describe("alice!~alice@alice.example", "", "#foo"); d != "alice!~alice@alice.example has access level 300 in #foo (granted by alice!.* in #Foo)" {
+		t.Errorf("wrong description %q", d)
+	}
+
+	c := ParseCommand(ParseServerLine(":alice!~alice@alice.example PRIVMSG #foo :.op"))
+	if l := ic.commandAccessLevel(c); l != 300 {
+		t.Errorf("command access level %d in #foo", l)
+	}
+	c = ParseCommand(ParseServerLine(":alice!~alice@alice.example PRIVMSG #bar :.op"))
+	if l := ic.commandAccessLevel(c); l != 100 {
+		t.Errorf("command access level %d in #bar", l)
+	}
+
+	if err := ic.DelChannelAccessLevel(`alice!.*`, "#Foo"); err != nil {
+		t.Fatal(err)
+	}
+	if l := ic.GetAccessLevel("alice!~alice@alice.example", "#foo"); l != 100 {
+		t.Errorf("access level %d in #foo after removing the entry", l)
+	}
+}
+
+func TestIgnore(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	if err := ic.Ignore(`troll!.*`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.Ignore("account/Spammer"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []string{"", "a b", "(", "account/", "account/a!b"} {
+		if err := ic.Ignore(bad); err == nil {
+			t.Errorf("invalid mask %q accepted", bad)
+		}
+	}
+	if got := ic.Ignored(); len(got) != 2 || got[0] != "account/Spammer" || got[1] != `troll!.*` {
+		t.Errorf("ignore list is %v", got)
+	}
+
+	ic.dispatchHandlers(":troll!~t@troll.example PRIVMSG #chan :.echo hi")
+	ic.dispatchHandlers("@account=spammer :bob!~bob@bob.example PRIVMSG #chan :.echo hi")
+	select {
+	case c := <-rec.commands:
+		t.Errorf("command of ignored user was dispatched: %#v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+	for line, want := range map[string]bool{
+		":troll!~t@troll.example NOTICE #chan :hi":         true,
+		":troll!~t@troll.example JOIN #chan":               false,
+		":atroll!~t@troll.example PRIVMSG #chan :hi":       false,
+		":server.example NOTICE * :troll!~t@troll.example": false,
+	} {
+		if got := ic.ignoredMessage(ParseServerLine(line)); got != want {
+			t.Errorf("%q ignored: %v, want %v", line, got, want)
+		}
+	}
+
+	if err := ic.Unignore(`troll!.*`); err != nil {
+		t.Fatal(err)
+	}
+	if err := ic.Unignore(`troll!.*`); err == nil {
+		t.Error("removed mask unignored again")
+	}
+	ic.dispatchHandlers(":troll!~t@troll.example PRIVMSG #chan :.echo hi")
+	select {
+	case <-rec.commands:
+	case <-time.After(time.Second):
+		t.Error("command was not dispatched after unignore")
+	}
+}
+
+func TestCooldown(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 10)}
+	ic.RegisterPlugin(rec)
+	ic.UnregisterCommandHandler("echo", rec)
+	opts := HandlerOpts{Cooldown: time.Minute, ChannelCooldown: time.Hour}
+	if err := ic.RegisterCommandHandlerOpts("echo", opts, rec); err != nil {
+		t.Fatal(err)
+	}
+	dispatched := func(line string) bool {
+		ic.dispatchHandlers(line)
+		select {
+		case <-rec.commands:
+			return true
+		case <-time.After(100 * time.Millisecond):
+			return false
+		}
+	}
+
+	if !dispatched(":alice!~alice@a.example PRIVMSG #chan :.echo") {
+		t.Error("first command was not dispatched")
+	}
+	// the same user with another nick, and another user in the same channel
+	if dispatched(":alice_!~alice@a.example PRIVMSG #other :.echo") {
+		t.Error("user cooldown ignored")
+	}
+	if dispatched(":bob!~bob@b.example PRIVMSG #CHAN :.echo") {
+		t.Error("channel cooldown ignored")
+	}
+	if !dispatched(":bob!~bob@b.example PRIVMSG testbot :.echo") {
+		t.Error("command of another user in query was not dispatched")
+	}
+
+	ic.cooldowns.Lock()
+	for key := range ic.cooldowns.until {
+		ic.cooldowns.until[key] = time.Now()
+	}
+	ic.cooldowns.Unlock()
+	if !dispatched(":alice!~alice@a.example PRIVMSG #chan :.echo") {
+		t.Error("command was not dispatched after the cooldown")
+	}
+}
+
+func TestAlias(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	ic.RegisterPlugin(new(usagePlugin))
+	if err := ic.RegisterAlias("e", "echo #y"); err != nil {
+		t.Fatal(err)
+	}
+	for alias, command := range map[string]string{"x": "e", "add": "echo", "a b": "echo", "y": " ", "z": "z"} {
+		if err := ic.RegisterAlias(alias, command); err == nil {
+			t.Errorf("alias %q for %q accepted", alias, command)
+		}
+	}
+
+	ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG #chan :.e hi")
+	select {
+	case c := <-rec.commands:
+		if c.Command != "echo" || len(c.Args) != 2 || c.Args[0] != "#y" || c.Args[1] != "hi" {
+			t.Errorf("alias resolved to %q %q", c.Command, c.Args)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("alias not dispatched")
+	}
+
+	ic.RegisterAlias("q", "add")
+	if usage := ic.GetUsage("q"); usage != ".add <quote>: adds a quote" {
+		t.Errorf("usage of alias is %q", usage)
+	}
+	if !ic.IsCommand("q") {
+		t.Error("alias is not a command")
+	}
+	if err := ic.UnregisterAlias("q"); err != nil {
+		t.Fatal(err)
+	}
+	if ic.IsCommand("q") || len(ic.Aliases()) != 1 {
+		t.Errorf("alias still there after unregistering: %v", ic.Aliases())
+	}
+}
+
+func TestParseArgs(t *testing.T) {
+	c := ParseCommand(ParseServerLine(`:a!b@c PRIVMSG #mett :.remind  --private --in=2d12h "call  \"mom\"" #mett  alice   now  please `))
+	a := c.ParseArgs()
+	if a.Len() != 5 || a.Arg(0) != `call  "mom"` || a.Arg(5) != "" {
+		t.Fatalf("arguments %q", a.Args)
+	}
+	if v, ok := a.Flag("private"); !ok || v != "" {
+		t.Errorf("flag private is %q, %v", v, ok)
+	}
+	if d, err := a.DurationFlag("in", 0); err != nil || d != 60*time.Hour {
+		t.Errorf("flag in is %v, %v", d, err)
+	}
+	if n, err := a.IntFlag("count", 3); err != nil || n != 3 {
+		t.Errorf("default of missing flag is %d, %v", n, err)
+	}
+	if ch, err := a.Channel(1); err != nil || ch != "#mett" {
+		t.Errorf("channel %q, %v", ch, err)
+	}
+	if nick, err := a.Nick(2); err != nil || nick != "alice" {
+		t.Errorf("nick %q, %v", nick, err)
+	}
+	if _, err := a.Channel(2); err == nil {
+		t.Error("nick accepted as channel")
+	}
+	if _, err := a.Int(3); err == nil {
+		t.Error("word accepted as number")
+	}
+	if _, err := a.Nick(7); err == nil {
+		t.Error("missing argument accepted")
+	}
+	if rest := a.Rest(3); rest != "now  please" {
+		t.Errorf("rest is %q", rest)
+	}
+
+	// unbalanced quotes are literal, "--" ends the flags
+	a = ParseCommand(ParseServerLine(`:a!b@c PRIVMSG #mett :.say 5" -- --long 1d`)).ParseArgs()
+	if a.Len() != 3 || a.Arg(0) != `5"` || a.Arg(1) != "--long" || len(a.Flags) != 0 {
+		t.Errorf("arguments %q, flags %v", a.Args, a.Flags)
+	}
+	if d, err := a.Duration(2); err != nil || d != 24*time.Hour {
+		t.Errorf("duration %v, %v", d, err)
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	for _, c := range []struct {
+		text string
+		max  int
+		want []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"", 10, []string{""}},
+		{"one two three four", 9, []string{"one two", "three", "four"}},
+		{"one  two\nthree", 8, []string{"one  two", "three"}},
+		{"abcdefghijkl mn", 5, []string{"abcde", "fghij", "kl mn"}},
+		{"grüße", 3, []string{"gr", "ü", "ße"}},
+	} {
+		got := splitMessage(c.text, c.max)
+		if len(got) != len(c.want) {
+			t.Errorf("%q split into %q, want %q", c.text, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%q split into %q, want %q", c.text, got, c.want)
+				break
+			}
+		}
+	}
+
+	srv := NewMockServer()
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, srv.Conn())
+	ic.SetIntOption("Server", "floodrate", 0)
+	srv.Send(":server 001 testbot :Welcome")
+	if err := ic.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if n := ic.ownPrefixLen(); n != len(":testbot!~testbot@ ")+max_host_length {
+		t.Errorf("prefix length is %d with unknown host", n)
+	}
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	cs.ProcessLine(ParseServerLine(":testbot!~bot@bot.example JOIN #mett"))
+	if n := ic.ownPrefixLen(); n != len(":testbot!~bot@bot.example ") {
+		t.Errorf("prefix length is %d", n)
+	}
+	long := strings.Repeat("word ", 199) + "end"
+	ic.Privmsg("#mett", long)
+	total := ""
+	for total != long {
+		line, ok := srv.Expect("PRIVMSG #mett :", time.Second)
+		if !ok {
+			t.Fatalf("got only %d bytes", len(total))
+		}
+		if n := len(":testbot!~bot@bot.example " + line); n > 510 {
+			t.Errorf("relayed line is %d bytes long", n)
+		}
+		if total != "" {
+			total += " "
+		}
+		total += strings.TrimPrefix(line, "PRIVMSG #mett :")
+	}
+}
+
+func TestTruncateLine(t *testing.T) {
+	ic := new_test_client(t)
+	cs := ic.GetPlugin("chanstate").(*chanStatePlugin)
+	cs.ProcessLine(ParseServerLine(":testbot!~bot@bot.example JOIN #mett"))
+	max := 510 - len(":testbot!~bot@bot.example ")
+
+	short := "PRIVMSG #mett :" + strings.Repeat("a", max-15)
+	if got := ic.truncateLine(short); got != short {
+		t.Errorf("line of %d bytes cut to %d", len(short), len(got))
+	}
+	// "ü" is two bytes, the cut must not split it
+	long := "PRIVMSG #mett :" + strings.Repeat("a", max-16) + "üü"
+	if got := ic.truncateLine(long); got != long[:max-1] {
+		t.Errorf("line cut to %q", got[len(got)-5:])
+	}
+	ic.SetStringOption("Server", "ellipsis", "…")
+	if got := ic.truncateLine(long); len(got) > max || !strings.HasSuffix(got, "a…") {
+		t.Errorf("line with ellipsis cut to %d bytes, ending in %q", len(got), got[len(got)-5:])
+	}
+}
+
+func TestCommandHelpers(t *testing.T) {
+	ic := new_test_client(t)
+	is := ic.GetPlugin("isupport").(*isupportPlugin)
+	is.ProcessLine(ParseServerLine(":server 005 testbot TOPICLEN=5 :are supported"))
+	for _, c := range []struct {
+		err  error
+		want string
+	}{
+		{ic.Action("#mett", "waves"), "PRIVMSG #mett :\x01ACTION waves\x01"},
+		{ic.Join("#mett", "secret"), "JOIN #mett secret"},
+		{ic.Part("#mett", "bye all"), "PART #mett :bye all"},
+		{ic.Kick("#mett", "troll", ""), "KICK #mett troll"},
+		{ic.Mode("#mett", "+ov", "alice", "bob"), "MODE #mett +ov alice bob"},
+		{ic.Topic("#mett", "grüße"), "TOPIC #mett :grü"},
+		{ic.Nick("mettbot"), "NICK mettbot"},
+		{ic.Whois("alice"), "WHOIS alice"},
+		{ic.Invite("alice", "#mett"), "INVITE alice #mett"},
+	} {
+		if c.err != nil {
+			t.Errorf("%q: %v", c.want, c.err)
+			continue
+		}
+		if line := <-ic.conn.Output; line != c.want {
+			t.Errorf("sent %q, want %q", line, c.want)
+		}
+	}
+	for _, err := range []error{
+		ic.Join("mett", ""),
+		ic.Join("#mett", "a b"),
+		ic.Kick("#mett", "troll :x", "reason"),
+		ic.Mode("#mett", "+b", ""),
+		ic.Nick("bad nick"),
+		ic.Privmsg("#mett\r\nQUIT", "hi"),
+		ic.Invite(":alice", "#mett"),
+	} {
+		if err == nil {
+			t.Error("invalid parameter accepted")
+		}
+	}
+	select {
+	case line := <-ic.conn.Output:
+		t.Errorf("sent %q with invalid parameters", line)
+	default:
+	}
+}
+
+func TestCTCP(t *testing.T) {
+	for line, want := range map[string]string{
+		":a!~a@a.example PRIVMSG #mett :\x01ACTION waves\x01":  "ACTION waves",
+		":a!~a@a.example PRIVMSG #mett :\x01version":           "VERSION ",
+		":a!~a@a.example NOTICE testbot :\x01PING 123 456\x01": "PING 123 456",
+		":a!~a@a.example PRIVMSG #mett :hello":                 "",
+		":a!~a@a.example PRIVMSG #mett :\x01\x01":              "",
+	} {
+		msg := ParseServerLine(line)
+		command, params, ok := msg.CTCP()
+		if got := command + " " + params; ok != (want != "") || ok && got != want {
+			t.Errorf("%q parsed as %q (%v)", line, got, ok)
+		}
+		if msg.IsAction() != strings.HasPrefix(want, "ACTION") {
+			t.Errorf("%q: IsAction() is %v", line, msg.IsAction())
+		}
+	}
+
+	ic := new_test_client(t)
+	ic.SetStringOption("CTCP", "time", "off")
+	ic.SetStringOption("CTCP", "finger", "no fingering")
+	events := make(chan *CTCPEvent, 1)
+	ic.Subscribe("CTCP", func(data interface{}) { events <- data.(*CTCPEvent) })
+	for _, c := range []struct{ request, command, want string }{
+		{"\x01VERSION\x01", "VERSION", "NOTICE alice :\x01VERSION MettBot\x01"},
+		{"\x01PING 12345\x01", "PING", "NOTICE alice :\x01PING 12345\x01"},
+		{"\x01CLIENTINFO\x01", "CLIENTINFO", "NOTICE alice :\x01CLIENTINFO ACTION CLIENTINFO FINGER PING VERSION\x01"},
+		{"\x01TIME\x01", "TIME", ""},
+		{"\x01SOURCE\x01", "SOURCE", ""},
+		{"\x01ACTION hugs\x01", "", ""},
+	} {
+		ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG testbot :" + c.request)
+		select {
+		case line := <-ic.conn.Output:
+			if line != c.want {
+				t.Errorf("answered %q with %q, want %q", c.request, line, c.want)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if c.want != "" {
+				t.Errorf("no answer to %q", c.request)
+			}
+		}
+		if c.command == "" {
+			continue
+		}
+		select {
+		case e := <-events:
+			if e.Nick != "alice" || !e.Private || e.Reply || e.Command != c.command {
+				t.Errorf("wrong event %+v for %q", e, c.request)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("no event for %q", c.request)
+		}
+	}
+
+	// Replies are rate limited, and replies are never answered
+	ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG testbot :\x01VERSION\x01")
+	ic.dispatchHandlers(":alice!~alice@a.example NOTICE testbot :\x01VERSION other\x01")
+	select {
+	case line := <-ic.conn.Output:
+		t.Errorf("sent %q", line)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if err := ic.SendCTCP("alice", "version", ""); err != nil {
+		t.Fatal(err)
+	}
+	if line := <-ic.conn.Output; line != "PRIVMSG alice :\x01VERSION\x01" {
+		t.Errorf("sent %q", line)
+	}
+	if ic.SendCTCPReply("alice", "PING", "") != nil || <-ic.conn.Output != "NOTICE alice :\x01PING\x01" {
+		t.Error("empty reply not sent")
+	}
+	if ic.SendCTCP("alice", "VERSION x", "") == nil || ic.SendCTCP("a b", "VERSION", "") == nil {
+		t.Error("invalid parameters accepted")
+	}
+}
+
+func TestDCC(t *testing.T) {
+	ic := new_test_client(t)
+	rec := &commandRecorder{make(chan *IRCCommand, 1)}
+	ic.RegisterPlugin(rec)
+	ic.SetAccessLevel(`alice!.*`, 400)
+	ic.SetStringOption("DCC", "ip", "127.0.0.1")
+	ic.SetStringOption("DCC", "timeout", "5")
+	offer := func() []string {
+		select {
+		case line := <-ic.conn.Output:
+			prefix := "PRIVMSG alice :\x01DCC "
+			if !strings.HasPrefix(line, prefix) {
+				t.Fatalf("sent %q instead of an offer", line)
+			}
+			return strings.Fields(strings.TrimSuffix(line[len(prefix):], "\x01"))
+		case <-time.After(time.Second):
+			t.Fatal("no offer sent")
+		}
+		return nil
+	}
+
+	// Active chat, commands are answered in the chat
+	ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG #mett :.dcc chat")
+	fields := offer()
+	if len(fields) != 4 || fields[0] != "CHAT" || fields[2] != "2130706433" {
+		t.Fatalf("wrong offer %q", fields)
+	}
+	conn, err := net.Dial("tcp", "127.0.0.1:"+fields[3])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bufio.NewReader(conn)
+	if greeting, _ := r.ReadString('\n'); !strings.HasPrefix(greeting, "Connected to testbot") {
+		t.Errorf("greeting %q", greeting)
+	}
+	conn.Write([]byte("echo hi there\r\n"))
+	select {
+	case c := <-rec.commands:
+		if c.Source != "alice!~alice@a.example" || strings.Join(c.Args, " ") != "hi there" {
+			t.Errorf("command %+v from chat", c)
+		}
+		ic.Reply(c, "pong")
+		if line, _ := r.ReadString('\n'); line != "pong\n" {
+			t.Errorf("reply %q in chat", line)
+		}
+	case <-time.After(time.Second):
+		t.Error("command from chat not dispatched")
+	}
+	conn.Close()
+
+	// Users below DCC/minaccess can't chat
+	ic.dispatchHandlers(":bob!~bob@b.example PRIVMSG testbot :\x01DCC CHAT chat 2130706433 1\x01")
+	if err := ic.OfferDCCChat("bob!~bob@b.example", ""); err == nil {
+		t.Error("chat offered to bob")
+	}
+
+	// Passive file transfer
+	f, err := ioutil.TempFile("", "dcc test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	data := strings.Repeat("log line\n", 1000)
+	f.WriteString(data)
+	f.Close()
+	ic.SetStringOption("DCC", "passive", "true")
+	if err := ic.SendFile("alice", f.Name()); err != nil {
+		t.Fatal(err)
+	}
+	fields = offer()
+	if len(fields) != 6 || fields[0] != "SEND" || strings.Contains(fields[1], " ") || fields[3] != "0" || fields[4] != strconv.Itoa(len(data)) {
+		t.Fatalf("wrong offer %q", fields)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	port := strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+	// a wrong token is refused
+	ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG testbot :\x01DCC SEND " + fields[1] + " 2130706433 " + port + " " + fields[4] + " 00000000\x01")
+	ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG testbot :\x01DCC SEND " + fields[1] + " 2130706433 " + port + " " + fields[4] + " " + fields[5] + "\x01")
+	conn, err = l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil || string(got) != data {
+		t.Errorf("received %d bytes, %v", len(got), err)
+	}
+	binary.Write(conn, binary.BigEndian, uint32(len(data)))
+}
+
+func TestKeepalive(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	conn := NewircConn()
+	conn.SetKeepalive(20*time.Millisecond, 200*time.Millisecond)
+	conn.attach(client)
+	go func() {
+		for range conn.Input {
+		}
+	}()
+
+	// The first PING is answered, the others aren't
+	r := bufio.NewReader(server)
+	line, err := r.ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "PING :") {
+		t.Fatalf("read %q, %v", line, err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	io.WriteString(server, ":server PONG server :"+strings.TrimSpace(line[len("PING :"):])+"\r\n")
+	go io.Copy(ioutil.Discard, r)
+	time.Sleep(10 * time.Millisecond)
+	if lag := conn.Lag(); lag < 10*time.Millisecond || lag > 100*time.Millisecond {
+		t.Errorf("lag %v", lag)
+	}
+
+	select {
+	case err := <-conn.Err:
+		if !strings.HasPrefix(err.Error(), "ping timeout") {
+			t.Errorf("closed with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("connection not closed after ping timeout")
+	}
+}
+
+func TestRunReconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// every connection is welcomed and then left silent
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, ":server 001 testbot :Welcome\r\n")
+			go func() {
+				// closed after our QUIT, like a server does
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+			conns <- c
+		}
+	}()
+
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, nil)
+	ic.SetStringOption("Server", "host", l.Addr().String())
+	ic.SetStringOption("Server", "pinginterval", "0")
+	ic.SetStringOption("Server", "pingtimeout", "0.1")
+	ic.SetStringOption("Server", "reconnectdelay", "0.01")
+	done := make(chan error, 1)
+	go func() { done <- ic.Run() }()
+	for i := 1; i <= 2; i++ {
+		select {
+		case c := <-conns:
+			defer c.Close()
+		case <-time.After(2 * time.Second):
+			t.Fatalf("connection %d not made", i)
+		}
+	}
+
+	ic.Disconnect("bye")
+	select {
+	case err := <-done:
+		if err != ErrQuit {
+			t.Errorf("Run() returned %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Run() still running after Disconnect()")
+	}
+}
+
+func TestRunResetsPlugins(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// the first connection is closed right after registering
+	second := make(chan net.Conn, 1)
+	go func() {
+		for i := 0; ; i++ {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, ":server 001 testbot :Welcome\r\n")
+			if i == 0 {
+				c.Close()
+				continue
+			}
+			go func() {
+				io.Copy(ioutil.Discard, c)
+				c.Close()
+			}()
+			second <- c
+		}
+	}()
+
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, nil)
+	ic.SetStringOption("Server", "host", l.Addr().String())
+	ic.SetStringOption("Server", "reconnectdelay", "0.01")
+	rec := new(lifecycleRecorder)
+	ic.RegisterPlugin(rec)
+	done := make(chan error, 1)
+	go func() { done <- ic.Run() }()
+	select {
+	case c := <-second:
+		defer c.Close()
+	case <-time.After(2 * time.Second):
+		t.Fatal("not reconnected")
+	}
+	ic.Disconnect("bye")
+	<-done
+	// calls is only read once Run() has returned
+	if calls := strings.Join(rec.calls, ","); calls != "disconnect,reset,disconnect,unregister" {
+		t.Errorf("wrong calls: %s", calls)
+	}
+}
+
+// Plugin counting its registrations
+type sharedTestPlugin struct {
+	commandRecorder
+	lines                    chan *IRCMessage
+	registered, unregistered int
+}
+
+func (p *sharedTestPlugin) ProcessLine(msg *IRCMessage) { p.lines <- msg }
+
+func (p *sharedTestPlugin) Register(cl *IRCClient) {
+	p.registered++
+	cl.RegisterCommandHandler("echo", 0, 0, p)
+}
+func (p *sharedTestPlugin) Unregister() { p.unregistered++ }
+
+func TestBotManager(t *testing.T) {
+	f, err := ioutil.TempFile("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(test_config + `
+[Networks]
+eosin: on
+libera: on
+
+[Server@libera]
+host: irc.libera.chat:6697
+nick: mettbot
+`)
+	f.Close()
+
+	m := NewBotManager(f.Name())
+	if nets := m.Networks(); strings.Join(nets, ",") != "eosin,libera" {
+		t.Fatalf("networks %q", nets)
+	}
+	eosin, libera := m.Client("eosin"), m.Client("libera")
+	if eosin.Network() != "eosin" || eosin.GetStringOption("Server", "nick") != "testbot" || libera.GetStringOption("Server", "nick") != "mettbot" || libera.GetStringOption("Server", "ident") != "testbot" {
+		t.Error("wrong options for the networks")
+	}
+	libera.SetStringOption("Channels", "#mett", "on")
+	if eosin.GetStringOption("Channels", "#mett") != "" || strings.Join(libera.GetOptions("Channels"), ",") != "#mett" {
+		t.Error("option of one network visible in the other one")
+	}
+
+	p := &sharedTestPlugin{commandRecorder: commandRecorder{make(chan *IRCCommand, 2)}, lines: make(chan *IRCMessage, 2)}
+	if err := m.RegisterPlugin(p); err != nil {
+		t.Fatal(err)
+	}
+	if p.registered != 2 || eosin.GetPlugin("recorder") != p {
+		t.Errorf("registered %d times", p.registered)
+	}
+	for _, network := range m.Networks() {
+		ic := m.Client(network)
+		ic.conn = NewircConn()
+		ic.dispatchHandlers(":alice!~alice@a.example PRIVMSG #mett :.echo")
+		select {
+		case c := <-p.commands:
+			if c.Network != network || c.Client() != ic {
+				t.Errorf("command from %s tagged %q", network, c.Network)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("command from %s not dispatched", network)
+		}
+		select {
+		case msg := <-p.lines:
+			if msg.Network != network {
+				t.Errorf("line from %s tagged %q", network, msg.Network)
+			}
+		case <-time.After(time.Second):
+			t.Errorf("line from %s not passed on", network)
+		}
+	}
+	eosin.UnregisterPlugin("recorder")
+	if p.unregistered != 0 || libera.GetPlugin("recorder") == nil {
+		t.Error("shared plugin unregistered while still in use")
+	}
+	libera.UnregisterPlugin("recorder")
+	if p.unregistered != 1 {
+		t.Errorf("unregistered %d times", p.unregistered)
+	}
+}
+
+func TestBotManagerListen(t *testing.T) {
+	f, err := ioutil.TempFile("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(test_config + `
+[Networks]
+eosin: on
+libera: on
+
+[Metrics]
+listen: localhost:9100
+`)
+	f.Close()
+
+	m := NewBotManager(f.Name())
+	if err := m.Run(); err == nil || !strings.Contains(err.Error(), "Metrics/listen") {
+		t.Errorf("same address for both networks: %v", err)
+	}
+	m.Client("libera").SetStringOption("Metrics", "listen", "localhost:9200")
+	if err := m.checkListen(); err != nil {
+		t.Error(err)
+	}
+	if err := m.Client("eosin").Upgrade(); err == nil {
+		t.Error("online restart with several networks")
+	}
+}
+
+// Plugin that records the config reloads it is told about
+type reloadRecorder struct {
+	commandRecorder
+	reloads [][]string
+}
+
+func (r *reloadRecorder) ConfigReloaded(changed []string) { r.reloads = append(r.reloads, changed) }
+
+func TestReloadConfig(t *testing.T) {
+	f, err := ioutil.TempFile("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	networks := `
+[Networks]
+eosin: on
+libera: on
+`
+	write := func(s string) {
+		if err := ioutil.WriteFile(f.Name(), []byte(s), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(test_config + networks + "\n[Server@libera]\nnick: mettbot\n")
+	f.Close()
+
+	m := NewBotManager(f.Name())
+	eosin, libera := m.Client("eosin"), m.Client("libera")
+	p := &reloadRecorder{commandRecorder: commandRecorder{make(chan *IRCCommand, 1)}}
+	if err := m.RegisterPlugin(p); err != nil {
+		t.Fatal(err)
+	}
+	// with the options the plugins added on startup
+	if err := eosin.FlushConfig(); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// not written, so lost when reloading
+	eosin.SetStringOption("Channels", "#mett", "on")
+
+	good := strings.Replace(string(saved), "mettbot\n", "mettbot2\n", 1) + "\n[Greeting]\nhello: hi\n"
+	write(good)
+	changed, err := eosin.ReloadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(changed, ",") != "Channels@eosin,Greeting,Server@libera" {
+		t.Errorf("changed sections %q", changed)
+	}
+	if len(p.reloads) != 1 || strings.Join(p.reloads[0], ",") != strings.Join(changed, ",") {
+		t.Errorf("shared plugin told %v", p.reloads)
+	}
+	if libera.GetStringOption("Server", "nick") != "mettbot2" || eosin.GetStringOption("Greeting", "hello") != "hi" || eosin.GetStringOption("Channels", "#mett") != "" {
+		t.Error("options not reloaded")
+	}
+	if !libera.ConfigChanged(changed, "Server") || eosin.ConfigChanged(changed, "Server") || !eosin.ConfigChanged(changed, "Greeting") {
+		t.Error("wrong sections considered changed")
+	}
+
+	write(strings.Replace(good, "trigger: .", "trigger: ..", 1))
+	if _, err := libera.ReloadConfig(); err == nil {
+		t.Error("invalid config accepted")
+	}
+	if libera.GetStringOption("Server", "trigger") != "." {
+		t.Error("invalid config replaced the current one")
+	}
+
+	write(good)
+	if changed, err := libera.ReloadConfig(); err != nil || len(changed) != 0 || len(p.reloads) != 1 {
+		t.Errorf("unchanged file: %q, %v, told %d times", changed, err, len(p.reloads))
+	}
+}
+
+func TestTypedOptions(t *testing.T) {
+	ic := new_test_client(t)
+	for option, value := range map[string]string{
+		"yes": "Yes", "off": "off", "bogus": "maybe",
+		"pi": "3.14", "minutes": "5m", "days": "1d12h", "secs": "90", "half": "0.5",
+		"list": " a, b ,,c ",
+	} {
+		ic.SetStringOption("Typed", option, value)
+	}
+
+	if !ic.GetBoolOption("Typed", "yes", false) || ic.GetBoolOption("Typed", "off", true) {
+		t.Error("booleans not parsed")
+	}
+	if !ic.GetBoolOption("Typed", "bogus", true) || ic.GetBoolOption("Typed", "missing", false) {
+		t.Error("default not used for invalid or missing boolean")
+	}
+	if f := ic.GetFloatOption("Typed", "pi", 0); f != 3.14 {
+		t.Errorf("float %v", f)
+	}
+	if f := ic.GetFloatOption("Typed", "list", 2.5); f != 2.5 {
+		t.Errorf("default float %v", f)
+	}
+	for option, want := range map[string]time.Duration{
+		"minutes": 5 * time.Minute,
+		"days":    36 * time.Hour,
+		"secs":    90 * time.Second,
+		"half":    500 * time.Millisecond,
+		"bogus":   time.Hour,
+		"missing": time.Hour,
+	} {
+		if d := ic.GetDurationOption("Typed", option, time.Hour); d != want {
+			t.Errorf("duration %s: %v, want %v", option, d, want)
+		}
+	}
+	if l := ic.GetStringSliceOption("Typed", "list", nil); strings.Join(l, "|") != "a|b|c" {
+		t.Errorf("list %q", l)
+	}
+	if l := ic.GetStringSliceOption("Typed", "missing", []string{"x"}); len(l) != 1 || l[0] != "x" {
+		t.Errorf("default list %q", l)
+	}
+}
+
+func TestMatchSecret(t *testing.T) {
+	ic := new_test_client(t)
+	ic.SetStringOption("Tokens", "empty", "")
+	ic.SetStringOption("Tokens", "script", "s3cret")
+	ic.SetStringOption("Tokens", "spaced", "s3cret\u00a0")
+
+	for secret, want := range map[string]string{
+		"s3cret":       "script",
+		"s3cret\u00a0": "spaced",
+		" s3cret":      "",
+		"":             "",
+		"S3CRET":       "",
+	} {
+		if name := ic.MatchSecret("Tokens", secret); name != want {
+			t.Errorf("MatchSecret(%q) = %q, want %q", secret, name, want)
+		}
+	}
+}
+
+type unmarshalTestConfig struct {
+	Name     string        `config:"name,required"`
+	Enabled  bool          `default:"yes"`
+	Count    uint8         `config:"count" default:"3"`
+	Ratio    float64       `config:"ratio"`
+	Interval time.Duration `config:"interval" default:"1m"`
+	Tags     []string      `config:"tags"`
+	Kept     string        `config:"kept"`
+	Skipped  string        `config:"-"`
+}
+
+func (c *unmarshalTestConfig) Validate() error {
+	if c.Name == "invalid" {
+		return errors.New("invalid name")
+	}
+	return nil
+}
+
+func TestUnmarshalSection(t *testing.T) {
+	ic := new_test_client(t)
+	for option, value := range map[string]string{
+		"name": "foo", "ratio": "0.25", "interval": "2h", "tags": "a, b", "skipped": "x",
+	} {
+		ic.SetStringOption("Struct", option, value)
+	}
+
+	c := unmarshalTestConfig{Kept: "before", Skipped: "before"}
+	if err := ic.UnmarshalSection("Struct", &c); err != nil {
+		t.Fatal(err)
+	}
+	want := unmarshalTestConfig{"foo", true, 3, 0.25, 2 * time.Hour, []string{"a", "b"}, "before", "before"}
+	if !reflect.DeepEqual(c, want) {
+		t.Errorf("got %+v, want %+v", c, want)
+	}
+
+	// invalid values are reported, the rest is still filled
+	ic.SetStringOption("Struct", "count", "300")
+	ic.SetStringOption("Struct", "enabled", "off")
+	c = unmarshalTestConfig{}
+	if err := ic.UnmarshalSection("Struct", &c); err == nil || !strings.Contains(err.Error(), "Struct/count") {
+		t.Errorf("error for count out of range: %v", err)
+	}
+	if c.Count != 3 || c.Enabled || c.Name != "foo" {
+		t.Errorf("after invalid value: %+v", c)
+	}
+
+	ic.RemoveOption("Struct", "name")
+	if err := ic.UnmarshalSection("Struct", &unmarshalTestConfig{}); err == nil {
+		t.Error("no error for missing required option")
+	}
+	ic.SetStringOption("Struct", "count", "4")
+	ic.SetStringOption("Struct", "name", "invalid")
+	if err := ic.UnmarshalSection("Struct", &unmarshalTestConfig{}); err == nil || !strings.Contains(err.Error(), "invalid name") {
+		t.Errorf("Validate not called: %v", err)
+	}
+	if err := ic.UnmarshalSection("Struct", c); err == nil {
+		t.Error("no error for non-pointer")
+	}
+}
+
+const toml_test_config = `# comment
+trigger = "."
+
+[Server]
+host = "irc.example.net:6697"
+nick = 'mettbot'   # literal string
+port = 6_697
+tls = true
+motd = """
+Hello \
+  world"""
+
+["Server@libera"]
+nick = "mettä"
+
+[Auth]
+"*!*@example.com" = 500
+
+[Feeds]
+channels = ["#mett", "#test"]
+heise.interval = "1h"
+[Feeds.golem]
+url = "https://golem.de/rss"
+[[Feeds.extra]]
+url = "https://example.com/feed"
+[[Feeds.extra]]
+url = "https://example.org/feed"
+tags = { lang = "de" }
+`
+
+const yaml_test_config = `# comment
+---
+trigger: "."
+
+Server:
+  host: irc.example.net:6697
+  nick: 'mettbot'   # quoted
+  port: 6697
+  tls: true
+  motd: >-
+    Hello
+    world
+
+Server@libera:
+  nick: "mettä"
+
+Auth:
+  "*!*@example.com": 500
+
+Feeds:
+  channels: [ "#mett", "#test" ]
+  heise:
+    interval: 1h
+  golem: {url: "https://golem.de/rss"}
+  extra:
+  - url: https://example.com/feed
+  - url: https://example.org/feed
+    tags:
+      lang: de
+`
+
+func TestConfigFormats(t *testing.T) {
+	want := map[string]string{
+		"DEFAULT/trigger":         ".",
+		"Server/host":             "irc.example.net:6697",
+		"Server/nick":             "mettbot",
+		"Server/port":             "6697",
+		"Server/tls":              "true",
+		"Server/motd":             "Hello world",
+		"Server@libera/nick":      "mettä",
+		"Auth/*!*@example.com":    "500",
+		"Feeds/channels":          "#mett, #test",
+		"Feeds/heise.interval":    "1h",
+		"Feeds/golem.url":         "https://golem.de/rss",
+		"Feeds/extra.0.url":       "https://example.com/feed",
+		"Feeds/extra.1.url":       "https://example.org/feed",
+		"Feeds/extra.1.tags.lang": "de",
+	}
+	check := func(name string, c ConfigBackend) {
+		n := 0
+		for _, s := range c.Sections() {
+			opts, err := c.Options(s)
+			if err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+			for _, o := range opts {
+				if !c.HasOption(s, o) {
+					// from DEFAULT
+					continue
+				}
+				n++
+				v, _ := c.String(s, o)
+				if w, ok := want[s+"/"+o]; !ok || v != w {
+					t.Errorf("%s: %s/%s = %q, want %q", name, s, o, v, w)
+				}
+			}
+		}
+		if n != len(want) {
+			t.Errorf("%s: %d options, want %d", name, n, len(want))
+		}
+		if v, _ := c.String("Server", "trigger"); v != "." {
+			t.Errorf("%s: no fallback to DEFAULT", name)
+		}
+	}
+
+	dir, err := ioutil.TempDir("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	for name, content := range map[string]string{"test.toml": toml_test_config, "test.yaml": yaml_test_config} {
+		filename := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(filename, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		c, err := readConfigFile(filename)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		check(name, c)
+
+		// written and read again, with a changed and a new option
+		c.AddOption("Server", "port", "6667")
+		c.AddOption("Auth", "*!*@example.org", "400")
+		if err := c.WriteFile(filename, 0600, "test"); err != nil {
+			t.Fatal(err)
+		}
+		written, _ := ioutil.ReadFile(filename)
+		c, err = readConfigFile(filename)
+		if err != nil {
+			t.Fatalf("%s written: %v\n%s", name, err, written)
+		}
+		want["Server/port"], want["Auth/*!*@example.org"] = "6667", "400"
+		check(name+" written", c)
+		delete(want, "Auth/*!*@example.org")
+		want["Server/port"] = "6697"
+		if !strings.Contains(string(written), "6667\n") || !strings.Contains(string(written), "#test") {
+			t.Errorf("%s: numbers or lists not kept:\n%s", name, written)
+		}
+	}
+
+	for _, invalid := range []string{"a = 1\na = 2\n", "[a]\n[a]\n", "a = \"open\n", "a = [1, 2\n", "a = 07\n", "a.b = 1\n[a.b]\n"} {
+		if _, err := parseTOML(invalid); err == nil {
+			t.Errorf("no error for TOML %q", invalid)
+		}
+	}
+	for _, invalid := range []string{"a: 1\na: 2\n", "a: 1\n  b: 2\n", "a: \"open\n", "a: [1, 2\n", "a: *alias\n", "- a\n", "a\n", ":", ": value\n", "#.{ :b,b\n:"} {
+		if _, err := parseYAML(invalid); err == nil {
+			t.Errorf("no error for YAML %q", invalid)
+		}
+	}
+	// typos must give errors, not panics
+	alphabet := "ab1 :#-[]{},'\"\n|>&*!~.\\\t?="
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		b := make([]byte, r.Intn(32))
+		for j := range b {
+			b[j] = alphabet[r.Intn(len(alphabet))]
+		}
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Errorf("panic parsing %q: %v", b, e)
+				}
+			}()
+			parseYAML(string(b))
+			parseTOML(string(b))
+		}()
+	}
+
+	// migrating the INI config of a client
+	ic := new_test_client(t)
+	ic.SetStringOption("Feeds", "channels", "#mett, #test")
+	filename := filepath.Join(dir, "migrated.yaml")
+	if err := ic.MigrateConfig(filename); err != nil {
+		t.Fatal(err)
+	}
+	c, err := readConfigFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.String("Feeds", "channels"); v != "#mett, #test" {
+		t.Errorf("migrated Feeds/channels %q", v)
+	}
+	if ic.GetStringOption("Server", "trigger") != "." || ic.GetStringOption("Feeds", "channels") != "#mett, #test" {
+		t.Error("options lost when migrating")
+	}
+	ic.SetStringOption("Feeds", "interval", "2h")
+	if err := ic.FlushConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if c, err = readConfigFile(filename); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := c.String("Feeds", "interval"); v != "2h" {
+		t.Error("not saved to the migrated file")
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	ic := new_test_client(t)
+	os.Setenv("METTBOT_TEST_HOST", "irc.example.net")
+	defer os.Unsetenv("METTBOT_TEST_HOST")
+	secret, err := ioutil.TempFile("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(secret.Name())
+	secret.WriteString("hunter2\n")
+	secret.Close()
+
+	ic.SetStringOption("Env", "host", "${METTBOT_TEST_HOST}:6697")
+	ic.SetStringOption("Env", "unset", "a${METTBOT_TEST_UNSET}b")
+	ic.SetStringOption("Env", "default", "${METTBOT_TEST_UNSET:-6667}")
+	ic.SetStringOption("Env", "literal", "$${METTBOT_TEST_HOST} $HOME")
+	ic.SetStringOption("Env", "password_file", secret.Name())
+	ic.SetStringOption("Env", "port_file", secret.Name()+".missing")
+	ic.SetStringOption("Env", "both", "direct")
+	ic.SetStringOption("Env", "both_file", secret.Name())
+	for option, want := range map[string]string{
+		"host":     "irc.example.net:6697",
+		"unset":    "ab",
+		"default":  "6667",
+		"literal":  "${METTBOT_TEST_HOST} $HOME",
+		"password": "hunter2",
+		"port":     "",
+		"both":     "direct",
+	} {
+		if v := ic.GetStringOption("Env", option); v != want {
+			t.Errorf("%s: %q, want %q", option, v, want)
+		}
+	}
+	if n, err := ic.GetIntOption("Env", "default"); err != nil || n != 6667 {
+		t.Errorf("GetIntOption: %d %v", n, err)
+	}
+	// not expanded in memory, so not written to the file
+	cf := ic.GetPlugin("conf").(*ConfigPlugin)
+	if v, _ := cf.Conf.String("Env", "host"); v != "${METTBOT_TEST_HOST}:6697" {
+		t.Errorf("stored %q", v)
+	}
+}
+
+func TestConfigPersistence(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ircclient_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "mettbot.cfg")
+	if err := ioutil.WriteFile(filename, []byte(test_config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.cfg")
+	if err := os.Symlink(filename, link); err != nil {
+		t.Fatal(err)
+	}
+	ic := NewIRCClient(link)
+	cf := ic.GetPlugin("conf").(*ConfigPlugin)
+	contains := func(s string) bool {
+		data, err := ioutil.ReadFile(filename)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return strings.Contains(string(data), s)
+	}
+
+	// changes are written later
+	ic.SetStringOption("Persist", "a", "1")
+	cf.Lock()
+	if cf.saveTimer == nil || cf.saveAt.Before(time.Now().Add(config_save_delay)) {
+		t.Error("no save scheduled for a change")
+	}
+	cf.Unlock()
+	if err := ic.SaveConfig(); err != nil {
+		t.Fatal(err)
+	}
+	cf.Lock()
+	if cf.saveAt.After(time.Now().Add(config_save_delay)) {
+		t.Error("SaveConfig() didn't move the save forward")
+	}
+	cf.Unlock()
+	if contains("Persist") {
+		t.Error("written before the delay")
+	}
+	// but not lost when reloading
+	if _, err := ic.ReloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if ic.GetStringOption("Persist", "a") != "1" || !contains("Persist") {
+		t.Error("saved option lost when reloading")
+	}
+
+	ic.SetStringOption("Persist", "b", "2")
+	if err := ic.FlushConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if !contains("2") {
+		t.Error("not written by FlushConfig()")
+	}
+	if fi, err := os.Lstat(link); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+		t.Error("symlink replaced")
+	}
+	if fi, err := os.Stat(filename); err != nil || fi.Mode().Perm() != 0600 {
+		t.Errorf("permissions not kept: %v", fi.Mode())
+	}
+	if _, err := os.Stat(filename + ".tmp"); !os.IsNotExist(err) {
+		t.Error("temporary file left")
+	}
+	cf.Lock()
+	if cf.dirty || cf.saveTimer != nil {
+		t.Error("still dirty after writing")
+	}
+	cf.Unlock()
+}
+
+func TestConnectionOptions(t *testing.T) {
+	srv := NewMockServer()
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, srv.Conn())
+	ic.SetStringOption("Server", "password", "secret word")
+	srv.Send(":server 001 testbot :Welcome")
+	if err := ic.Connect(); err != nil {
+		t.Fatal(err)
+	}
+	if line, ok := <-srv.Received; !ok || line != "PASS :secret word" {
+		t.Errorf("first line %q, want PASS", line)
+	}
+	srv.Close()
+	ic.Shutdown()
+
+	for family, want := range map[string]string{"": "tcp", "4": "tcp4", "IPv6": "tcp6", "5": ""} {
+		ic.SetStringOption("Server", "family", family)
+		opts, err := ic.dialOptions()
+		if want == "" && err == nil || want != "" && (err != nil || opts.network != want) {
+			t.Errorf("family %q: %q %v", family, opts.network, err)
+		}
+	}
+
+	l, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	accepted := make(chan net.Addr, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- c.RemoteAddr()
+			c.Close()
+		}
+	}()
+	c, err := dial(l.Addr().String(), dialOptions{bind: "127.0.0.1", network: "tcp4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if addr := <-accepted; !addr.(*net.TCPAddr).IP.Equal(net.IPv4(127, 0, 0, 1)) {
+		t.Errorf("connected from %v", addr)
+	}
+	if _, err := dial(l.Addr().String(), dialOptions{network: "tcp6"}); err == nil {
+		t.Error("IPv4 address dialed with IPv6 only")
+	}
+	if _, err := dial(l.Addr().String(), dialOptions{bind: "::1", network: "tcp4"}); err == nil {
+		t.Error("no error for invalid bind address")
+	}
+}
+
+// Accepts one connection on a new listener and passes it to serve
+func serveOnce(t *testing.T, serve func(c net.Conn)) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		c, err := l.Accept()
+		l.Close()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		serve(c)
+	}()
+	return l.Addr().String()
+}
+
+func TestProxy(t *testing.T) {
+	// what the proxies were asked for
+	requests := make(chan string, 1)
+	socks := func(c net.Conn) {
+		read := func(n int) []byte {
+			buf := make([]byte, n)
+			io.ReadFull(c, buf)
+			return buf
+		}
+		// methods, user/password authentication chosen
+		read(int(read(2)[1]))
+		c.Write([]byte{5, 2})
+		user := string(read(int(read(2)[1])))
+		password := string(read(int(read(1)[0])))
+		c.Write([]byte{1, 0})
+		// CONNECT with a host name
+		host := string(read(int(read(5)[4])))
+		port := binary.BigEndian.Uint16(read(2))
+		requests <- fmt.Sprintf("%s:%s %s:%d", user, password, host, port)
+		c.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0, ':', 'h', 'i', '\n'})
+	}
+	httpProxy := func(c net.Conn) {
+		r := bufio.NewReader(c)
+		var request []string
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil || line == "\r\n" {
+				break
+			}
+			request = append(request, strings.TrimSpace(line))
+		}
+		requests <- strings.Join(request, "|")
+		// the server talks first, in the same packet
+		c.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n:hi\n"))
+	}
+	for _, test := range []struct {
+		scheme string
+		serve  func(c net.Conn)
+		want   string
+	}{
+		{"socks5h", socks, "mett:secret irc.example.net:6697"},
+		{"http", httpProxy, "CONNECT irc.example.net:6697 HTTP/1.1|Host: irc.example.net:6697|Proxy-Authorization: Basic bWV0dDpzZWNyZXQ="},
+	} {
+		addr := serveOnce(t, test.serve)
+		u, err := parseProxyURL(test.scheme + "://mett:secret@" + addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := dial("irc.example.net:6697", dialOptions{proxy: u})
+		if err != nil {
+			t.Fatalf("%s: %v", test.scheme, err)
+		}
+		if request := <-requests; request != test.want {
+			t.Errorf("%s: request %q, want %q", test.scheme, request, test.want)
+		}
+		if line, err := bufio.NewReader(c).ReadString('\n'); line != ":hi\n" {
+			t.Errorf("%s: read %q %v after the handshake", test.scheme, line, err)
+		}
+		if _, ok := c.(*net.TCPConn); !ok {
+			t.Errorf("%s: not a TCP connection", test.scheme)
+		}
+		c.Close()
+	}
+
+	// refused by the proxy
+	addr := serveOnce(t, func(c net.Conn) {
+		buf := make([]byte, 3)
+		io.ReadFull(c, buf)
+		c.Write([]byte{5, 0})
+		io.ReadFull(c, make([]byte, 4+4+2))
+		c.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+	})
+	u, _ := parseProxyURL("socks5://" + addr)
+	if _, err := dial("127.0.0.1:6667", dialOptions{proxy: u}); err == nil || !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("error %v, want connection refused", err)
+	}
+	if _, err := parseProxyURL("https://proxy:443"); err == nil {
+		t.Error("no error for unsupported proxy")
+	}
+}
+
+func TestServerFailover(t *testing.T) {
+	config := write_test_config(t)
+	defer os.Remove(config)
+	ic := NewIRCClientWithConn(config, nil)
+	defer ic.Shutdown()
+
+	// a port nobody listens on
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+	open := serveOnce(t, func(c net.Conn) {})
+	ic.SetStringOption("Server", "host", closed+", "+open)
+	opts, err := ic.dialOptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := ic.dialServer(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if s := ic.GetStatus(); s.Server != open || ic.serverIndex != 0 {
+		t.Errorf("connected to %q (next %d), want %s", s.Server, ic.serverIndex, open)
+	}
+
+	// if all fail, the next attempt starts one further
+	ic.SetStringOption("Server", "host", closed+", "+closed+", "+closed)
+	ic.serverIndex = 1
+	if _, err := ic.dialServer(opts); err == nil {
+		t.Fatal("connected to a closed port")
+	}
+	if ic.serverIndex != 2 {
+		t.Errorf("server index %d after failing, want 2", ic.serverIndex)
+	}
+
+	// reconnecting moves on to the next server
+	welcome := func(c net.Conn) {
+		io.WriteString(c, ":server 001 testbot :Welcome\r\n")
+		io.Copy(ioutil.Discard, c)
+	}
+	first, second := serveOnce(t, welcome), serveOnce(t, welcome)
+	ic.SetStringOption("Server", "host", first+", "+second)
+	ic.serverIndex = 0
+	for i, want := range []string{first, second} {
+		if err := ic.Connect(); err != nil {
+			t.Fatalf("connect %d: %v", i+1, err)
+		}
+		if s := ic.GetStatus(); s.Server != want {
+			t.Errorf("connect %d went to %s, want %s", i+1, s.Server, want)
+		}
+		ic.connection().Quit()
+	}
+
+	ic.SetStringOption("Server", "host", "")
+	if _, err := ic.dialServer(opts); err == nil {
+		t.Error("no error without servers")
+	}
+}
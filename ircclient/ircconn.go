@@ -3,20 +3,59 @@ package ircclient
 import (
 	"bufio"
 	"errors"
+	"golang.org/x/text/encoding/charmap"
 	"log"
 	"net"
+	"net/url"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
+// How long Quit() waits for pending output to be sent and for the server
+// to close the connection after our QUIT
+const quit_timeout = 5 * time.Second
+
+// Returned by InputLoop() after Disconnect()
+var ErrQuit = errors.New("Connection closed by user")
+
+// Legacy 8-bit encodings that may be used on the wire instead of UTF-8
+var charmaps = map[string]*charmap.Charmap{
+	"latin1":       charmap.ISO8859_1,
+	"iso-8859-1":   charmap.ISO8859_1,
+	"latin9":       charmap.ISO8859_15,
+	"iso-8859-15":  charmap.ISO8859_15,
+	"cp1252":       charmap.Windows1252,
+	"windows-1252": charmap.Windows1252,
+}
+
 type ircConn struct {
-	conn    *net.TCPConn
+	// a *net.TCPConn, except in tests (see NewIRCClientWithConn())
+	conn    net.Conn
 	bio     *bufio.ReadWriter
 	tmgr    *throttleIrcu
 	done    chan bool
 	flushed chan bool
+	// closed when the reading/writing goroutines have exited
+	readerDone chan bool
+	writerDone chan bool
+	quitOnce   sync.Once
+	// nil for UTF-8
+	charmap *charmap.Charmap
+	// called after each line sent, may be nil
+	sent func(line string)
+	// Keepalive settings and state, see keepalive.go
+	pingInterval time.Duration
+	pingTimeout  time.Duration
+	lastRecv     time.Time
+	pingToken    string
+	pingSent     time.Time
+	lag          time.Duration
+	lagLock      sync.Mutex
 
 	Err    chan error
 	Output chan string
@@ -24,10 +63,88 @@ type ircConn struct {
 }
 
 func NewircConn() *ircConn {
-	return &ircConn{done: make(chan bool, 1), flushed: make(chan bool), Output: make(chan string, 50), Input: make(chan string, 50), tmgr: new(throttleIrcu), Err: make(chan error, 5)}
+	return &ircConn{done: make(chan bool, 1), flushed: make(chan bool, 1), readerDone: make(chan bool), writerDone: make(chan bool), Output: make(chan string, default_send_queue), Input: make(chan string, 50), tmgr: newthrottleIrcu(default_flood_burst, default_flood_rate), Err: make(chan error, 5), pingInterval: default_ping_interval * time.Second, pingTimeout: default_ping_timeout * time.Second}
+}
+
+// Sets the encoding used on the wire, e.g. "utf-8" (the default) or
+// "latin1". Lines are always passed to and from the application in UTF-8.
+func (ic *ircConn) SetEncoding(name string) error {
+	name = strings.ToLower(name)
+	if name == "" || name == "utf-8" || name == "utf8" {
+		ic.charmap = nil
+		return nil
+	}
+	cm, ok := charmaps[name]
+	if !ok {
+		return errors.New("unsupported encoding: " + name)
+	}
+	ic.charmap = cm
+	return nil
 }
 
-func (ic *ircConn) Connect(hostport string) error {
+// Converts a line received from the server to UTF-8. Lines that already are
+// valid UTF-8 are passed through, as clients in legacy channels often are
+// mixed.
+func (ic *ircConn) decode(s string) string {
+	if ic.charmap == nil || utf8.ValidString(s) {
+		return s
+	}
+	buf := make([]rune, len(s))
+	for i := 0; i < len(s); i++ {
+		buf[i] = ic.charmap.DecodeByte(s[i])
+	}
+	return string(buf)
+}
+
+// Converts a UTF-8 line to the wire encoding, replacing characters that
+// can't be represented (and invalid UTF-8) with '?'
+func (ic *ircConn) encode(s string) string {
+	if ic.charmap == nil {
+		return s
+	}
+	buf := make([]byte, 0, len(s))
+	for _, r := range s {
+		b, ok := ic.charmap.EncodeRune(r)
+		if !ok || r == utf8.RuneError {
+			b = '?'
+		}
+		buf = append(buf, b)
+	}
+	return string(buf)
+}
+
+// How Connect() dials the server, see Server/bind and Server/family
+type dialOptions struct {
+	// Local address to connect from, empty for any
+	bind string
+	// "tcp", or "tcp4" or "tcp6" to force IPv4 or IPv6
+	network string
+	// To connect through, see proxy.go, nil for none
+	proxy *url.URL
+}
+
+// Connects to hostport
+func dial(hostport string, opts dialOptions) (net.Conn, error) {
+	network := opts.network
+	if network == "" {
+		network = "tcp"
+	}
+	var d net.Dialer
+	if opts.bind != "" {
+		local, err := net.ResolveTCPAddr(network, net.JoinHostPort(opts.bind, "0"))
+		if err != nil {
+			return nil, errors.New("invalid bind address: " + err.Error())
+		}
+		// only addresses of the server of the same family are tried
+		d.LocalAddr = local
+	}
+	if opts.proxy != nil {
+		return dialProxy(&d, network, opts.proxy, hostport)
+	}
+	return d.Dial(network, hostport)
+}
+
+func (ic *ircConn) Connect(hostport string, opts dialOptions) error {
 	if len(os.Args) > 1 { // we're coming from kexec
 		fd, err := strconv.Atoi(os.Args[1])
 		if err != nil {
@@ -39,22 +156,33 @@ func (ic *ircConn) Connect(hostport string) error {
 			log.Println("Connection fd is: " + strconv.Itoa(fd))
 			log.Fatal("unable to recover conn: " + err.Error())
 		}
-		ic.conn, _ = conn.(*net.TCPConn)
+		ic.conn = conn
 	} else {
 		if len(hostport) == 0 {
 			return errors.New("empty server addr, not connecting")
 		}
 		if ic.conn != nil {
-			log.Printf("warning: already connected")
+			logWarnf("already connected")
 		}
-		c, err := net.Dial("tcp", hostport)
+		c, err := dial(hostport, opts)
 		if err != nil {
 			return err
 		}
-		ic.conn, _ = c.(*net.TCPConn)
+		ic.conn = c
 	}
 	// from here on, we're on same behaviour again
+	ic.serve()
+	return nil
+}
 
+// Uses the already established connection c instead of dialing
+func (ic *ircConn) attach(c net.Conn) {
+	ic.conn = c
+	ic.serve()
+}
+
+// Starts the goroutines reading from and writing to ic.conn
+func (ic *ircConn) serve() {
 	ic.bio = bufio.NewReadWriter(bufio.NewReader(ic.conn), bufio.NewWriter(ic.conn))
 
 	go func() {
@@ -63,6 +191,7 @@ func (ic *ircConn) Connect(hostport string) error {
 		for {
 			s, err := ic.bio.ReadString('\n')
 			if err != nil {
+				close(ic.readerDone)
 				select {
 				case d := <-ic.done:
 					ic.done <- d
@@ -73,42 +202,52 @@ func (ic *ircConn) Connect(hostport string) error {
 					return
 				}
 			}
-			s = strings.Trim(s, "\r\n")
+			s = ic.decode(strings.Trim(s, "\r\n"))
+			logDebugf("<< %s", redactLine(s))
+			ic.received(s)
 			ic.Input <- s
-			//log.Println("<< " + s)
 		}
 	}()
+	go ic.keepalive()
 	go func() {
 		// This goroutine is responsible for sending the output waiting in channel
 		// ic.Output to the server
 		for {
 			select {
-			case s := <-ic.Output:
-				s = s + "\r\n"
+			case line := <-ic.Output:
+				s := ic.encode(line) + "\r\n"
 				ic.tmgr.WaitSend(s)
-				//log.Print(">> " + s)
+				logDebugf(">> %s", redactLine(line))
 				if _, err := ic.bio.WriteString(s); err != nil {
+					close(ic.writerDone)
 					ic.Err <- errors.New("ircmessage: send: " + err.Error())
-					log.Println("Send failed: " + err.Error())
+					logErrorf("send failed: %v", err)
 					ic.Quit()
 					return
 				}
 				ic.bio.Flush()
+				ic.tmgr.Sent(line)
+				if ic.sent != nil {
+					ic.sent(line)
+				}
 			case d := <-ic.done:
 				// Connection is going to close, flush all data
 				ic.done <- d
 				for {
 					select {
-					case s := <-ic.Output:
-						s = s + "\r\n"
+					case line := <-ic.Output:
+						s := ic.encode(line) + "\r\n"
 						ic.tmgr.WaitSend(s)
-						log.Print(">> " + s)
+						logDebugf(">> %s", redactLine(line))
 						// Do no more error handling here
 						if _, err := ic.bio.WriteString(s); err != nil {
 							ic.flushed <- true
 							return
 						}
 						ic.bio.Flush()
+						if ic.sent != nil {
+							ic.sent(line)
+						}
 					default:
 						ic.flushed <- true
 						// No more data to send
@@ -118,21 +257,47 @@ func (ic *ircConn) Connect(hostport string) error {
 			}
 		}
 	}()
-
-	return nil
 }
 
+// Sends all pending output (e.g. the QUIT) and closes the connection. Only
+// the first call has an effect.
 func (ic *ircConn) Quit() {
-	ic.done <- true
+	ic.quitOnce.Do(func() {
+		ic.closeSocket()
+		close(ic.Input)
+		ic.Err <- ErrQuit
+	})
+}
+
+// Flushes all pending output and closes the socket, but leaves Input open
+func (ic *ircConn) closeSocket() {
+	select {
+	case ic.done <- true:
+	default:
+		// already closing
+	}
 
 	// Wait until all sends have completed
 	select {
-	case _ = <-ic.flushed:
+	case <-ic.flushed:
+	case <-ic.writerDone:
+	case <-time.After(quit_timeout):
+		logWarnf("timeout while flushing output")
 	}
 
-	close(ic.Input)
+	// Closing a socket with unread input makes the kernel reset the
+	// connection, which may discard our QUIT. Close our side and give
+	// the server a chance to close the connection first.
+	if tc, ok := ic.conn.(interface{ CloseWrite() error }); ok {
+		tc.CloseWrite()
+	} else {
+		ic.conn.Close()
+	}
+	select {
+	case <-ic.readerDone:
+	case <-time.After(quit_timeout):
+	}
 	ic.conn.Close()
-	ic.Err <- errors.New("Connection closed by user")
 }
 
 // returns the socket of the ircConn or -1 if an error occurs
@@ -140,15 +305,20 @@ func (ic *ircConn) Quit() {
 // the file descriptor returned by Conn.File() is a duplicate, with flag CloseOnExec set
 // we have to unset the flag manually to successfully exec
 func (ic *ircConn) GetSocket() int {
+	tc, ok := ic.conn.(*net.TCPConn)
+	if !ok {
+		logErrorf("unable to get socket fd: not a TCP connection")
+		return -1
+	}
 	// get a duplicate of the file descriptor
-	file, err := ic.conn.File()
+	file, err := tc.File()
 	if err != nil {
-		log.Println("Unable to get socket fd:", err.Error())
+		logErrorf("unable to get socket fd: %v", err)
 		return -1
 	}
 	fd, err := syscall.Dup(int(file.Fd()))
 	if err != nil {
-		log.Println("Unable to duplicate file descriptor:", err)
+		logErrorf("unable to duplicate file descriptor: %v", err)
 	}
 	return fd
 }
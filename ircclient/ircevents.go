@@ -0,0 +1,197 @@
+package ircclient
+
+// Typed events for lines from the server, published on the event bus with
+// the IRC command as topic, e.g.
+//
+//	unsubscribe := ic.Subscribe("JOIN", func(data interface{}) {
+//		e := data.(*JoinEvent)
+//		ic.SendLine("PRIVMSG " + e.Channel + " :Hi " + e.Nick)
+//	})
+//
+// Plugins don't have to split sources or pick arguments apart themselves.
+// ProcessLine() still gets every line.
+
+import (
+	"strings"
+)
+
+// Fields common to all events
+type Event struct {
+	// The line the event has been built from
+	Msg *IRCMessage
+	// The sender, split from Msg.Source. Ident and Host are empty if the
+	// sender is a server.
+	Nick, Ident, Host string
+	// The network the line was received from, see BotManager
+	Network string
+}
+
+// Published as "JOIN". Account and Realname are only known with
+// extended-join.
+type JoinEvent struct {
+	Event
+	Channel  string
+	Account  string
+	Realname string
+}
+
+// Published as "PART"
+type PartEvent struct {
+	Event
+	Channel string
+	Reason  string
+}
+
+// Published as "KICK", Nick kicked Kicked
+type KickEvent struct {
+	Event
+	Channel string
+	Kicked  string
+	Reason  string
+}
+
+// Published as "QUIT"
+type QuitEvent struct {
+	Event
+	Reason string
+}
+
+// Published as "PRIVMSG" and "NOTICE", except for CTCP messages other than
+// ACTION, see CTCPEvent
+type MessageEvent struct {
+	Event
+	// Channel or our nick
+	Target string
+	// Without the CTCP quoting if Action is set
+	Text string
+	// Sent to us instead of a channel
+	Private bool
+	Notice  bool
+	// CTCP ACTION ("/me")
+	Action bool
+}
+
+// Where replies to the message should be sent: the channel, or the sender
+// for private messages
+func (e *MessageEvent) ReplyTarget() string {
+	if e.Private {
+		return e.Nick
+	}
+	return e.Target
+}
+
+// Published as "NICK", Nick is now NewNick
+type NickEvent struct {
+	Event
+	NewNick string
+}
+
+// Published as "MODE" for channel and user modes, e.g. Modes "+ov" with
+// Params ["alice", "bob"]
+type ModeEvent struct {
+	Event
+	Target string
+	Modes  string
+	Params []string
+}
+
+// Published as "TOPIC" when the topic is changed
+type TopicEvent struct {
+	Event
+	Channel string
+	Topic   string
+}
+
+// Published with the numeric as topic, e.g. "001" or RPL_ENDOFWHO. Args
+// doesn't contain our nick, which servers send first.
+type NumericEvent struct {
+	Event
+	Numeric string
+	Args    []string
+}
+
+// Splits a source "nick!ident@host" into its parts. Server names are
+// returned as nick.
+func ParseSource(source string) (nick, ident, host string) {
+	nick = source
+	if i := strings.Index(nick, "@"); i >= 0 {
+		nick, host = nick[:i], nick[i+1:]
+	}
+	if i := strings.Index(nick, "!"); i >= 0 {
+		nick, ident = nick[:i], nick[i+1:]
+	}
+	return
+}
+
+// Builds the typed event for msg. Returns nil for lines without an event
+// type and malformed ones.
+func newEvent(msg *IRCMessage, isChannel func(string) bool) interface{} {
+	if msg.Source == "" {
+		return nil
+	}
+	e := Event{Msg: msg, Network: msg.Network}
+	e.Nick, e.Ident, e.Host = ParseSource(msg.Source)
+	arg := func(i int) string {
+		if i < len(msg.Args) {
+			return msg.Args[i]
+		}
+		return ""
+	}
+
+	switch msg.Command {
+	case "JOIN":
+		ev := &JoinEvent{Event: e, Channel: msg.Target, Realname: arg(1)}
+		if a := arg(0); a != "*" {
+			ev.Account = a
+		}
+		return ev
+	case "PART":
+		return &PartEvent{e, msg.Target, arg(0)}
+	case "KICK":
+		if len(msg.Args) == 0 {
+			return nil
+		}
+		return &KickEvent{e, msg.Target, msg.Args[0], arg(1)}
+	case "QUIT":
+		// the reason is the first parameter
+		return &QuitEvent{e, msg.Target}
+	case "PRIVMSG", "NOTICE":
+		if len(msg.Args) == 0 {
+			return nil
+		}
+		private := !isChannel(msg.Target)
+		if command, params, ok := msg.CTCP(); ok && command != "ACTION" {
+			return &CTCPEvent{e, msg.Target, command, params, msg.Command == "NOTICE", private}
+		}
+		ev := &MessageEvent{Event: e, Target: msg.Target, Text: msg.Args[0], Private: private, Notice: msg.Command == "NOTICE"}
+		if msg.IsAction() {
+			ev.Action = true
+			_, ev.Text, _ = msg.CTCP()
+		}
+		return ev
+	case "NICK":
+		return &NickEvent{e, msg.Target}
+	case "MODE":
+		if len(msg.Args) == 0 {
+			return nil
+		}
+		return &ModeEvent{e, msg.Target, msg.Args[0], msg.Args[1:]}
+	case "TOPIC":
+		return &TopicEvent{e, msg.Target, arg(0)}
+	}
+	if len(msg.Command) == 3 && strings.Trim(msg.Command, "0123456789") == "" {
+		return &NumericEvent{e, msg.Command, msg.Args}
+	}
+	return nil
+}
+
+// Publishes the typed event for msg, if it has one
+func (ic *IRCClient) publishEvent(msg *IRCMessage) {
+	if ev := newEvent(msg, ic.IsChannelName); ev != nil {
+		topic := msg.Command
+		if _, ok := ev.(*CTCPEvent); ok {
+			topic = "CTCP"
+		}
+		ic.Publish(topic, ev)
+	}
+}
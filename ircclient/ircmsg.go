@@ -2,6 +2,7 @@ package ircclient
 
 import (
 	"strings"
+	"time"
 )
 
 type IRCMessage struct {
@@ -10,6 +11,56 @@ type IRCMessage struct {
 	Command  string
 	Args     []string
 	Complete string
+	// IRCv3 message tags (e.g. "time"), unescaped. nil if the line had none.
+	Tags map[string]string
+	// The network the line was received from, see BotManager
+	Network string
+	// Local time the line was received
+	received time.Time
+}
+
+// Returns the time the message was sent by the server if it told us (using
+// the server-time capability), or the time it was received otherwise.
+func (m *IRCMessage) Timestamp() time.Time {
+	if t, ok := m.ServerTime(); ok {
+		return t
+	}
+	return m.received
+}
+
+// Returns the message's arguments with all formatting (colors, bold, ...)
+// removed, see StripFormatting(). Args is left unchanged.
+func (m *IRCMessage) PlainText() []string {
+	plain := make([]string, len(m.Args))
+	for i, arg := range m.Args {
+		plain[i] = StripFormatting(arg)
+	}
+	return plain
+}
+
+// Returns the time from the message's "time" tag. ok is false if the
+// message has no such tag or it can't be parsed.
+func (m *IRCMessage) ServerTime() (t time.Time, ok bool) {
+	v, ok := m.Tags["time"]
+	if !ok {
+		return time.Time{}, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// Returns the services account of the sender from the message's "account"
+// tag (requires the account-tag capability). ok is false if the tag is
+// missing, i.e. the sender isn't logged in or the server doesn't tell.
+func (m *IRCMessage) Account() (account string, ok bool) {
+	account, ok = m.Tags["account"]
+	if account == "" || account == "*" {
+		return "", false
+	}
+	return account, ok
 }
 
 type IRCCommand struct {
@@ -17,6 +68,24 @@ type IRCCommand struct {
 	Command string
 	Target  string
 	Args    []string
+	// Services account of the sender from the account tag, empty if
+	// unknown (see IRCMessage.Account())
+	Account string
+	// The network the command was sent in, see BotManager
+	Network string
+	// The arguments as sent and the client that received the command, see
+	// ParseArgs()
+	text   string
+	client *IRCClient
+	// The DCC chat the command was sent in, replies go there
+	dcc *dccSession
+}
+
+// Returns the client that received the command, nil for commands built by
+// plugins. Plugins registered on several networks reply through it, see
+// BotManager.RegisterPlugin().
+func (c *IRCCommand) Client() *IRCClient {
+	return c.client
 }
 
 func ParseCommand(msg *IRCMessage) *IRCCommand {
@@ -27,7 +96,8 @@ func ParseCommand(msg *IRCMessage) *IRCCommand {
 	}
 
 	toParse := msg.Args[0]
-	ret := &IRCCommand{msg.Source, "", msg.Target, make([]string, 0)}
+	ret := &IRCCommand{Source: msg.Source, Target: msg.Target, Network: msg.Network, Args: make([]string, 0)}
+	ret.Account, _ = msg.Account()
 	for i, last, matchP := 0, 0, false; i < len(toParse); i++ {
 		//log.Printf("Now at: %c\n", toParse[i])
 
@@ -65,6 +135,10 @@ func ParseCommand(msg *IRCMessage) *IRCCommand {
 	}
 	//log.Printf("%#v\n", ret.Args)
 	if len(ret.Args) > 0 {
+		text := strings.TrimLeft(toParse, " \t")
+		if i := strings.IndexAny(text, " \t"); i >= 0 {
+			ret.text = strings.TrimLeft(text[i:], " \t")
+		}
 		ret.Command = ret.Args[0]
 		ret.Args = ret.Args[1:len(ret.Args)]
 	} else if len(ret.Args) > 1 {
@@ -74,12 +148,22 @@ func ParseCommand(msg *IRCMessage) *IRCCommand {
 }
 
 func ParseServerLine(line string) *IRCMessage {
-	im := &IRCMessage{"", "", "", make([]string, 0), line}
+	im := &IRCMessage{Args: make([]string, 0), Complete: line, received: time.Now()}
 
 	if len(line) == 0 || strings.Trim(line, " \t\n\r") == "" {
 		return nil
 	}
 
+	// @tag1=value;tag2 :source COMMAND ...
+	if line[0] == '@' {
+		split := strings.SplitN(line[1:], " ", 2)
+		if len(split) < 2 || strings.Trim(split[1], " ") == "" {
+			return nil
+		}
+		im.Tags = parseTags(split[0])
+		line = strings.TrimLeft(split[1], " ")
+	}
+
 	// Omit : at beginning of line
 	if line[0] == ':' {
 		line = line[1:]
@@ -119,3 +203,54 @@ func ParseServerLine(line string) *IRCMessage {
 	//log.Printf("im: %#v\n", im)
 	return im
 }
+
+// Parses the tags part of a line (without the leading '@'). If a key is
+// repeated, the last value counts. Missing and empty values are both "".
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		if tag == "" {
+			continue
+		}
+		kv := strings.SplitN(tag, "=", 2)
+		if len(kv) == 2 {
+			tags[kv[0]] = unescapeTag(kv[1])
+		} else {
+			tags[kv[0]] = ""
+		}
+	}
+	return tags
+}
+
+// Reverses the escaping of tag values: "\:" is ';', "\s" is ' ', "\r" and
+// "\n" are CR and LF and "\\" is '\'. Other escaped characters stand for
+// themselves, a trailing backslash is dropped.
+func unescapeTag(v string) string {
+	if strings.IndexByte(v, '\\') < 0 {
+		return v
+	}
+	buf := make([]byte, 0, len(v))
+	for i := 0; i < len(v); i++ {
+		if v[i] != '\\' {
+			buf = append(buf, v[i])
+			continue
+		}
+		i++
+		if i == len(v) {
+			break
+		}
+		switch v[i] {
+		case ':':
+			buf = append(buf, ';')
+		case 's':
+			buf = append(buf, ' ')
+		case 'r':
+			buf = append(buf, '\r')
+		case 'n':
+			buf = append(buf, '\n')
+		default:
+			buf = append(buf, v[i])
+		}
+	}
+	return string(buf)
+}
@@ -0,0 +1,228 @@
+package ircclient
+
+// Collects the server's ISUPPORT (005) tokens, which describe limits and
+// features of the server (e.g. TARGMAX, CHANTYPES, PREFIX).
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Member modes and their prefixes if the server doesn't send PREFIX (RFC
+// 2812 plus the common extensions)
+const default_prefix = "(qaohv)~&@%+"
+
+// The server's features and limits as announced in ISUPPORT, see
+// IRCClient.ServerInfo(). Defaults are filled in for missing tokens where
+// there are sensible ones, unknown limits are 0.
+type ServerInfo struct {
+	Network string
+	// rfc1459 (the default), strict-rfc1459 or ascii
+	CaseMapping string
+	// Member modes and the corresponding prefixes, most powerful first,
+	// e.g. "ov" and "@+"
+	PrefixModes string
+	Prefixes    string
+	// Characters channel names start with, e.g. "#&"
+	ChanTypes string
+	// Channel modes by type: list modes, modes that always have a
+	// parameter, modes that have one only when set and flags
+	ChanModes  [4]string
+	NickLen    int
+	ChannelLen int
+	TopicLen   int
+	KickLen    int
+	AwayLen    int
+	// All tokens as sent by the server, tokens without value map to ""
+	Tokens map[string]string
+}
+
+type isupportPlugin struct {
+	ic     *IRCClient
+	tokens map[string]string
+	sync.RWMutex
+}
+
+func (is *isupportPlugin) Register(cl *IRCClient) {
+	is.ic = cl
+	is.tokens = make(map[string]string)
+}
+
+func (is *isupportPlugin) String() string {
+	return "isupport"
+}
+
+func (is *isupportPlugin) Info() string {
+	return "collects the features advertised by the server"
+}
+
+func (is *isupportPlugin) Usage(cmd string) string {
+	// stub, no commands here
+	return ""
+}
+
+func (is *isupportPlugin) ProcessCommand(cmd *IRCCommand) {
+}
+
+func (is *isupportPlugin) Unregister() {
+}
+
+func (is *isupportPlugin) OnReconnectReset() {
+	// The next server may support different things
+	is.Lock()
+	is.tokens = make(map[string]string)
+	is.Unlock()
+}
+
+func (is *isupportPlugin) ProcessLine(msg *IRCMessage) {
+	switch msg.Command {
+	case RPL_WELCOME:
+		// New connection, forget what the last server told us
+		is.Lock()
+		is.tokens = make(map[string]string)
+		is.Unlock()
+	case RPL_ISUPPORT:
+		// :server 005 nick TOKEN KEY=value -NEGATED :are supported by this server
+		if len(msg.Args) < 2 {
+			return
+		}
+		is.Lock()
+		defer is.Unlock()
+		for _, tok := range msg.Args[:len(msg.Args)-1] {
+			if strings.HasPrefix(tok, "-") {
+				delete(is.tokens, tok[1:])
+				continue
+			}
+			kv := strings.SplitN(tok, "=", 2)
+			if len(kv) == 2 {
+				is.tokens[kv[0]] = kv[1]
+			} else {
+				is.tokens[kv[0]] = ""
+			}
+		}
+	}
+}
+
+func (is *isupportPlugin) get(key string) (string, bool) {
+	is.RLock()
+	defer is.RUnlock()
+	v, ok := is.tokens[key]
+	return v, ok
+}
+
+// Returns the member modes and their prefixes from PREFIX, e.g. "ov" and "@+"
+func (is *isupportPlugin) prefixes() (modes, prefixes string) {
+	prefix, ok := is.get("PREFIX")
+	if !ok {
+		prefix = default_prefix
+	}
+	// (modes)prefixes, or empty if the server has no member modes at all
+	end := strings.IndexByte(prefix, ')')
+	if !strings.HasPrefix(prefix, "(") || end < 0 || len(prefix)-end-1 != end-1 {
+		return "", ""
+	}
+	return prefix[1:end], prefix[end+1:]
+}
+
+// Returns a snapshot of the server's features
+func (is *isupportPlugin) serverInfo() ServerInfo {
+	var info ServerInfo
+	info.Tokens = make(map[string]string)
+	is.RLock()
+	for k, v := range is.tokens {
+		info.Tokens[k] = v
+	}
+	is.RUnlock()
+
+	info.Network = info.Tokens["NETWORK"]
+	info.CaseMapping = strings.ToLower(info.Tokens["CASEMAPPING"])
+	if info.CaseMapping == "" {
+		info.CaseMapping = "rfc1459"
+	}
+	info.PrefixModes, info.Prefixes = is.prefixes()
+	info.ChanTypes = "#&"
+	if v, ok := info.Tokens["CHANTYPES"]; ok {
+		info.ChanTypes = v
+	}
+	chanmodes, ok := info.Tokens["CHANMODES"]
+	if !ok {
+		chanmodes = default_chanmodes
+	}
+	copy(info.ChanModes[:], strings.SplitN(chanmodes, ",", 4))
+	limits := map[string]*int{
+		"NICKLEN":    &info.NickLen,
+		"CHANNELLEN": &info.ChannelLen,
+		"TOPICLEN":   &info.TopicLen,
+		"KICKLEN":    &info.KickLen,
+		"AWAYLEN":    &info.AwayLen,
+	}
+	for token, limit := range limits {
+		*limit, _ = strconv.Atoi(info.Tokens[token])
+	}
+	return info
+}
+
+// Returns the maximum number of targets the server accepts for command,
+// according to TARGMAX (or MAXTARGETS for PRIVMSG and NOTICE). Returns 0
+// if the server allows an unlimited number of targets and 1 if it didn't
+// tell, as batching targets isn't safe then.
+func (is *isupportPlugin) maxTargets(command string) int {
+	command = strings.ToUpper(command)
+	if targmax, ok := is.get("TARGMAX"); ok {
+		for _, entry := range strings.Split(targmax, ",") {
+			kv := strings.SplitN(entry, ":", 2)
+			if len(kv) != 2 || strings.ToUpper(kv[0]) != command {
+				continue
+			}
+			if kv[1] == "" {
+				return 0
+			}
+			if n, err := strconv.Atoi(kv[1]); err == nil && n > 0 {
+				return n
+			}
+			return 1
+		}
+	}
+	if command == "PRIVMSG" || command == "NOTICE" {
+		if v, ok := is.get("MAXTARGETS"); ok {
+			if n, err := strconv.Atoi(v); err == nil && n > 0 {
+				return n
+			}
+		}
+	}
+	return 1
+}
+
+// Returns whether name starts with one of the server's CHANTYPES ("#&" if
+// not announced) and contains no characters forbidden in channel names
+func (is *isupportPlugin) isChannel(name string) bool {
+	chantypes, ok := is.get("CHANTYPES")
+	if !ok {
+		chantypes = "#&"
+	}
+	return name != "" && strings.IndexByte(chantypes, name[0]) >= 0 && !strings.ContainsAny(name, " ,\x07")
+}
+
+// Folds s to lower case according to the server's CASEMAPPING, so names
+// that the server considers equal are equal after folding. Defaults to
+// rfc1459, where []\~ are the upper case forms of {}|^.
+func (is *isupportPlugin) casefold(s string) string {
+	mapping, _ := is.get("CASEMAPPING")
+	upper := "[]\\~"
+	switch strings.ToLower(mapping) {
+	case "ascii":
+		upper = ""
+	case "strict-rfc1459":
+		upper = "[]\\"
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'A' && r <= 'Z' {
+			return r + 'a' - 'A'
+		}
+		if i := strings.IndexRune(upper, r); i >= 0 {
+			return rune("{}|^"[i])
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,76 @@
+package ircclient
+
+// Plugins that have to do something after connecting but before channels are
+// joined (e.g. authenticate to services, so that the bot's host is hidden
+// when it joins) register a join hold with HoldJoins(). On each connection,
+// the autojoin waits until all holds have been released, see WhenJoinable().
+
+// Protected by IRCClient.stateLock
+type joinHolds struct {
+	// hold name -> released on the current connection
+	holds map[string]bool
+	// run once all holds have been released
+	waiting []func()
+}
+
+// Registers the join hold name, usually from a plugin's Register(). On every
+// connection, WhenJoinable() waits until ReleaseJoins(name) is called, so
+// the plugin must release the hold even if it fails (e.g. after a timeout).
+func (ic *IRCClient) HoldJoins(name string) {
+	ic.stateLock.Lock()
+	defer ic.stateLock.Unlock()
+	if ic.joinHolds.holds == nil {
+		ic.joinHolds.holds = make(map[string]bool)
+	}
+	ic.joinHolds.holds[name] = false
+}
+
+// Releases the join hold name on the current connection
+func (ic *IRCClient) ReleaseJoins(name string) {
+	ic.stateLock.Lock()
+	if _, ok := ic.joinHolds.holds[name]; ok {
+		ic.joinHolds.holds[name] = true
+	}
+	ic.runJoinable()
+}
+
+// Removes the join hold name, e.g. when its plugin is unregistered
+func (ic *IRCClient) RemoveJoinHold(name string) {
+	ic.stateLock.Lock()
+	delete(ic.joinHolds.holds, name)
+	ic.runJoinable()
+}
+
+// Runs f in its own goroutine as soon as all join holds have been released
+// on the current connection, right away if there are none
+func (ic *IRCClient) WhenJoinable(f func()) {
+	ic.stateLock.Lock()
+	ic.joinHolds.waiting = append(ic.joinHolds.waiting, f)
+	ic.runJoinable()
+}
+
+// Starts the waiting functions if there are no holds left. Must be called
+// with stateLock held, which it releases.
+func (ic *IRCClient) runJoinable() {
+	for _, released := range ic.joinHolds.holds {
+		if !released {
+			ic.stateLock.Unlock()
+			return
+		}
+	}
+	waiting := ic.joinHolds.waiting
+	ic.joinHolds.waiting = nil
+	ic.stateLock.Unlock()
+	for _, f := range waiting {
+		go f()
+	}
+}
+
+// Closes all holds for a new connection and forgets the functions waiting
+// on the old one. Must be called with stateLock held.
+func (ic *IRCClient) resetJoinHolds(released bool) {
+	for name := range ic.joinHolds.holds {
+		ic.joinHolds.holds[name] = released
+	}
+	ic.joinHolds.waiting = nil
+}
@@ -0,0 +1,131 @@
+package ircclient
+
+// Keeps an eye on the connection: a PING is sent every Server/pinginterval
+// seconds to measure the lag, and the connection is closed (so Run()
+// reconnects) if nothing at all has been received for Server/pingtimeout
+// seconds. Otherwise a half-dead TCP connection, e.g. after a NAT timeout,
+// leaves the bot waiting for lines that never come.
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Seconds, unless Server/pinginterval and Server/pingtimeout are set
+	default_ping_interval = 60
+	default_ping_timeout  = 240
+	// Prefix of the tokens of our PINGs, so PONGs to other PINGs aren't
+	// mistaken for ours
+	ping_token_prefix = "LAG"
+)
+
+// Sets the keepalive timing. Zero disables the PINGs or the timeout.
+func (ic *ircConn) SetKeepalive(interval, timeout time.Duration) {
+	ic.lagLock.Lock()
+	defer ic.lagLock.Unlock()
+	ic.pingInterval, ic.pingTimeout = interval, timeout
+}
+
+// Returns the round-trip time of the last PING answered. If the current one
+// has been waiting for longer, that time is returned instead, so a growing
+// lag shows before the PONG arrives. 0 if no PING has been answered yet.
+func (ic *ircConn) Lag() time.Duration {
+	ic.lagLock.Lock()
+	defer ic.lagLock.Unlock()
+	if !ic.pingSent.IsZero() && ic.lag > 0 {
+		if waiting := time.Since(ic.pingSent); waiting > ic.lag {
+			return waiting
+		}
+	}
+	return ic.lag
+}
+
+// Called by the reader for every line received
+func (ic *ircConn) received(line string) {
+	now := time.Now()
+	ic.lagLock.Lock()
+	defer ic.lagLock.Unlock()
+	ic.lastRecv = now
+	if ic.pingToken == "" || !strings.Contains(line, " PONG ") {
+		return
+	}
+	msg := ParseServerLine(line)
+	if msg == nil || msg.Command != "PONG" || len(msg.Args) == 0 || msg.Args[len(msg.Args)-1] != ic.pingToken {
+		return
+	}
+	ic.lag = now.Sub(ic.pingSent)
+	ic.pingToken = ""
+	ic.pingSent = time.Time{}
+}
+
+// Sends the PINGs and watches for the timeout until the connection is
+// closed. Started by serve().
+func (ic *ircConn) keepalive() {
+	ic.lagLock.Lock()
+	ic.lastRecv = time.Now()
+	interval, timeout := ic.pingInterval, ic.pingTimeout
+	ic.lagLock.Unlock()
+	if interval <= 0 && timeout <= 0 {
+		return
+	}
+	// check often enough to notice the timeout in time
+	check := interval
+	if check <= 0 || timeout > 0 && timeout/4 < check {
+		check = timeout / 4
+	}
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	var lastPing time.Time
+	for {
+		select {
+		case <-ic.readerDone:
+			return
+		case now := <-ticker.C:
+			ic.lagLock.Lock()
+			idle := now.Sub(ic.lastRecv)
+			ic.lagLock.Unlock()
+			if timeout > 0 && idle >= timeout {
+				logWarnf("nothing received for %v, closing the connection", idle.Round(time.Second))
+				ic.Err <- fmt.Errorf("ping timeout: nothing received for %v", idle.Round(time.Second))
+				// unblocks the reader, which then closes the connection
+				ic.conn.Close()
+				return
+			}
+			if interval > 0 && now.Sub(lastPing) >= interval {
+				lastPing = now
+				ic.ping(now)
+			}
+		}
+	}
+}
+
+// Queues a PING, unless the send queue is full
+func (ic *ircConn) ping(now time.Time) {
+	ic.lagLock.Lock()
+	token := ic.pingToken
+	if token == "" {
+		// the last one has been answered, otherwise it's still measured
+		token = ping_token_prefix + strconv.FormatInt(now.UnixNano(), 10)
+		ic.pingToken = token
+		ic.pingSent = now
+	}
+	ic.lagLock.Unlock()
+	select {
+	case ic.Output <- "PING :" + token:
+	default:
+	}
+}
+
+// Returns the round-trip time to the server of the last PING, see
+// Server/pinginterval. While a PING is unanswered for longer than that, the
+// time since it was sent. 0 if not connected or not measured yet.
+func (ic *IRCClient) Lag() time.Duration {
+	conn := ic.connection()
+	if conn == nil {
+		return 0
+	}
+	return conn.Lag()
+}
@@ -0,0 +1,107 @@
+package ircclient
+
+// Every plugin gets the lines from the server in order from a worker of its
+// own, so a slow plugin neither delays the others nor piles up goroutines
+
+// Lines queued per plugin at most, unless Server/linequeue is set
+const default_line_queue = 100
+
+type lineQueue struct {
+	lines chan *IRCMessage
+	stop  chan bool
+	// Wait for room instead of dropping lines, see Server/linepolicy
+	block bool
+	// Lines are being dropped, only accessed by the dispatching goroutine
+	full bool
+}
+
+// Returns the queue of p, starting its worker on first use. Server/linequeue
+// and Server/linepolicy are read then, the config may not be loaded yet when
+// the plugin is registered. Returns nil if p has been unregistered
+// meanwhile.
+func (ic *IRCClient) lineQueue(p Plugin) *lineQueue {
+	ic.lineQueueLock.Lock()
+	defer ic.lineQueueLock.Unlock()
+	if q, ok := ic.lineQueues[p]; ok {
+		return q
+	}
+	ic.registry.RLock()
+	registered := ic.plugins[p.String()] == p
+	ic.registry.RUnlock()
+	if !registered {
+		return nil
+	}
+	size, err := ic.GetIntOption("Server", "linequeue")
+	if err != nil || size <= 0 {
+		size = default_line_queue
+	}
+	q := &lineQueue{lines: make(chan *IRCMessage, size), stop: make(chan bool)}
+	switch policy := ic.GetStringOption("Server", "linepolicy"); policy {
+	case "", "drop":
+	case "block":
+		q.block = true
+	default:
+		logWarnf("unknown linepolicy %q, dropping lines", policy)
+	}
+	if ic.lineQueues == nil {
+		ic.lineQueues = make(map[Plugin]*lineQueue)
+	}
+	ic.lineQueues[p] = q
+	go ic.lineWorker(p, q)
+	return q
+}
+
+func (ic *IRCClient) lineWorker(p Plugin, q *lineQueue) {
+	for {
+		select {
+		case msg := <-q.lines:
+			ic.runLineHandler(p, msg)
+		case <-q.stop:
+			return
+		}
+	}
+}
+
+// Stops the worker of p, lines still queued are dropped
+func (ic *IRCClient) stopLineQueue(p Plugin) {
+	ic.lineQueueLock.Lock()
+	defer ic.lineQueueLock.Unlock()
+	if q, ok := ic.lineQueues[p]; ok {
+		close(q.stop)
+		delete(ic.lineQueues, p)
+	}
+}
+
+// Passes msg to the line handlers of all plugins. If the queue of a plugin
+// is full, what happens depends on Server/linepolicy:
+//   - "drop" (the default): the plugin doesn't get the line
+//   - "block": wait until there is room again. As no more lines are read
+//     meanwhile, a stuck plugin stalls the whole bot.
+func (ic *IRCClient) queueLine(msg *IRCMessage) {
+	for name, p := range ic.GetPlugins() {
+		if ic.PluginDisabled(name) {
+			continue
+		}
+		q := ic.lineQueue(p)
+		if q == nil {
+			continue
+		}
+		if q.block {
+			select {
+			case q.lines <- msg:
+			case <-q.stop:
+			}
+			continue
+		}
+		select {
+		case q.lines <- msg:
+			q.full = false
+		default:
+			ic.stats.linesDropped.Inc(p.String())
+			if !q.full {
+				logWarnf("line queue of plugin %s is full, dropping lines", p.String())
+				q.full = true
+			}
+		}
+	}
+}
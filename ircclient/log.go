@@ -0,0 +1,155 @@
+package ircclient
+
+// Leveled logging on top of the standard log package. Messages below the
+// current level (Server/loglevel, "info" by default) are discarded. At level
+// debug, every line sent and received is logged, with passwords redacted.
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"unicode"
+)
+
+const (
+	LogDebug = iota
+	LogInfo
+	LogWarn
+	LogError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+// ANSI colors for the level prefixes, used if stderr is a terminal
+var logLevelColors = []string{"\x1b[90m", "\x1b[0m", "\x1b[33m", "\x1b[31m"}
+
+var (
+	logLevel int32 = LogInfo
+	logColor       = isTerminal(os.Stderr)
+)
+
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// Sets the minimum level of messages that are logged, one of the Log
+// constants. May be called at any time.
+func SetLogLevel(level int) {
+	atomic.StoreInt32(&logLevel, int32(level))
+}
+
+// Returns the current log level, see SetLogLevel()
+func LogLevel() int {
+	return int(atomic.LoadInt32(&logLevel))
+}
+
+// Returns the log level with the given name ("debug", "info", "warn" or
+// "error")
+func ParseLogLevel(name string) (int, error) {
+	for level, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return level, nil
+		}
+	}
+	return 0, errors.New("unknown log level: " + name)
+}
+
+// Returns the name of level, see ParseLogLevel()
+func LogLevelName(level int) string {
+	if level < 0 || level >= len(logLevelNames) {
+		return "unknown"
+	}
+	return logLevelNames[level]
+}
+
+func logf(level int, format string, v ...interface{}) {
+	if level < LogLevel() {
+		return
+	}
+	prefix := strings.ToUpper(logLevelNames[level]) + ": "
+	if logColor {
+		prefix = logLevelColors[level] + prefix + "\x1b[0m"
+	}
+	// report the caller of the level function, not us
+	log.Output(3, prefix+fmt.Sprintf(format, v...))
+}
+
+func logDebugf(format string, v ...interface{}) { logf(LogDebug, format, v...) }
+func logInfof(format string, v ...interface{})  { logf(LogInfo, format, v...) }
+func logWarnf(format string, v ...interface{})  { logf(LogWarn, format, v...) }
+func logErrorf(format string, v ...interface{}) { logf(LogError, format, v...) }
+
+// Returns line with passwords replaced by "***", for logging. Works for
+// received lines as well, their tags and source are kept.
+func redactLine(line string) string {
+	rest := line
+	for _, marker := range []string{"@", ":"} {
+		if !strings.HasPrefix(rest, marker) {
+			continue
+		}
+		i := strings.IndexByte(rest, ' ')
+		if i < 0 {
+			return line
+		}
+		rest = strings.TrimLeft(rest[i:], " ")
+	}
+	return line[:len(line)-len(rest)] + redactCommand(rest)
+}
+
+// Redacts a line without tags and source, see redactLine()
+func redactCommand(line string) string {
+	parts := strings.SplitN(line, " ", 3)
+	switch strings.ToUpper(parts[0]) {
+	case "PASS", "AUTHENTICATE":
+		return parts[0] + " ***"
+	case "OPER", "JOIN":
+		// OPER name password, JOIN channels keys
+		if len(parts) == 3 {
+			return parts[0] + " " + parts[1] + " ***"
+		}
+	case "PRIVMSG", "NOTICE":
+		if len(parts) < 3 {
+			break
+		}
+		text := strings.TrimPrefix(parts[2], ":")
+		words := strings.SplitN(text, " ", 2)
+		target := strings.ToLower(parts[1])
+		// e.g. "PRIVMSG NickServ :IDENTIFY password",
+		// "PRIVMSG Q@CServe.quakenet.org :AUTH user password" or the same
+		// sent to us
+		private := target != "" && !strings.ContainsRune("#&!+", rune(target[0]))
+		switch strings.ToUpper(words[0]) {
+		case "IDENTIFY", "AUTH", "LOGIN":
+		default:
+			private = false
+		}
+		if strings.Contains(target, "serv") || private {
+			if len(words) == 2 {
+				return parts[0] + " " + parts[1] + " :" + words[0] + " ***"
+			}
+			break
+		}
+		if redacted, ok := redactSetCommand(text); ok {
+			return parts[0] + " " + parts[1] + " :" + redacted
+		}
+	}
+	return line
+}
+
+// Redacts the value of a set command for an option holding a password (see
+// IsSensitiveOption()), e.g. "!set Server sasl_pass secret" or "bot: set
+// ...", whatever the trigger is
+func redactSetCommand(text string) (string, bool) {
+	words := strings.Fields(text)
+	for i := 0; i < len(words) && i < 2; i++ {
+		cmd := strings.TrimLeftFunc(words[i], func(r rune) bool { return !unicode.IsLetter(r) })
+		if strings.EqualFold(cmd, "set") && len(words) > i+3 && isSensitive(words[i+1], words[i+2]) {
+			return strings.Join(words[:i+3], " ") + " ***", true
+		}
+	}
+	return text, false
+}
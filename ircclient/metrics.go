@@ -0,0 +1,451 @@
+package ircclient
+
+// Metrics in the Prometheus text format. The client keeps some on its own
+// (lines received and sent, commands per plugin, reconnects, handler latency,
+// send queue length), plugins add theirs with the New*() methods of
+// Metrics(). If Metrics/listen is set (e.g. "localhost:9100"), they are
+// served via HTTP at /metrics while connected.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the buckets of handler latencies, in seconds
+var default_latency_buckets = []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30}
+
+// A collection of metrics, see IRCClient.Metrics()
+type Metrics struct {
+	lock    sync.Mutex
+	metrics map[string]metric
+	// the HTTP server, see serve()
+	server *http.Server
+}
+
+type metric interface {
+	desc() *metricDesc
+	write(w io.Writer)
+}
+
+type metricDesc struct {
+	name, help, kind string
+	labels           []string
+}
+
+func (d *metricDesc) desc() *metricDesc {
+	return d
+}
+
+// A counter or gauge, per combination of label values
+type valueMetric struct {
+	metricDesc
+	lock sync.Mutex
+	// label values joined by "\xff" -> value
+	values map[string]*labeledValue
+}
+
+type labeledValue struct {
+	labels []string
+	value  float64
+}
+
+// A value that only goes up, e.g. the number of lines received
+type Counter struct {
+	v *valueMetric
+}
+
+// A value that may go up and down, e.g. the number of channels joined
+type Gauge struct {
+	v *valueMetric
+}
+
+// A gauge whose value is read from a function when the metrics are written
+type gaugeFunc struct {
+	metricDesc
+	f func() float64
+}
+
+// Counts observations (e.g. durations) in buckets
+type Histogram struct {
+	metricDesc
+	buckets []float64
+	lock    sync.Mutex
+	values  map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	// counts[i] is the number of observations <= buckets[i]
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// The metrics the client keeps itself
+type clientMetrics struct {
+	linesReceived *Counter
+	linesSent     *Counter
+	commands      *Counter
+	reconnects    *Counter
+	handlerTime   *Histogram
+	panics        *Counter
+	linesDropped  *Counter
+}
+
+func newMetrics() *Metrics {
+	return &Metrics{metrics: make(map[string]metric)}
+}
+
+// Returns the client's metrics, see NewCounter() and friends to add a metric
+func (ic *IRCClient) Metrics() *Metrics {
+	return ic.metrics
+}
+
+// Registers the client's own metrics
+func (ic *IRCClient) initMetrics() {
+	m := ic.metrics
+	ic.stats.linesReceived, _ = m.NewCounter("mettbot_lines_received_total", "Lines received from the server.")
+	ic.stats.linesSent, _ = m.NewCounter("mettbot_lines_sent_total", "Lines sent to the server.")
+	ic.stats.commands, _ = m.NewCounter("mettbot_commands_total", "Commands dispatched to plugins.", "plugin", "command")
+	ic.stats.reconnects, _ = m.NewCounter("mettbot_reconnects_total", "Connections to the server after the first one.")
+	ic.stats.handlerTime, _ = m.NewHistogram("mettbot_handler_duration_seconds", "Time plugins took to process a line or command.", default_latency_buckets, "plugin", "kind")
+	ic.stats.panics, _ = m.NewCounter("mettbot_plugin_panics_total", "Panics of plugins and event subscribers recovered from.", "plugin")
+	ic.stats.linesDropped, _ = m.NewCounter("mettbot_lines_dropped_total", "Lines not passed to plugins because their queue was full.", "plugin")
+	m.NewGaugeFunc("mettbot_send_queue_length", "Lines waiting to be sent.", func() float64 { return float64(ic.OutboundQueueLen()) })
+}
+
+// Runs the plugin's line handler, measuring the time it takes. Panics are
+// recovered from.
+func (ic *IRCClient) runLineHandler(p Plugin, msg *IRCMessage) {
+	defer ic.recoverPlugin(p, "ProcessLine", nil)
+	start := time.Now()
+	p.ProcessLine(msg)
+	ic.stats.handlerTime.Observe(time.Since(start).Seconds(), p.String(), "line")
+}
+
+// Runs the plugin's command handler, measuring the time it takes. If it
+// panics, the user is told that something went wrong.
+func (ic *IRCClient) runCommandHandler(p Plugin, cmd *IRCCommand) {
+	defer ic.running.Done()
+	defer ic.recoverPlugin(p, "ProcessCommand", func() {
+		ic.Reply(cmd, "Sorry, something went wrong.")
+	})
+	start := time.Now()
+	p.ProcessCommand(cmd)
+	ic.stats.handlerTime.Observe(time.Since(start).Seconds(), p.String(), "command")
+}
+
+// Adds metric, or returns the metric already registered under its name if
+// it's of the same kind and has the same labels (e.g. when a plugin is
+// registered again)
+func (m *Metrics) add(metric metric) (metric, error) {
+	d := metric.desc()
+	if !validMetricName(d.name) {
+		return nil, errors.New("invalid metric name: " + d.name)
+	}
+	for _, l := range d.labels {
+		if !validMetricName(l) || strings.HasPrefix(l, "__") || l == "le" {
+			return nil, errors.New("invalid label name: " + l)
+		}
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if old, ok := m.metrics[d.name]; ok {
+		od := old.desc()
+		if od.kind != d.kind || strings.Join(od.labels, ",") != strings.Join(d.labels, ",") {
+			return nil, fmt.Errorf("metric %s already registered as %s with labels %v", d.name, od.kind, od.labels)
+		}
+		return old, nil
+	}
+	m.metrics[d.name] = metric
+	return metric, nil
+}
+
+// Registers a counter. labels are the names of its labels, values for them
+// have to be passed to Inc() and Add(). If a counter with the same name and
+// labels exists already, it is returned.
+func (m *Metrics) NewCounter(name, help string, labels ...string) (*Counter, error) {
+	v, err := m.add(&valueMetric{metricDesc: metricDesc{name, help, "counter", labels}, values: make(map[string]*labeledValue)})
+	if err != nil {
+		return nil, err
+	}
+	return &Counter{v.(*valueMetric)}, nil
+}
+
+// Registers a gauge, see NewCounter()
+func (m *Metrics) NewGauge(name, help string, labels ...string) (*Gauge, error) {
+	v, err := m.add(&valueMetric{metricDesc: metricDesc{name, help, "gauge", labels}, values: make(map[string]*labeledValue)})
+	if err != nil {
+		return nil, err
+	}
+	return &Gauge{v.(*valueMetric)}, nil
+}
+
+// Registers a gauge whose value is returned by f, which is called whenever
+// the metrics are written. Replaces an existing gauge of the same name.
+func (m *Metrics) NewGaugeFunc(name, help string, f func() float64) error {
+	g := &gaugeFunc{metricDesc{name, help, "gauge", nil}, f}
+	old, err := m.add(g)
+	if err != nil {
+		return err
+	}
+	if old != g {
+		m.lock.Lock()
+		m.metrics[name] = g
+		m.lock.Unlock()
+	}
+	return nil
+}
+
+// Registers a histogram with the given bucket upper bounds, which have to
+// be sorted. See NewCounter().
+func (m *Metrics) NewHistogram(name, help string, buckets []float64, labels ...string) (*Histogram, error) {
+	if !sort.Float64sAreSorted(buckets) {
+		return nil, errors.New("histogram buckets have to be sorted: " + name)
+	}
+	h, err := m.add(&Histogram{metricDesc: metricDesc{name, help, "histogram", labels}, buckets: buckets, values: make(map[string]*histogramValue)})
+	if err != nil {
+		return nil, err
+	}
+	return h.(*Histogram), nil
+}
+
+// Removes the metric name, e.g. when the plugin it belongs to is unloaded
+func (m *Metrics) Unregister(name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.metrics, name)
+}
+
+// Writes all metrics in the Prometheus text format, ordered by name
+func (m *Metrics) WriteText(w io.Writer) error {
+	m.lock.Lock()
+	metrics := make([]metric, 0, len(m.metrics))
+	for _, metric := range m.metrics {
+		metrics = append(metrics, metric)
+	}
+	m.lock.Unlock()
+	sort.Slice(metrics, func(i, j int) bool { return metrics[i].desc().name < metrics[j].desc().name })
+
+	bw := bufio.NewWriter(w)
+	for _, metric := range metrics {
+		d := metric.desc()
+		fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", d.name, escapeHelp(d.help), d.name, d.kind)
+		metric.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Serves the metrics, for the Prometheus server scraping them
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	m.WriteText(w)
+}
+
+// Starts serving the metrics at /metrics on addr, unless they are served
+// already
+func (m *Metrics) serve(addr string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.server != nil {
+		return nil
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	m.server = &http.Server{Handler: mux}
+	go func(s *http.Server) {
+		if err := s.Serve(l); err != nil && err != http.ErrServerClosed {
+			logErrorf("metrics server failed: %v", err)
+		}
+	}(m.server)
+	return nil
+}
+
+// Stops serving the metrics
+func (m *Metrics) stop() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.server != nil {
+		m.server.Close()
+		m.server = nil
+	}
+}
+
+// Returns the value for the label values, creating it if necessary. Returns
+// nil if the number of label values is wrong.
+func (v *valueMetric) get(labels []string) *labeledValue {
+	if len(labels) != len(v.labels) {
+		logWarnf("metric %s needs %d label values, got %d", v.name, len(v.labels), len(labels))
+		return nil
+	}
+	key := strings.Join(labels, "\xff")
+	lv, ok := v.values[key]
+	if !ok {
+		lv = &labeledValue{labels: append([]string(nil), labels...)}
+		v.values[key] = lv
+	}
+	return lv
+}
+
+func (v *valueMetric) add(delta float64, labels []string) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	if lv := v.get(labels); lv != nil {
+		lv.value += delta
+	}
+}
+
+func (v *valueMetric) write(w io.Writer) {
+	v.lock.Lock()
+	defer v.lock.Unlock()
+	keys := make([]string, 0, len(v.values))
+	for key := range v.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	if len(keys) == 0 && len(v.labels) == 0 {
+		fmt.Fprintf(w, "%s 0\n", v.name)
+	}
+	for _, key := range keys {
+		lv := v.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", v.name, formatLabels(v.labels, lv.labels), formatValue(lv.value))
+	}
+}
+
+// Adds 1 to the counter for the label values
+func (c *Counter) Inc(labels ...string) {
+	c.v.add(1, labels)
+}
+
+// Adds delta to the counter for the label values. Negative deltas are
+// ignored, counters only go up.
+func (c *Counter) Add(delta float64, labels ...string) {
+	if delta < 0 {
+		logWarnf("counter %s can't be decreased", c.v.name)
+		return
+	}
+	c.v.add(delta, labels)
+}
+
+// Sets the gauge for the label values
+func (g *Gauge) Set(value float64, labels ...string) {
+	g.v.lock.Lock()
+	defer g.v.lock.Unlock()
+	if lv := g.v.get(labels); lv != nil {
+		lv.value = value
+	}
+}
+
+// Adds delta (which may be negative) to the gauge for the label values
+func (g *Gauge) Add(delta float64, labels ...string) {
+	g.v.add(delta, labels)
+}
+
+func (g *gaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.f()))
+}
+
+// Adds an observation for the label values
+func (h *Histogram) Observe(value float64, labels ...string) {
+	if len(labels) != len(h.labels) {
+		logWarnf("metric %s needs %d label values, got %d", h.name, len(h.labels), len(labels))
+		return
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(labels, "\xff")
+	hv, ok := h.values[key]
+	if !ok {
+		hv = &histogramValue{labels: append([]string(nil), labels...), counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hv
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			hv.counts[i]++
+		}
+	}
+	hv.sum += value
+	hv.count++
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	names := append(append([]string(nil), h.labels...), "le")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		hv := h.values[key]
+		values := append(append([]string(nil), hv.labels...), "")
+		for i, bound := range h.buckets {
+			values[len(values)-1] = formatValue(bound)
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), hv.counts[i])
+		}
+		values[len(values)-1] = "+Inf"
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(names, values), hv.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, hv.labels), formatValue(hv.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, hv.labels), hv.count)
+	}
+}
+
+// Names match [a-zA-Z_:][a-zA-Z0-9_:]*
+func validMetricName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// e.g. {plugin="karma",kind="line"}, empty without labels
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		v := strings.Replace(values[i], `\`, `\\`, -1)
+		v = strings.Replace(v, `"`, `\"`, -1)
+		v = strings.Replace(v, "\n", `\n`, -1)
+		pairs[i] = name + `="` + v + `"`
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func escapeHelp(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	return strings.Replace(s, "\n", `\n`, -1)
+}
@@ -0,0 +1,92 @@
+package ircclient
+
+// A scripted stand-in for an IRC server, so plugins can be tested without
+// network access:
+//
+//   srv := ircclient.NewMockServer()
+//   ic := ircclient.NewIRCClientWithConn("test.cfg", srv.Conn())
+//   ic.RegisterPlugin(new(SayPlugin))
+//   srv.Send(":server 001 testbot :Welcome")
+//   ic.Connect()
+//   go ic.InputLoop()
+//   srv.Send(":admin!~admin@host PRIVMSG #x :.say #y hi")
+//   line, ok := srv.Expect("PRIVMSG #y", time.Second)
+//
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"time"
+)
+
+type MockServer struct {
+	client, server net.Conn
+	// lines to send to the bot, written in order by a separate goroutine
+	outgoing chan string
+	// Lines received from the bot, without "\r\n"
+	Received chan string
+}
+
+// Returns a new server. Pass Conn() to NewIRCClientWithConn().
+func NewMockServer() *MockServer {
+	client, server := net.Pipe()
+	m := &MockServer{client: client, server: server, outgoing: make(chan string, 100), Received: make(chan string, 100)}
+
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				close(m.Received)
+				return
+			}
+			m.Received <- strings.TrimRight(line, "\r\n")
+		}
+	}()
+	go func() {
+		for line := range m.outgoing {
+			if _, err := server.Write([]byte(line + "\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	return m
+}
+
+// Returns the bot's end of the connection
+func (m *MockServer) Conn() net.Conn {
+	return m.client
+}
+
+// Queues line to be sent to the bot. Doesn't block, so lines may be sent
+// before the bot has connected.
+func (m *MockServer) Send(line string) {
+	m.outgoing <- line
+}
+
+// Waits for a line from the bot starting with prefix, skipping all other
+// lines. ok is false if no such line arrived within timeout.
+func (m *MockServer) Expect(prefix string, timeout time.Duration) (line string, ok bool) {
+	deadline := time.After(timeout)
+	for {
+		select {
+		case line, open := <-m.Received:
+			if !open {
+				return "", false
+			}
+			if strings.HasPrefix(line, prefix) {
+				return line, true
+			}
+		case <-deadline:
+			return "", false
+		}
+	}
+}
+
+// Closes the connection, as if the server went away. Send() must not be
+// called afterwards.
+func (m *MockServer) Close() {
+	close(m.outgoing)
+	m.server.Close()
+}
@@ -0,0 +1,61 @@
+package ircclient
+
+// Numeric server replies as defined in RFC 1459/2812 (and the common
+// extensions), used by the library and by plugins instead of the raw
+// three-digit strings.
+
+const (
+	// Connection registration
+	RPL_WELCOME  = "001"
+	RPL_YOURHOST = "002"
+	RPL_CREATED  = "003"
+	RPL_MYINFO   = "004"
+	RPL_ISUPPORT = "005"
+
+	// Command replies
+	RPL_WHOISUSER     = "311"
+	RPL_ENDOFWHO      = "315"
+	RPL_ENDOFWHOIS    = "318"
+	RPL_CHANNELMODEIS = "324"
+	RPL_WHOISACCOUNT  = "330"
+	RPL_NOTOPIC       = "331"
+	RPL_TOPIC         = "332"
+	RPL_TOPICWHOTIME  = "333"
+	RPL_INVITING      = "341"
+	RPL_WHOREPLY      = "352"
+	RPL_NAMREPLY      = "353"
+	RPL_WHOSPCRPL     = "354" // WHOX
+	RPL_ENDOFNAMES    = "366"
+	RPL_MOTD          = "372"
+	RPL_MOTDSTART     = "375"
+	RPL_ENDOFMOTD     = "376"
+	RPL_HOSTHIDDEN    = "396"
+
+	// Error replies
+	ERR_NOSUCHNICK       = "401"
+	ERR_NOSUCHCHANNEL    = "403"
+	ERR_CANNOTSENDTOCHAN = "404"
+	ERR_TOOMANYCHANNELS  = "405"
+	ERR_TOOMANYTARGETS   = "407"
+	ERR_NOMOTD           = "422"
+	ERR_ERRONEUSNICKNAME = "432"
+	ERR_NICKNAMEINUSE    = "433"
+	ERR_NICKCOLLISION    = "436"
+	ERR_UNAVAILRESOURCE  = "437"
+	ERR_NOTONCHANNEL     = "442"
+	ERR_CHANNELISFULL    = "471"
+	ERR_INVITEONLYCHAN   = "473"
+	ERR_BANNEDFROMCHAN   = "474"
+	ERR_BADCHANNELKEY    = "475"
+	ERR_CHANOPRIVSNEEDED = "482"
+
+	// SASL authentication (IRCv3)
+	RPL_LOGGEDIN    = "900"
+	RPL_LOGGEDOUT   = "901"
+	ERR_NICKLOCKED  = "902"
+	RPL_SASLSUCCESS = "903"
+	ERR_SASLFAIL    = "904"
+	ERR_SASLTOOLONG = "905"
+	ERR_SASLABORTED = "906"
+	ERR_SASLALREADY = "907"
+)
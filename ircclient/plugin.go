@@ -1,5 +1,10 @@
 package ircclient
 
+import (
+	"sort"
+	"sync"
+)
+
 // The interface to be implemented by all plugins
 type Plugin interface {
 	// This function is called by IRCClient when registering the plugin.
@@ -22,7 +27,85 @@ type Plugin interface {
 	// initial NOTICEs are _NOT_ passed to this method. Replies can be easily sent
 	// using the Reply() function of the parent IRCClient.
 	ProcessCommand(cmd *IRCCommand)
-	// Automatically called when the connection is lost. Should perform cleanup
-	// work and not expect that the plugin is used again.
+	// Called when the bot shuts down for good (Disconnect(), Restart(),
+	// Shutdown()) or the plugin is unloaded. Should free all resources (close
+	// files and databases, stop goroutines) and not expect that the plugin is
+	// used again. Not called if the connection is merely lost, see
+	// ReconnectHandler.
 	Unregister()
 }
+
+// Optional interface for plugins that want to know why the connection has
+// been lost. ProcessDisconnect() is called before Unregister() or
+// OnReconnectReset(), reason is always a *DisconnectError.
+type DisconnectHandler interface {
+	ProcessDisconnect(reason error)
+}
+
+// Optional interface for plugins keeping state that is only valid for one
+// connection (joined channels, pending requests, ...). OnReconnectReset() is
+// called when the connection has been lost and InputLoop() returns, or when
+// Run() failed to connect, before Run() reconnects with the same plugins
+// (library users calling Connect() and InputLoop() themselves may do the
+// same). It should drop that state, but keep durable resources like open
+// databases or tickers.
+//
+// Which methods are called, in order:
+//   - connection lost: ProcessDisconnect(), OnReconnectReset(), then Run()
+//     reconnects
+//   - Disconnect(), Restart(): ProcessDisconnect(), Unregister()
+//   - Shutdown(), e.g. for an online restart: Unregister()
+//   - UnregisterPlugin(): Unregister()
+type ReconnectHandler interface {
+	OnReconnectReset()
+}
+
+// Optional interface for plugins that read options once (e.g. in Register())
+// and want to pick up changes. ConfigReloaded() is called after the config
+// file has been reloaded (see IRCClient.ReloadConfig()) with the sections
+// whose options changed; IRCClient.ConfigChanged() tells whether one of
+// them is relevant for the plugin's network.
+type ConfigReloadHandler interface {
+	ConfigReloaded(changed []string)
+}
+
+// Constructs a new, unregistered instance of a plugin
+type PluginFactory func() Plugin
+
+var (
+	factories     = make(map[string]PluginFactory)
+	factoriesLock sync.Mutex
+)
+
+// Makes a plugin constructable at runtime (e.g. by an admin command), as Go
+// can't load arbitrary code. Plugin packages usually call this from their
+// init() functions, name should match the plugin's String().
+func RegisterPluginFactory(name string, f PluginFactory) {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	factories[name] = f
+}
+
+// Returns a new instance of the plugin registered with RegisterPluginFactory()
+// under the given name, or nil if there is no such plugin
+func NewPlugin(name string) Plugin {
+	factoriesLock.Lock()
+	f, ok := factories[name]
+	factoriesLock.Unlock()
+	if !ok {
+		return nil
+	}
+	return f()
+}
+
+// Returns the names of all plugins registered with RegisterPluginFactory()
+func PluginFactories() []string {
+	factoriesLock.Lock()
+	defer factoriesLock.Unlock()
+	names := make([]string, 0, len(factories))
+	for name := range factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,225 @@
+package ircclient
+
+// Connecting to the server through a proxy, see Server/proxy: SOCKS5 (RFC
+// 1928, with user/password authentication of RFC 1929) and HTTP CONNECT.
+// The connection stays a plain TCP connection to the proxy, so online
+// restarts keep working.
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Time for the handshake with the proxy
+const proxy_timeout = 30 * time.Second
+
+var socksErrors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// Checks a proxy URL, see Server/proxy
+func parseProxyURL(rawurl string) (*url.URL, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h", "http":
+	default:
+		return nil, errors.New("unsupported proxy " + u.Scheme + ", use socks5://, socks5h:// or http://")
+	}
+	if u.Host == "" {
+		return nil, errors.New("proxy without host")
+	}
+	return u, nil
+}
+
+// Connects to hostport through the proxy, which is connected to with d
+func dialProxy(d *net.Dialer, network string, proxy *url.URL, hostport string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		port := "1080"
+		if proxy.Scheme == "http" {
+			port = "8080"
+		}
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), port)
+	}
+	conn, err := d.Dial(network, proxyAddr)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(proxy_timeout))
+	if proxy.Scheme == "http" {
+		err = httpConnect(conn, proxy, hostport)
+	} else {
+		err = socksConnect(conn, network, proxy, hostport)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("proxy %s: %v", proxyAddr, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func socksConnect(conn net.Conn, network string, proxy *url.URL, hostport string) error {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return errors.New("invalid port " + portStr)
+	}
+
+	// methods: no authentication, user/password if we have one
+	methods := []byte{0}
+	if proxy.User != nil {
+		methods = append(methods, 2)
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 {
+		return errors.New("not a SOCKS5 proxy")
+	}
+	switch reply[1] {
+	case 0:
+	case 2:
+		if proxy.User == nil {
+			return errors.New("proxy wants a user name and password")
+		}
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("user name or password too long")
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("authentication failed")
+		}
+	default:
+		return errors.New("no acceptable authentication method")
+	}
+
+	request := []byte{5, 1, 0}
+	ip := net.ParseIP(host)
+	if ip == nil && proxy.Scheme == "socks5" {
+		// resolved by us, socks5h leaves it to the proxy
+		ipNetwork := "ip"
+		switch network {
+		case "tcp4":
+			ipNetwork = "ip4"
+		case "tcp6":
+			ipNetwork = "ip6"
+		}
+		addr, err := net.ResolveIPAddr(ipNetwork, host)
+		if err != nil {
+			return err
+		}
+		ip = addr.IP
+	}
+	switch {
+	case ip == nil:
+		if len(host) > 255 {
+			return errors.New("host name too long")
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	case ip.To4() != nil:
+		request = append(append(request, 1), ip.To4()...)
+	default:
+		request = append(append(request, 4), ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != 0 {
+		if msg, ok := socksErrors[header[1]]; ok {
+			return errors.New(msg)
+		}
+		return fmt.Errorf("error %d", header[1])
+	}
+	// the address the proxy connects from, not needed
+	var skip int
+	switch header[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		if _, err := io.ReadFull(conn, header[:1]); err != nil {
+			return err
+		}
+		skip = int(header[0])
+	default:
+		return fmt.Errorf("invalid address type %d in reply", header[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, skip+2))
+	return err
+}
+
+func httpConnect(conn net.Conn, proxy *url.URL, hostport string) error {
+	request := "CONNECT " + hostport + " HTTP/1.1\r\nHost: " + hostport + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		request += "Proxy-Authorization: Basic " + base64.StdEncoding.EncodeToString([]byte(proxy.User.Username()+":"+password)) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, request+"\r\n"); err != nil {
+		return err
+	}
+	// read byte by byte, the server may talk right after the header and
+	// nothing of that may be lost in a buffer
+	var header []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(header, []byte("\r\n\r\n")) {
+		if len(header) > 16384 {
+			return errors.New("response header too long")
+		}
+		if _, err := io.ReadFull(conn, b); err != nil {
+			return err
+		}
+		header = append(header, b[0])
+	}
+	response, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(header)), nil)
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return errors.New(response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,51 @@
+package ircclient
+
+// The most recent lines sent to and received from the server, for debugging
+// (see RecentLines())
+
+import (
+	"sync"
+	"time"
+)
+
+// Lines kept by the raw log
+const raw_log_size = 200
+
+// A line sent to or received from the server
+type RawLine struct {
+	Time time.Time
+	// false if the line has been received
+	Sent bool
+	Line string
+}
+
+// A ring buffer of the last raw_log_size lines
+type rawLog struct {
+	lock  sync.Mutex
+	lines []RawLine
+	// index of the oldest line once the buffer is full
+	next int
+}
+
+func (l *rawLog) add(sent bool, line string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	entry := RawLine{time.Now(), sent, redactLine(line)}
+	if len(l.lines) < raw_log_size {
+		l.lines = append(l.lines, entry)
+		return
+	}
+	l.lines[l.next] = entry
+	l.next = (l.next + 1) % raw_log_size
+}
+
+// Returns the lines most recently sent to and received from the server,
+// oldest first. Passwords are replaced by "***" like in the log.
+func (ic *IRCClient) RecentLines() []RawLine {
+	l := &ic.rawLog
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	lines := make([]RawLine, 0, len(l.lines))
+	lines = append(lines, l.lines[l.next:]...)
+	return append(lines, l.lines[:l.next]...)
+}
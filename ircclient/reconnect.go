@@ -0,0 +1,86 @@
+package ircclient
+
+// Reconnecting after the connection has been lost, e.g. by a ping timeout
+// (see keepalive.go) or the server closing it, see Run()
+
+import (
+	"time"
+)
+
+const (
+	// Seconds to wait before reconnecting, unless Server/reconnectdelay and
+	// Server/reconnectmaxdelay are set
+	default_reconnect_delay     = 10
+	default_reconnect_max_delay = 300
+)
+
+// Connects and processes lines like Connect() and InputLoop(), but
+// reconnects whenever the connection is lost or can't be established. Before
+// that, the plugins are told about the lost connection and reset, see
+// ReconnectHandler. Waits Server/reconnectdelay seconds (10 by default)
+// before reconnecting, twice as long after every further failed attempt, up
+// to Server/reconnectmaxdelay seconds (300). Only returns once the bot has
+// been shut down on purpose (Disconnect(), GracefulDisconnect(), Shutdown(),
+// ...), always with ErrQuit.
+func (ic *IRCClient) Run() error {
+	ic.stateLock.Lock()
+	ic.stopped = false
+	ic.stateLock.Unlock()
+	select {
+	case <-ic.stop:
+	default:
+	}
+
+	var delay time.Duration
+	for {
+		started := time.Now()
+		err := ic.Connect()
+		if err == nil {
+			if ic.isStopped() {
+				// shut down while connecting
+				ic.connection().Quit()
+				return ErrQuit
+			}
+			err = ic.InputLoop()
+		} else {
+			// registration may have failed after some lines had been
+			// processed, InputLoop() resets the plugins otherwise
+			ic.connectionLost(&DisconnectError{DisconnectSocketError, err.Error()})
+		}
+		if err == ErrQuit || ic.isStopped() {
+			return ErrQuit
+		}
+
+		min := ic.GetDurationOption("Server", "reconnectdelay", default_reconnect_delay*time.Second)
+		if min <= 0 {
+			min = default_reconnect_delay * time.Second
+		}
+		max := ic.GetDurationOption("Server", "reconnectmaxdelay", default_reconnect_max_delay*time.Second)
+		if max < min {
+			max = min
+		}
+		// start over once a connection has lasted for a while
+		if delay == 0 || time.Since(started) > max {
+			delay = min
+		} else if delay *= 2; delay > max {
+			delay = max
+		}
+		logWarnf("%v, reconnecting in %v", err, delay)
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ic.stop:
+		}
+		timer.Stop()
+		if ic.isStopped() {
+			return ErrQuit
+		}
+	}
+}
+
+// Returns whether shutdown() has been called since Run() started
+func (ic *IRCClient) isStopped() bool {
+	ic.stateLock.Lock()
+	defer ic.stateLock.Unlock()
+	return ic.stopped
+}
@@ -0,0 +1,81 @@
+package ircclient
+
+// Keeps a panicking plugin from taking the whole bot down
+
+import (
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+// Plugins are disabled after this many panics, unless Server/maxpanics is
+// set (0 never disables them)
+const default_max_panics = 5
+
+// Plugins registered by NewIRCClient(), the client doesn't work without them
+var builtin_plugins = map[string]bool{"basic": true, "conf": true, "auth": true, "chanstate": true, "isupport": true, "ctcp": true, "dcc": true}
+
+// Recovers from a panic of plugin p in where (e.g. "ProcessLine"), must be
+// deferred directly. The stack trace is logged, the panic is reported in the
+// channel Server/adminchannel if set and then onPanic is called, unless nil.
+//
+// p may be nil for code that doesn't belong to a plugin (e.g. event
+// subscribers). Otherwise, the panics are counted per plugin and the plugin
+// is disabled after Server/maxpanics of them, see DisablePlugin().
+func (ic *IRCClient) recoverPlugin(p Plugin, where string, onPanic func()) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	name := ""
+	if p != nil {
+		name = p.String()
+		where = "plugin " + name + " in " + where
+	}
+	logErrorf("panic in %s: %v\n%s", where, r, debug.Stack())
+	ic.stats.panics.Inc(name)
+	ic.notifyAdmins(fmt.Sprintf("panic in %s: %v", where, r))
+	if onPanic != nil {
+		onPanic()
+	}
+	if p == nil || builtin_plugins[name] {
+		return
+	}
+
+	max, err := ic.GetIntOption("Server", "maxpanics")
+	if err != nil || max < 0 {
+		max = default_max_panics
+	}
+	ic.stateLock.Lock()
+	if ic.panics == nil {
+		ic.panics = make(map[string]int)
+	}
+	ic.panics[name]++
+	count := ic.panics[name]
+	ic.stateLock.Unlock()
+	if max > 0 && count >= max && !ic.PluginDisabled(name) {
+		logErrorf("disabling plugin %s after %d panics", name, count)
+		ic.notifyAdmins(fmt.Sprintf("plugin %s disabled after %d panics", name, count))
+		if err := ic.DisablePlugin(name); err != nil {
+			logErrorf("unable to disable plugin %s: %v", name, err)
+		}
+	}
+}
+
+// Returns how often the plugin has panicked, see recoverPlugin()
+func (ic *IRCClient) PanicCount(plugin string) int {
+	ic.stateLock.Lock()
+	defer ic.stateLock.Unlock()
+	return ic.panics[plugin]
+}
+
+// Sends message to the channel Server/adminchannel, if set
+func (ic *IRCClient) notifyAdmins(message string) {
+	channel := ic.GetStringOption("Server", "adminchannel")
+	if channel == "" {
+		return
+	}
+	// the panic value may contain anything
+	message = strings.NewReplacer("\r", " ", "\n", " ").Replace(message)
+	ic.SendLine("PRIVMSG " + channel + " :" + message)
+}
@@ -0,0 +1,235 @@
+package ircclient
+
+// Timers for plugins: functions run after a delay (After()) or repeatedly
+// according to a cron-like spec (Schedule()). Jobs don't depend on the
+// connection, so they keep running across reconnects, and are cancelled by
+// Shutdown() and Disconnect().
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Parsed cron spec, each field is a bit set of the allowed values
+type cronSpec struct {
+	minute, hour, dom, month, dow uint64
+	// day of month or day of week is "*", see matchDay()
+	domStar, dowStar bool
+}
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// Parses a cron spec with the fields minute, hour, day of month, month and
+// day of week, e.g. "*/15 8-18 * * 1-5". Fields may be "*", numbers, ranges
+// and lists of them, optionally with a step ("0-30/10"). Sunday is 0 or 7.
+func parseCron(spec string) (*cronSpec, error) {
+	if s, ok := cronDescriptors[spec]; ok {
+		spec = s
+	}
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("cron spec needs 5 fields: " + spec)
+	}
+	s := new(cronSpec)
+	var err error
+	if s.minute, err = parseCronField(fields[0], 0, 59); err != nil {
+		return nil, err
+	}
+	if s.hour, err = parseCronField(fields[1], 0, 23); err != nil {
+		return nil, err
+	}
+	if s.dom, err = parseCronField(fields[2], 1, 31); err != nil {
+		return nil, err
+	}
+	if s.month, err = parseCronField(fields[3], 1, 12); err != nil {
+		return nil, err
+	}
+	if s.dow, err = parseCronField(fields[4], 0, 7); err != nil {
+		return nil, err
+	}
+	if s.dow&(1<<7) != 0 {
+		// 7 is Sunday, too
+		s.dow |= 1
+	}
+	s.domStar = fields[2] == "*"
+	s.dowStar = fields[4] == "*"
+	return s, nil
+}
+
+// Returns the set of values allowed by field, which must be in [min, max]
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.IndexByte(part, '/'); i >= 0 {
+			var err error
+			if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+				return 0, errors.New("invalid step in cron field: " + field)
+			}
+			part = part[:i]
+		}
+		lo, hi := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			var err error
+			if lo, err = strconv.Atoi(bounds[0]); err != nil {
+				return 0, errors.New("invalid cron field: " + field)
+			}
+			hi = lo
+			if len(bounds) == 2 {
+				if hi, err = strconv.Atoi(bounds[1]); err != nil {
+					return 0, errors.New("invalid cron field: " + field)
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 to the end
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return 0, errors.New("cron field out of range: " + field)
+		}
+		for v := lo; v <= hi; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+	return bits, nil
+}
+
+// As in Vixie cron, if both day of month and day of week are restricted, a
+// day matching either of them is fine
+func (s *cronSpec) matchDay(t time.Time) bool {
+	dom := s.dom&(1<<uint(t.Day())) != 0
+	dow := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// Returns the first time after t matching the spec, in t's location. ok is
+// false if there is none within the next five years (e.g. "0 0 31 2 *").
+func (s *cronSpec) next(t time.Time) (time.Time, bool) {
+	t = t.Truncate(time.Minute).Add(time.Minute)
+	limit := t.AddDate(5, 0, 0)
+	for t.Before(limit) {
+		if s.month&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.hour&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, t.Location())
+			continue
+		}
+		if s.minute&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+// Runs f in its own goroutine whenever the time matches spec, a cron spec
+// (see parseCron()) or one of "@hourly", "@daily", "@weekly", "@monthly",
+// "@yearly" and "@every <duration>" (e.g. "@every 10m"). Times are local.
+// The job runs until cancel is called or the bot shuts down.
+func (ic *IRCClient) Schedule(spec string, f func()) (cancel func(), err error) {
+	if strings.HasPrefix(spec, "@every ") {
+		d, err := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if err != nil {
+			return nil, err
+		}
+		if d <= 0 {
+			return nil, errors.New("@every needs a positive duration: " + spec)
+		}
+		return ic.startJob(func(t time.Time) (time.Time, bool) { return t.Add(d), true }, f), nil
+	}
+	s, err := parseCron(spec)
+	if err != nil {
+		return nil, err
+	}
+	return ic.startJob(s.next, f), nil
+}
+
+// Runs f in its own goroutine once d has passed, unless cancel is called or
+// the bot shuts down before
+func (ic *IRCClient) After(d time.Duration, f func()) (cancel func()) {
+	fired := false
+	return ic.startJob(func(t time.Time) (time.Time, bool) {
+		if fired {
+			return time.Time{}, false
+		}
+		fired = true
+		return t.Add(d), true
+	}, f)
+}
+
+// Starts a job running f at the times returned by next, until next returns
+// false or the job is cancelled
+func (ic *IRCClient) startJob(next func(time.Time) (time.Time, bool), f func()) (cancel func()) {
+	stop := make(chan bool)
+	ic.jobLock.Lock()
+	if ic.jobs == nil {
+		ic.jobs = make(map[int]chan bool)
+	}
+	id := ic.nextJobID
+	ic.nextJobID++
+	ic.jobs[id] = stop
+	ic.jobLock.Unlock()
+
+	cancel = func() {
+		ic.jobLock.Lock()
+		defer ic.jobLock.Unlock()
+		if _, ok := ic.jobs[id]; ok {
+			delete(ic.jobs, id)
+			close(stop)
+		}
+	}
+	go func() {
+		now := time.Now()
+		for {
+			t, ok := next(now)
+			if !ok {
+				cancel()
+				return
+			}
+			timer := time.NewTimer(t.Sub(time.Now()))
+			select {
+			case now = <-timer.C:
+				if now.Before(t) {
+					// the wall clock has been set back
+					now = t
+				}
+				go f()
+			case <-stop:
+				timer.Stop()
+				return
+			}
+		}
+	}()
+	return cancel
+}
+
+// Cancels all jobs started by Schedule() and After()
+func (ic *IRCClient) cancelJobs() {
+	ic.jobLock.Lock()
+	defer ic.jobLock.Unlock()
+	for id, stop := range ic.jobs {
+		delete(ic.jobs, id)
+		close(stop)
+	}
+}
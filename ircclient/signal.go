@@ -0,0 +1,92 @@
+package ircclient
+
+// Graceful shutdown, e.g. when the service manager stops the bot, and
+// reloading the config file on SIGHUP
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	// Seconds to wait for running command handlers, unless
+	// Server/shutdowntimeout is set
+	default_shutdown_timeout = 10
+	// Used if Server/quitmsg isn't set
+	default_shutdown_quitmsg = "Shutting down"
+)
+
+// Calls GracefulDisconnect() with the quit message Server/quitmsg when the
+// process receives SIGTERM or SIGINT, which makes InputLoop() return
+// ErrQuit. A second signal exits immediately. SIGHUP reloads the config
+// file, see ReloadConfig().
+func (ic *IRCClient) HandleSignals() {
+	ic.handleShutdownSignals()
+	ic.handleHangup()
+}
+
+// Reloads the config file on every SIGHUP
+func (ic *IRCClient) handleHangup() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	go func() {
+		for range c {
+			logInfof("received SIGHUP, reloading the config file")
+			if _, err := ic.ReloadConfig(); err != nil {
+				logErrorf("unable to reload config, keeping the current one: %v", err)
+			}
+		}
+	}()
+}
+
+func (ic *IRCClient) handleShutdownSignals() {
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-c
+		logInfof("received %v, shutting down", sig)
+		go func() {
+			<-c
+			logWarnf("received another signal, exiting without cleaning up")
+			os.Exit(1)
+		}()
+		quitmsg := ic.GetStringOption("Server", "quitmsg")
+		if quitmsg == "" {
+			quitmsg = default_shutdown_quitmsg
+		}
+		ic.GracefulDisconnect(quitmsg)
+	}()
+}
+
+// Like Disconnect(), but doesn't dispatch any more commands and first waits
+// for the running command handlers to return, at most Server/shutdowntimeout
+// seconds (10 by default). The config is written before the plugins are
+// unregistered. Must not be called from a command handler, as it would wait
+// for itself.
+func (ic *IRCClient) GracefulDisconnect(quitmsg string) {
+	ic.stateLock.Lock()
+	ic.closing = true
+	ic.stateLock.Unlock()
+
+	timeout, err := ic.GetIntOption("Server", "shutdowntimeout")
+	if err != nil || timeout < 0 {
+		timeout = default_shutdown_timeout
+	}
+	done := make(chan bool)
+	go func() {
+		ic.running.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Duration(timeout) * time.Second):
+		logWarnf("command handlers still running after %d seconds, disconnecting anyway", timeout)
+	}
+
+	if err := ic.FlushConfig(); err != nil {
+		logErrorf("unable to write config: %v", err)
+	}
+	ic.Disconnect(quitmsg)
+}
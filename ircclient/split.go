@@ -0,0 +1,134 @@
+package ircclient
+
+// Splitting of messages that don't fit into a single line. The server
+// relays our messages as ":nick!user@host PRIVMSG target :text\r\n", which
+// may be at most 512 bytes long, so the text has to be shorter than what
+// SendLine() would send. Lines that are still too long are cut by
+// SendLine().
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	// Longest line without "\r\n"
+	max_line_length = 510
+	// Assumed length of our host as long as we don't know it
+	max_host_length = 63
+	// Messages are never split into shorter pieces than this, even with
+	// absurdly long nicks or targets
+	min_split_length = 64
+)
+
+// Sends message to target with PRIVMSG, split into several lines on word
+// boundaries if it's too long for one
+func (ic *IRCClient) Privmsg(target, message string) error {
+	return ic.sendMessage("PRIVMSG", target, message)
+}
+
+// Like Privmsg(), but sends NOTICEs
+func (ic *IRCClient) Notice(target, message string) error {
+	return ic.sendMessage("NOTICE", target, message)
+}
+
+// Sends message to target with command, split to fit into lines as the
+// server relays them. Returns the first error of SendLine().
+func (ic *IRCClient) sendMessage(command, target, message string) error {
+	return ic.sendCTCP(command, target, "", message)
+}
+
+// Like sendMessage(), but wraps each line into a CTCP message of type ctcp
+// (e.g. "ACTION") unless it's empty
+func (ic *IRCClient) sendCTCP(command, target, ctcp, message string) error {
+	if err := checkParam("target", target); err != nil {
+		return err
+	}
+	before, after := "", ""
+	if ctcp != "" {
+		before, after = "\x01"+ctcp+" ", "\x01"
+	}
+	max := max_line_length - ic.ownPrefixLen() - len(command+" "+target+" :"+before+after)
+	if max < min_split_length {
+		max = min_split_length
+	}
+	var firstErr error
+	for _, line := range splitMessage(message, max) {
+		if err := ic.SendLine(command + " " + target + " :" + before + line + after); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Returns the length of the prefix the server puts in front of our lines
+// when relaying them, ":nick!user@host ". As long as our host is unknown,
+// the longest one is assumed.
+func (ic *IRCClient) ownPrefixLen() int {
+	nick := ic.GetStringOption("Server", "nick")
+	if cs, ok := ic.GetPlugin("chanstate").(*chanStatePlugin); ok {
+		if u, ok := cs.knownUser(nick); ok {
+			return len(":" + nick + "!" + u.Ident + "@" + u.Host + " ")
+		}
+	}
+	return ic.maxPrefixLen()
+}
+
+// Returns the length of our prefix with the longest host
+func (ic *IRCClient) maxPrefixLen() int {
+	// the server may prepend ~ to the ident
+	return len(":"+ic.GetStringOption("Server", "nick")+"!~"+ic.GetStringOption("Server", "ident")+"@ ") + max_host_length
+}
+
+// Splits text into pieces of at most max bytes, at spaces if possible and
+// never within a UTF-8 character. Newlines are treated as spaces, as
+// SendLine() would replace them anyway.
+func splitMessage(text string, max int) []string {
+	text = strings.NewReplacer("\r\n", " ", "\r", " ", "\n", " ").Replace(text)
+	var lines []string
+	for len(text) > max {
+		cut := strings.LastIndexByte(text[:max+1], ' ')
+		next := cut + 1
+		if cut <= 0 {
+			// a single long word
+			cut = max
+			for cut > 0 && !utf8.RuneStart(text[cut]) {
+				cut--
+			}
+			if cut == 0 {
+				cut = max
+			}
+			next = cut
+		}
+		lines = append(lines, text[:cut])
+		text = strings.TrimLeft(text[next:], " ")
+	}
+	if text != "" || len(lines) == 0 {
+		lines = append(lines, text)
+	}
+	return lines
+}
+
+// Cuts line so it fits into 512 bytes as the server relays it, with our
+// prefix and "\r\n", appending Server/ellipsis if set. Never cuts within a
+// UTF-8 character.
+func (ic *IRCClient) truncateLine(line string) string {
+	// don't look up our prefix for lines that fit even with the longest host
+	if len(line) <= max_line_length-ic.maxPrefixLen() {
+		return line
+	}
+	max := max_line_length - ic.ownPrefixLen()
+	if len(line) <= max {
+		return line
+	}
+	ellipsis := ic.GetStringOption("Server", "ellipsis")
+	if len(ellipsis) >= max {
+		ellipsis = ""
+	}
+	cut := max - len(ellipsis)
+	for cut > 0 && !utf8.RuneStart(line[cut]) {
+		cut--
+	}
+	logWarnf("%s line too long, cut after %d bytes", strings.SplitN(line, " ", 2)[0], cut)
+	return line[:cut] + ellipsis
+}
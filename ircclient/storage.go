@@ -0,0 +1,154 @@
+package ircclient
+
+// Persistent key-value storage for plugins, so data like quotes or counters
+// doesn't end up in the config file. All plugins share one SQLite database
+// (Storage/file, "storage.db" by default), each one gets its own namespace.
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+)
+
+const default_storage_file = "storage.db"
+
+// The keys and values of a single plugin, see IRCClient.Storage(). Safe for
+// concurrent use. Each write is atomic: after a crash, a key has either its
+// old or its new value.
+type Store struct {
+	db        *sql.DB
+	namespace string
+	// serializes Update(), so read-modify-write cycles don't interleave
+	updateLock *sync.Mutex
+}
+
+// Returns the storage of the plugin called name. The database is opened on
+// first use and closed by Shutdown(). The clients of a BotManager use one
+// namespace per network, "<network>/<name>".
+func (ic *IRCClient) Storage(name string) (*Store, error) {
+	if name == "" {
+		return nil, errors.New("empty storage namespace")
+	}
+	ic.storageLock.Lock()
+	defer ic.storageLock.Unlock()
+	if ic.storage == nil {
+		file := ic.GetStringOption("Storage", "file")
+		if file == "" {
+			file = default_storage_file
+			log.Println("added default storage file \"" + file + "\" to config file")
+			ic.SetStringOption("Storage", "file", file)
+		}
+		db, err := openStorage(file)
+		if err != nil {
+			return nil, err
+		}
+		ic.storage = db
+	}
+	if ic.network != "" {
+		name = ic.network + "/" + name
+	}
+	return &Store{ic.storage, name, &ic.storageUpdate}, nil
+}
+
+// Closes the storage database, if it has been opened
+func (ic *IRCClient) closeStorage() {
+	ic.storageLock.Lock()
+	defer ic.storageLock.Unlock()
+	if ic.storage == nil {
+		return
+	}
+	if err := ic.storage.Close(); err != nil {
+		logErrorf("unable to close storage: %v", err)
+	}
+	ic.storage = nil
+}
+
+// Opens the database in file, creating it if necessary
+func openStorage(file string) (*sql.DB, error) {
+	db, err := sql.Open("sqlite", file)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows only one writer anyway, with a single connection
+	// concurrent writes wait instead of failing with "database is locked"
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec("CREATE TABLE IF NOT EXISTS storage (namespace TEXT NOT NULL, key TEXT NOT NULL, value TEXT NOT NULL, PRIMARY KEY (namespace, key))")
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Returns the value of key, ok is false if there is no such key
+func (s *Store) Get(key string) (value string, ok bool, err error) {
+	err = s.db.QueryRow("SELECT value FROM storage WHERE namespace = ? AND key = ?", s.namespace, key).Scan(&value)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return value, true, nil
+}
+
+// Sets key to value, replacing the old value
+func (s *Store) Put(key, value string) error {
+	_, err := s.db.Exec("INSERT OR REPLACE INTO storage (namespace, key, value) VALUES (?, ?, ?)", s.namespace, key, value)
+	return err
+}
+
+// Removes key, deleting a key that doesn't exist is no error
+func (s *Store) Delete(key string) error {
+	_, err := s.db.Exec("DELETE FROM storage WHERE namespace = ? AND key = ?", s.namespace, key)
+	return err
+}
+
+// Calls fn for each key and its value, sorted by key, until fn returns
+// false. fn may use the store, e.g. to delete the key.
+func (s *Store) Iterate(fn func(key, value string) bool) error {
+	rows, err := s.db.Query("SELECT key, value FROM storage WHERE namespace = ? ORDER BY key", s.namespace)
+	if err != nil {
+		return err
+	}
+	// read everything first, the only connection is busy while rows is open
+	var keys, values []string
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			rows.Close()
+			return err
+		}
+		keys = append(keys, key)
+		values = append(values, value)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for i := range keys {
+		if !fn(keys[i], values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Replaces the value of key with the one returned by fn, which gets the
+// current value (ok is false if there is none). If fn returns keep = false,
+// the key is deleted. Other updates of the same database wait meanwhile, so
+// e.g. counters can be incremented safely.
+func (s *Store) Update(key string, fn func(value string, ok bool) (newValue string, keep bool)) error {
+	s.updateLock.Lock()
+	defer s.updateLock.Unlock()
+	value, ok, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	value, keep := fn(value, ok)
+	if !keep {
+		return s.Delete(key)
+	}
+	return s.Put(key, value)
+}
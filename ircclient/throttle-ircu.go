@@ -1,32 +1,111 @@
 package ircclient
 
-// Implement Undernet ircu's throttling algorithm here
+// Flood protection: lines are sent at most at Server/floodrate lines per
+// minute, after an initial burst of Server/floodburst lines (token bucket).
+// This keeps the bot below the rate at which servers like ircu kill clients
+// with "Excess Flood".
 
 import (
+	"strings"
+	"sync"
 	"time"
 )
 
+// Lines sent to a target are accounted for this long
+const send_rate_window = 30 * time.Second
+
+const (
+	// Lines that may be sent at once after being idle
+	default_flood_burst = 5
+	// Lines per minute once the burst is used up, ircu allows about one
+	// line every two seconds
+	default_flood_rate = 30
+)
+
 type throttleIrcu struct {
-	lastsent  time.Time
-	tscounter time.Time
+	// bucket size and time to earn a token, no limit if interval is 0
+	burst    int
+	interval time.Duration
+	// tokens available at time refilled
+	tokens   float64
+	refilled time.Time
+	// lowercased target -> times of the lines sent to it within the window
+	targets map[string][]time.Time
+	sync.Mutex
 }
 
-func newthrottleIrcu() *throttleIrcu {
-	// Could be handy later
-	return &throttleIrcu{lastsent: time.Now(), tscounter: time.Now()}
+// Returns a throttle allowing burst lines at once and rate lines per minute
+// after that. A rate of 0 disables the throttling.
+func newthrottleIrcu(burst, rate int) *throttleIrcu {
+	tm := &throttleIrcu{burst: burst, tokens: float64(burst), refilled: time.Now()}
+	if tm.burst < 1 {
+		tm.burst = 1
+		tm.tokens = 1
+	}
+	if rate > 0 {
+		tm.interval = time.Minute / time.Duration(rate)
+	}
+	return tm
 }
 
+// Blocks until line may be sent without exceeding the rate
 func (tm *throttleIrcu) WaitSend(line string) {
-	/*
-	tm.lastsent = time.Now()
-	if tm.lastsent.Sub(tm.tscounter) > 0 {
-		tm.tscounter = time.Now()
-	}
-	tm.tscounter = tm.tscounter.Add(time.Duration(2+len(line)/120) * time.Second)
-	t := tm.tscounter.Sub(time.Now())
-	if t-(10*time.Second) > 0 {
-		time.Sleep(t - (10 * time.Second))
-	}
-	return
-	*/
+	tm.Lock()
+	if tm.interval <= 0 {
+		tm.Unlock()
+		return
+	}
+	now := time.Now()
+	tm.tokens += float64(now.Sub(tm.refilled)) / float64(tm.interval)
+	if tm.tokens > float64(tm.burst) {
+		tm.tokens = float64(tm.burst)
+	}
+	tm.refilled = now
+	tm.tokens--
+	// a negative balance is the debt the line has to wait for
+	wait := time.Duration(-tm.tokens * float64(tm.interval))
+	tm.Unlock()
+	if wait > 0 {
+		logDebugf("flood protection, delaying line by %v", wait)
+		time.Sleep(wait)
+	}
+}
+
+// Accounts a line that has been sent to the server to its targets
+func (tm *throttleIrcu) Sent(line string) {
+	parts := strings.SplitN(line, " ", 3)
+	if len(parts) < 3 || (parts[0] != "PRIVMSG" && parts[0] != "NOTICE") {
+		return
+	}
+	now := time.Now()
+	tm.Lock()
+	defer tm.Unlock()
+	if tm.targets == nil {
+		tm.targets = make(map[string][]time.Time)
+	}
+	for _, target := range strings.Split(parts[1], ",") {
+		key := strings.ToLower(target)
+		tm.targets[key] = append(tm.expire(tm.targets[key], now), now)
+	}
+	// forget targets we haven't talked to recently
+	for key, times := range tm.targets {
+		if times = tm.expire(times, now); len(times) == 0 {
+			delete(tm.targets, key)
+		}
+	}
+}
+
+// Returns the number of lines sent to target within the window
+func (tm *throttleIrcu) SendRate(target string) (int, time.Duration) {
+	tm.Lock()
+	defer tm.Unlock()
+	return len(tm.expire(tm.targets[strings.ToLower(target)], time.Now())), send_rate_window
+}
+
+// Removes the send times that are outside the window
+func (tm *throttleIrcu) expire(times []time.Time, now time.Time) []time.Time {
+	for len(times) > 0 && now.Sub(times[0]) > send_rate_window {
+		times = times[1:]
+	}
+	return times
 }
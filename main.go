@@ -5,6 +5,7 @@ import (
 	"./plugins"
 	"log"
 	"math/rand"
+	"os"
 	"time"
 )
 
@@ -12,31 +13,77 @@ func main() {
 	rand.Seed(time.Now().Unix())
 	log.SetFlags(log.Lshortfile)
 
-	s := ircclient.NewIRCClient("mettbot.cfg")
-	s.RegisterPlugin(new(plugins.KexecPlugin))
-	s.RegisterPlugin(new(plugins.ListPlugins))
-	s.RegisterPlugin(new(plugins.LoggerPlugin))
-	s.RegisterPlugin(new(plugins.QuitHandler))
-	s.RegisterPlugin(new(plugins.ChannelsPlugin))
-	s.RegisterPlugin(new(plugins.AdminPlugin))
-	s.RegisterPlugin(new(plugins.TwitterPlugin))
-	s.RegisterPlugin(new(plugins.DongPlugin))
-	s.RegisterPlugin(new(plugins.TopicDiffPlugin))
-	s.RegisterPlugin(new(plugins.MumblePlugin))
-	s.RegisterPlugin(new(plugins.QuoteDBPlugin))
-	s.RegisterPlugin(new(plugins.MettDBPlugin))
-	s.RegisterPlugin(new(plugins.XKCDPlugin))
-	//s.RegisterPlugin(new(plugins.AltPlugin))
-	s.RegisterPlugin(new(plugins.TemperaturPlugin))
-	//s.RegisterPlugin(new(plugins.CorrectionPlugin))
+	// TOML and YAML files (e.g. after migrateconfig) are preferred to the
+	// old INI file
+	configfile := "mettbot.cfg"
+	for _, f := range []string{"mettbot.toml", "mettbot.yaml", "mettbot.yml"} {
+		if _, err := os.Stat(f); err == nil {
+			configfile = f
+			break
+		}
+	}
 
-	err := s.Connect()
-	if err != nil {
-		log.Fatal(err.Error())
+	// one client per network in section Networks, see BotManager
+	m := ircclient.NewBotManager(configfile)
+	for _, f := range []ircclient.PluginFactory{
+		func() ircclient.Plugin { return new(plugins.KexecPlugin) },
+		func() ircclient.Plugin { return new(plugins.ListPlugins) },
+		func() ircclient.Plugin { return new(plugins.HelpPlugin) },
+		func() ircclient.Plugin { return new(plugins.PluginManager) },
+		func() ircclient.Plugin { return new(plugins.ACLPlugin) },
+		func() ircclient.Plugin { return new(plugins.StatusPlugin) },
+		func() ircclient.Plugin { return new(plugins.DashboardPlugin) },
+		func() ircclient.Plugin { return new(plugins.LoggerPlugin) },
+		func() ircclient.Plugin { return new(plugins.QuitHandler) },
+		func() ircclient.Plugin { return new(plugins.ChannelsPlugin) },
+		func() ircclient.Plugin { return new(plugins.AdminPlugin) },
+		func() ircclient.Plugin { return new(plugins.InvitePlugin) },
+		func() ircclient.Plugin { return new(plugins.NickServPlugin) },
+		func() ircclient.Plugin { return new(plugins.QAuthPlugin) },
+		func() ircclient.Plugin { return new(plugins.TwitterPlugin) },
+		func() ircclient.Plugin { return new(plugins.URLTitlePlugin) },
+		func() ircclient.Plugin { return new(plugins.DongPlugin) },
+		func() ircclient.Plugin { return new(plugins.TopicDiffPlugin) },
+		func() ircclient.Plugin { return new(plugins.MumblePlugin) },
+		func() ircclient.Plugin { return new(plugins.QuoteDBPlugin) },
+		func() ircclient.Plugin { return new(plugins.MettDBPlugin) },
+		func() ircclient.Plugin { return new(plugins.SeenPlugin) },
+		func() ircclient.Plugin { return new(plugins.TellPlugin) },
+		func() ircclient.Plugin { return new(plugins.RemindPlugin) },
+		func() ircclient.Plugin { return new(plugins.FeedPlugin) },
+		func() ircclient.Plugin { return new(plugins.WebhookPlugin) },
+		func() ircclient.Plugin { return new(plugins.APIPlugin) },
+		func() ircclient.Plugin { return new(plugins.KarmaPlugin) },
+		func() ircclient.Plugin { return new(plugins.FactoidPlugin) },
+		func() ircclient.Plugin { return new(plugins.LuaPlugin) },
+		func() ircclient.Plugin { return new(plugins.ExternalPlugin) },
+		func() ircclient.Plugin { return new(plugins.XKCDPlugin) },
+		//func() ircclient.Plugin { return new(plugins.AltPlugin) },
+		func() ircclient.Plugin { return new(plugins.TemperaturPlugin) },
+		//func() ircclient.Plugin { return new(plugins.CorrectionPlugin) },
+	} {
+		if err := m.RegisterPerNetwork(f); err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	// one instance for all networks, they relay between them
+	for _, p := range []ircclient.Plugin{
+		new(plugins.RelayPlugin),
+		new(plugins.MatrixPlugin),
+		new(plugins.DiscordPlugin),
+		new(plugins.TelegramPlugin),
+		new(plugins.XMPPPlugin),
+	} {
+		if err := m.RegisterPlugin(p); err != nil {
+			log.Fatal(err.Error())
+		}
 	}
 
-	err = s.InputLoop()
-	if err != nil {
-		log.Fatal(err.Error())
+	m.HandleSignals()
+	err := m.Run()
+	if err == ircclient.ErrQuit {
+		log.Println("disconnected, bye")
+		return
 	}
+	log.Fatal(err.Error())
 }
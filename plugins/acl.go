@@ -0,0 +1,194 @@
+package plugins
+
+// Manages the auth database from IRC. Overrides the access command of the
+// auth plugin with "access add|del|list|check"; unloading acl brings the old
+// one back.
+
+import (
+	"../ircclient"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	default_acl_access = 500
+)
+
+type ACLPlugin struct {
+	ic *ircclient.IRCClient
+}
+
+// An entry of the auth database, see IRCClient.GetAccessLevels()
+type aclEntry struct {
+	mask, channel string
+	level         int
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("acl", func() ircclient.Plugin { return new(ACLPlugin) })
+}
+
+func (q *ACLPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.ic.RegisterCommandHandler("access", 1, default_acl_access, q)
+	// Don't tell the whole channel who has which access
+	q.ic.SetReplyMode("access", ircclient.ReplyModePrivate)
+}
+
+func (q *ACLPlugin) String() string {
+	return "acl"
+}
+
+func (q *ACLPlugin) Info() string {
+	return "manages the access levels of users from IRC"
+}
+
+func (q *ACLPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "access":
+		return "access add <mask> <level> [#channel] | access del <mask> [#channel] | access list [#channel] | access check <nick|mask> [#channel]: " +
+			"manages the access levels of hostmasks (regular expressions) and services accounts (account/<name>), in all channels or only in #channel"
+	}
+	return ""
+}
+
+func (q *ACLPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	// empty
+}
+
+func (q *ACLPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// optional channel after the required arguments of each subcommand
+	channel := func(n int) string {
+		if len(cmd.Args) > n {
+			return cmd.Args[n]
+		}
+		return ""
+	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "add":
+		if len(cmd.Args) < 3 {
+			q.ic.Reply(cmd, q.ic.GetUsage("access"))
+			return
+		}
+		level, err := strconv.Atoi(cmd.Args[2])
+		if err != nil {
+			q.ic.Reply(cmd, "Invalid level "+cmd.Args[2])
+			return
+		}
+		ch := channel(3)
+		own := q.ic.GetAccessLevel(cmd.Source, ch)
+		old, ok := q.entry(cmd.Args[1], ch)
+		if level > own || (ok && old.level >= own) {
+			q.ic.Reply(cmd, "You are not authorized to do this")
+			return
+		}
+		if ok {
+			// overwrite it instead of adding one with different case
+			ch = old.channel
+		}
+		if err := q.ic.SetChannelAccessLevel(cmd.Args[1], ch, level); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, fmt.Sprintf("%s now has access level %d%s", cmd.Args[1], level, q.in(ch)))
+	case "del":
+		if len(cmd.Args) < 2 {
+			q.ic.Reply(cmd, q.ic.GetUsage("access"))
+			return
+		}
+		ch := channel(2)
+		e, ok := q.entry(cmd.Args[1], ch)
+		if !ok {
+			q.ic.Reply(cmd, "No entry for "+cmd.Args[1]+q.in(ch))
+			return
+		}
+		if e.level >= q.ic.GetAccessLevel(cmd.Source, ch) {
+			q.ic.Reply(cmd, "Can't remove "+cmd.Args[1]+": has higher privileges than you")
+			return
+		}
+		if err := q.ic.DelChannelAccessLevel(e.mask, e.channel); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "Removed "+cmd.Args[1]+q.in(ch))
+	case "list":
+		ch := channel(1)
+		entries := q.entries()
+		n := 0
+		for _, e := range entries {
+			if ch != "" && q.ic.CanonChannel(e.channel) != q.ic.CanonChannel(ch) {
+				continue
+			}
+			q.ic.Reply(cmd, fmt.Sprintf("%s%s: %d", e.mask, q.in(e.channel), e.level))
+			n++
+		}
+		if n == 0 {
+			q.ic.Reply(cmd, "No entries"+q.in(ch))
+		}
+	case "check":
+		if len(cmd.Args) < 2 {
+			q.ic.Reply(cmd, q.ic.GetUsage("access"))
+			return
+		}
+		host := cmd.Args[1]
+		if !strings.ContainsAny(host, "!@") {
+			// It's a nick, we need the full hostmask
+			u, ok := q.ic.LookupUser(host)
+			if !ok {
+				q.ic.Reply(cmd, "Unable to find out the hostmask of "+host)
+				return
+			}
+			host = u.Nick + "!" + u.Ident + "@" + u.Host
+		}
+		ch := channel(2)
+		q.ic.Reply(cmd, fmt.Sprintf("%s has access level %d%s", host, q.ic.GetAccessLevel(host, ch), q.in(ch)))
+	default:
+		q.ic.Reply(cmd, q.ic.GetUsage("access"))
+	}
+}
+
+func (q *ACLPlugin) Unregister() {
+	// nothing to do here
+}
+
+// Returns all entries of the auth database, highest level first
+func (q *ACLPlugin) entries() []aclEntry {
+	entries := make([]aclEntry, 0)
+	for key, level := range q.ic.GetAccessLevels() {
+		e := aclEntry{mask: key, level: level}
+		if i := strings.LastIndex(key, " "); i >= 0 {
+			e.mask, e.channel = key[:i], key[i+1:]
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].level != entries[j].level {
+			return entries[i].level > entries[j].level
+		}
+		if entries[i].mask != entries[j].mask {
+			return entries[i].mask < entries[j].mask
+		}
+		return entries[i].channel < entries[j].channel
+	})
+	return entries
+}
+
+// Returns the entry for exactly mask in channel (in any case)
+func (q *ACLPlugin) entry(mask, channel string) (aclEntry, bool) {
+	for _, e := range q.entries() {
+		if e.mask == mask && q.ic.CanonChannel(e.channel) == q.ic.CanonChannel(channel) {
+			return e, true
+		}
+	}
+	return aclEntry{}, false
+}
+
+// Returns " in <channel>", or "" for entries valid in all channels
+func (q *ACLPlugin) in(channel string) string {
+	if channel == "" {
+		return ""
+	}
+	return " in " + channel
+}
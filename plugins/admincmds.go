@@ -2,25 +2,86 @@ package plugins
 
 import (
 	"../ircclient"
+	"fmt"
+	"log"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 const (
-	auto_op_access = 200
+	// Added on first start, so users of access level 200 keep getting ops
+	// everywhere
+	default_autoop_level = 200
+	// Member modes that can be set automatically, most powerful first
+	autoop_modes = "ohv"
+	// Admin/opcommand is sent at most this often per channel while the bot
+	// isn't opped
+	opcommand_cooldown = 5 * time.Minute
+	// Users waiting for the bot to get ops in a channel, further ones don't
+	// get their mode
+	max_op_waiting = 100
 )
 
+// An auto-mode entry, stored as "<channel> <who>" -> mode. channel is the
+// canonical channel name or "*" for all channels; who is an access level,
+// a hostmask (regular expression) or account/<name>.
+type autoMode struct {
+	channel, who string
+	mode         byte
+}
+
+// Users joining while the bot isn't opped, they get their mode once it is
+type opRequest struct {
+	// when Admin/opcommand was sent
+	asked time.Time
+	// canonical nick -> mode
+	waiting map[string]byte
+}
+
 type AdminPlugin struct {
-	ic *ircclient.IRCClient
+	ic    *ircclient.IRCClient
+	store *ircclient.Store
+	// canonical channel name -> users waiting
+	opRequests map[string]*opRequest
+	sync.Mutex
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("admin", func() ircclient.Plugin { return new(AdminPlugin) })
 }
 
 func (q *AdminPlugin) Register(cl *ircclient.IRCClient) {
 	q.ic = cl
+	q.opRequests = make(map[string]*opRequest)
 
 	q.ic.RegisterCommandHandler("inviteme", 1, 400, q)
 	q.ic.RegisterCommandHandler("say", 2, 400, q)
 	q.ic.RegisterCommandHandler("notice", 2, 400, q)
 	q.ic.RegisterCommandHandler("action", 2, 400, q)
 	q.ic.RegisterCommandHandler("raw", 1, 500, q)
+	q.ic.RegisterCommandHandler("maintenance", 1, 500, q)
+	q.ic.RegisterCommandHandler("loglevel", 0, 500, q)
+	q.ic.RegisterCommandHandler("ignore", 1, 400, q)
+	q.ic.RegisterCommandHandler("unignore", 1, 400, q)
+	q.ic.RegisterCommandHandler("ignorelist", 0, 400, q)
+	q.ic.RegisterCommandHandler("alias", 1, 400, q)
+
+	store, err := q.ic.Storage(q.String())
+	if err != nil {
+		log.Println("unable to open admin storage, auto-modes are disabled: " + err.Error())
+		return
+	}
+	q.store = store
+	if _, ok, err := q.store.Get("initialized"); err == nil && !ok {
+		log.Printf("added default autoop entry (op for access level %d in all channels) to storage", default_autoop_level)
+		q.store.Put("* "+strconv.Itoa(default_autoop_level), "o")
+		q.store.Put("initialized", "true")
+	}
+	q.ic.RegisterCommandHandler("autoop", 1, 400, q)
 }
 
 func (q *AdminPlugin) String() string {
@@ -36,42 +97,462 @@ func (q *AdminPlugin) Usage(cmd string) string {
 	case "inviteme":
 		return "inviteme <channelname>"
 	case "say":
-		return "say <channelname> <message>"
+		return "say <target>[,<target>...] <message>: sends <message> to the channels or nicks"
 	case "notice":
-		return "notice <channelname> <message>"
+		return "notice <target>[,<target>...] <message>: sends <message> as notice to the channels or nicks"
 	case "action":
-		return "action <channelname> <message>"
+		return "action <target>[,<target>...] <message>: sends <message> as action to the channels or nicks"
 	case "raw":
 		return "raw <ircline>: sends raw line to server"
+	case "maintenance":
+		return "maintenance on|off [message]: only lets admins use commands while on, everyone else gets <message>"
+	case "loglevel":
+		return "loglevel [debug|info|warn|error]: shows or sets what the bot logs, debug logs all lines sent and received"
+	case "ignore":
+		return "ignore <nick|hostmask|account/name>: drops all messages and commands from the user, a nick is ignored by its host"
+	case "unignore":
+		return "unignore <hostmask|account/name>: removes an entry from the ignore list"
+	case "ignorelist":
+		return "ignorelist: lists the ignored hostmasks and accounts"
+	case "alias":
+		return "alias add <alias> <command> [args] | alias del <alias> | alias list: manages shorthand names for commands, e.g. \"alias add q quote\"; args are put in front of the user's"
+	case "autoop":
+		return "autoop add <#channel|*> <level|hostmask|account/name> <o|h|v> | autoop del <#channel|*> <level|hostmask|account/name> | autoop list [#channel]: " +
+			"gives users with at least access level <level>, matching <hostmask> or logged in to account <name> op, halfop or voice when they join <#channel> (* for all channels)"
 	}
 	return ""
 }
 
 func (q *AdminPlugin) ProcessLine(msg *ircclient.IRCMessage) {
-	if msg.Command != "JOIN" {
+	if q.store == nil {
 		return
 	}
-	if q.ic.GetAccessLevel(msg.Source) >= auto_op_access {
-		q.ic.SendLine("MODE " + msg.Target + " +o " + strings.SplitN(msg.Source, "!", 2)[0])
+	switch msg.Command {
+	case "JOIN":
+		q.processJoin(msg)
+	case "MODE":
+		q.processMode(msg)
+	}
+}
+
+// Gives the joining user the auto-mode, or asks for ops first
+func (q *AdminPlugin) processJoin(msg *ircclient.IRCMessage) {
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+	me := q.ic.GetStringOption("Server", "nick")
+	if q.ic.CanonNick(nick) == q.ic.CanonNick(me) {
 		return
 	}
+	mode := q.autoMode(msg)
+	if mode == 0 {
+		return
+	}
+	if q.hasMode(msg.Target, nick, mode) {
+		return
+	}
+	if !q.ic.IsChannelOp(msg.Target, me) {
+		q.waitForOp(msg.Target, nick, mode)
+		return
+	}
+	q.ic.Mode(msg.Target, "+"+string(mode), nick)
+}
+
+// Returns whether nick holds mode or a more powerful one in channel, e.g.
+// when opped by services already
+func (q *AdminPlugin) hasMode(channel, nick string, mode byte) bool {
+	for i := 0; i <= strings.IndexByte(autoop_modes, mode); i++ {
+		if q.ic.HasMemberMode(channel, nick, autoop_modes[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// Remembers that nick gets mode once the bot is opped in channel. The
+// server would reject our MODE until then. If configured, services are
+// asked for ops instead, e.g. "PRIVMSG ChanServ :OP %s", at most once per
+// opcommand_cooldown.
+func (q *AdminPlugin) waitForOp(channel, nick string, mode byte) {
+	q.Lock()
+	defer q.Unlock()
+	key := q.ic.CanonChannel(channel)
+	r := q.opRequests[key]
+	if r == nil {
+		r = &opRequest{waiting: make(map[string]byte)}
+		q.opRequests[key] = r
+	}
+	if len(r.waiting) < max_op_waiting {
+		r.waiting[q.ic.CanonNick(nick)] = mode
+	}
+	if time.Since(r.asked) < opcommand_cooldown {
+		return
+	}
+	if opcmd := q.ic.GetStringOption("Admin", "opcommand"); opcmd != "" {
+		q.ic.SendLine(strings.Replace(opcmd, "%s", channel, -1))
+		r.asked = time.Now()
+	}
+}
+
+// Gives the users waiting in the channel their modes once the bot is opped
+// there. The channel state may not have seen the MODE yet, so it is parsed
+// here; only "+o" is looked for, it's taken as ours if our nick is among
+// the parameters.
+func (q *AdminPlugin) processMode(msg *ircclient.IRCMessage) {
+	if len(msg.Args) < 2 {
+		return
+	}
+	adding, opped := true, false
+	for _, c := range msg.Args[0] {
+		switch c {
+		case '+', '-':
+			adding = c == '+'
+		case 'o':
+			opped = opped || adding
+		}
+	}
+	me := q.ic.CanonNick(q.ic.GetStringOption("Server", "nick"))
+	ours := false
+	for _, param := range msg.Args[1:] {
+		ours = ours || q.ic.CanonNick(param) == me
+	}
+	if !opped || !ours {
+		return
+	}
+
+	q.Lock()
+	r := q.opRequests[q.ic.CanonChannel(msg.Target)]
+	delete(q.opRequests, q.ic.CanonChannel(msg.Target))
+	q.Unlock()
+	if r == nil {
+		return
+	}
+	for nick, mode := range r.waiting {
+		if q.ic.IsOnChannel(msg.Target, nick) && !q.hasMode(msg.Target, nick, mode) {
+			q.ic.Mode(msg.Target, "+"+string(mode), nick)
+		}
+	}
+}
+
+// Returns the most powerful member mode the user joining with msg gets, 0
+// for none
+func (q *AdminPlugin) autoMode(msg *ircclient.IRCMessage) byte {
+	// from the account tag or extended-join
+	account, ok := msg.Account()
+	if !ok && len(msg.Args) >= 2 && msg.Args[0] != "*" {
+		account = msg.Args[0]
+	}
+	level := -1
+	var best byte
+	for _, e := range q.autoModes(msg.Target) {
+		if best != 0 && strings.IndexByte(autoop_modes, e.mode) >= strings.IndexByte(autoop_modes, best) {
+			continue
+		}
+		switch min, err := strconv.Atoi(e.who); {
+		case err == nil:
+			if level < 0 {
+				level = q.ic.GetAccessLevel(msg.Source, msg.Target)
+			}
+			ok = level >= min
+		case strings.HasPrefix(e.who, "account/"):
+			ok = account != "" && q.ic.CanonNick(account) == q.ic.CanonNick(e.who[len("account/"):])
+		default:
+			re, err := regexp.Compile("^(?:" + e.who + ")$")
+			ok = err == nil && re.MatchString(msg.Source)
+		}
+		if ok {
+			best = e.mode
+		}
+	}
+	return best
+}
+
+// Returns the entries for channel and for all channels, or all entries if
+// channel is empty
+func (q *AdminPlugin) autoModes(channel string) []autoMode {
+	modes := make([]autoMode, 0)
+	err := q.store.Iterate(func(key, value string) bool {
+		parts := strings.SplitN(key, " ", 2)
+		if len(parts) != 2 || len(value) != 1 {
+			return true
+		}
+		if channel == "" || parts[0] == "*" || parts[0] == q.ic.CanonChannel(channel) {
+			modes = append(modes, autoMode{parts[0], parts[1], value[0]})
+		}
+		return true
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return modes
+}
+
+func (q *AdminPlugin) processAutoOp(cmd *ircclient.IRCCommand) {
+	if q.store == nil {
+		q.ic.Reply(cmd, "Auto-modes are unavailable, the storage couldn't be opened.")
+		return
+	}
+	// the channel as stored, "*" or canonical
+	channel := func(name string) (string, bool) {
+		if name == "*" {
+			return name, true
+		}
+		return q.ic.CanonChannel(name), q.ic.IsChannelName(name)
+	}
+	switch strings.ToLower(cmd.Args[0]) {
+	case "add":
+		if len(cmd.Args) < 4 {
+			q.ic.Reply(cmd, q.ic.GetUsage("autoop"))
+			return
+		}
+		ch, ok := channel(cmd.Args[1])
+		if !ok {
+			q.ic.Reply(cmd, cmd.Args[1]+" is not a channel.")
+			return
+		}
+		who, mode := cmd.Args[2], cmd.Args[3]
+		prefixes := q.ic.ServerInfo().PrefixModes
+		if len(mode) != 1 || !strings.Contains(autoop_modes, mode) || (prefixes != "" && !strings.Contains(prefixes, mode)) {
+			q.ic.Reply(cmd, "Unsupported mode "+mode+", use o, h or v if the server has it.")
+			return
+		}
+		if _, err := strconv.Atoi(who); err != nil && !strings.HasPrefix(who, "account/") {
+			if _, err := regexp.Compile(who); err != nil {
+				q.ic.Reply(cmd, "Invalid hostmask: "+err.Error())
+				return
+			}
+		}
+		if err := q.store.Put(ch+" "+who, mode); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, fmt.Sprintf("Ok, %s gets +%s in %s.", who, mode, cmd.Args[1]))
+	case "del":
+		if len(cmd.Args) < 3 {
+			q.ic.Reply(cmd, q.ic.GetUsage("autoop"))
+			return
+		}
+		ch, _ := channel(cmd.Args[1])
+		key := ch + " " + cmd.Args[2]
+		if _, ok, err := q.store.Get(key); err != nil || !ok {
+			q.ic.Reply(cmd, "No such entry.")
+			return
+		}
+		if err := q.store.Delete(key); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "Removed the entry for "+cmd.Args[2]+" in "+cmd.Args[1]+".")
+	case "list":
+		channel := ""
+		if len(cmd.Args) > 1 {
+			channel = cmd.Args[1]
+		}
+		modes := q.autoModes(channel)
+		if len(modes) == 0 {
+			q.ic.Reply(cmd, "No auto-modes.")
+			return
+		}
+		sort.Slice(modes, func(i, j int) bool {
+			if modes[i].channel != modes[j].channel {
+				return modes[i].channel < modes[j].channel
+			}
+			return modes[i].who < modes[j].who
+		})
+		for _, m := range modes {
+			q.ic.Reply(cmd, fmt.Sprintf("%s: %s gets +%c", m.channel, m.who, m.mode))
+		}
+	default:
+		q.ic.Reply(cmd, q.ic.GetUsage("autoop"))
+	}
 }
 
 func (q *AdminPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
 	switch cmd.Command {
 	case "inviteme":
-		q.ic.SendLine("INVITE " + strings.SplitN(cmd.Source, "!", 2)[0] + " " + cmd.Args[0])
+		if err := q.ic.Invite(strings.SplitN(cmd.Source, "!", 2)[0], cmd.Args[0]); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+		}
 	case "say":
-		q.ic.SendLine("PRIVMSG " + cmd.Args[0] + " :" + strings.Join(cmd.Args[1:], " "))
+		q.sendTo(cmd, "PRIVMSG", q.ic.Privmsg, strings.Join(cmd.Args[1:], " "))
 	case "notice":
-		q.ic.SendLine("NOTICE " + cmd.Args[0] + " :" + strings.Join(cmd.Args[1:], " "))
+		q.sendTo(cmd, "NOTICE", q.ic.Notice, strings.Join(cmd.Args[1:], " "))
 	case "action":
-		q.ic.SendLine("PRIVMSG " + cmd.Args[0] + " :\001ACTION " + strings.Join(cmd.Args[1:], " ") + "\001")
+		q.sendTo(cmd, "PRIVMSG", q.ic.Action, strings.Join(cmd.Args[1:], " "))
 	case "raw":
 		q.ic.SendLine(strings.Join(cmd.Args, " "))
+	case "maintenance":
+		var on bool
+		switch cmd.Args[0] {
+		case "on":
+			on = true
+		case "off":
+			on = false
+		default:
+			q.ic.Reply(cmd, q.Usage(cmd.Command))
+			return
+		}
+		if err := q.ic.SetMaintenance(on, strings.Join(cmd.Args[1:], " ")); err != nil {
+			q.ic.Reply(cmd, "Maintenance mode "+cmd.Args[0]+", but saving it failed: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "Maintenance mode "+cmd.Args[0])
+	case "loglevel":
+		if len(cmd.Args) == 0 {
+			q.ic.Reply(cmd, "Log level is "+ircclient.LogLevelName(ircclient.LogLevel()))
+			return
+		}
+		level, err := ircclient.ParseLogLevel(cmd.Args[0])
+		if err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		ircclient.SetLogLevel(level)
+		// so writeconfig keeps it
+		q.ic.SetStringOption("Server", "loglevel", ircclient.LogLevelName(level))
+		q.ic.Reply(cmd, "Log level set to "+ircclient.LogLevelName(level))
+	case "autoop":
+		q.processAutoOp(cmd)
+	case "ignore":
+		mask := cmd.Args[0]
+		if ircclient.ValidNick(mask) {
+			// It's a nick, ignore its host so a nick change doesn't help
+			if u, ok := q.ic.LookupUser(mask); ok {
+				mask = ".*!.*@" + regexp.QuoteMeta(u.Host)
+			} else {
+				mask = regexp.QuoteMeta(mask) + "!.*"
+			}
+		}
+		if err := q.ic.Ignore(mask); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		if q.ic.IsIgnored(cmd.Source, cmd.Account) {
+			q.ic.Unignore(mask)
+			q.ic.Reply(cmd, "Not ignoring "+mask+", it matches you.")
+			return
+		}
+		q.ic.Reply(cmd, "Ignoring "+mask)
+	case "unignore":
+		if err := q.ic.Unignore(cmd.Args[0]); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "No longer ignoring "+cmd.Args[0])
+	case "alias":
+		q.processAlias(cmd)
+	case "ignorelist":
+		ignored := q.ic.Ignored()
+		if len(ignored) == 0 {
+			q.ic.Reply(cmd, "Nobody is ignored.")
+			return
+		}
+		q.ic.Reply(cmd, "Ignored: "+strings.Join(ignored, ", "))
+	}
+}
+
+func (q *AdminPlugin) processAlias(cmd *ircclient.IRCCommand) {
+	switch strings.ToLower(cmd.Args[0]) {
+	case "add":
+		if len(cmd.Args) < 3 {
+			q.ic.Reply(cmd, q.ic.GetUsage("alias"))
+			return
+		}
+		alias := strings.TrimPrefix(cmd.Args[1], q.ic.Trigger())
+		command := strings.TrimPrefix(cmd.Args[2], q.ic.Trigger())
+		if !q.ic.IsCommand(command) {
+			q.ic.Reply(cmd, "No such command: "+command)
+			return
+		}
+		target := strings.Join(append([]string{command}, cmd.Args[3:]...), " ")
+		if err := q.ic.RegisterAlias(alias, target); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		q.ic.SetStringOption("Alias", alias, target)
+		if err := q.ic.SaveConfig(); err != nil {
+			q.ic.Reply(cmd, "Alias added, but saving it failed: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "Ok, "+q.ic.Trigger()+alias+" now runs "+q.ic.Trigger()+target)
+	case "del":
+		if len(cmd.Args) < 2 {
+			q.ic.Reply(cmd, q.ic.GetUsage("alias"))
+			return
+		}
+		if err := q.ic.UnregisterAlias(cmd.Args[1]); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		q.ic.RemoveOption("Alias", cmd.Args[1])
+		if err := q.ic.SaveConfig(); err != nil {
+			q.ic.Reply(cmd, "Alias removed, but saving it failed: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "Removed alias "+cmd.Args[1])
+	case "list":
+		aliases := q.ic.Aliases()
+		if len(aliases) == 0 {
+			q.ic.Reply(cmd, "No aliases.")
+			return
+		}
+		names := make([]string, 0, len(aliases))
+		for a := range aliases {
+			names = append(names, a)
+		}
+		sort.Strings(names)
+		for i, a := range names {
+			names[i] = a + " -> " + aliases[a]
+		}
+		q.ic.Reply(cmd, "Aliases: "+strings.Join(names, ", "))
+	default:
+		q.ic.Reply(cmd, q.ic.GetUsage("alias"))
+	}
+}
+
+// Sends text with send (e.g. IRCClient.Privmsg()) to the comma-separated
+// targets in the first argument, using as few lines as the server's target
+// limit for command allows. Nothing is sent if any of the targets is
+// invalid.
+func (q *AdminPlugin) sendTo(cmd *ircclient.IRCCommand, command string, send func(target, text string) error, text string) {
+	var targets, invalid []string
+	for _, t := range strings.Split(cmd.Args[0], ",") {
+		switch {
+		case t == "":
+		case q.ic.IsChannelName(t) || ircclient.ValidNick(t):
+			targets = append(targets, t)
+		default:
+			invalid = append(invalid, t)
+		}
+	}
+	if len(invalid) > 0 {
+		q.ic.Reply(cmd, "Invalid targets, nothing sent: "+strings.Join(invalid, ", "))
+		return
+	}
+	if len(targets) == 0 {
+		q.ic.Reply(cmd, q.ic.GetUsage(cmd.Command))
+		return
+	}
+
+	max := q.ic.GetMaxTargets(command)
+	if max == 0 {
+		max = len(targets)
+	}
+	for len(targets) > 0 {
+		n := max
+		if n > len(targets) {
+			n = len(targets)
+		}
+		send(strings.Join(targets[:n], ","), text)
+		targets = targets[n:]
 	}
 }
 
 func (q *AdminPlugin) Unregister() {
 	return
 }
+
+func (q *AdminPlugin) OnReconnectReset() {
+	// ops are gone with the old connection, ask again
+	q.Lock()
+	q.opRequests = make(map[string]*opRequest)
+	q.Unlock()
+}
@@ -27,6 +27,10 @@ type AltPlugin struct {
 	regex *regexp.Regexp
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("altbot", func() ircclient.Plugin { return new(AltPlugin) })
+}
+
 func (q *AltPlugin) String() string {
 	return "altbot"
 }
@@ -56,7 +60,7 @@ func (q *AltPlugin) ProcessLine(msg *ircclient.IRCMessage) {
 		return
 	}
 
-	urls := q.regex.FindAllString(msg.Args[0], -1)
+	urls := q.regex.FindAllString(msg.PlainText()[0], -1)
 	for _, url := range urls {
 		numsPosted, firstPosted := q.testAndAdd(url)
 		if numsPosted == 0 || firstPosted.IsZero() {
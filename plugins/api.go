@@ -0,0 +1,205 @@
+package plugins
+
+import (
+	"../ircclient"
+	"encoding/json"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Put a reverse proxy with TLS in front of it to reach it from outside
+	default_api_listen = "localhost:8092"
+	// Lines of text sent per request at most
+	max_api_lines = 10
+)
+
+// The body of a request, either JSON or a form
+type apiRequest struct {
+	Target string
+	Text   string
+	Line   string
+}
+
+// Lets scripts send messages through the bot via HTTP:
+//
+//	curl -H "Authorization: Bearer <token>" -d target=#mett -d text=hi \
+//	    http://localhost:8092/api/privmsg
+//
+// Tokens are set in section APITokens, one per script ("<name>: <token>").
+// /api/raw sends any line and is disabled unless API/raw is "true".
+type APIPlugin struct {
+	ic     *ircclient.IRCClient
+	server *http.Server
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("api", func() ircclient.Plugin { return new(APIPlugin) })
+}
+
+func (q *APIPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+
+	if q.ic.GetStringOption("API", "listen") == "" {
+		log.Println("added default api listen address \"" + default_api_listen + "\" to config file")
+		q.ic.SetStringOption("API", "listen", default_api_listen)
+	}
+	if len(q.ic.GetOptions("APITokens")) == 0 {
+		log.Println("api: no tokens set in section APITokens, all requests are refused")
+	}
+	for _, name := range q.ic.GetOptions("APITokens") {
+		if q.ic.GetStringOption("APITokens", name) == "" {
+			log.Println("api: token " + name + " is empty and ignored")
+		}
+	}
+
+	l, err := net.Listen("tcp", q.ic.GetStringOption("API", "listen"))
+	if err != nil {
+		log.Println("unable to start api: " + err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/privmsg", q.serveMessage("PRIVMSG"))
+	mux.HandleFunc("/api/notice", q.serveMessage("NOTICE"))
+	mux.HandleFunc("/api/raw", q.serveRaw)
+	q.server = &http.Server{Handler: mux}
+	go func() {
+		if err := q.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println("api server failed: " + err.Error())
+		}
+	}()
+}
+
+func (q *APIPlugin) String() string {
+	return "api"
+}
+
+func (q *APIPlugin) Info() string {
+	return "HTTP API for scripts sending messages through the bot"
+}
+
+func (q *APIPlugin) Usage(cmd string) string {
+	return ""
+}
+
+func (q *APIPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+}
+
+func (q *APIPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+}
+
+func (q *APIPlugin) Unregister() {
+	if q.server != nil {
+		q.server.Close()
+	}
+}
+
+// Returns the name of the token the request has been made with, or an empty
+// string if it's missing or unknown
+func (q *APIPlugin) authenticate(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return ""
+	}
+	return q.ic.MatchSecret("APITokens", auth[len("Bearer "):])
+}
+
+// Checks method and token and parses the request. Writes the error and
+// returns false if anything is wrong.
+func (q *APIPlugin) parseRequest(w http.ResponseWriter, r *http.Request, req *apiRequest) (name string, ok bool) {
+	if r.Method != "POST" {
+		apiError(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return "", false
+	}
+	if name = q.authenticate(r); name == "" {
+		apiError(w, "invalid or missing token", http.StatusUnauthorized)
+		return "", false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, 64<<10)
+	if mediatype, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediatype == "application/json" {
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			apiError(w, "invalid JSON: "+err.Error(), http.StatusBadRequest)
+			return "", false
+		}
+	} else {
+		req.Target, req.Text, req.Line = r.FormValue("target"), r.FormValue("text"), r.FormValue("line")
+	}
+	return name, true
+}
+
+// Sends the text of the request to its target with command, PRIVMSG or
+// NOTICE. Each line of the text is sent as a message of its own.
+func (q *APIPlugin) serveMessage(command string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req apiRequest
+		name, ok := q.parseRequest(w, r, &req)
+		if !ok {
+			return
+		}
+		target := strings.TrimSpace(req.Target)
+		if target == "" || strings.ContainsAny(target, " ,\r\n") {
+			apiError(w, "invalid target", http.StatusBadRequest)
+			return
+		}
+		lines := make([]string, 0)
+		for _, line := range strings.Split(strings.Replace(req.Text, "\r", "", -1), "\n") {
+			if strings.TrimSpace(line) != "" {
+				lines = append(lines, line)
+			}
+		}
+		if len(lines) == 0 {
+			apiError(w, "no text", http.StatusBadRequest)
+			return
+		}
+		if len(lines) > max_api_lines {
+			apiError(w, "too many lines", http.StatusBadRequest)
+			return
+		}
+		log.Printf("api: %s sends %d lines to %s", name, len(lines), target)
+		for _, line := range lines {
+			if err := q.ic.SendLine(command + " " + target + " :" + line); err != nil {
+				apiError(w, err.Error(), http.StatusServiceUnavailable)
+				return
+			}
+		}
+		apiOK(w)
+	}
+}
+
+func (q *APIPlugin) serveRaw(w http.ResponseWriter, r *http.Request) {
+	var req apiRequest
+	name, ok := q.parseRequest(w, r, &req)
+	if !ok {
+		return
+	}
+	if !q.ic.GetBoolOption("API", "raw", false) {
+		apiError(w, "raw lines are disabled", http.StatusForbidden)
+		return
+	}
+	line := strings.TrimSpace(req.Line)
+	if line == "" || strings.ContainsAny(line, "\r\n") {
+		apiError(w, "invalid line", http.StatusBadRequest)
+		return
+	}
+	// the rest may be a password
+	log.Printf("api: %s sends a raw %s", name, strings.Fields(line)[0])
+	if err := q.ic.SendLine(line); err != nil {
+		apiError(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	apiOK(w)
+}
+
+func apiOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte("{\"ok\":true}\n"))
+}
+
+func apiError(w http.ResponseWriter, message string, status int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{"ok": false, "error": message})
+}
@@ -2,14 +2,65 @@ package plugins
 
 import (
 	"../ircclient"
+	"log"
+	"strings"
+	"sync"
+	"time"
 )
 
+const (
+	default_join_rate = 2 // JOIN lines per second
+	// How long to wait for the server to refuse a JOIN of a user
+	join_error_timeout = time.Minute
+)
+
+// Reasons for failed JOINs
+var join_errors = map[string]string{
+	ircclient.ERR_TOOMANYCHANNELS: "I'm in too many channels",
+	ircclient.ERR_CHANNELISFULL:   "channel is full",
+	ircclient.ERR_INVITEONLYCHAN:  "channel is invite only",
+	ircclient.ERR_BANNEDFROMCHAN:  "I'm banned",
+	ircclient.ERR_BADCHANNELKEY:   "bad channel key",
+}
+
+// A JOIN requested by a user, who is told if it fails
+type joinRequest struct {
+	cmd  *ircclient.IRCCommand
+	sent time.Time
+}
+
 type ChannelsPlugin struct {
-	ic *ircclient.IRCClient
+	ic   *ircclient.IRCClient
+	quit chan bool
+	// canonical channel name -> pending JOIN
+	requests map[string]joinRequest
+	sync.Mutex
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("channel", func() ircclient.Plugin { return new(ChannelsPlugin) })
 }
 
 func (q *ChannelsPlugin) Register(cl *ircclient.IRCClient) {
 	q.ic = cl
+	q.quit = make(chan bool)
+	q.requests = make(map[string]joinRequest)
+
+	// section Channels is the autojoin list, join_rate used to be there
+	if rate := q.ic.GetStringOption("Channels", "join_rate"); rate != "" {
+		log.Println("moved join_rate from section Channels to ChannelOptions")
+		q.ic.SetStringOption("ChannelOptions", "join_rate", rate)
+		q.ic.RemoveOption("Channels", "join_rate")
+		if q.ic.GetStringOption("Channels", "join_rate") != "" {
+			// in the section shared by all networks, which we can't change
+			log.Println("join_rate in section Channels is taken for a channel, move it to ChannelOptions")
+		}
+	}
+	if _, err := q.ic.GetIntOption("ChannelOptions", "join_rate"); err != nil {
+		log.Printf("added default join_rate value of %d to config file", default_join_rate)
+		q.ic.SetIntOption("ChannelOptions", "join_rate", default_join_rate)
+	}
+
 	cl.RegisterCommandHandler("join", 1, 200, q)
 	cl.RegisterCommandHandler("part", 1, 200, q)
 	cl.RegisterCommandHandler("addchannel", 1, 400, q)
@@ -26,40 +77,181 @@ func (q *ChannelsPlugin) Info() string {
 func (q *ChannelsPlugin) Usage(cmd string) string {
 	switch cmd {
 	case "join":
-		return "join <channel_without_#>, makes the bot join #<channel>"
+		return "join <channel_without_#> [key], makes the bot join #<channel>"
 	case "part":
-		return "part <channel_without_#>, parts the bot from #<channel>"
+		return "part <channel_without_#> [message], parts the bot from #<channel>"
 	case "addchannel":
-		return "addchannel <channel_without_#>, adds #<channel> to the bot's autojoin list"
+		return "addchannel <channel_without_#> [key], adds #<channel> to the bot's autojoin list, with key <key> for channels with mode +k"
 	}
 	return ""
 }
 
 func (q *ChannelsPlugin) ProcessLine(msg *ircclient.IRCMessage) {
-	if msg.Command != "001" {
+	if reason, ok := join_errors[msg.Command]; ok && len(msg.Args) > 0 {
+		// :server 475 me #channel :Cannot join channel (+k)
+		q.joinFailed(msg.Args[0], reason)
+		return
+	}
+	if msg.Command == "JOIN" && strings.EqualFold(strings.SplitN(msg.Source, "!", 2)[0], q.ic.GetStringOption("Server", "nick")) {
+		q.Lock()
+		delete(q.requests, q.ic.CanonChannel(msg.Target))
+		q.Unlock()
+		return
+	}
+
+	// Wait for the end of the MOTD instead of RPL_WELCOME, so we
+	// already know the server's limits (ISUPPORT) when joining
+	if msg.Command != ircclient.RPL_ENDOFMOTD && msg.Command != ircclient.ERR_NOMOTD {
 		return
 	}
 	/* When registering, join channels */
-	options := q.ic.GetOptions("Channels")
-	for _, key := range options {
-		q.ic.SendLine("JOIN #" + key)
+	channels := make([]string, 0)
+	seen := make(map[string]bool)
+	// e.g. after an online restart, we're already in some channels
+	for _, c := range q.ic.JoinedChannels() {
+		seen[q.ic.CanonChannel(c)] = true
+	}
+	for _, key := range q.ic.GetOptions("Channels") {
+		if seen[q.ic.CanonChannel("#"+key)] {
+			continue
+		}
+		seen[q.ic.CanonChannel("#"+key)] = true
+		channels = append(channels, "#"+key)
+	}
+	// e.g. until we're authed and our host is hidden
+	q.ic.WhenJoinable(func() { q.autojoin(channels) })
+}
+
+// Tells the user who asked us to join channel why it failed, or logs it if
+// it was an autojoin
+func (q *ChannelsPlugin) joinFailed(channel, reason string) {
+	key := q.ic.CanonChannel(channel)
+	q.Lock()
+	req, ok := q.requests[key]
+	delete(q.requests, key)
+	q.Unlock()
+	if ok && time.Since(req.sent) < join_error_timeout {
+		q.ic.Reply(req.cmd, "Unable to join "+channel+": "+reason)
+		return
+	}
+	log.Printf("unable to join %s: %s", channel, reason)
+}
+
+// Returns the key of channel from section ChannelKeys, channel given
+// without '#'
+func (q *ChannelsPlugin) channelKey(channel string) string {
+	for _, name := range q.ic.GetOptions("ChannelKeys") {
+		if q.ic.CanonChannel(name) == q.ic.CanonChannel(channel) {
+			return q.ic.GetStringOption("ChannelKeys", name)
+		}
+	}
+	return ""
+}
+
+// Joins the given channels, batching as many channels into a single JOIN
+// as the server allows and sending at most ChannelOptions/join_rate JOINs per
+// second, so we don't trip the server's flood protection.
+func (q *ChannelsPlugin) autojoin(channels []string) {
+	rate, err := q.ic.GetIntOption("ChannelOptions", "join_rate")
+	if err != nil || rate <= 0 {
+		rate = default_join_rate
+	}
+	interval := time.Second / time.Duration(rate)
+	max := q.ic.GetMaxTargets("JOIN")
+
+	// Keys are matched to channels by position, so channels with a key
+	// have to come first
+	keys := make([]string, len(channels))
+	sorted := make([]string, 0, len(channels))
+	for _, c := range channels {
+		if key := q.channelKey(c[1:]); key != "" {
+			keys[len(sorted)] = key
+			sorted = append(sorted, c)
+		}
+	}
+	for _, c := range channels {
+		if q.channelKey(c[1:]) == "" {
+			sorted = append(sorted, c)
+		}
+	}
+	channels = sorted
+
+	for len(channels) > 0 {
+		names, keylist := channels[0], keys[0]
+		n := 1
+		for ; n < len(channels) && (max == 0 || n < max); n++ {
+			// keep some space for the server's prefix when relayed
+			if len(names)+len(keylist)+7+len(channels[n])+len(keys[n]) > 400 {
+				break
+			}
+			names += "," + channels[n]
+			if keys[n] != "" {
+				keylist += "," + keys[n]
+			}
+		}
+		channels, keys = channels[n:], keys[n:]
+		if keylist != "" {
+			q.ic.SendLine("JOIN " + names + " " + keylist)
+		} else {
+			q.ic.SendLine("JOIN " + names)
+		}
+
+		select {
+		case <-time.After(interval):
+		case <-q.quit:
+			return
+		}
 	}
 }
 
 func (q *ChannelsPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
 	switch cmd.Command {
 	case "join":
-		q.ic.SendLine("JOIN #" + cmd.Args[0])
+		key := q.channelKey(cmd.Args[0])
+		if len(cmd.Args) > 1 {
+			key = cmd.Args[1]
+		}
+		q.join(cmd, "#"+cmd.Args[0], key)
 	case "part":
-		q.ic.SendLine("PART #" + cmd.Args[0])
+		if err := q.ic.Part("#"+cmd.Args[0], strings.Join(cmd.Args[1:], " ")); err != nil {
+			q.ic.Reply(cmd, "Error: "+err.Error())
+		}
 	case "addchannel":
-		// TODO: Quick'n'dirty. Check whether channel already exists and strip #, if
-		// existent.
-		q.ic.SetStringOption("Channels", cmd.Args[0], "42")
-		q.ic.SendLine("JOIN #" + cmd.Args[0])
+		name := strings.TrimPrefix(cmd.Args[0], "#")
+		for _, key := range q.ic.GetOptions("Channels") {
+			if q.ic.CanonChannel(key) == q.ic.CanonChannel(name) {
+				q.ic.Reply(cmd, "#"+key+" is already in the autojoin list")
+				return
+			}
+		}
+		q.ic.SetStringOption("Channels", name, "42")
+		if len(cmd.Args) > 1 {
+			q.ic.SetStringOption("ChannelKeys", name, cmd.Args[1])
+		}
+		q.join(cmd, "#"+name, q.channelKey(name))
+	}
+}
+
+// Joins channel on behalf of the user who sent cmd
+func (q *ChannelsPlugin) join(cmd *ircclient.IRCCommand, channel, key string) {
+	q.Lock()
+	q.requests[q.ic.CanonChannel(channel)] = joinRequest{cmd, time.Now()}
+	q.Unlock()
+	if err := q.ic.Join(channel, key); err != nil {
+		q.Lock()
+		delete(q.requests, q.ic.CanonChannel(channel))
+		q.Unlock()
+		q.ic.Reply(cmd, "Error: "+err.Error())
 	}
 }
 
 func (q *ChannelsPlugin) Unregister() {
-	return
+	close(q.quit)
+}
+
+func (q *ChannelsPlugin) OnReconnectReset() {
+	// JOINs sent on the old connection won't be answered anymore
+	q.Lock()
+	q.requests = make(map[string]joinRequest)
+	q.Unlock()
 }
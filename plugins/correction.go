@@ -12,6 +12,10 @@ type CorrectionPlugin struct {
 	lastMsgs map[string]string
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("correction", func() ircclient.Plugin { return new(CorrectionPlugin) })
+}
+
 func (q *CorrectionPlugin) String() string {
 	return "correction"
 }
@@ -39,8 +43,9 @@ func (q *CorrectionPlugin) ProcessLine(msg *ircclient.IRCMessage) {
 		return
 	}
 
-	if strings.HasPrefix(msg.Args[0], "s/") {
-		correction, err := q.correct(q.lastMsgs[msg.Source], msg.Args[0])
+	text := msg.PlainText()[0]
+	if strings.HasPrefix(text, "s/") {
+		correction, err := q.correct(q.lastMsgs[msg.Source], text)
 		if err != nil {
 			_, ok := err.(*exec.ExitError)
 			if !ok {
@@ -52,7 +57,7 @@ func (q *CorrectionPlugin) ProcessLine(msg *ircclient.IRCMessage) {
 		}
 		q.ic.ReplyMsg(msg, strings.SplitN(msg.Source, "!", 2)[0]+" meant: "+correction)
 	} else {
-		q.lastMsgs[msg.Source] = msg.Args[0]
+		q.lastMsgs[msg.Source] = text
 	}
 }
 
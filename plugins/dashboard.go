@@ -0,0 +1,472 @@
+package plugins
+
+import (
+	"../ircclient"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Put a reverse proxy with TLS in front of it to reach it from outside
+	default_dashboard_listen = "localhost:8091"
+	// Access level needed to log in
+	default_dashboard_access = 500
+	// Login links sent by the dashboard command are valid this long
+	dashboard_login_timeout   = 5 * time.Minute
+	dashboard_session_timeout = 12 * time.Hour
+	dashboard_cookie          = "mettbot_session"
+)
+
+// A logged in user
+type dashboardSession struct {
+	// hostmask of the user who asked for the login link, their access
+	// level is checked on every request
+	source  string
+	expires time.Time
+	// sent with every form, so other sites can't post them
+	csrf string
+}
+
+type DashboardPlugin struct {
+	sync.Mutex
+	ic     *ircclient.IRCClient
+	server *http.Server
+	// one-time login token -> session it turns into
+	logins map[string]*dashboardSession
+	// session cookie -> session
+	sessions map[string]*dashboardSession
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("dashboard", func() ircclient.Plugin { return new(DashboardPlugin) })
+}
+
+func (q *DashboardPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.logins = make(map[string]*dashboardSession)
+	q.sessions = make(map[string]*dashboardSession)
+
+	if q.ic.GetStringOption("Dashboard", "listen") == "" {
+		log.Println("added default dashboard listen address \"" + default_dashboard_listen + "\" to config file")
+		q.ic.SetStringOption("Dashboard", "listen", default_dashboard_listen)
+	}
+	access, err := q.ic.GetIntOption("Dashboard", "access")
+	if err != nil {
+		log.Printf("added default dashboard access level of %d to config file", default_dashboard_access)
+		q.ic.SetIntOption("Dashboard", "access", default_dashboard_access)
+		access = default_dashboard_access
+	}
+
+	l, err := net.Listen("tcp", q.ic.GetStringOption("Dashboard", "listen"))
+	if err != nil {
+		log.Println("unable to start dashboard: " + err.Error())
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", q.authenticated(q.servePage))
+	mux.HandleFunc("/login", q.serveLogin)
+	mux.HandleFunc("/logout", q.authenticated(q.serveLogout))
+	mux.HandleFunc("/send", q.authenticated(q.serveSend))
+	mux.HandleFunc("/config", q.authenticated(q.serveConfig))
+	mux.HandleFunc("/json/status", q.authenticated(q.serveJSON(q.status)))
+	mux.HandleFunc("/json/channels", q.authenticated(q.serveJSON(q.channels)))
+	mux.HandleFunc("/json/plugins", q.authenticated(q.serveJSON(q.plugins)))
+	mux.HandleFunc("/json/log", q.authenticated(q.serveJSON(q.rawLog)))
+	mux.HandleFunc("/json/auth", q.authenticated(q.serveJSON(q.auth)))
+	mux.HandleFunc("/json/config", q.authenticated(q.serveJSON(q.config)))
+	q.server = &http.Server{Handler: mux}
+	go func() {
+		if err := q.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println("dashboard server failed: " + err.Error())
+		}
+	}()
+
+	q.ic.RegisterCommandHandler("dashboard", 0, access, q)
+}
+
+func (q *DashboardPlugin) String() string {
+	return "dashboard"
+}
+
+func (q *DashboardPlugin) Info() string {
+	return "web interface showing the bot's state and changing its config"
+}
+
+func (q *DashboardPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "dashboard":
+		return "dashboard: sends you a link to log in to the web dashboard, valid for 5 minutes"
+	}
+	return ""
+}
+
+func (q *DashboardPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+}
+
+func (q *DashboardPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	token := randomToken()
+	q.Lock()
+	q.expireLogins()
+	q.logins[token] = &dashboardSession{source: cmd.Source, expires: time.Now().Add(dashboard_login_timeout)}
+	q.Unlock()
+	// never to the channel, whatever section Reply says
+	q.ic.ReplyPrivate(cmd, "Log in at "+q.baseURL()+"/login?token="+token)
+}
+
+// Drops the login tokens that expired unused, q must be locked
+func (q *DashboardPlugin) expireLogins() {
+	now := time.Now()
+	for token, s := range q.logins {
+		if now.After(s.expires) {
+			delete(q.logins, token)
+		}
+	}
+}
+
+func (q *DashboardPlugin) Unregister() {
+	if q.server != nil {
+		q.server.Close()
+	}
+}
+
+// The URL the dashboard is reached at, Dashboard/url if it's behind a proxy
+func (q *DashboardPlugin) baseURL() string {
+	if u := q.ic.GetStringOption("Dashboard", "url"); u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	return "http://" + q.ic.GetStringOption("Dashboard", "listen")
+}
+
+func randomToken() string {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Exchanges a login token for a session cookie
+func (q *DashboardPlugin) serveLogin(w http.ResponseWriter, r *http.Request) {
+	token := r.URL.Query().Get("token")
+	q.Lock()
+	s, ok := q.logins[token]
+	delete(q.logins, token)
+	q.expireLogins()
+	q.Unlock()
+	if !ok || time.Now().After(s.expires) {
+		http.Error(w, "Invalid or expired login link, ask the bot for a new one.", http.StatusForbidden)
+		return
+	}
+
+	cookie := randomToken()
+	s.expires = time.Now().Add(dashboard_session_timeout)
+	s.csrf = randomToken()
+	q.Lock()
+	q.sessions[cookie] = s
+	q.Unlock()
+	log.Printf("dashboard: %s logged in", s.source)
+	http.SetCookie(w, &http.Cookie{
+		Name:     dashboard_cookie,
+		Value:    cookie,
+		Path:     "/",
+		Expires:  s.expires,
+		HttpOnly: true,
+		Secure:   strings.HasPrefix(q.baseURL(), "https:"),
+		SameSite: http.SameSiteStrictMode,
+	})
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Wraps handler so it's only called for logged in users who still have
+// the access level needed. POST requests need the session's CSRF token.
+func (q *DashboardPlugin) authenticated(handler func(http.ResponseWriter, *http.Request, *dashboardSession)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var s *dashboardSession
+		if c, err := r.Cookie(dashboard_cookie); err == nil {
+			q.Lock()
+			now := time.Now()
+			for key, session := range q.sessions {
+				if now.After(session.expires) {
+					delete(q.sessions, key)
+				}
+			}
+			s = q.sessions[c.Value]
+			q.Unlock()
+		}
+		access, _ := q.ic.GetIntOption("Dashboard", "access")
+		if s == nil || q.ic.GetAccessLevel(s.source, "") < access {
+			http.Error(w, "Not logged in, send the dashboard command to the bot to get a login link.", http.StatusUnauthorized)
+			return
+		}
+		if r.Method == "POST" && subtle.ConstantTimeCompare([]byte(r.FormValue("csrf")), []byte(s.csrf)) != 1 {
+			http.Error(w, "Invalid form, reload the page.", http.StatusForbidden)
+			return
+		}
+		handler(w, r, s)
+	}
+}
+
+func (q *DashboardPlugin) serveLogout(w http.ResponseWriter, r *http.Request, s *dashboardSession) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	q.Lock()
+	for key, session := range q.sessions {
+		if session == s {
+			delete(q.sessions, key)
+		}
+	}
+	q.Unlock()
+	http.SetCookie(w, &http.Cookie{Name: dashboard_cookie, Path: "/", MaxAge: -1})
+	http.Error(w, "Logged out.", http.StatusOK)
+}
+
+// Sends a PRIVMSG or NOTICE
+func (q *DashboardPlugin) serveSend(w http.ResponseWriter, r *http.Request, s *dashboardSession) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	target, text := strings.TrimSpace(r.FormValue("target")), r.FormValue("text")
+	command := "PRIVMSG"
+	if r.FormValue("notice") != "" {
+		command = "NOTICE"
+	}
+	if target == "" || strings.ContainsAny(target, " ,\r\n") || text == "" {
+		http.Error(w, "Target and text are needed.", http.StatusBadRequest)
+		return
+	}
+	log.Printf("dashboard: %s sent %s to %s: %s", s.source, command, target, text)
+	if err := q.ic.SendLine(command + " " + target + " :" + text); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Sets a config option, and writes the config if asked to
+func (q *DashboardPlugin) serveConfig(w http.ResponseWriter, r *http.Request, s *dashboardSession) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	section, option, value := strings.TrimSpace(r.FormValue("section")), strings.TrimSpace(r.FormValue("option")), r.FormValue("value")
+	if section == "" || option == "" || strings.ContainsAny(section+option+value, "\r\n") {
+		http.Error(w, "Section and option are needed.", http.StatusBadRequest)
+		return
+	}
+	if value == "" {
+		q.ic.RemoveOption(section, option)
+		log.Printf("dashboard: %s removed %s/%s", s.source, section, option)
+	} else {
+		q.ic.SetStringOption(section, option, value)
+		if ircclient.IsSensitiveOption(section, option) {
+			value = "***"
+		}
+		log.Printf("dashboard: %s set %s/%s to %q", s.source, section, option, value)
+	}
+	if r.FormValue("write") != "" {
+		if err := q.ic.FlushConfig(); err != nil {
+			http.Error(w, "Unable to write the config: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// Serves what data returns as JSON
+func (q *DashboardPlugin) serveJSON(data func() interface{}) func(http.ResponseWriter, *http.Request, *dashboardSession) {
+	return func(w http.ResponseWriter, r *http.Request, s *dashboardSession) {
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		enc.Encode(data())
+	}
+}
+
+func (q *DashboardPlugin) servePage(w http.ResponseWriter, r *http.Request, s *dashboardSession) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	data := map[string]interface{}{
+		"CSRF":     s.csrf,
+		"User":     s.source,
+		"Status":   q.status(),
+		"Channels": q.channels(),
+		"Plugins":  q.plugins(),
+		"Log":      q.rawLog(),
+		"Auth":     q.auth(),
+		"Config":   q.config(),
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardPage.Execute(w, data); err != nil {
+		log.Println(err)
+	}
+}
+
+func (q *DashboardPlugin) status() interface{} {
+	s := q.ic.GetStatus()
+	return map[string]interface{}{
+		"Nick":       s.Nick,
+		"Server":     s.Server,
+		"Connected":  s.Connected,
+		"Uptime":     (s.Uptime - s.Uptime%time.Second).String(),
+		"Latency":    s.Latency.String(),
+		"Channels":   s.Channels,
+		"Reconnects": s.Reconnects,
+		"SendQueue":  q.ic.OutboundQueueLen(),
+	}
+}
+
+func (q *DashboardPlugin) channels() interface{} {
+	channels := q.ic.GetChannels()
+	sort.Slice(channels, func(i, j int) bool { return channels[i].Name < channels[j].Name })
+	return channels
+}
+
+type dashboardPlugin struct {
+	Name     string
+	Info     string
+	Commands []string
+}
+
+func (q *DashboardPlugin) plugins() interface{} {
+	commands := make(map[string][]string)
+	for h := range q.ic.IterHandlers() {
+		commands[h.Handler.String()] = append(commands[h.Handler.String()], h.Command)
+	}
+	plugins := make([]dashboardPlugin, 0)
+	for name, p := range q.ic.GetPlugins() {
+		sort.Strings(commands[name])
+		plugins = append(plugins, dashboardPlugin{name, p.Info(), commands[name]})
+	}
+	sort.Slice(plugins, func(i, j int) bool { return plugins[i].Name < plugins[j].Name })
+	return plugins
+}
+
+func (q *DashboardPlugin) rawLog() interface{} {
+	return q.ic.RecentLines()
+}
+
+type dashboardAuthEntry struct {
+	Mask  string
+	Level int
+}
+
+func (q *DashboardPlugin) auth() interface{} {
+	entries := make([]dashboardAuthEntry, 0)
+	for mask, level := range q.ic.GetAccessLevels() {
+		entries = append(entries, dashboardAuthEntry{mask, level})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Level != entries[j].Level {
+			return entries[i].Level > entries[j].Level
+		}
+		return entries[i].Mask < entries[j].Mask
+	})
+	return entries
+}
+
+type dashboardSection struct {
+	Name    string
+	Options [][2]string
+}
+
+// All config options, with the values of sensitive ones hidden
+func (q *DashboardPlugin) config() interface{} {
+	sections := make([]dashboardSection, 0)
+	for _, name := range q.ic.GetSections() {
+		s := dashboardSection{Name: name}
+		for _, opt := range q.ic.GetOptions(name) {
+			value := q.ic.GetStringOption(name, opt)
+			if ircclient.IsSensitiveOption(name, opt) {
+				value = "***"
+			}
+			s.Options = append(s.Options, [2]string{opt, value})
+		}
+		sections = append(sections, s)
+	}
+	sort.Slice(sections, func(i, j int) bool { return sections[i].Name < sections[j].Name })
+	return sections
+}
+
+var dashboardPage = template.Must(template.New("dashboard").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status.Nick}} - MettBot</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1em; }
+td, th { border: 1px solid #ccc; padding: 0.2em 0.5em; text-align: left; vertical-align: top; }
+pre { background: #f4f4f4; padding: 0.5em; max-height: 30em; overflow: auto; }
+</style>
+</head>
+<body>
+<form method="post" action="/logout" style="float: right">
+{{.User}} <input type="hidden" name="csrf" value="{{.CSRF}}"><button>Log out</button>
+</form>
+<h1>{{.Status.Nick}}</h1>
+<p>Connected to {{.Status.Server}} since {{.Status.Connected.Format "2006-01-02 15:04:05"}} ({{.Status.Uptime}}), lag {{.Status.Latency}},
+{{.Status.Reconnects}} reconnects, {{.Status.SendQueue}} lines waiting to be sent.</p>
+
+<h2>Send a message</h2>
+<form method="post" action="/send">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input name="target" placeholder="#channel or nick" required>
+<input name="text" placeholder="text" size="60" required>
+<label><input type="checkbox" name="notice"> as notice</label>
+<button>Send</button>
+</form>
+
+<h2>Channels</h2>
+<table>
+<tr><th>Channel</th><th>Users</th><th>Modes</th><th>Topic</th></tr>
+{{range .Channels}}<tr><td>{{.Name}}</td><td>{{.Users}}</td><td>{{.Modes}}</td><td>{{.Topic}}</td></tr>
+{{end}}</table>
+
+<h2>Plugins</h2>
+<table>
+<tr><th>Plugin</th><th>Description</th><th>Commands</th></tr>
+{{range .Plugins}}<tr><td>{{.Name}}</td><td>{{.Info}}</td><td>{{range .Commands}}{{.}} {{end}}</td></tr>
+{{end}}</table>
+
+<h2>Recent lines</h2>
+<pre>{{range .Log}}{{.Time.Format "15:04:05"}} {{if .Sent}}&gt;&gt;{{else}}&lt;&lt;{{end}} {{.Line}}
+{{end}}</pre>
+
+<h2>Access levels</h2>
+<table>
+<tr><th>Mask</th><th>Level</th></tr>
+{{range .Auth}}<tr><td>{{.Mask}}</td><td>{{.Level}}</td></tr>
+{{end}}</table>
+
+<h2>Config</h2>
+<form method="post" action="/config">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<input name="section" placeholder="section" required>
+<input name="option" placeholder="option" required>
+<input name="value" placeholder="value (empty to remove)">
+<label><input type="checkbox" name="write" checked> write config file</label>
+<button>Set</button>
+</form>
+{{range .Config}}<h3>{{.Name}}</h3>
+<table>
+{{range .Options}}<tr><td>{{index . 0}}</td><td>{{index . 1}}</td></tr>
+{{end}}</table>
+{{end}}
+</body>
+</html>
+`))
@@ -0,0 +1,602 @@
+package plugins
+
+// Bridges Discord channels and IRC channels. Messages from Discord are
+// received through the gateway with a bot account, messages from IRC are
+// posted with a webhook of the Discord channel, so they show the IRC nick:
+//
+//	[Discord]
+//	token: <token of the bot>
+//
+//	[DiscordChannels]
+//	mett: 123456789012345678 https://discord.com/api/webhooks/... libera/#mett
+//
+// Each option of section DiscordChannels links a Discord channel (its ID)
+// with channels, written as in section Relay, and gives the webhook to post
+// with. The bot needs the message content intent (see the developer portal)
+// and, like the relay plugin, has to be registered with
+// BotManager.RegisterPlugin(). Mentions, channels, roles, custom emoji and
+// timestamps are turned into text, attachments into their links.
+
+import (
+	"../ircclient"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	discord_gateway = "wss://gateway.discord.gg/?v=10&encoding=json"
+	// GUILDS, GUILD_MESSAGES and MESSAGE_CONTENT
+	discord_intents = 1<<0 | 1<<9 | 1<<15
+	// Wait after losing the gateway, doubled up to discord_max_retry
+	discord_retry     = 5 * time.Second
+	discord_max_retry = 5 * time.Minute
+	// Messages from IRC waiting to be posted, more are dropped
+	discord_queue_size = 100
+	discord_timeout    = 30 * time.Second
+)
+
+// Gateway opcodes
+const (
+	discord_dispatch       = 0
+	discord_heartbeat      = 1
+	discord_identify       = 2
+	discord_reconnect      = 7
+	discord_invalid        = 9
+	discord_hello          = 10
+	discord_heartbeat_ack  = 11
+	discord_close_auth     = 4004
+	discord_close_intents  = 4013
+	discord_close_disallow = 4014
+)
+
+// <@id>, <@!id>, <@&id> (roles), <#id> (channels), <:name:id> and
+// <a:name:id> (custom emoji), <t:unix:style> (timestamps)
+var discordMarkup = regexp.MustCompile(`<(@!?|@&|#)(\d+)>|<a?:(\w+):\d+>|<t:(-?\d+)(?::[tTdDfFR])?>`)
+
+type discordPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s,omitempty"`
+	T  string          `json:"t,omitempty"`
+}
+
+type discordUser struct {
+	ID         string `json:"id"`
+	Username   string `json:"username"`
+	GlobalName string `json:"global_name"`
+	Member     *struct {
+		Nick string `json:"nick"`
+	} `json:"member"`
+}
+
+// Returns the name shown in the guild: the nickname there, the display
+// name or the username
+func (u *discordUser) name() string {
+	if u.Member != nil && u.Member.Nick != "" {
+		return u.Member.Nick
+	}
+	if u.GlobalName != "" {
+		return u.GlobalName
+	}
+	return u.Username
+}
+
+type discordMessage struct {
+	ChannelID string      `json:"channel_id"`
+	WebhookID string      `json:"webhook_id"`
+	Type      int         `json:"type"`
+	Author    discordUser `json:"author"`
+	Member    *struct {
+		Nick string `json:"nick"`
+	} `json:"member"`
+	Content     string        `json:"content"`
+	Mentions    []discordUser `json:"mentions"`
+	Attachments []struct {
+		URL string `json:"url"`
+	} `json:"attachments"`
+	StickerItems []struct {
+		Name string `json:"name"`
+	} `json:"sticker_items"`
+}
+
+// The parts of a guild needed for the names of channels and roles
+type discordGuild struct {
+	Channels []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"channels"`
+	Roles []struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"roles"`
+}
+
+// A Discord channel and the IRC channels linked to it
+type discordLink struct {
+	webhook   string
+	endpoints []relayEndpoint
+}
+
+// A message from IRC to be posted with a webhook
+type discordPost struct {
+	webhook, username, content string
+}
+
+type DiscordPlugin struct {
+	// network -> client, see Register()
+	clients map[string]*ircclient.IRCClient
+	token   string
+	// Discord channel ID -> link
+	links map[string]*discordLink
+	// IDs of our webhooks and, once connected, our user; their messages
+	// aren't relayed
+	webhooks map[string]bool
+	userID   string
+	// channel and role ID -> name, from the guilds we are in
+	channels map[string]string
+	roles    map[string]string
+	http     *http.Client
+	out      chan discordPost
+	// stops the gateway connection and posting
+	cancel func()
+	sync.Mutex
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("discord", func() ircclient.Plugin { return new(DiscordPlugin) })
+}
+
+// Called once per network when registered with a BotManager, starts the
+// bridge on the first call
+func (q *DiscordPlugin) Register(cl *ircclient.IRCClient) {
+	q.Lock()
+	defer q.Unlock()
+	if q.clients != nil {
+		q.clients[cl.Network()] = cl
+		return
+	}
+	q.clients = map[string]*ircclient.IRCClient{cl.Network(): cl}
+	q.token = cl.GetStringOption("Discord", "token")
+	if q.token == "" {
+		log.Println("discord: no token set in section Discord, not bridging")
+		return
+	}
+	q.links = make(map[string]*discordLink)
+	q.webhooks = make(map[string]bool)
+	for _, option := range cl.GetOptions("DiscordChannels") {
+		// the Discord channel, then the webhook and channels in any order
+		fields := strings.Fields(cl.GetStringOption("DiscordChannels", option))
+		link := &discordLink{}
+		var channels []string
+		for i := 1; i < len(fields); i++ {
+			if strings.HasPrefix(fields[i], "https://") {
+				link.webhook = fields[i]
+			} else {
+				channels = append(channels, fields[i])
+			}
+		}
+		if link.webhook == "" || len(channels) == 0 {
+			log.Println("discord: option " + option + " of section DiscordChannels needs a channel ID, a webhook and channels")
+			continue
+		}
+		link.endpoints = parseRelayLink(strings.Join(channels, " "))
+		q.links[fields[0]] = link
+		if id := discordWebhookID(link.webhook); id != "" {
+			q.webhooks[id] = true
+		}
+	}
+	q.channels = make(map[string]string)
+	q.roles = make(map[string]string)
+	q.http = &http.Client{Timeout: discord_timeout}
+	q.out = make(chan discordPost, discord_queue_size)
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	go q.run(ctx)
+	go q.post(ctx)
+}
+
+func (q *DiscordPlugin) String() string {
+	return "discord"
+}
+
+func (q *DiscordPlugin) Info() string {
+	return "bridges Discord channels and IRC channels"
+}
+
+func (q *DiscordPlugin) Usage(cmd string) string {
+	// plugin has no commands
+	return ""
+}
+
+func (q *DiscordPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// interface saturation
+}
+
+func (q *DiscordPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.clients = nil
+}
+
+// Posts messages of linked channels to Discord
+func (q *DiscordPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if msg.Command != "PRIVMSG" || len(msg.Args) == 0 || !strings.Contains(msg.Source, "!") {
+		return
+	}
+	q.Lock()
+	ic, out, links := q.clients[msg.Network], q.out, q.links
+	q.Unlock()
+	if ic == nil || out == nil || !ic.IsChannelName(msg.Target) {
+		return
+	}
+	nick, _, _ := ircclient.ParseSource(msg.Source)
+	if ic.CanonNick(nick) == ic.CanonNick(ic.GetStringOption("Server", "nick")) {
+		return
+	}
+
+	content := ircclient.StripFormatting(msg.Args[0])
+	if command, text, ok := msg.CTCP(); ok {
+		if command != "ACTION" {
+			return
+		}
+		// italics, like /me on Discord
+		content = "_" + ircclient.StripFormatting(text) + "_"
+	}
+	from := relayEndpoint{msg.Network, ic.CanonChannel(msg.Target)}
+	for _, link := range links {
+		for _, e := range link.endpoints {
+			if e.network != from.network || ic.CanonChannel(e.channel) != from.channel {
+				continue
+			}
+			select {
+			case out <- discordPost{link.webhook, nick, content}:
+			default:
+				log.Println("discord: too many messages waiting, dropping one")
+			}
+			break
+		}
+	}
+}
+
+// Keeps a gateway connection up until ctx is cancelled
+func (q *DiscordPlugin) run(ctx context.Context) {
+	retry := discord_retry
+	for {
+		started := time.Now()
+		err := q.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if e, ok := err.(*wsCloseError); ok {
+			switch e.Code {
+			case discord_close_auth:
+				log.Println("discord: the token was rejected, not bridging")
+				return
+			case discord_close_intents, discord_close_disallow:
+				log.Println("discord: the bot isn't allowed to read messages, enable the message content intent")
+				return
+			}
+		}
+		log.Println("discord: lost the gateway: " + err.Error())
+		// a connection that worked for a while doesn't count as failure
+		if time.Since(started) > discord_max_retry {
+			retry = discord_retry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > discord_max_retry {
+			retry = discord_max_retry
+		}
+	}
+}
+
+// Connects to the gateway and relays messages until the connection is lost
+// or ctx is cancelled
+func (q *DiscordPlugin) connect(ctx context.Context) error {
+	ws, err := dialWebsocket(ctx, discord_gateway)
+	if err != nil {
+		return err
+	}
+	defer ws.close(1000)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks the reader
+			ws.close(1000)
+		case <-done:
+		}
+	}()
+
+	var hello struct {
+		HeartbeatInterval int `json:"heartbeat_interval"`
+	}
+	if p, err := q.receive(ws); err != nil {
+		return err
+	} else if p.Op != discord_hello || json.Unmarshal(p.D, &hello) != nil || hello.HeartbeatInterval <= 0 {
+		return errors.New("no hello from the gateway")
+	}
+	identify := map[string]interface{}{
+		"token":      q.token,
+		"intents":    discord_intents,
+		"properties": map[string]string{"os": "linux", "browser": "MettBot", "device": "MettBot"},
+	}
+	if err := q.sendPayload(ws, discord_identify, identify); err != nil {
+		return err
+	}
+
+	// the sequence number of the last dispatch, sent with the heartbeats
+	var seqLock sync.Mutex
+	var seq *int64
+	acked := make(chan struct{}, 1)
+	go func() {
+		ticker := time.NewTicker(time.Duration(hello.HeartbeatInterval) * time.Millisecond)
+		defer ticker.Stop()
+		waiting := false
+		for {
+			select {
+			case <-done:
+				return
+			case <-acked:
+				waiting = false
+			case <-ticker.C:
+				if waiting {
+					// zombie connection, reconnect
+					log.Println("discord: heartbeat not acknowledged")
+					ws.close(4000)
+					return
+				}
+				seqLock.Lock()
+				s := seq
+				seqLock.Unlock()
+				q.sendPayload(ws, discord_heartbeat, s)
+				waiting = true
+			}
+		}
+	}()
+
+	for {
+		p, err := q.receive(ws)
+		if err != nil {
+			return err
+		}
+		switch p.Op {
+		case discord_dispatch:
+			if p.S != nil {
+				seqLock.Lock()
+				seq = p.S
+				seqLock.Unlock()
+			}
+			q.dispatch(p.T, p.D)
+		case discord_heartbeat:
+			seqLock.Lock()
+			s := seq
+			seqLock.Unlock()
+			q.sendPayload(ws, discord_heartbeat, s)
+		case discord_heartbeat_ack:
+			select {
+			case acked <- struct{}{}:
+			default:
+			}
+		case discord_reconnect, discord_invalid:
+			return errors.New("asked to reconnect")
+		}
+	}
+}
+
+func (q *DiscordPlugin) receive(ws *wsConn) (*discordPayload, error) {
+	data, err := ws.readMessage()
+	if err != nil {
+		return nil, err
+	}
+	var p discordPayload
+	if err := json.Unmarshal(data, &p); err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+func (q *DiscordPlugin) sendPayload(ws *wsConn, op int, d interface{}) error {
+	data, err := json.Marshal(map[string]interface{}{"op": op, "d": d})
+	if err != nil {
+		return err
+	}
+	return ws.writeMessage(data)
+}
+
+// Handles the gateway events
+func (q *DiscordPlugin) dispatch(event string, d json.RawMessage) {
+	switch event {
+	case "READY":
+		var ready struct {
+			User discordUser `json:"user"`
+		}
+		if json.Unmarshal(d, &ready) == nil {
+			q.Lock()
+			q.userID = ready.User.ID
+			q.Unlock()
+		}
+	case "GUILD_CREATE", "GUILD_UPDATE":
+		var guild discordGuild
+		if json.Unmarshal(d, &guild) != nil {
+			return
+		}
+		q.Lock()
+		for _, c := range guild.Channels {
+			q.channels[c.ID] = c.Name
+		}
+		for _, r := range guild.Roles {
+			q.roles[r.ID] = r.Name
+		}
+		q.Unlock()
+	case "CHANNEL_CREATE", "CHANNEL_UPDATE":
+		var channel struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		}
+		if json.Unmarshal(d, &channel) == nil {
+			q.Lock()
+			q.channels[channel.ID] = channel.Name
+			q.Unlock()
+		}
+	case "MESSAGE_CREATE":
+		var msg discordMessage
+		if json.Unmarshal(d, &msg) == nil {
+			q.relay(&msg)
+		}
+	}
+}
+
+// Sends a message to the channels linked to its Discord channel
+func (q *DiscordPlugin) relay(msg *discordMessage) {
+	q.Lock()
+	link := q.links[msg.ChannelID]
+	own := msg.Author.ID == q.userID || q.webhooks[msg.WebhookID]
+	clients := q.clients
+	q.Unlock()
+	// 0: plain message, 19: reply
+	if link == nil || own || (msg.Type != 0 && msg.Type != 19) {
+		return
+	}
+
+	text := q.translate(msg)
+	for _, s := range msg.StickerItems {
+		text += " [sticker: " + s.Name + "]"
+	}
+	for _, a := range msg.Attachments {
+		text += " " + a.URL
+	}
+	if text = strings.TrimSpace(text); text == "" {
+		return
+	}
+	author := msg.Author
+	if msg.Member != nil {
+		author.Member = msg.Member
+	}
+	prefix := "<" + relayNick(author.name()) + "> "
+	for _, to := range link.endpoints {
+		if ic := clients[to.network]; ic != nil {
+			sendBridged(ic, to.channel, prefix, text)
+		}
+	}
+}
+
+// Replaces the markup of mentions, channels, roles, custom emoji and
+// timestamps in the message with text
+func (q *DiscordPlugin) translate(msg *discordMessage) string {
+	q.Lock()
+	defer q.Unlock()
+	return discordMarkup.ReplaceAllStringFunc(msg.Content, func(m string) string {
+		parts := discordMarkup.FindStringSubmatch(m)
+		switch {
+		case parts[1] == "#":
+			if name, ok := q.channels[parts[2]]; ok {
+				return "#" + name
+			}
+		case parts[1] == "@&":
+			if name, ok := q.roles[parts[2]]; ok {
+				return "@" + name
+			}
+		case parts[1] != "":
+			for _, u := range msg.Mentions {
+				if u.ID == parts[2] {
+					return "@" + u.name()
+				}
+			}
+		case parts[3] != "":
+			return ":" + parts[3] + ":"
+		case parts[4] != "":
+			if t, err := strconv.ParseInt(parts[4], 10, 64); err == nil {
+				return time.Unix(t, 0).UTC().Format("2006-01-02 15:04 MST")
+			}
+		}
+		return m
+	})
+}
+
+// Posts the messages from IRC in order until ctx is cancelled
+func (q *DiscordPlugin) post(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case p := <-q.out:
+			if err := q.execute(ctx, p); err != nil && ctx.Err() == nil {
+				log.Println("discord: unable to post to webhook: " + err.Error())
+			}
+		}
+	}
+}
+
+// Posts with a webhook. Requests that hit the rate limit are retried after
+// the time asked for.
+func (q *DiscordPlugin) execute(ctx context.Context, p discordPost) error {
+	data, err := json.Marshal(map[string]interface{}{
+		"content":  p.content,
+		"username": p.username,
+		// no pings for @everyone and the like from IRC
+		"allowed_mentions": map[string][]string{"parse": {}},
+	})
+	if err != nil {
+		return err
+	}
+	for {
+		request, err := http.NewRequestWithContext(ctx, "POST", p.webhook, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		request.Header.Set("Content-Type", "application/json")
+		response, err := q.http.Do(request)
+		if err != nil {
+			return err
+		}
+		content, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1<<16))
+		response.Body.Close()
+		switch {
+		case response.StatusCode/100 == 2:
+			return nil
+		case response.StatusCode == http.StatusTooManyRequests:
+			var limit struct {
+				RetryAfter float64 `json:"retry_after"`
+			}
+			json.Unmarshal(content, &limit)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(limit.RetryAfter*float64(time.Second)) + 100*time.Millisecond):
+			}
+		default:
+			return fmt.Errorf("%s: %s", response.Status, strings.TrimSpace(string(content)))
+		}
+	}
+}
+
+// Returns the ID of a webhook, the number in .../webhooks/<id>/<token>
+func discordWebhookID(webhook string) string {
+	parts := strings.Split(webhook, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "webhooks" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
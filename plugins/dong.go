@@ -10,6 +10,10 @@ type DongPlugin struct {
 	ic *ircclient.IRCClient
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("dong", func() ircclient.Plugin { return new(DongPlugin) })
+}
+
 func (q *DongPlugin) String() string {
 	return "dong"
 }
@@ -0,0 +1,506 @@
+package plugins
+
+import (
+	"../ircclient"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds a program may take to read an event before it's restarted
+	default_external_timeout = 10
+	// Events waiting for a program at most, further ones are dropped
+	external_queue = 100
+	// Commands can be replied to for this long
+	external_reply_time = 10 * time.Minute
+	// Waiting time before restarting a program that exited, doubled each
+	// time it exits again soon, up to external_max_backoff
+	external_min_backoff = time.Second
+	external_max_backoff = 5 * time.Minute
+)
+
+// Sent to the programs, one JSON object per line
+type externalEvent struct {
+	// "hello" after start, "command" or "line"
+	Event   string            `json:"event"`
+	ID      int               `json:"id,omitempty"`
+	Nick    string            `json:"nick,omitempty"`
+	Trigger string            `json:"trigger,omitempty"`
+	Source  string            `json:"source,omitempty"`
+	Command string            `json:"command,omitempty"`
+	Target  string            `json:"target,omitempty"`
+	Args    []string          `json:"args,omitempty"`
+	Tags    map[string]string `json:"tags,omitempty"`
+}
+
+// Read from the programs, one JSON object per line
+type externalAction struct {
+	Action    string
+	Command   string
+	MinAccess int
+	Cooldown  int
+	Usage     string
+	Enabled   bool
+	ID        int
+	Target    string
+	Channel   string
+	Text      string
+}
+
+type externalCommand struct {
+	cmd *ircclient.IRCCommand
+	at  time.Time
+}
+
+// A program from section ExternalPrograms and the process running it
+type externalProgram struct {
+	sync.Mutex
+	name string
+	args []string
+	// nil while not running
+	process *exec.Cmd
+	events  chan []byte
+	// wants all lines, see the "lines" action
+	lines bool
+	// commands registered by the running process -> their usage
+	commands map[string]string
+	// commands waiting for replies, by event id
+	pending map[int]externalCommand
+	started time.Time
+	stop    chan bool
+	stopped bool
+}
+
+// Runs the programs in section ExternalPrograms ("<name>: <program> <args>")
+// and restarts them when they exit. Programs get events as JSON objects on
+// stdin, one per line:
+//
+//	{"event":"hello","nick":"mettbot","trigger":"!"}
+//	{"event":"command","id":1,"command":"hi","args":["a"],"source":"nick!user@host","nick":"nick","target":"#mett"}
+//	{"event":"line","source":"...","command":"PRIVMSG","target":"#mett","args":["hi"],"tags":{}}
+//
+// and write actions to stdout the same way (cooldown is the number of
+// seconds a user has to wait between two uses of the command):
+//
+//	{"action":"register","command":"hi","minaccess":0,"cooldown":10,"usage":"hi: says hi"}
+//	{"action":"lines","enabled":true}  (get all lines from the server)
+//	{"action":"reply","id":1,"text":"hi"}
+//	{"action":"privmsg","target":"#mett","text":"hi"}  (also "notice", "me")
+//	{"action":"join","channel":"#mett"}  (also "part")
+//
+// Stderr ends up in the log. A program that doesn't read its events for
+// External/timeout seconds is killed and restarted.
+type ExternalPlugin struct {
+	sync.RWMutex
+	ic       *ircclient.IRCClient
+	programs map[string]*externalProgram
+	// command -> program handling it
+	commands map[string]*externalProgram
+	nextID   int
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("external", func() ircclient.Plugin { return new(ExternalPlugin) })
+}
+
+func (q *ExternalPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.programs = make(map[string]*externalProgram)
+	q.commands = make(map[string]*externalProgram)
+
+	if _, err := q.ic.GetIntOption("External", "timeout"); err != nil {
+		log.Printf("added default external timeout of %d seconds to config file", default_external_timeout)
+		q.ic.SetIntOption("External", "timeout", default_external_timeout)
+	}
+
+	q.ic.RegisterCommandHandler("external", 1, 500, q)
+	for _, name := range q.ic.GetOptions("ExternalPrograms") {
+		args := strings.Fields(q.ic.GetStringOption("ExternalPrograms", name))
+		if len(args) == 0 {
+			continue
+		}
+		p := &externalProgram{name: name, args: args, stop: make(chan bool)}
+		q.programs[name] = p
+		go q.supervise(p)
+	}
+}
+
+func (q *ExternalPlugin) String() string {
+	return "external"
+}
+
+func (q *ExternalPlugin) Info() string {
+	return "runs plugins written in other languages as external programs"
+}
+
+func (q *ExternalPlugin) Usage(cmd string) string {
+	if cmd == "external" {
+		return "external list|restart <program>: lists the external programs, or restarts <program>"
+	}
+	q.RLock()
+	p, ok := q.commands[cmd]
+	q.RUnlock()
+	if !ok {
+		return ""
+	}
+	p.Lock()
+	defer p.Unlock()
+	return p.commands[cmd]
+}
+
+func (q *ExternalPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	ev := &externalEvent{Event: "line", Source: msg.Source, Command: msg.Command, Target: msg.Target, Args: msg.Args, Tags: msg.Tags}
+	q.RLock()
+	defer q.RUnlock()
+	for _, p := range q.programs {
+		p.Lock()
+		lines := p.lines
+		p.Unlock()
+		if lines {
+			q.send(p, ev)
+		}
+	}
+}
+
+func (q *ExternalPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	if cmd.Command == "external" {
+		q.manage(cmd)
+		return
+	}
+	q.Lock()
+	p, ok := q.commands[cmd.Command]
+	q.nextID++
+	id := q.nextID
+	q.Unlock()
+	if !ok {
+		return
+	}
+
+	p.Lock()
+	now := time.Now()
+	for i, c := range p.pending {
+		if now.Sub(c.at) > external_reply_time {
+			delete(p.pending, i)
+		}
+	}
+	p.pending[id] = externalCommand{cmd, now}
+	p.Unlock()
+	q.send(p, &externalEvent{Event: "command", ID: id, Command: cmd.Command, Args: cmd.Args, Source: cmd.Source, Nick: strings.SplitN(cmd.Source, "!", 2)[0], Target: cmd.Target})
+}
+
+func (q *ExternalPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	for _, p := range q.programs {
+		p.Lock()
+		if !p.stopped {
+			p.stopped = true
+			close(p.stop)
+		}
+		if p.process != nil {
+			p.process.Process.Kill()
+		}
+		p.Unlock()
+	}
+}
+
+func (q *ExternalPlugin) manage(cmd *ircclient.IRCCommand) {
+	switch cmd.Args[0] {
+	case "list":
+		q.RLock()
+		names := make([]string, 0, len(q.programs))
+		for name := range q.programs {
+			names = append(names, name)
+		}
+		q.RUnlock()
+		if len(names) == 0 {
+			q.ic.Reply(cmd, "No external programs configured.")
+			return
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			q.ic.Reply(cmd, q.describe(q.programs[name]))
+		}
+	case "restart":
+		if len(cmd.Args) < 2 {
+			q.ic.Reply(cmd, q.Usage("external"))
+			return
+		}
+		q.RLock()
+		p, ok := q.programs[cmd.Args[1]]
+		q.RUnlock()
+		if !ok {
+			q.ic.Reply(cmd, "No such program: "+cmd.Args[1])
+			return
+		}
+		p.Lock()
+		if p.process != nil {
+			// the supervisor starts it again
+			p.process.Process.Kill()
+		}
+		p.Unlock()
+		q.ic.Reply(cmd, "Restarting "+p.name+".")
+	default:
+		q.ic.Reply(cmd, q.Usage("external"))
+	}
+}
+
+// e.g. "weather: running since 10m0s, commands: forecast, weather"
+func (q *ExternalPlugin) describe(p *externalProgram) string {
+	p.Lock()
+	defer p.Unlock()
+	if p.process == nil {
+		return p.name + ": not running"
+	}
+	commands := make([]string, 0, len(p.commands))
+	for c := range p.commands {
+		commands = append(commands, c)
+	}
+	sort.Strings(commands)
+	return fmt.Sprintf("%s: running since %v, commands: %s", p.name, time.Since(p.started).Truncate(time.Second), strings.Join(commands, ", "))
+}
+
+// Runs p until the plugin is unregistered, restarting it when it exits
+func (q *ExternalPlugin) supervise(p *externalProgram) {
+	backoff := external_min_backoff
+	for {
+		start := time.Now()
+		if err := q.run(p); err != nil {
+			log.Printf("external: %s: %v", p.name, err)
+		}
+		if time.Since(start) > external_max_backoff {
+			backoff = external_min_backoff
+		}
+		select {
+		case <-p.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > external_max_backoff {
+			backoff = external_max_backoff
+		}
+	}
+}
+
+// Starts p and handles its actions until it exits
+func (q *ExternalPlugin) run(p *externalProgram) error {
+	cmd := exec.Command(p.args[0], p.args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	p.Lock()
+	if p.stopped {
+		p.Unlock()
+		return nil
+	}
+	if err := cmd.Start(); err != nil {
+		p.Unlock()
+		return err
+	}
+	log.Printf("external: started %s", p.name)
+	events := make(chan []byte, external_queue)
+	p.process, p.events, p.started = cmd, events, time.Now()
+	p.lines = false
+	p.commands = make(map[string]string)
+	p.pending = make(map[int]externalCommand)
+	p.Unlock()
+
+	writerDone := make(chan bool)
+	go q.write(p, cmd, stdin, events, writerDone)
+	stderrDone := make(chan bool)
+	go func() {
+		s := bufio.NewScanner(stderr)
+		for s.Scan() {
+			log.Printf("external: %s: %s", p.name, s.Text())
+		}
+		close(stderrDone)
+	}()
+	q.send(p, &externalEvent{Event: "hello", Nick: q.ic.GetStringOption("Server", "nick"), Trigger: q.ic.Trigger()})
+
+	s := bufio.NewScanner(stdout)
+	s.Buffer(make([]byte, 64<<10), 1<<20)
+	for s.Scan() {
+		var a externalAction
+		if err := json.Unmarshal(s.Bytes(), &a); err != nil {
+			log.Printf("external: %s: invalid action: %v", p.name, err)
+			continue
+		}
+		q.handle(p, &a)
+	}
+	// all reads must be done before Wait()
+	<-stderrDone
+	err = cmd.Wait()
+
+	p.Lock()
+	p.process, p.events = nil, nil
+	commands := p.commands
+	p.commands = nil
+	p.Unlock()
+	close(writerDone)
+	q.Lock()
+	for c := range commands {
+		if q.commands[c] == p {
+			delete(q.commands, c)
+			q.ic.UnregisterCommandHandler(c, q)
+		}
+	}
+	q.Unlock()
+	if err != nil {
+		return fmt.Errorf("exited: %v", err)
+	}
+	log.Printf("external: %s exited", p.name)
+	return nil
+}
+
+// Writes the events to the program's stdin, killing it if a write takes
+// longer than External/timeout
+func (q *ExternalPlugin) write(p *externalProgram, cmd *exec.Cmd, stdin io.WriteCloser, events chan []byte, done chan bool) {
+	defer stdin.Close()
+	for {
+		var ev []byte
+		select {
+		case ev = <-events:
+		case <-done:
+			return
+		}
+		timeout, err := q.ic.GetIntOption("External", "timeout")
+		if err != nil || timeout <= 0 {
+			timeout = default_external_timeout
+		}
+		written := make(chan error, 1)
+		go func() {
+			_, err := stdin.Write(ev)
+			written <- err
+		}()
+		select {
+		case err := <-written:
+			if err != nil {
+				// exited, run() notices
+				return
+			}
+		case <-time.After(time.Duration(timeout) * time.Second):
+			log.Printf("external: %s doesn't read its events, killing it", p.name)
+			cmd.Process.Kill()
+			return
+		case <-done:
+			return
+		}
+	}
+}
+
+// Queues the event for p, drops it if p isn't running or its queue is full
+func (q *ExternalPlugin) send(p *externalProgram, ev *externalEvent) {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		log.Printf("external: %v", err)
+		return
+	}
+	p.Lock()
+	defer p.Unlock()
+	if p.events == nil {
+		return
+	}
+	select {
+	case p.events <- append(data, '\n'):
+	default:
+		log.Printf("external: queue of %s is full, dropping %s event", p.name, ev.Event)
+	}
+}
+
+func (q *ExternalPlugin) handle(p *externalProgram, a *externalAction) {
+	switch a.Action {
+	case "register":
+		if a.Command == "" || strings.ContainsAny(a.Command, " \t") || a.Command == "external" {
+			log.Printf("external: %s: invalid command %q", p.name, a.Command)
+			return
+		}
+		q.Lock()
+		if other, ok := q.commands[a.Command]; ok && other != p {
+			log.Printf("external: command %s of %s replaces the one of %s", a.Command, p.name, other.name)
+		}
+		if _, ok := q.commands[a.Command]; !ok {
+			opts := ircclient.HandlerOpts{MinAccess: a.MinAccess, Cooldown: time.Duration(a.Cooldown) * time.Second}
+			if err := q.ic.RegisterCommandHandlerOpts(a.Command, opts, q); err != nil {
+				log.Printf("external: unable to register command %s: %v", a.Command, err)
+			}
+		}
+		q.commands[a.Command] = p
+		q.Unlock()
+		p.Lock()
+		if p.commands != nil {
+			p.commands[a.Command] = a.Usage
+		}
+		p.Unlock()
+	case "lines":
+		p.Lock()
+		p.lines = a.Enabled
+		p.Unlock()
+	case "reply":
+		p.Lock()
+		c, ok := p.pending[a.ID]
+		p.Unlock()
+		if !ok {
+			log.Printf("external: %s: reply to unknown command %d", p.name, a.ID)
+			return
+		}
+		for _, line := range externalLines(a.Text) {
+			q.ic.Reply(c.cmd, line)
+		}
+	case "privmsg", "notice", "me":
+		if a.Target == "" || strings.ContainsAny(a.Target, " ,\r\n") {
+			log.Printf("external: %s: invalid target %q", p.name, a.Target)
+			return
+		}
+		for _, line := range externalLines(a.Text) {
+			switch a.Action {
+			case "privmsg":
+				q.ic.Privmsg(a.Target, line)
+			case "notice":
+				q.ic.Notice(a.Target, line)
+			case "me":
+				q.ic.Action(a.Target, line)
+			}
+		}
+	case "join", "part":
+		if !q.ic.IsChannelName(a.Channel) || strings.ContainsAny(a.Channel, " ,\r\n") {
+			log.Printf("external: %s: invalid channel %q", p.name, a.Channel)
+			return
+		}
+		if a.Action == "join" {
+			q.ic.Join(a.Channel, "")
+		} else {
+			q.ic.Part(a.Channel, "")
+		}
+	default:
+		log.Printf("external: %s: unknown action %q", p.name, a.Action)
+	}
+}
+
+// Splits text into lines, leaving out empty ones
+func externalLines(text string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.Replace(text, "\r", "", -1), "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
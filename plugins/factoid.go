@@ -0,0 +1,215 @@
+package plugins
+
+import (
+	"../ircclient"
+	"bufio"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	default_factoid_file = "factoids.db"
+)
+
+type FactoidPlugin struct {
+	sync.Mutex
+	ic *ircclient.IRCClient
+	// lowercased key -> values, one of them is picked at random on recall
+	facts map[string][]string
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("factoid", func() ircclient.Plugin { return new(FactoidPlugin) })
+}
+
+func (q *FactoidPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.facts = make(map[string][]string)
+
+	if q.ic.GetStringOption("Factoids", "file") == "" {
+		log.Println("added default factoid file \"" + default_factoid_file + "\" to config file")
+		q.ic.SetStringOption("Factoids", "file", default_factoid_file)
+	}
+	if err := q.load(); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	q.ic.RegisterCommandHandler("learn", 2, 100, q)
+	q.ic.RegisterCommandHandler("forget", 1, 100, q)
+	q.ic.RegisterCommandHandler("whatis", 1, 0, q)
+}
+
+func (q *FactoidPlugin) String() string {
+	return "factoid"
+}
+
+func (q *FactoidPlugin) Info() string {
+	return "remembers facts and tells them when asked"
+}
+
+func (q *FactoidPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "learn":
+		return "learn <key> <value>: teaches the bot <value> for <key>, if <key> has several values one of them is picked at random"
+	case "forget":
+		return "forget <key>: deletes all values of <key>"
+	case "whatis":
+		return "whatis <key>: tells a value of <key>, so does " + q.ic.Trigger() + "<key>"
+	}
+	return ""
+}
+
+// Answers "<trigger><key>" if key isn't a command
+func (q *FactoidPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if msg.Command != "PRIVMSG" || len(msg.Args) == 0 {
+		return
+	}
+	trigger := q.ic.Trigger()
+	if !strings.HasPrefix(msg.Args[0], trigger) {
+		return
+	}
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+	if q.ic.CanonNick(nick) == q.ic.CanonNick(q.ic.GetStringOption("Server", "nick")) {
+		return
+	}
+	fields := strings.Fields(msg.Args[0][len(trigger):])
+	if len(fields) != 1 || q.ic.IsCommand(fields[0]) {
+		return
+	}
+	if value, ok := q.recall(fields[0]); ok {
+		q.ic.ReplyMsg(msg, value)
+	}
+}
+
+func (q *FactoidPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	key := strings.ToLower(cmd.Args[0])
+	switch cmd.Command {
+	case "learn":
+		if q.ic.IsCommand(key) {
+			q.ic.Reply(cmd, "Can't learn "+key+", it's a command.")
+			return
+		}
+		if strings.Contains(key, "\t") {
+			q.ic.Reply(cmd, "Keys can't contain tabs.")
+			return
+		}
+		value := strings.Join(cmd.Args[1:], " ")
+		q.Lock()
+		for _, v := range q.facts[key] {
+			if v == value {
+				q.Unlock()
+				q.ic.Reply(cmd, "I already know that.")
+				return
+			}
+		}
+		q.facts[key] = append(q.facts[key], value)
+		n := len(q.facts[key])
+		err := q.save()
+		q.Unlock()
+		if err != nil {
+			log.Println(err)
+			q.ic.Reply(cmd, "Learned "+key+", but saving failed: "+err.Error())
+			return
+		}
+		if n > 1 {
+			q.ic.Reply(cmd, fmt.Sprintf("Ok, %s now has %d values.", key, n))
+		} else {
+			q.ic.Reply(cmd, "Ok, learned "+key+".")
+		}
+	case "forget":
+		q.Lock()
+		_, ok := q.facts[key]
+		delete(q.facts, key)
+		var err error
+		if ok {
+			err = q.save()
+		}
+		q.Unlock()
+		if !ok {
+			q.ic.Reply(cmd, "I don't know anything about "+key+".")
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			q.ic.Reply(cmd, "Forgot "+key+", but saving failed: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "Ok, forgot "+key+".")
+	case "whatis":
+		if value, ok := q.recall(key); ok {
+			q.ic.Reply(cmd, key+" is "+value)
+		} else {
+			q.ic.Reply(cmd, "I don't know anything about "+key+".")
+		}
+	}
+}
+
+func (q *FactoidPlugin) Unregister() {
+}
+
+// Returns one of the values of key, picked at random
+func (q *FactoidPlugin) recall(key string) (string, bool) {
+	q.Lock()
+	defer q.Unlock()
+	values := q.facts[strings.ToLower(key)]
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[rand.Intn(len(values))], true
+}
+
+// Reads the factoid file, each line contains a key and one of its values,
+// separated by a tab
+func (q *FactoidPlugin) load() error {
+	f, err := os.Open(q.ic.GetStringOption("Factoids", "file"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	q.Lock()
+	defer q.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), "\t", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		q.facts[fields[0]] = append(q.facts[fields[0]], fields[1])
+	}
+	return scanner.Err()
+}
+
+// Writes all factoids to the factoid file. Must be called with the lock held.
+func (q *FactoidPlugin) save() error {
+	keys := make([]string, 0, len(q.facts))
+	for key := range q.facts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	file := q.ic.GetStringOption("Factoids", "file")
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		for _, value := range q.facts[key] {
+			fmt.Fprintf(w, "%s\t%s\n", key, value)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
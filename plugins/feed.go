@@ -0,0 +1,402 @@
+package plugins
+
+import (
+	"../ircclient"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Minutes between two polls of a feed, if not given to "feed add"
+	default_feed_interval = 15
+	// %s is replaced with the escaped link, "none" disables shortening
+	default_feed_shortener = "https://is.gd/create.php?format=simple&url=%s"
+	// Entries announced per poll at most, the rest is skipped
+	max_feed_announce = 5
+	// GUIDs remembered per feed, a bit more than feeds usually contain
+	max_feed_seen = 200
+	// Feeds larger than this are cut off
+	max_feed_size = 2 << 20
+	feed_timeout  = 15 * time.Second
+)
+
+// A subscription as kept in the storage, under key "feed/<id>"
+type feed struct {
+	Channel  string
+	URL      string
+	Interval int // minutes
+	// GUIDs of the entries that have been announced, newest last
+	Seen []string
+	// the entries present when the feed was added have been marked as seen
+	Primed bool
+}
+
+type feedEntry struct {
+	guid, title, link string
+}
+
+// RSS 2.0 and Atom, only what's announced
+type feedDocument struct {
+	Title string `xml:"channel>title"`
+	Items []struct {
+		Title string `xml:"title"`
+		Link  string `xml:"link"`
+		GUID  string `xml:"guid"`
+	} `xml:"channel>item"`
+	AtomTitle string `xml:"title"`
+	Entries   []struct {
+		Title string `xml:"title"`
+		ID    string `xml:"id"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+type FeedPlugin struct {
+	sync.Mutex
+	ic     *ircclient.IRCClient
+	store  *ircclient.Store
+	client *http.Client
+	// id -> cancels the polling
+	polling map[int]func()
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("feed", func() ircclient.Plugin { return new(FeedPlugin) })
+}
+
+func (q *FeedPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.client = &http.Client{Timeout: feed_timeout}
+	q.polling = make(map[int]func())
+
+	if q.ic.GetStringOption("Feeds", "shortener") == "" {
+		log.Printf("added default feed shortener \"%s\" to config file", default_feed_shortener)
+		q.ic.SetStringOption("Feeds", "shortener", default_feed_shortener)
+	}
+
+	store, err := q.ic.Storage(q.String())
+	if err != nil {
+		log.Println("unable to open feed storage: " + err.Error())
+		return
+	}
+	q.store = store
+	for id, f := range q.feeds() {
+		q.startPolling(id, f.Interval)
+	}
+
+	q.ic.RegisterCommandHandler("feed", 1, 400, q)
+}
+
+func (q *FeedPlugin) String() string {
+	return "feed"
+}
+
+func (q *FeedPlugin) Info() string {
+	return "announces new entries of RSS and Atom feeds in channels"
+}
+
+func (q *FeedPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "feed":
+		return fmt.Sprintf("feed add <#channel> <url> [interval] | feed del <id> | feed list: announces new entries of the feed at <url> in <#channel>, polling it every <interval> (e.g. 30m, %d minutes by default)", default_feed_interval)
+	}
+	return ""
+}
+
+func (q *FeedPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+}
+
+func (q *FeedPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch strings.ToLower(cmd.Args[0]) {
+	case "add":
+		if len(cmd.Args) < 3 || !q.ic.IsChannelName(cmd.Args[1]) {
+			q.ic.Reply(cmd, q.ic.GetUsage("feed"))
+			return
+		}
+		u, err := url.Parse(cmd.Args[2])
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			q.ic.Reply(cmd, "That's not an HTTP(S) URL.")
+			return
+		}
+		interval := default_feed_interval
+		if len(cmd.Args) > 3 {
+			d, err := time.ParseDuration(cmd.Args[3])
+			if err != nil {
+				// plain minutes
+				n, nerr := strconv.Atoi(cmd.Args[3])
+				d, err = time.Duration(n)*time.Minute, nerr
+			}
+			if err != nil || d < time.Minute {
+				q.ic.Reply(cmd, "Invalid interval "+cmd.Args[3]+", it has to be at least a minute.")
+				return
+			}
+			interval = int(d / time.Minute)
+		}
+		// fetch it once, so typos show up right away
+		if _, err := q.fetch(u.String()); err != nil {
+			q.ic.Reply(cmd, "Couldn't read the feed: "+err.Error())
+			return
+		}
+		id, err := q.add(&feed{Channel: cmd.Args[1], URL: u.String(), Interval: interval})
+		if err != nil {
+			q.ic.Reply(cmd, "Couldn't add the feed: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, fmt.Sprintf("Ok, feed #%d is announced in %s.", id, cmd.Args[1]))
+	case "del":
+		if len(cmd.Args) < 2 {
+			q.ic.Reply(cmd, q.ic.GetUsage("feed"))
+			return
+		}
+		id, err := strconv.Atoi(strings.TrimPrefix(cmd.Args[1], "#"))
+		if err != nil {
+			q.ic.Reply(cmd, q.ic.GetUsage("feed"))
+			return
+		}
+		if ok, err := q.del(id); err != nil {
+			q.ic.Reply(cmd, "Couldn't delete the feed: "+err.Error())
+		} else if !ok {
+			q.ic.Reply(cmd, "There is no such feed.")
+		} else {
+			q.ic.Reply(cmd, fmt.Sprintf("Ok, deleted feed #%d.", id))
+		}
+	case "list":
+		feeds := q.feeds()
+		if len(feeds) == 0 {
+			q.ic.Reply(cmd, "There are no feeds.")
+			return
+		}
+		ids := make([]int, 0, len(feeds))
+		for id := range feeds {
+			ids = append(ids, id)
+		}
+		sort.Ints(ids)
+		for _, id := range ids {
+			f := feeds[id]
+			q.ic.Reply(cmd, fmt.Sprintf("#%d: %s in %s, every %d minutes", id, f.URL, f.Channel, f.Interval))
+		}
+	default:
+		q.ic.Reply(cmd, q.ic.GetUsage("feed"))
+	}
+}
+
+func (q *FeedPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	for id, cancel := range q.polling {
+		cancel()
+		delete(q.polling, id)
+	}
+}
+
+// Returns all stored feeds by id
+func (q *FeedPlugin) feeds() map[int]*feed {
+	feeds := make(map[int]*feed)
+	err := q.store.Iterate(func(key, value string) bool {
+		id, err := strconv.Atoi(strings.TrimPrefix(key, "feed/"))
+		f := new(feed)
+		if strings.HasPrefix(key, "feed/") && err == nil && json.Unmarshal([]byte(value), f) == nil {
+			feeds[id] = f
+		}
+		return true
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	return feeds
+}
+
+// Stores f under the next free id and starts polling it
+func (q *FeedPlugin) add(f *feed) (int, error) {
+	id := 0
+	err := q.store.Update("next", func(value string, ok bool) (string, bool) {
+		id, _ = strconv.Atoi(value)
+		return strconv.Itoa(id + 1), true
+	})
+	if err != nil {
+		return 0, err
+	}
+	value, _ := json.Marshal(f)
+	if err := q.store.Put("feed/"+strconv.Itoa(id), string(value)); err != nil {
+		return 0, err
+	}
+	q.startPolling(id, f.Interval)
+	// mark the current entries as seen
+	go q.poll(id)
+	return id, nil
+}
+
+// Stops polling feed id and deletes it, ok is false if there is no such feed
+func (q *FeedPlugin) del(id int) (ok bool, err error) {
+	q.Lock()
+	if cancel, found := q.polling[id]; found {
+		cancel()
+		delete(q.polling, id)
+	}
+	q.Unlock()
+	key := "feed/" + strconv.Itoa(id)
+	if _, ok, err = q.store.Get(key); err != nil || !ok {
+		return ok, err
+	}
+	return true, q.store.Delete(key)
+}
+
+func (q *FeedPlugin) startPolling(id, interval int) {
+	if interval < 1 {
+		interval = default_feed_interval
+	}
+	cancel, err := q.ic.Schedule(fmt.Sprintf("@every %dm", interval), func() { q.poll(id) })
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	q.Lock()
+	q.polling[id] = cancel
+	q.Unlock()
+}
+
+// Fetches feed id and announces the entries that haven't been seen yet
+func (q *FeedPlugin) poll(id int) {
+	key := "feed/" + strconv.Itoa(id)
+	value, ok, err := q.store.Get(key)
+	if err != nil || !ok {
+		return
+	}
+	var f feed
+	if err := json.Unmarshal([]byte(value), &f); err != nil {
+		log.Println(err)
+		return
+	}
+	title, entries, err := q.fetchEntries(f.URL)
+	if err != nil {
+		log.Printf("unable to poll feed %s: %v", f.URL, err)
+		return
+	}
+
+	var announce []feedEntry
+	// announce all new entries, even if the GUIDs are updated concurrently
+	err = q.store.Update(key, func(value string, ok bool) (string, bool) {
+		announce = nil
+		var f feed
+		if !ok || json.Unmarshal([]byte(value), &f) != nil {
+			// deleted meanwhile
+			return value, ok
+		}
+		seen := make(map[string]bool, len(f.Seen))
+		for _, guid := range f.Seen {
+			seen[guid] = true
+		}
+		// feeds list the newest entries first
+		for i := len(entries) - 1; i >= 0; i-- {
+			if seen[entries[i].guid] {
+				continue
+			}
+			seen[entries[i].guid] = true
+			f.Seen = append(f.Seen, entries[i].guid)
+			if f.Primed {
+				announce = append(announce, entries[i])
+			}
+		}
+		f.Primed = true
+		if len(f.Seen) > max_feed_seen {
+			f.Seen = f.Seen[len(f.Seen)-max_feed_seen:]
+		}
+		b, _ := json.Marshal(&f)
+		return string(b), true
+	})
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	if len(announce) > max_feed_announce {
+		q.ic.Privmsg(f.Channel, fmt.Sprintf("[%s] %d new entries, showing the latest %d", title, len(announce), max_feed_announce))
+		announce = announce[len(announce)-max_feed_announce:]
+	}
+	for _, e := range announce {
+		q.ic.Privmsg(f.Channel, fmt.Sprintf("[%s] %s %s", title, e.title, q.shorten(e.link)))
+	}
+}
+
+// Returns the body of url, at most max_feed_size bytes
+func (q *FeedPlugin) fetch(url string) ([]byte, error) {
+	resp, err := q.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, max_feed_size))
+}
+
+// Returns the title of the RSS or Atom feed at url and its entries, newest
+// first
+func (q *FeedPlugin) fetchEntries(url string) (string, []feedEntry, error) {
+	body, err := q.fetch(url)
+	if err != nil {
+		return "", nil, err
+	}
+	var doc feedDocument
+	if err := xml.Unmarshal(body, &doc); err != nil {
+		return "", nil, err
+	}
+
+	entries := make([]feedEntry, 0, len(doc.Items)+len(doc.Entries))
+	for _, item := range doc.Items {
+		e := feedEntry{strings.TrimSpace(item.GUID), strings.TrimSpace(item.Title), strings.TrimSpace(item.Link)}
+		if e.guid == "" {
+			e.guid = e.link
+		}
+		entries = append(entries, e)
+	}
+	for _, entry := range doc.Entries {
+		e := feedEntry{guid: strings.TrimSpace(entry.ID), title: strings.TrimSpace(entry.Title)}
+		for _, l := range entry.Links {
+			if l.Rel == "" || l.Rel == "alternate" {
+				e.link = l.Href
+				break
+			}
+		}
+		if e.guid == "" {
+			e.guid = e.link
+		}
+		entries = append(entries, e)
+	}
+	title := doc.Title
+	if title == "" {
+		title = doc.AtomTitle
+	}
+	return strings.TrimSpace(title), entries, nil
+}
+
+// Returns a short form of link using Feeds/shortener, or link itself if
+// that fails
+func (q *FeedPlugin) shorten(link string) string {
+	shortener := q.ic.GetStringOption("Feeds", "shortener")
+	if link == "" || shortener == "none" || !strings.Contains(shortener, "%s") {
+		return link
+	}
+	body, err := q.fetch(strings.Replace(shortener, "%s", url.QueryEscape(link), 1))
+	short := strings.TrimSpace(string(body))
+	if err != nil || !strings.HasPrefix(short, "http") || strings.ContainsAny(short, " \r\n") {
+		return link
+	}
+	return short
+}
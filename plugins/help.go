@@ -0,0 +1,104 @@
+package plugins
+
+import (
+	"../ircclient"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+type HelpPlugin struct {
+	ic *ircclient.IRCClient
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("help", func() ircclient.Plugin { return new(HelpPlugin) })
+}
+
+func (q *HelpPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.ic.RegisterCommandHandler("help", 0, 0, q)
+	// One line per plugin, don't flood the channel with them
+	q.ic.SetReplyMode("help", ircclient.ReplyModePrivate)
+}
+
+func (q *HelpPlugin) String() string {
+	return "help"
+}
+
+func (q *HelpPlugin) Info() string {
+	return "lists all commands and explains them"
+}
+
+func (q *HelpPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "help":
+		return "help [command]: lists all commands grouped by plugin, with the access level they need, or explains command"
+	}
+	return ""
+}
+
+func (q *HelpPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+}
+
+func (q *HelpPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch cmd.Command {
+	case "help":
+		if len(cmd.Args) > 0 {
+			q.explain(cmd, strings.TrimPrefix(cmd.Args[0], q.ic.Trigger()))
+			return
+		}
+		q.list(cmd)
+	}
+}
+
+func (q *HelpPlugin) Unregister() {
+}
+
+// Replies with one line per plugin, e.g. "karma: .karma" or
+// "factoid: .forget (100), .learn (100), .whatis"
+func (q *HelpPlugin) list(cmd *ircclient.IRCCommand) {
+	// plugin name -> its commands
+	commands := make(map[string][]string)
+	for h := range q.ic.IterHandlers() {
+		c := q.ic.Trigger() + h.Command
+		if h.Minaccess > 0 {
+			c += fmt.Sprintf(" (%d)", h.Minaccess)
+		}
+		commands[h.Handler.String()] = append(commands[h.Handler.String()], c)
+	}
+	plugins := make([]string, 0, len(commands))
+	for name := range commands {
+		plugins = append(plugins, name)
+	}
+	sort.Strings(plugins)
+
+	for _, name := range plugins {
+		sort.Strings(commands[name])
+		q.ic.Reply(cmd, name+": "+strings.Join(commands[name], ", "))
+	}
+	q.ic.Reply(cmd, "Numbers are the access level a command needs. Use "+q.ic.Trigger()+"help <command> for details.")
+}
+
+// Replies with the usage of command and what its plugin does
+func (q *HelpPlugin) explain(cmd *ircclient.IRCCommand, command string) {
+	var plugin ircclient.Plugin
+	for h := range q.ic.IterHandlers() {
+		if h.Command == command {
+			plugin = h.Handler
+		}
+	}
+	usage := q.ic.GetUsage(command)
+	if plugin == nil {
+		// a command registered by prefix or none at all, GetUsage() knows
+		q.ic.Reply(cmd, usage)
+		return
+	}
+	if usage == "" {
+		usage = q.ic.Trigger() + command
+	}
+	q.ic.Reply(cmd, usage)
+	if info := plugin.Info(); info != "" {
+		q.ic.Reply(cmd, "("+plugin.String()+": "+info+")")
+	}
+}
@@ -0,0 +1,81 @@
+package plugins
+
+import (
+	"../ircclient"
+	"log"
+	"strings"
+)
+
+const (
+	default_invite_access = 200
+)
+
+type InvitePlugin struct {
+	ic *ircclient.IRCClient
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("invite", func() ircclient.Plugin { return new(InvitePlugin) })
+}
+
+func (q *InvitePlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	if _, err := q.ic.GetIntOption("Invite", "minaccess"); err != nil {
+		log.Printf("added default invite minaccess value of %d to config file", default_invite_access)
+		q.ic.SetIntOption("Invite", "minaccess", default_invite_access)
+	}
+}
+
+func (q *InvitePlugin) String() string {
+	return "invite"
+}
+
+func (q *InvitePlugin) Info() string {
+	return "joins channels the bot is invited to by authorized users"
+}
+
+func (q *InvitePlugin) Usage(cmd string) string {
+	// plugin has no commands
+	return ""
+}
+
+func (q *InvitePlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	// :nick!user@host INVITE bot :#channel
+	if msg.Command != "INVITE" || len(msg.Args) == 0 {
+		return
+	}
+	channel := msg.Args[0]
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+
+	// The bot itself is a member of all channels it is in
+	if _, ok := q.ic.GetUserInfo(channel, q.ic.GetStringOption("Server", "nick")); ok {
+		return
+	}
+
+	minaccess, err := q.ic.GetIntOption("Invite", "minaccess")
+	if err != nil {
+		minaccess = default_invite_access
+	}
+	if q.ic.GetAccessLevel(msg.Source, channel) < minaccess {
+		q.ic.Notice(nick, "You are not authorized to invite me.")
+		return
+	}
+
+	if err := q.ic.Join(channel, ""); err != nil {
+		log.Println("invite: " + err.Error())
+		return
+	}
+	if q.ic.GetBoolOption("Invite", "autojoin", false) && strings.HasPrefix(channel, "#") {
+		// same format as the addchannel command
+		q.ic.SetStringOption("Channels", channel[1:], "42")
+	}
+}
+
+func (q *InvitePlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// interface saturation
+	return
+}
+
+func (q *InvitePlugin) Unregister() {
+	// nothing to do here
+}
@@ -0,0 +1,222 @@
+package plugins
+
+import (
+	"../ircclient"
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_karma_file = "karma.db"
+	// The first group of each pattern is the nick whose karma changes
+	default_karma_increment = `([A-Za-z0-9_\-\[\]\\^{}|` + "`" + `]+)\+\+`
+	default_karma_decrement = `([A-Za-z0-9_\-\[\]\\^{}|` + "`" + `]+)--`
+	// Seconds a user has to wait before changing the same nick's karma again
+	default_karma_cooldown = 60
+)
+
+// Published as "karma_changed" event whenever a score changes
+type KarmaChange struct {
+	Nick    string
+	Giver   string
+	Channel string
+	Delta   int
+	Score   int
+}
+
+type KarmaPlugin struct {
+	sync.Mutex
+	ic *ircclient.IRCClient
+	// canonical nick -> score
+	scores map[string]int
+	// canonical giver + " " + canonical nick -> time of the last change
+	lastChange map[string]time.Time
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("karma", func() ircclient.Plugin { return new(KarmaPlugin) })
+}
+
+func (q *KarmaPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.scores = make(map[string]int)
+	q.lastChange = make(map[string]time.Time)
+
+	if q.ic.GetStringOption("Karma", "file") == "" {
+		log.Println("added default karma file \"" + default_karma_file + "\" to config file")
+		q.ic.SetStringOption("Karma", "file", default_karma_file)
+	}
+	if q.ic.GetStringOption("Karma", "increment") == "" {
+		log.Println("added default karma increment pattern to config file")
+		q.ic.SetStringOption("Karma", "increment", default_karma_increment)
+	}
+	if q.ic.GetStringOption("Karma", "decrement") == "" {
+		log.Println("added default karma decrement pattern to config file")
+		q.ic.SetStringOption("Karma", "decrement", default_karma_decrement)
+	}
+	if _, err := q.ic.GetIntOption("Karma", "cooldown"); err != nil {
+		log.Printf("added default karma cooldown of %d seconds to config file", default_karma_cooldown)
+		q.ic.SetIntOption("Karma", "cooldown", default_karma_cooldown)
+	}
+
+	if err := q.load(); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+
+	q.ic.RegisterCommandHandler("karma", 1, 0, q)
+}
+
+func (q *KarmaPlugin) String() string {
+	return "karma"
+}
+
+func (q *KarmaPlugin) Info() string {
+	return "counts nick++ and nick-- in channels"
+}
+
+func (q *KarmaPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "karma":
+		return "karma <nick>: shows the karma of <nick>, which is changed by saying <nick>++ or <nick>-- in a channel"
+	}
+	return ""
+}
+
+func (q *KarmaPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if msg.Command != "PRIVMSG" || !strings.HasPrefix(msg.Target, "#") || len(msg.Args) == 0 {
+		return
+	}
+	// don't count "!karma foo--" and the like
+	if strings.HasPrefix(msg.Args[0], q.ic.Trigger()) {
+		return
+	}
+	giver := strings.SplitN(msg.Source, "!", 2)[0]
+	text := msg.PlainText()[0]
+	for _, nick := range q.match("increment", text) {
+		q.change(giver, nick, msg.Target, 1)
+	}
+	for _, nick := range q.match("decrement", text) {
+		q.change(giver, nick, msg.Target, -1)
+	}
+}
+
+func (q *KarmaPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch cmd.Command {
+	case "karma":
+		nick := cmd.Args[0]
+		q.Lock()
+		score := q.scores[q.ic.CanonNick(nick)]
+		q.Unlock()
+		q.ic.Reply(cmd, fmt.Sprintf("%s has a karma of %d", nick, score))
+	}
+}
+
+func (q *KarmaPlugin) Unregister() {
+}
+
+// Returns the nicks matched by the increment or decrement pattern in text
+func (q *KarmaPlugin) match(option, text string) []string {
+	re, err := regexp.Compile(q.ic.GetStringOption("Karma", option))
+	if err != nil {
+		log.Printf("invalid karma %s pattern: %v", option, err)
+		return nil
+	}
+	var nicks []string
+	for _, m := range re.FindAllStringSubmatch(text, -1) {
+		if len(m) > 1 && m[1] != "" {
+			nicks = append(nicks, m[1])
+		}
+	}
+	return nicks
+}
+
+// Changes the karma of nick by delta, unless giver is nick or has changed
+// it less than Karma/cooldown seconds ago
+func (q *KarmaPlugin) change(giver, nick, channel string, delta int) {
+	g, n := q.ic.CanonNick(giver), q.ic.CanonNick(nick)
+	if g == n {
+		return
+	}
+	cooldown, _ := q.ic.GetIntOption("Karma", "cooldown")
+
+	q.Lock()
+	key := g + " " + n
+	if last, ok := q.lastChange[key]; ok && time.Since(last) < time.Duration(cooldown)*time.Second {
+		q.Unlock()
+		return
+	}
+	// forget cooldowns that have passed, so the map doesn't grow forever
+	for k, last := range q.lastChange {
+		if time.Since(last) >= time.Duration(cooldown)*time.Second {
+			delete(q.lastChange, k)
+		}
+	}
+	q.lastChange[key] = time.Now()
+	q.scores[n] += delta
+	score := q.scores[n]
+	err := q.save()
+	q.Unlock()
+
+	if err != nil {
+		log.Println(err)
+	}
+	q.ic.Publish("karma_changed", &KarmaChange{nick, giver, channel, delta, score})
+}
+
+// Reads the karma file, each line contains the canonical nick and its score
+func (q *KarmaPlugin) load() error {
+	f, err := os.Open(q.ic.GetStringOption("Karma", "file"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	q.Lock()
+	defer q.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		if score, err := strconv.Atoi(fields[1]); err == nil {
+			q.scores[fields[0]] = score
+		}
+	}
+	return scanner.Err()
+}
+
+// Writes all scores to the karma file. Must be called with the lock held.
+func (q *KarmaPlugin) save() error {
+	nicks := make([]string, 0, len(q.scores))
+	for nick := range q.scores {
+		nicks = append(nicks, nick)
+	}
+	sort.Strings(nicks)
+
+	file := q.ic.GetStringOption("Karma", "file")
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, nick := range nicks {
+		fmt.Fprintf(w, "%s %d\n", nick, q.scores[nick])
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(file+".tmp", file)
+}
@@ -2,19 +2,20 @@ package plugins
 
 import (
 	"../ircclient"
-	"log"
-	"os"
-	"strconv"
-	"syscall"
 )
 
 type KexecPlugin struct {
 	ic *ircclient.IRCClient
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("kexec", func() ircclient.Plugin { return new(KexecPlugin) })
+}
+
 func (kp *KexecPlugin) Register(cl *ircclient.IRCClient) {
 	kp.ic = cl
 	kp.ic.RegisterCommandHandler("kexec", 0, 500, kp)
+	kp.ic.RegisterCommandHandler("upgrade", 0, 500, kp)
 }
 
 func (kp *KexecPlugin) String() string {
@@ -29,6 +30,8 @@ func (kp *KexecPlugin) Usage(cmd string) string {
 	switch cmd {
 	case "kexec":
 		return "kexec: execute bot, thereby using new binary"
+	case "upgrade":
+		return "upgrade: execute the new binary of the bot, keeping the connection, channels and nick"
 	}
 	return ""
 }
@@ -38,17 +41,8 @@ func (kp *KexecPlugin) ProcessLine(msg *ircclient.IRCMessage) {
 }
 
 func (kp *KexecPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
-	socket := kp.ic.GetSocket()
-	// check for error
-	if socket == -1 {
-		kp.ic.Reply(cmd, "Online restart failed")
-		return
-	}
 	kp.ic.Reply(cmd, "Now trying online restart.")
-	kp.ic.Shutdown()
-	progname := os.Args[0]
-	log.Println("kexec: " + progname)
-	err := syscall.Exec(progname, []string{progname, strconv.Itoa(socket)}, os.Environ())
+	err := kp.ic.Upgrade()
 	// exec normally doesn't return
 	kp.ic.Reply(cmd, "couldn't kexec: "+err.Error())
 }
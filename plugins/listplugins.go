@@ -9,12 +9,19 @@ type ListPlugins struct {
 	ic *ircclient.IRCClient
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("listplugins", func() ircclient.Plugin { return new(ListPlugins) })
+}
+
 func (lp *ListPlugins) Register(ic *ircclient.IRCClient) {
 	lp.ic = ic
 	ic.RegisterCommandHandler("listplugins", 0, 0, lp)
 	ic.RegisterCommandHandler("listcommands", 0, 0, lp)
-	ic.RegisterCommandHandler("help", 0, 0, lp)
 	ic.RegisterCommandHandler("info", 0, 0, lp)
+	// Long lists, don't flood the channel with them
+	for _, cmd := range []string{"listplugins", "listcommands"} {
+		ic.SetReplyMode(cmd, ircclient.ReplyModePrivate)
+	}
 }
 
 func (lp *ListPlugins) String() string {
@@ -33,10 +40,8 @@ func (lp *ListPlugins) Usage(cmd string) string {
 	switch cmd {
 	case "listplugins":
 		return "listplugins: lists all loaded plugins"
-	case "help":
-		fallthrough
 	case "listcommands":
-		return cmd + ": list all available commands"
+		return "listcommands: list all available commands, see help for details"
 	case "info":
 		return "info <plugin>: get short description of this plugin"
 	}
@@ -56,12 +61,6 @@ func (lp *ListPlugins) ProcessCommand(cmd *ircclient.IRCCommand) {
 		}
 
 		lp.ic.Reply(cmd, strings.Join(a, ", "))
-	case "help":
-		if len(cmd.Args) >= 1 {
-			lp.ic.Reply(cmd, lp.ic.GetUsage(cmd.Args[0]))
-			return
-		}
-		fallthrough // listcommands if 0 parameters
 	case "listcommands":
 		c := lp.ic.IterHandlers()
 		commands := ""
@@ -69,7 +68,7 @@ func (lp *ListPlugins) ProcessCommand(cmd *ircclient.IRCCommand) {
 			if commands != "" {
 				commands += ", "
 			}
-			commands += e.Command
+			commands += lp.ic.Trigger() + e.Command
 		}
 		lp.ic.Reply(cmd, commands)
 	case "info":
@@ -6,7 +6,6 @@ import (
 	"log"
 	"os"
 	"strings"
-	"time"
 )
 
 const (
@@ -17,6 +16,10 @@ type LoggerPlugin struct {
 	ic *ircclient.IRCClient
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("logger", func() ircclient.Plugin { return new(LoggerPlugin) })
+}
+
 func make_sure_dir_exists(dirname string) error {
 	finfo, err := os.Lstat(dirname)
 	if err != nil {
@@ -88,7 +91,7 @@ func (l *LoggerPlugin) ProcessLine(msg *ircclient.IRCMessage) {
 		}
 		host := strings.SplitN(l.ic.GetStringOption("Server", "host"), ":", 2)[0]
 		full_filename := l.ic.GetStringOption("Logger", "dir") + "/" + host + "_" + s
-		msg := fmt.Sprintf("%s | %s: %s\n", time.Now().String(),
+		msg := fmt.Sprintf("%s | %s: %s\n", msg.Timestamp().Local().String(),
 			strings.SplitN(msg.Source, "!", 2)[0], strings.Join(msg.Args, " "))
 		if err := write_string_to_file(full_filename, msg); err != nil {
 			log.Println(err.Error())
@@ -96,6 +99,10 @@ func (l *LoggerPlugin) ProcessLine(msg *ircclient.IRCMessage) {
 	}
 }
 
+func (l *LoggerPlugin) ProcessDisconnect(reason error) {
+	log.Println("lost connection: " + reason.Error())
+}
+
 func (l *LoggerPlugin) Unregister() {
 	return
 }
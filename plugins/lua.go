@@ -0,0 +1,380 @@
+package plugins
+
+import (
+	"../ircclient"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/yuin/gopher-lua"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_lua_dir = "scripts"
+	// Seconds a script may run per call
+	default_lua_timeout = 5
+)
+
+// A script loaded from Lua/dir, with a Lua state of its own
+type luaScript struct {
+	// the state isn't safe for concurrent use
+	sync.Mutex
+	name  string
+	state *lua.LState
+	store *ircclient.Store
+	// commands registered while the script is being loaded, nil afterwards
+	pending map[string]*luaCommand
+}
+
+// A command registered by a script
+type luaCommand struct {
+	script    *luaScript
+	fn        *lua.LFunction
+	minaccess int
+	usage     string
+}
+
+// Runs the Lua scripts (*.lua) in the directory Lua/dir, so small commands
+// can be added without rebuilding the bot. Scripts use the table "bot":
+//
+//	bot.register_command("hello", function(cmd)
+//		bot.reply(cmd, "Hello " .. cmd.nick .. "!")
+//	end, 0, "hello: greets you")
+//
+//	bot.register_command(name, fn[, minaccess[, usage]]), while loading
+//	bot.send(target, text)
+//	bot.reply(cmd, text)
+//	bot.get_option(section, option), bot.set_option(section, option, value)
+//	bot.get(key), bot.put(key, value), bot.delete(key): storage of the script
+//
+// fn gets a table with command, args (a list), source, nick and target. Only
+// the base, table, string and math libraries are available, and each call
+// may take Lua/timeout seconds at most.
+type LuaPlugin struct {
+	// protects scripts and commands, which are replaced on reload
+	sync.RWMutex
+	ic       *ircclient.IRCClient
+	scripts  []*luaScript
+	commands map[string]*luaCommand
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("lua", func() ircclient.Plugin { return new(LuaPlugin) })
+}
+
+func (q *LuaPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.commands = make(map[string]*luaCommand)
+
+	if q.ic.GetStringOption("Lua", "dir") == "" {
+		log.Println("added default lua script directory \"" + default_lua_dir + "\" to config file")
+		q.ic.SetStringOption("Lua", "dir", default_lua_dir)
+	}
+	if _, err := q.ic.GetIntOption("Lua", "timeout"); err != nil {
+		log.Printf("added default lua timeout of %d seconds to config file", default_lua_timeout)
+		q.ic.SetIntOption("Lua", "timeout", default_lua_timeout)
+	}
+
+	q.ic.RegisterCommandHandler("lua", 1, 500, q)
+	q.Lock()
+	defer q.Unlock()
+	for _, err := range q.load() {
+		log.Println(err)
+	}
+}
+
+func (q *LuaPlugin) String() string {
+	return "lua"
+}
+
+func (q *LuaPlugin) Info() string {
+	return "runs commands written in Lua"
+}
+
+func (q *LuaPlugin) Usage(cmd string) string {
+	if cmd == "lua" {
+		return "lua reload|list: reloads the scripts, or lists them with their commands"
+	}
+	q.RLock()
+	defer q.RUnlock()
+	if c, ok := q.commands[cmd]; ok {
+		return c.usage
+	}
+	return ""
+}
+
+func (q *LuaPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+}
+
+func (q *LuaPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	if cmd.Command == "lua" {
+		q.manage(cmd)
+		return
+	}
+	q.RLock()
+	c, ok := q.commands[cmd.Command]
+	q.RUnlock()
+	if !ok {
+		return
+	}
+	if err := q.call(c, cmd); err != nil {
+		log.Printf("lua: %s: %v", c.script.name, err)
+		q.ic.Reply(cmd, "Script error in "+c.script.name+", see the log.")
+	}
+}
+
+func (q *LuaPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	q.unload()
+}
+
+func (q *LuaPlugin) manage(cmd *ircclient.IRCCommand) {
+	switch cmd.Args[0] {
+	case "reload":
+		q.Lock()
+		q.unload()
+		errs := q.load()
+		count := len(q.scripts)
+		q.Unlock()
+		for _, err := range errs {
+			log.Println(err)
+			// Lua errors may come with a stack trace
+			q.ic.Reply(cmd, strings.TrimSpace(strings.SplitN(err.Error(), "\n", 2)[0]))
+		}
+		q.ic.Reply(cmd, fmt.Sprintf("Loaded %d of %d scripts.", count, count+len(errs)))
+	case "list":
+		q.RLock()
+		defer q.RUnlock()
+		if len(q.scripts) == 0 {
+			q.ic.Reply(cmd, "No scripts loaded.")
+			return
+		}
+		for _, s := range q.scripts {
+			names := make([]string, 0)
+			for name, c := range q.commands {
+				if c.script == s {
+					names = append(names, name)
+				}
+			}
+			sort.Strings(names)
+			q.ic.Reply(cmd, s.name+": "+strings.Join(names, ", "))
+		}
+	default:
+		q.ic.Reply(cmd, q.Usage("lua"))
+	}
+}
+
+// Loads all scripts, returns the errors of those that failed. Must be called
+// with the lock held.
+func (q *LuaPlugin) load() []error {
+	files, err := filepath.Glob(filepath.Join(q.ic.GetStringOption("Lua", "dir"), "*.lua"))
+	if err != nil {
+		return []error{err}
+	}
+	sort.Strings(files)
+	errs := make([]error, 0)
+	for _, file := range files {
+		if err := q.loadScript(file); err != nil {
+			errs = append(errs, errors.New("lua: "+filepath.Base(file)+": "+err.Error()))
+		}
+	}
+	return errs
+}
+
+// Runs the script in file and registers its commands. Must be called with
+// the lock held.
+func (q *LuaPlugin) loadScript(file string) error {
+	code, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	name := strings.TrimSuffix(filepath.Base(file), ".lua")
+	store, err := q.ic.Storage("lua/" + name)
+	if err != nil {
+		return err
+	}
+	s := &luaScript{name: name, store: store, pending: make(map[string]*luaCommand)}
+	s.state = lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{{lua.BaseLibName, lua.OpenBase}, {lua.TabLibName, lua.OpenTable}, {lua.StringLibName, lua.OpenString}, {lua.MathLibName, lua.OpenMath}} {
+		s.state.Push(s.state.NewFunction(lib.open))
+		s.state.Push(lua.LString(lib.name))
+		s.state.Call(1, 0)
+	}
+	// scripts may only use what we give them
+	for _, fn := range []string{"dofile", "loadfile", "load", "loadstring", "require", "collectgarbage"} {
+		s.state.SetGlobal(fn, lua.LNil)
+	}
+	s.state.SetGlobal("bot", q.api(s))
+
+	cancel := q.setTimeout(s)
+	err = s.state.DoString(string(code))
+	cancel()
+	if err != nil {
+		s.state.Close()
+		return err
+	}
+
+	// only scripts that ran completely get their commands
+	for cmd, c := range s.pending {
+		if other, ok := q.commands[cmd]; ok {
+			log.Printf("lua: command %s of %s replaces the one of %s", cmd, s.name, other.script.name)
+			q.ic.UnregisterCommandHandler(cmd, q)
+		}
+		q.commands[cmd] = c
+		if err := q.ic.RegisterCommandHandler(cmd, 0, c.minaccess, q); err != nil {
+			log.Printf("lua: unable to register command %s: %v", cmd, err)
+		}
+	}
+	log.Printf("lua: loaded %s with %d commands", s.name, len(s.pending))
+	s.pending = nil
+	q.scripts = append(q.scripts, s)
+	return nil
+}
+
+// Unregisters the commands of all scripts and closes them. Must be called
+// with the lock held.
+func (q *LuaPlugin) unload() {
+	for cmd := range q.commands {
+		q.ic.UnregisterCommandHandler(cmd, q)
+	}
+	q.commands = make(map[string]*luaCommand)
+	for _, s := range q.scripts {
+		// wait for running calls
+		s.Lock()
+		s.state.Close()
+		s.Unlock()
+	}
+	q.scripts = nil
+}
+
+// Limits the time the script may run to Lua/timeout, call the returned
+// function when it's done
+func (q *LuaPlugin) setTimeout(s *luaScript) context.CancelFunc {
+	timeout, err := q.ic.GetIntOption("Lua", "timeout")
+	if err != nil || timeout <= 0 {
+		timeout = default_lua_timeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeout)*time.Second)
+	s.state.SetContext(ctx)
+	return func() {
+		s.state.RemoveContext()
+		cancel()
+	}
+}
+
+// Calls the function of the command c with cmd
+func (q *LuaPlugin) call(c *luaCommand, cmd *ircclient.IRCCommand) error {
+	s := c.script
+	s.Lock()
+	defer s.Unlock()
+	if s.state.IsClosed() {
+		// unloaded meanwhile
+		return nil
+	}
+	L := s.state
+	args := L.NewTable()
+	for _, arg := range cmd.Args {
+		args.Append(lua.LString(arg))
+	}
+	t := L.NewTable()
+	t.RawSetString("command", lua.LString(cmd.Command))
+	t.RawSetString("args", args)
+	t.RawSetString("source", lua.LString(cmd.Source))
+	t.RawSetString("nick", lua.LString(strings.SplitN(cmd.Source, "!", 2)[0]))
+	t.RawSetString("target", lua.LString(cmd.Target))
+	ud := L.NewUserData()
+	ud.Value = cmd
+	t.RawSetString("_cmd", ud)
+
+	cancel := q.setTimeout(s)
+	defer cancel()
+	return L.CallByParam(lua.P{Fn: c.fn, NRet: 0, Protect: true}, t)
+}
+
+// Returns the table "bot" for the script s
+func (q *LuaPlugin) api(s *luaScript) *lua.LTable {
+	L := s.state
+	api := L.NewTable()
+	fns := map[string]lua.LGFunction{
+		"register_command": func(L *lua.LState) int {
+			if s.pending == nil {
+				L.RaiseError("commands can only be registered while the script is loaded")
+			}
+			name := L.CheckString(1)
+			if strings.ContainsAny(name, " \t") || name == "lua" {
+				L.ArgError(1, "invalid command name")
+			}
+			s.pending[name] = &luaCommand{script: s, fn: L.CheckFunction(2), minaccess: L.OptInt(3, 0), usage: L.OptString(4, "")}
+			return 0
+		},
+		"send": func(L *lua.LState) int {
+			target, text := L.CheckString(1), L.CheckString(2)
+			if strings.ContainsAny(target, " ,\r\n") || target == "" {
+				L.ArgError(1, "invalid target")
+			}
+			for _, line := range strings.Split(text, "\n") {
+				q.ic.SendLine("PRIVMSG " + target + " :" + strings.TrimRight(line, "\r"))
+			}
+			return 0
+		},
+		"reply": func(L *lua.LState) int {
+			var cmd *ircclient.IRCCommand
+			if ud, ok := L.CheckTable(1).RawGetString("_cmd").(*lua.LUserData); ok {
+				cmd, _ = ud.Value.(*ircclient.IRCCommand)
+			}
+			if cmd == nil {
+				L.ArgError(1, "not a command")
+			}
+			for _, line := range strings.Split(L.CheckString(2), "\n") {
+				q.ic.Reply(cmd, strings.TrimRight(line, "\r"))
+			}
+			return 0
+		},
+		"get_option": func(L *lua.LState) int {
+			L.Push(lua.LString(q.ic.GetStringOption(L.CheckString(1), L.CheckString(2))))
+			return 1
+		},
+		"set_option": func(L *lua.LState) int {
+			q.ic.SetStringOption(L.CheckString(1), L.CheckString(2), L.CheckString(3))
+			return 0
+		},
+		"get": func(L *lua.LState) int {
+			value, ok, err := s.store.Get(L.CheckString(1))
+			if err != nil {
+				L.RaiseError("%v", err)
+			}
+			if !ok {
+				L.Push(lua.LNil)
+			} else {
+				L.Push(lua.LString(value))
+			}
+			return 1
+		},
+		"put": func(L *lua.LState) int {
+			if err := s.store.Put(L.CheckString(1), L.CheckString(2)); err != nil {
+				L.RaiseError("%v", err)
+			}
+			return 0
+		},
+		"delete": func(L *lua.LState) int {
+			if err := s.store.Delete(L.CheckString(1)); err != nil {
+				L.RaiseError("%v", err)
+			}
+			return 0
+		},
+	}
+	for name, fn := range fns {
+		api.RawSetString(name, L.NewFunction(fn))
+	}
+	return api
+}
@@ -0,0 +1,532 @@
+package plugins
+
+// Bridges Matrix rooms and IRC channels through the client-server API of a
+// homeserver, using an account of its own:
+//
+//	[Matrix]
+//	homeserver: https://matrix.example.org
+//	token: <access token of the bot's Matrix account>
+//
+//	[MatrixRooms]
+//	mett: !AbCdEfGh:example.org libera/#mett
+//
+// Instead of a token, user and password can be given, the token received
+// when logging in is saved as token then. Each option of section
+// MatrixRooms links a room (its ID or an alias) with channels, written as
+// in section Relay. Like the relay plugin, it has to be registered with
+// BotManager.RegisterPlugin(). Messages from Matrix are prefixed with the
+// sender's display name; multi-line messages become several IRC messages,
+// see sendBridged().
+
+import (
+	"../ircclient"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Seconds the homeserver holds a sync request if there are no events
+	matrix_sync_timeout = 30
+	// Wait after a failed request, doubled up to matrix_max_retry
+	matrix_retry     = 5 * time.Second
+	matrix_max_retry = 5 * time.Minute
+	// Responses larger than this are rejected
+	max_matrix_response = 16 << 20
+	// Messages from IRC waiting to be sent, more are dropped
+	matrix_queue_size = 100
+	matrix_api        = "/_matrix/client/v3"
+)
+
+// An event of a room, only the fields used here
+type matrixEvent struct {
+	Type     string  `json:"type"`
+	Sender   string  `json:"sender"`
+	StateKey *string `json:"state_key"`
+	Content  struct {
+		MsgType     string `json:"msgtype"`
+		Body        string `json:"body"`
+		URL         string `json:"url"`
+		Displayname string `json:"displayname"`
+		Membership  string `json:"membership"`
+		RelatesTo   struct {
+			RelType string `json:"rel_type"`
+		} `json:"m.relates_to"`
+		NewContent *struct {
+			MsgType string `json:"msgtype"`
+			Body    string `json:"body"`
+		} `json:"m.new_content"`
+	} `json:"content"`
+}
+
+type matrixEvents struct {
+	Events []matrixEvent `json:"events"`
+}
+
+type matrixSync struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			State    matrixEvents `json:"state"`
+			Timeline matrixEvents `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// A message from IRC to be sent to a room
+type matrixMessage struct {
+	room, msgtype, body string
+}
+
+type MatrixPlugin struct {
+	// network -> client, see Register()
+	clients map[string]*ircclient.IRCClient
+	// the client the options are read from; sections Matrix and MatrixRooms
+	// are the same for all networks
+	conf       *ircclient.IRCClient
+	http       *http.Client
+	homeserver string
+	token      string
+	// our own user ID, its messages aren't relayed
+	userID string
+	// room ID -> channels linked to it, known once the rooms are joined
+	rooms map[string][]relayEndpoint
+	// room ID -> user ID -> display name
+	names map[string]map[string]string
+	out   chan matrixMessage
+	// stops syncing and sending
+	cancel func()
+	// counter for the transaction IDs of sent messages
+	txn int
+	sync.Mutex
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("matrix", func() ircclient.Plugin { return new(MatrixPlugin) })
+}
+
+// Called once per network when registered with a BotManager, starts the
+// bridge on the first call
+func (q *MatrixPlugin) Register(cl *ircclient.IRCClient) {
+	q.Lock()
+	defer q.Unlock()
+	if q.clients != nil {
+		q.clients[cl.Network()] = cl
+		return
+	}
+	q.clients = map[string]*ircclient.IRCClient{cl.Network(): cl}
+	q.conf = cl
+	q.homeserver = strings.TrimRight(cl.GetStringOption("Matrix", "homeserver"), "/")
+	if q.homeserver == "" {
+		log.Println("matrix: no homeserver set in section Matrix, not bridging")
+		return
+	}
+	q.http = &http.Client{Timeout: (matrix_sync_timeout + 30) * time.Second}
+	q.rooms = make(map[string][]relayEndpoint)
+	q.names = make(map[string]map[string]string)
+	q.out = make(chan matrixMessage, matrix_queue_size)
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	go q.run(ctx)
+}
+
+func (q *MatrixPlugin) String() string {
+	return "matrix"
+}
+
+func (q *MatrixPlugin) Info() string {
+	return "bridges Matrix rooms and IRC channels"
+}
+
+func (q *MatrixPlugin) Usage(cmd string) string {
+	// plugin has no commands
+	return ""
+}
+
+func (q *MatrixPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// interface saturation
+}
+
+func (q *MatrixPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.clients = nil
+}
+
+// Sends messages of linked channels to their rooms
+func (q *MatrixPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if msg.Command != "PRIVMSG" || len(msg.Args) == 0 || !strings.Contains(msg.Source, "!") {
+		return
+	}
+	q.Lock()
+	ic, out := q.clients[msg.Network], q.out
+	q.Unlock()
+	if ic == nil || out == nil || !ic.IsChannelName(msg.Target) {
+		return
+	}
+	nick, _, _ := ircclient.ParseSource(msg.Source)
+	if ic.CanonNick(nick) == ic.CanonNick(ic.GetStringOption("Server", "nick")) {
+		return
+	}
+
+	body := "<" + nick + "> " + ircclient.StripFormatting(msg.Args[0])
+	if command, text, ok := msg.CTCP(); ok {
+		if command != "ACTION" {
+			return
+		}
+		body = "* " + nick + " " + ircclient.StripFormatting(text)
+	}
+	for _, room := range q.linkedRooms(ic, relayEndpoint{msg.Network, ic.CanonChannel(msg.Target)}) {
+		select {
+		case out <- matrixMessage{room, "m.text", body}:
+		default:
+			log.Println("matrix: too many messages waiting, dropping one for " + room)
+		}
+	}
+}
+
+// Returns the IDs of the rooms linked to the channel from
+func (q *MatrixPlugin) linkedRooms(ic *ircclient.IRCClient, from relayEndpoint) []string {
+	q.Lock()
+	defer q.Unlock()
+	var rooms []string
+	for room, endpoints := range q.rooms {
+		for _, e := range endpoints {
+			if e.network == from.network && ic.CanonChannel(e.channel) == from.channel {
+				rooms = append(rooms, room)
+				break
+			}
+		}
+	}
+	return rooms
+}
+
+// Logs in, joins the rooms and syncs until ctx is cancelled
+func (q *MatrixPlugin) run(ctx context.Context) {
+	retry := matrix_retry
+	wait := func() bool {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > matrix_max_retry {
+			retry = matrix_max_retry
+		}
+		return true
+	}
+
+	for {
+		err := q.setup(ctx)
+		if err == nil {
+			break
+		}
+		log.Println("matrix: " + err.Error())
+		if !wait() {
+			return
+		}
+	}
+	go q.send(ctx)
+
+	// the first sync only returns the current state, the history isn't
+	// relayed
+	since := ""
+	for {
+		next, err := q.sync(ctx, since)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("matrix: sync failed: " + err.Error())
+			if !wait() {
+				return
+			}
+			continue
+		}
+		since, retry = next, matrix_retry
+	}
+}
+
+// Gets our user ID, logging in first if there's no token, and joins the
+// rooms of section MatrixRooms
+func (q *MatrixPlugin) setup(ctx context.Context) error {
+	q.token = q.conf.GetStringOption("Matrix", "token")
+	if q.token == "" {
+		if err := q.login(ctx); err != nil {
+			return err
+		}
+	}
+	var whoami struct {
+		UserID string `json:"user_id"`
+	}
+	if err := q.call(ctx, "GET", "/account/whoami", nil, &whoami); err != nil {
+		return err
+	}
+	q.userID = whoami.UserID
+
+	rooms := make(map[string][]relayEndpoint)
+	for _, option := range q.conf.GetOptions("MatrixRooms") {
+		fields := strings.Fields(q.conf.GetStringOption("MatrixRooms", option))
+		if len(fields) < 2 {
+			log.Println("matrix: option " + option + " of section MatrixRooms needs a room and a channel")
+			continue
+		}
+		var joined struct {
+			RoomID string `json:"room_id"`
+		}
+		if err := q.call(ctx, "POST", "/join/"+url.PathEscape(fields[0]), struct{}{}, &joined); err != nil {
+			return errors.New("unable to join " + fields[0] + ": " + err.Error())
+		}
+		rooms[joined.RoomID] = append(rooms[joined.RoomID], parseRelayLink(strings.Join(fields[1:], " "))...)
+	}
+	q.Lock()
+	q.rooms = rooms
+	q.Unlock()
+	return nil
+}
+
+// Logs in with user and password and saves the token
+func (q *MatrixPlugin) login(ctx context.Context) error {
+	user, password := q.conf.GetStringOption("Matrix", "user"), q.conf.GetStringOption("Matrix", "password")
+	if user == "" || password == "" {
+		return errors.New("need token or user and password in section Matrix")
+	}
+	request := map[string]interface{}{
+		"type":       "m.login.password",
+		"identifier": map[string]string{"type": "m.id.user", "user": user},
+		"password":   password,
+		// shown in the device list of the account
+		"initial_device_display_name": "MettBot",
+	}
+	var response struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := q.call(ctx, "POST", "/login", request, &response); err != nil {
+		return errors.New("login failed: " + err.Error())
+	}
+	q.token = response.AccessToken
+	// otherwise every start would add a device
+	q.conf.SetStringOption("Matrix", "token", q.token)
+	log.Println("matrix: logged in as " + user + ", access token saved to config file")
+	return nil
+}
+
+// Fetches the events after since and relays them. Returns the token for
+// the next call.
+func (q *MatrixPlugin) sync(ctx context.Context, since string) (next string, err error) {
+	params := url.Values{}
+	if since == "" {
+		// just the state, without history
+		params.Set("filter", `{"room":{"timeline":{"limit":0}}}`)
+	} else {
+		params.Set("since", since)
+		params.Set("timeout", strconv.Itoa(matrix_sync_timeout*1000))
+	}
+	var response matrixSync
+	if err := q.call(ctx, "GET", "/sync?"+params.Encode(), nil, &response); err != nil {
+		return "", err
+	}
+	for room, r := range response.Rooms.Join {
+		for i := range r.State.Events {
+			q.learnName(room, &r.State.Events[i])
+		}
+		for i := range r.Timeline.Events {
+			e := &r.Timeline.Events[i]
+			q.learnName(room, e)
+			if since != "" {
+				q.relay(room, e)
+			}
+		}
+	}
+	return response.NextBatch, nil
+}
+
+// Remembers the display name if e is a membership event
+func (q *MatrixPlugin) learnName(room string, e *matrixEvent) {
+	if e.Type != "m.room.member" || e.StateKey == nil {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.names[room] == nil {
+		q.names[room] = make(map[string]string)
+	}
+	if e.Content.Membership == "join" && e.Content.Displayname != "" {
+		q.names[room][*e.StateKey] = e.Content.Displayname
+	} else {
+		delete(q.names[room], *e.StateKey)
+	}
+}
+
+// Returns the display name of user in room, made fit for IRC. Falls back to
+// the user ID's local part, e.g. "alice" for "@alice:example.org".
+func (q *MatrixPlugin) displayName(room, user string) string {
+	q.Lock()
+	name := q.names[room][user]
+	q.Unlock()
+	// no line breaks and such
+	if name = strings.Join(strings.Fields(ircclient.StripFormatting(name)), " "); name != "" {
+		return name
+	}
+	return strings.SplitN(strings.TrimPrefix(user, "@"), ":", 2)[0]
+}
+
+// Sends a message event to the channels linked to room
+func (q *MatrixPlugin) relay(room string, e *matrixEvent) {
+	if e.Type != "m.room.message" || e.Sender == q.userID {
+		return
+	}
+	msgtype, body := e.Content.MsgType, e.Content.Body
+	edited := e.Content.RelatesTo.RelType == "m.replace" && e.Content.NewContent != nil
+	if edited {
+		msgtype, body = e.Content.NewContent.MsgType, e.Content.NewContent.Body
+	}
+	body = stripReplyFallback(body)
+	if body == "" {
+		return
+	}
+	who := relayNick(q.displayName(room, e.Sender))
+
+	prefix := "<" + who + "> "
+	switch msgtype {
+	case "m.text", "m.notice":
+	case "m.emote":
+		prefix = "* " + who + " "
+	case "m.image", "m.file", "m.audio", "m.video":
+		if link := q.mediaURL(e.Content.URL); link != "" {
+			body += " " + link
+		}
+	default:
+		return
+	}
+	if edited {
+		prefix += "(edit) "
+	}
+
+	q.Lock()
+	endpoints := q.rooms[room]
+	clients := q.clients
+	q.Unlock()
+	for _, to := range endpoints {
+		if ic := clients[to.network]; ic != nil {
+			sendBridged(ic, to.channel, prefix, body)
+		}
+	}
+}
+
+// Returns the download link for an mxc:// URL, "" if it isn't one
+func (q *MatrixPlugin) mediaURL(mxc string) string {
+	if !strings.HasPrefix(mxc, "mxc://") {
+		return ""
+	}
+	return q.homeserver + "/_matrix/media/v3/download/" + strings.TrimPrefix(mxc, "mxc://")
+}
+
+// Removes the quote that replies carry for clients not supporting them,
+// "> <@alice:example.org> original" lines followed by an empty one
+func stripReplyFallback(body string) string {
+	if !strings.HasPrefix(body, "> ") {
+		return body
+	}
+	lines := strings.Split(body, "\n")
+	for i, line := range lines {
+		if !strings.HasPrefix(line, ">") {
+			return strings.TrimSpace(strings.Join(lines[i:], "\n"))
+		}
+	}
+	// nothing but a quote
+	return body
+}
+
+// Sends the messages from IRC in order until ctx is cancelled
+func (q *MatrixPlugin) send(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case m := <-q.out:
+			q.Lock()
+			q.txn++
+			txn := strconv.FormatInt(time.Now().UnixNano(), 36) + "." + strconv.Itoa(q.txn)
+			q.Unlock()
+			content := map[string]string{"msgtype": m.msgtype, "body": m.body}
+			path := "/rooms/" + url.PathEscape(m.room) + "/send/m.room.message/" + txn
+			if err := q.call(ctx, "PUT", path, content, nil); err != nil && ctx.Err() == nil {
+				log.Println("matrix: unable to send to " + m.room + ": " + err.Error())
+			}
+		}
+	}
+}
+
+// Calls the client-server API at path (below /_matrix/client/v3) with body
+// encoded as JSON, if it isn't nil, and decodes the response into result.
+// Requests that hit the rate limit are retried after the time asked for.
+func (q *MatrixPlugin) call(ctx context.Context, method, path string, body, result interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	for {
+		request, err := http.NewRequestWithContext(ctx, method, q.homeserver+matrix_api+path, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if body != nil {
+			request.Header.Set("Content-Type", "application/json")
+		}
+		if q.token != "" {
+			request.Header.Set("Authorization", "Bearer "+q.token)
+		}
+		response, err := q.http.Do(request)
+		if err != nil {
+			return err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(response.Body, max_matrix_response))
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		if response.StatusCode == http.StatusOK {
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(content, result)
+		}
+
+		var failure struct {
+			Errcode      string `json:"errcode"`
+			Error        string `json:"error"`
+			RetryAfterMs int    `json:"retry_after_ms"`
+		}
+		json.Unmarshal(content, &failure)
+		if response.StatusCode == http.StatusTooManyRequests {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(time.Duration(failure.RetryAfterMs)*time.Millisecond + time.Second):
+			}
+			continue
+		}
+		if failure.Errcode != "" {
+			return fmt.Errorf("%s: %s", failure.Errcode, failure.Error)
+		}
+		return errors.New(response.Status)
+	}
+}
@@ -17,6 +17,10 @@ type MettDBPlugin struct {
 	ic *ircclient.IRCClient
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("mettdb", func() ircclient.Plugin { return new(MettDBPlugin) })
+}
+
 func (q *MettDBPlugin) String() string {
 	return "mettdb"
 }
@@ -28,6 +28,10 @@ type MumblePlugin struct {
 	running              bool
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("mumble", func() ircclient.Plugin { return new(MumblePlugin) })
+}
+
 func (q *MumblePlugin) String() string {
 	return "mumble"
 }
@@ -63,7 +67,7 @@ func (q *MumblePlugin) Unregister() {
 
 func (q *MumblePlugin) ProcessLine(msg *ircclient.IRCMessage) {
 	// log topic
-	if msg.Command == "332" && msg.Args[0][1:] == q.ic.GetStringOption("Mumble", "channel") { // announce of topic during joining of channel
+	if msg.Command == ircclient.RPL_TOPIC && msg.Args[0][1:] == q.ic.GetStringOption("Mumble", "channel") { // announce of topic during joining of channel
 		q.topic = msg.Args[1]
 	} else if msg.Command == "TOPIC" && msg.Target[1:] == q.ic.GetStringOption("Mumble", "channel") {
 		q.topic = msg.Args[0]
@@ -104,12 +108,13 @@ func (q *MumblePlugin) run() {
 			q.lastUsers = users
 
 			// set topic in topicdiff plugin so, it won't get diffed
-			topicdiff := q.ic.GetPlugin("topicdiff").(*TopicDiffPlugin)
-			if topicdiff != nil {
+			// (it may have been unloaded)
+			topicdiff, ok := q.ic.GetPlugin("topicdiff").(*TopicDiffPlugin)
+			if ok {
 				topicdiff.SetTopic(q.ic.GetStringOption("Mumble", "channel"), newTopic)
 			}
 
-			q.ic.SendLine("TOPIC #" + q.ic.GetStringOption("Mumble", "channel") + " :" + newTopic)
+			q.ic.Topic("#"+q.ic.GetStringOption("Mumble", "channel"), newTopic)
 		case <-q.quit:
 			return
 		}
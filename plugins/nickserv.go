@@ -0,0 +1,285 @@
+package plugins
+
+// Identifies the bot to NickServ and keeps its configured nick. If the
+// server offers SASL, the bot authenticates during registration; if that
+// fails or isn't available, it sends IDENTIFY after connecting. If the nick
+// is taken when connecting (the bot then registers with "_" appended), the
+// nick is freed with GHOST (or REGAIN, see NickServ/regain) and taken back
+// as soon as it's available.
+
+import (
+	"../ircclient"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_nickserv_service = "NickServ"
+	// GHOST (Anope, Atheme) or REGAIN (Atheme, which also changes our nick)
+	default_nickserv_regain = "GHOST"
+	// Seconds between two attempts to get the configured nick back
+	default_nickserv_retry = 60
+	// Registration goes on without SASL if the server doesn't answer
+	nickserv_sasl_timeout = 30 * time.Second
+	// AUTHENTICATE payloads are sent in chunks of this size
+	sasl_chunk_size = 400
+)
+
+type NickServPlugin struct {
+	sync.Mutex
+	ic *ircclient.IRCClient
+	// logged in to our account, with SASL or IDENTIFY
+	loggedIn bool
+	// lets registration go on, nil if no SASL authentication is running
+	saslDone func()
+	// stops the attempts to get the nick back, nil if not running
+	cancelRetry func()
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("nickserv", func() ircclient.Plugin { return new(NickServPlugin) })
+}
+
+func (q *NickServPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	if q.ic.GetStringOption("NickServ", "nick") == "" {
+		log.Println("added default nickserv nick (the current nick) to config file")
+		q.ic.SetStringOption("NickServ", "nick", q.ic.GetStringOption("Server", "nick"))
+	}
+	if q.ic.GetStringOption("NickServ", "service") == "" {
+		log.Println("added default nickserv service to config file")
+		q.ic.SetStringOption("NickServ", "service", default_nickserv_service)
+	}
+	if q.ic.GetStringOption("NickServ", "regain") == "" {
+		log.Println("added default nickserv regain command to config file")
+		q.ic.SetStringOption("NickServ", "regain", default_nickserv_regain)
+	}
+	if _, err := q.ic.GetIntOption("NickServ", "retry"); err != nil {
+		log.Printf("added default nickserv retry value of %d to config file", default_nickserv_retry)
+		q.ic.SetIntOption("NickServ", "retry", default_nickserv_retry)
+	}
+	if q.ic.GetStringOption("NickServ", "sasl") == "" {
+		log.Println("added default nickserv sasl setting to config file")
+		q.ic.SetStringOption("NickServ", "sasl", "true")
+	}
+	if q.ic.GetBoolOption("NickServ", "sasl", false) && q.password() != "" {
+		q.ic.HandleCapability("sasl", q.startSASL)
+	}
+	q.ic.RegisterCommandHandler("regain", 0, 500, q)
+}
+
+func (q *NickServPlugin) String() string {
+	return "nickserv"
+}
+
+func (q *NickServPlugin) Info() string {
+	return "identifies to NickServ and keeps the configured nick"
+}
+
+func (q *NickServPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "regain":
+		return "regain: identifies to NickServ if necessary and takes the configured nick back"
+	}
+	return ""
+}
+
+func (q *NickServPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	switch msg.Command {
+	case "AUTHENTICATE":
+		// "AUTHENTICATE +" without source, but some servers add one
+		arg := msg.Target
+		if len(msg.Args) > 0 {
+			arg = msg.Args[0]
+		}
+		q.Lock()
+		running := q.saslDone != nil
+		q.Unlock()
+		if running && arg == "+" {
+			q.sendSASLPlain()
+		}
+	case ircclient.RPL_LOGGEDIN:
+		q.Lock()
+		q.loggedIn = true
+		q.Unlock()
+		log.Println("nickserv: logged in to account " + q.account())
+	case ircclient.RPL_SASLSUCCESS, ircclient.ERR_SASLALREADY:
+		q.finishSASL()
+	case ircclient.ERR_NICKLOCKED, ircclient.ERR_SASLFAIL, ircclient.ERR_SASLTOOLONG, ircclient.ERR_SASLABORTED:
+		log.Printf("nickserv: SASL authentication failed (%s), identifying after connect", msg.Command)
+		q.finishSASL()
+	case ircclient.RPL_WELCOME:
+		// registered as msg.Target, which may differ from the nick we asked for
+		q.ic.SetStringOption("Server", "nick", msg.Target)
+		q.identify()
+		q.regain()
+	case "NICK":
+		nick := strings.SplitN(msg.Source, "!", 2)[0]
+		switch {
+		case q.sameNick(nick, q.ic.GetStringOption("Server", "nick")):
+			q.ic.SetStringOption("Server", "nick", msg.Target)
+			if q.sameNick(msg.Target, q.primaryNick()) {
+				log.Println("nickserv: got nick " + msg.Target + " back")
+				q.stopRetry()
+			}
+		case q.sameNick(nick, q.primaryNick()):
+			// whoever had our nick changed it
+			q.claimNick()
+		}
+	case "QUIT":
+		if q.sameNick(strings.SplitN(msg.Source, "!", 2)[0], q.primaryNick()) {
+			q.claimNick()
+		}
+	case "NOTICE":
+		// e.g. "bot_ has been ghosted."
+		if q.sameNick(strings.SplitN(msg.Source, "!", 2)[0], q.ic.GetStringOption("NickServ", "service")) {
+			q.claimNick()
+		}
+	}
+}
+
+func (q *NickServPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch cmd.Command {
+	case "regain":
+		q.identify()
+		if q.hasPrimaryNick() {
+			q.ic.Reply(cmd, "I already am "+q.primaryNick())
+			return
+		}
+		q.regain()
+		q.ic.Reply(cmd, "Trying to get my nick "+q.primaryNick()+" back")
+	}
+}
+
+func (q *NickServPlugin) Unregister() {
+	q.ic.HandleCapability("sasl", nil)
+	q.finishSASL()
+	q.stopRetry()
+}
+
+func (q *NickServPlugin) OnReconnectReset() {
+	q.Lock()
+	q.loggedIn = false
+	q.Unlock()
+	q.finishSASL()
+	q.stopRetry()
+}
+
+func (q *NickServPlugin) password() string {
+	return q.ic.GetStringOption("NickServ", "password")
+}
+
+// Returns the services account, the configured nick by default
+func (q *NickServPlugin) account() string {
+	if account := q.ic.GetStringOption("NickServ", "account"); account != "" {
+		return account
+	}
+	return q.primaryNick()
+}
+
+func (q *NickServPlugin) primaryNick() string {
+	return q.ic.GetStringOption("NickServ", "nick")
+}
+
+func (q *NickServPlugin) sameNick(a, b string) bool {
+	return q.ic.CanonNick(a) == q.ic.CanonNick(b)
+}
+
+func (q *NickServPlugin) hasPrimaryNick() bool {
+	return q.sameNick(q.ic.GetStringOption("Server", "nick"), q.primaryNick())
+}
+
+// Called from the connection loop when the server has acknowledged sasl
+func (q *NickServPlugin) startSASL(done func()) {
+	q.Lock()
+	q.saslDone = done
+	q.Unlock()
+	time.AfterFunc(nickserv_sasl_timeout, done)
+	q.ic.SendLine("AUTHENTICATE PLAIN")
+}
+
+// Sends our credentials, split into chunks as the server expects them
+func (q *NickServPlugin) sendSASLPlain() {
+	payload := base64.StdEncoding.EncodeToString([]byte(q.account() + "\x00" + q.account() + "\x00" + q.password()))
+	for len(payload) >= sasl_chunk_size {
+		q.ic.SendLine("AUTHENTICATE " + payload[:sasl_chunk_size])
+		payload = payload[sasl_chunk_size:]
+	}
+	if payload == "" {
+		payload = "+"
+	}
+	q.ic.SendLine("AUTHENTICATE " + payload)
+}
+
+// Lets registration go on after SASL authentication
+func (q *NickServPlugin) finishSASL() {
+	q.Lock()
+	done := q.saslDone
+	q.saslDone = nil
+	q.Unlock()
+	if done != nil {
+		done()
+	}
+}
+
+// Identifies to NickServ unless we're logged in already (e.g. with SASL)
+func (q *NickServPlugin) identify() {
+	q.Lock()
+	loggedIn := q.loggedIn
+	q.Unlock()
+	if loggedIn || q.password() == "" {
+		return
+	}
+	q.ic.SendLine("PRIVMSG " + q.ic.GetStringOption("NickServ", "service") + " :IDENTIFY " + q.account() + " " + q.password())
+}
+
+// Frees our nick with the regain command and retries to take it until it's
+// ours
+func (q *NickServPlugin) regain() {
+	if q.hasPrimaryNick() {
+		return
+	}
+	log.Println("nickserv: nick " + q.primaryNick() + " is taken, trying to get it back")
+	if q.password() != "" {
+		q.ic.SendLine("PRIVMSG " + q.ic.GetStringOption("NickServ", "service") + " :" + q.ic.GetStringOption("NickServ", "regain") + " " + q.primaryNick() + " " + q.password())
+	}
+	retry, err := q.ic.GetIntOption("NickServ", "retry")
+	if err != nil || retry <= 0 {
+		retry = default_nickserv_retry
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.cancelRetry != nil {
+		return
+	}
+	cancel, err := q.ic.Schedule(fmt.Sprintf("@every %ds", retry), q.claimNick)
+	if err != nil {
+		log.Println("nickserv: unable to schedule nick retries: " + err.Error())
+		return
+	}
+	q.cancelRetry = cancel
+}
+
+// Tries to change to the configured nick if we don't have it. If it's still
+// taken, the server answers with ERR_NICKNAMEINUSE, which is ignored after
+// registration.
+func (q *NickServPlugin) claimNick() {
+	if q.hasPrimaryNick() {
+		return
+	}
+	q.ic.Nick(q.primaryNick())
+}
+
+func (q *NickServPlugin) stopRetry() {
+	q.Lock()
+	cancel := q.cancelRetry
+	q.cancelRetry = nil
+	q.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+}
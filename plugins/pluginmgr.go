@@ -0,0 +1,145 @@
+package plugins
+
+import (
+	"../ircclient"
+	"sort"
+	"strings"
+)
+
+// plugins that can't be unloaded, as the bot won't work without them
+var core_plugins = []string{"basic", "conf", "auth", "chanstate", "isupport", "ctcp", "dcc", "pluginmgr"}
+
+type PluginManager struct {
+	ic *ircclient.IRCClient
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("pluginmgr", func() ircclient.Plugin { return new(PluginManager) })
+}
+
+func (pm *PluginManager) Register(cl *ircclient.IRCClient) {
+	pm.ic = cl
+	pm.ic.RegisterCommandHandler("plugins", 0, 300, pm)
+	pm.ic.RegisterCommandHandler("load", 1, 500, pm)
+	pm.ic.RegisterCommandHandler("unload", 1, 500, pm)
+	pm.ic.RegisterCommandHandler("reload", 1, 500, pm)
+	pm.ic.RegisterCommandHandler("disableplugin", 1, 500, pm)
+	pm.ic.RegisterCommandHandler("enableplugin", 1, 500, pm)
+}
+
+func (pm *PluginManager) String() string {
+	return "pluginmgr"
+}
+
+func (pm *PluginManager) Info() string {
+	return "loads, unloads, disables and enables plugins at runtime"
+}
+
+func (pm *PluginManager) Usage(cmd string) string {
+	switch cmd {
+	case "plugins":
+		return "plugins: lists all loaded plugins with their description and whether they're disabled, and all loadable plugins"
+	case "load":
+		return "load <plugin>: creates and registers the plugin <plugin>"
+	case "unload":
+		return "unload <plugin>: unregisters the plugin <plugin> and removes its commands"
+	case "reload":
+		return "reload <plugin>: replaces the plugin <plugin> with a fresh instance, e.g. to reread its config"
+	case "disableplugin":
+		return "disableplugin <plugin>: ignores the commands of the plugin <plugin> and stops passing lines to it, but keeps it loaded"
+	case "enableplugin":
+		return "enableplugin <plugin>: enables the plugin <plugin> after disableplugin"
+	}
+	return ""
+}
+
+func (pm *PluginManager) ProcessLine(msg *ircclient.IRCMessage) {
+	// empty
+}
+
+func (pm *PluginManager) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch cmd.Command {
+	case "plugins":
+		loaded := pm.ic.GetPlugins()
+		names := make([]string, 0, len(loaded))
+		for name := range loaded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			p := loaded[name]
+			if pm.ic.PluginDisabled(name) {
+				pm.ic.Reply(cmd, name+" (disabled): "+p.Info())
+			} else {
+				pm.ic.Reply(cmd, name+": "+p.Info())
+			}
+		}
+		available := make([]string, 0)
+		for _, name := range ircclient.PluginFactories() {
+			if _, ok := loaded[name]; !ok {
+				available = append(available, name)
+			}
+		}
+		if len(available) > 0 {
+			pm.ic.Reply(cmd, "Not loaded: "+strings.Join(available, ", "))
+		}
+	case "load":
+		p := ircclient.NewPlugin(cmd.Args[0])
+		if p == nil {
+			pm.ic.Reply(cmd, "No such plugin: "+cmd.Args[0])
+			return
+		}
+		if err := pm.ic.RegisterPlugin(p); err != nil {
+			pm.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		pm.ic.Reply(cmd, "Loaded plugin "+cmd.Args[0])
+	case "reload":
+		if pm.ic.GetPlugin(cmd.Args[0]) == nil {
+			pm.ic.Reply(cmd, "Plugin not loaded: "+cmd.Args[0])
+			return
+		}
+		p := ircclient.NewPlugin(cmd.Args[0])
+		if p == nil {
+			pm.ic.Reply(cmd, "Can't reload plugin "+cmd.Args[0])
+			return
+		}
+		if err := pm.ic.ReplacePlugin(p); err != nil {
+			pm.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		pm.ic.Reply(cmd, "Reloaded plugin "+cmd.Args[0])
+	case "disableplugin":
+		if cmd.Args[0] == pm.String() {
+			pm.ic.Reply(cmd, "Refusing to disable myself")
+			return
+		}
+		if err := pm.ic.DisablePlugin(cmd.Args[0]); err != nil {
+			pm.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		pm.ic.Reply(cmd, "Disabled plugin "+cmd.Args[0])
+	case "enableplugin":
+		if err := pm.ic.EnablePlugin(cmd.Args[0]); err != nil {
+			pm.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		pm.ic.Reply(cmd, "Enabled plugin "+cmd.Args[0])
+	case "unload":
+		for _, name := range core_plugins {
+			if name == cmd.Args[0] {
+				pm.ic.Reply(cmd, "Refusing to unload core plugin "+name)
+				return
+			}
+		}
+		if err := pm.ic.UnregisterPlugin(cmd.Args[0]); err != nil {
+			pm.ic.Reply(cmd, "Error: "+err.Error())
+			return
+		}
+		pm.ic.Reply(cmd, "Unloaded plugin "+cmd.Args[0])
+	}
+}
+
+func (pm *PluginManager) Unregister() {
+	// nothing to do here
+}
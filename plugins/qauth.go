@@ -0,0 +1,193 @@
+package plugins
+
+// Authenticates the bot to QuakeNet's Q with CHALLENGEAUTH, so the password
+// is never sent in plain text, and hides its host with usermode +x. Channels
+// are joined after that, so the real host doesn't show up in them.
+
+import (
+	"../ircclient"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_qauth_service = "Q@CServe.quakenet.org"
+	// Channels are joined anyway if Q doesn't answer
+	qauth_timeout = 30 * time.Second
+	// Q only uses the first 10 characters of passwords
+	qauth_max_password = 10
+	qauth_algorithm    = "HMAC-SHA-256"
+)
+
+type QAuthPlugin struct {
+	sync.Mutex
+	ic *ircclient.IRCClient
+	// releases the join hold if Q doesn't answer, nil if not authing
+	timeout *time.Timer
+	// waiting for RPL_HOSTHIDDEN after setting +x
+	hiding bool
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("qauth", func() ircclient.Plugin { return new(QAuthPlugin) })
+}
+
+func (q *QAuthPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	if q.ic.GetStringOption("QAuth", "service") == "" {
+		log.Println("added default qauth service to config file")
+		q.ic.SetStringOption("QAuth", "service", default_qauth_service)
+	}
+	if q.ic.GetStringOption("QAuth", "hidehost") == "" {
+		log.Println("added default qauth hidehost setting to config file")
+		q.ic.SetStringOption("QAuth", "hidehost", "true")
+	}
+	if q.configured() {
+		q.ic.HoldJoins(q.String())
+	}
+}
+
+func (q *QAuthPlugin) String() string {
+	return "qauth"
+}
+
+func (q *QAuthPlugin) Info() string {
+	return "authenticates to QuakeNet's Q with CHALLENGEAUTH and hides the bot's host"
+}
+
+func (q *QAuthPlugin) Usage(cmd string) string {
+	// plugin has no commands
+	return ""
+}
+
+func (q *QAuthPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if !q.configured() {
+		return
+	}
+	switch msg.Command {
+	case ircclient.RPL_WELCOME:
+		q.Lock()
+		q.hiding = false
+		if q.timeout != nil {
+			q.timeout.Stop()
+		}
+		q.timeout = time.AfterFunc(qauth_timeout, func() {
+			log.Println("qauth: no answer from Q, joining channels anyway")
+			q.done()
+		})
+		q.Unlock()
+		q.ic.SendLine("PRIVMSG " + q.ic.GetStringOption("QAuth", "service") + " :CHALLENGE")
+	case ircclient.RPL_HOSTHIDDEN:
+		q.Lock()
+		hiding := q.hiding
+		q.Unlock()
+		if hiding {
+			q.done()
+		}
+	case "NOTICE":
+		service := strings.SplitN(q.ic.GetStringOption("QAuth", "service"), "@", 2)[0]
+		if len(msg.Args) == 0 || q.ic.CanonNick(strings.SplitN(msg.Source, "!", 2)[0]) != q.ic.CanonNick(service) {
+			return
+		}
+		q.processNotice(msg.Args[0])
+	}
+}
+
+// Handles Q's answers to CHALLENGE and CHALLENGEAUTH
+func (q *QAuthPlugin) processNotice(text string) {
+	fields := strings.Fields(text)
+	switch {
+	case len(fields) >= 2 && fields[0] == "CHALLENGE":
+		// CHALLENGE <challenge> HMAC-MD5 HMAC-SHA-1 HMAC-SHA-256 LEGACY-MD5
+		supported := false
+		for _, alg := range fields[2:] {
+			supported = supported || alg == qauth_algorithm
+		}
+		if !supported {
+			log.Println("qauth: Q doesn't support " + qauth_algorithm + ", not authing")
+			q.done()
+			return
+		}
+		user := q.ic.GetStringOption("QAuth", "user")
+		response := challengeResponse(user, q.ic.GetStringOption("QAuth", "password"), fields[1])
+		q.ic.SendLine("PRIVMSG " + q.ic.GetStringOption("QAuth", "service") + " :CHALLENGEAUTH " + user + " " + response + " " + qauth_algorithm)
+	case strings.HasPrefix(text, "You are now logged in as"):
+		log.Println("qauth: authed as " + q.ic.GetStringOption("QAuth", "user"))
+		if !q.ic.GetBoolOption("QAuth", "hidehost", false) {
+			q.done()
+			return
+		}
+		// channels are joined once the host is hidden
+		q.Lock()
+		q.hiding = true
+		q.Unlock()
+		q.ic.Mode(q.ic.GetStringOption("Server", "nick"), "+x")
+	case strings.HasPrefix(text, "Username or password incorrect"):
+		log.Println("qauth: unable to auth as " + q.ic.GetStringOption("QAuth", "user") + ": " + text)
+		q.done()
+	}
+}
+
+func (q *QAuthPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// interface saturation
+	return
+}
+
+func (q *QAuthPlugin) Unregister() {
+	q.stopTimeout()
+	q.ic.RemoveJoinHold(q.String())
+}
+
+func (q *QAuthPlugin) OnReconnectReset() {
+	q.stopTimeout()
+}
+
+func (q *QAuthPlugin) configured() bool {
+	return q.ic.GetStringOption("QAuth", "user") != "" && q.ic.GetStringOption("QAuth", "password") != ""
+}
+
+// Stops waiting for Q and lets the channels be joined
+func (q *QAuthPlugin) done() {
+	q.stopTimeout()
+	q.ic.ReleaseJoins(q.String())
+}
+
+func (q *QAuthPlugin) stopTimeout() {
+	q.Lock()
+	defer q.Unlock()
+	q.hiding = false
+	if q.timeout != nil {
+		q.timeout.Stop()
+		q.timeout = nil
+	}
+}
+
+// Computes the CHALLENGEAUTH response to challenge:
+// HMAC-SHA-256 keyed with hex(SHA-256(lower(user) + ":" + hex(SHA-256(password)))),
+// where the password is cut to 10 characters and user is lowered as in
+// RFC 1459
+func challengeResponse(user, password, challenge string) string {
+	if len(password) > qauth_max_password {
+		password = password[:qauth_max_password]
+	}
+	user = strings.Map(func(r rune) rune {
+		if i := strings.IndexRune("[]\\~", r); i >= 0 {
+			return rune("{}|^"[i])
+		}
+		return r
+	}, strings.ToLower(user))
+	key := sha256Hex(user + ":" + sha256Hex(password))
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(challenge))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func sha256Hex(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
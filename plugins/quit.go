@@ -3,6 +3,7 @@ package plugins
 import (
 	"../ircclient"
 	"log"
+	"strings"
 )
 
 const (
@@ -13,15 +14,25 @@ type QuitHandler struct {
 	ic *ircclient.IRCClient
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("quit", func() ircclient.Plugin { return new(QuitHandler) })
+}
+
 func (q *QuitHandler) Register(ic *ircclient.IRCClient) {
 	q.ic = ic
 
-	if q.ic.GetStringOption("Quit", "quitmsg") == "" {
-		log.Println("added default quitmsg value of \"" + default_quit_msg + "\" to config file")
-		q.ic.SetStringOption("Quit", "quitmsg", default_quit_msg)
+	if q.ic.GetStringOption("Server", "quitmsg") == "" {
+		// Older configs had the quit message in its own section
+		quitmsg := q.ic.GetStringOption("Quit", "quitmsg")
+		if quitmsg == "" {
+			quitmsg = default_quit_msg
+		}
+		log.Println("added default quitmsg value of \"" + quitmsg + "\" to config file")
+		q.ic.SetStringOption("Server", "quitmsg", quitmsg)
 	}
 
-	q.ic.RegisterCommandHandler("quit", 0, 300, q)
+	q.ic.RegisterCommandHandler("quit", 0, 500, q)
+	q.ic.RegisterCommandHandler("restart", 0, 500, q)
 }
 
 func (q *QuitHandler) String() string {
@@ -29,13 +40,15 @@ func (q *QuitHandler) String() string {
 }
 
 func (q *QuitHandler) Info() string {
-	return "handles the quit command"
+	return "handles the quit and restart commands"
 }
 
 func (q *QuitHandler) Usage(cmd string) string {
 	switch cmd {
 	case "quit":
-		return "quit: quits this bot"
+		return "quit [message]: quits this bot with <message> or the configured quit message"
+	case "restart":
+		return "restart [message]: quits this bot with <message> or the configured quit message and starts it again"
 	}
 	return ""
 }
@@ -45,7 +58,18 @@ func (q *QuitHandler) ProcessLine(msg *ircclient.IRCMessage) {
 }
 
 func (q *QuitHandler) ProcessCommand(cmd *ircclient.IRCCommand) {
-	q.ic.Disconnect(q.ic.GetStringOption("Quit", "quitmsg"))
+	quitmsg := strings.Join(cmd.Args, " ")
+	if quitmsg == "" {
+		quitmsg = q.ic.GetStringOption("Server", "quitmsg")
+	}
+
+	switch cmd.Command {
+	case "quit":
+		q.ic.Disconnect(quitmsg)
+	case "restart":
+		err := q.ic.Restart(quitmsg)
+		log.Println("couldn't restart: " + err.Error())
+	}
 }
 
 func (q *QuitHandler) Unregister() {
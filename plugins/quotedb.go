@@ -4,11 +4,13 @@ import (
 	"../answers"
 	"../ircclient"
 	"bufio"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math/rand"
 	"os"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -17,11 +19,28 @@ import (
 
 const (
 	default_time_format = "2006-01-02T15:04"
+	// Access level needed to delete quotes added by someone else
+	default_delquote_access = 200
+	// Search results shown at most, so a search for "e" doesn't flood
+	max_quote_results = 5
 )
 
+// A quote as kept in the storage, under key "quote/<id>"
+type quote struct {
+	Text    string
+	Author  string `json:",omitempty"`
+	Channel string `json:",omitempty"`
+	Time    time.Time
+}
+
 type QuoteDBPlugin struct {
-	sync.RWMutex
-	ic *ircclient.IRCClient
+	sync.Mutex
+	ic    *ircclient.IRCClient
+	store *ircclient.Store
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("quotedb", func() ircclient.Plugin { return new(QuoteDBPlugin) })
 }
 
 func (q *QuoteDBPlugin) String() string {
@@ -35,11 +54,13 @@ func (q *QuoteDBPlugin) Info() string {
 func (q *QuoteDBPlugin) Usage(cmd string) string {
 	switch cmd {
 	case "quote":
-		return "quote <arg>: if arg is an integer, return quote number <arg>, else if <arg> is empty return a random quote, else return a random quote from user <arg>"
+		return "quote [id|text]: if the argument is a number, return quote number <id>, else if it's empty return a random quote, else return a random quote containing <text>"
 	case "search":
 		return "search <pattern>: search for <pattern> in quote database, interpret <pattern> as regex if it starts and ends with an '/'"
-	case "add":
-		return "add <quote>: adds the string <quote> appended to the current time to the database"
+	case "add", "addquote":
+		return cmd + " <quote>: adds <quote> to the database, along with you, the channel and the current time"
+	case "delquote":
+		return "delquote <id>: deletes quote number <id>, if you added it or are allowed to delete any quote"
 	}
 	return ""
 }
@@ -51,10 +72,27 @@ func (q *QuoteDBPlugin) Register(cl *ircclient.IRCClient) {
 		log.Println("added default timeformat value of \"" + default_time_format + "\" to config file")
 		q.ic.SetStringOption("QuoteDB", "timeformat", default_time_format)
 	}
+	if _, err := q.ic.GetIntOption("QuoteDB", "delaccess"); err != nil {
+		log.Printf("added default delaccess value of %d to config file", default_delquote_access)
+		q.ic.SetIntOption("QuoteDB", "delaccess", default_delquote_access)
+	}
+
+	store, err := q.ic.Storage(q.String())
+	if err != nil {
+		log.Println("unable to open quote storage: " + err.Error())
+		return
+	}
+	q.store = store
+	if err := q.migrate(); err != nil {
+		log.Println("unable to migrate quotes: " + err.Error())
+	}
 
 	q.ic.RegisterCommandHandler("quote", 0, 0, q)
 	q.ic.RegisterCommandHandler("search", 1, 0, q)
+	q.ic.RegisterCommandHandler("addquote", 1, 0, q)
+	// the old name of addquote
 	q.ic.RegisterCommandHandler("add", 1, 0, q)
+	q.ic.RegisterCommandHandler("delquote", 1, 0, q)
 }
 
 func (q *QuoteDBPlugin) Unregister() {
@@ -71,185 +109,261 @@ func (q *QuoteDBPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
 		var out string
 		if len(cmd.Args) == 0 {
 			// no argument, get random quote
-			out = q.getRandomQuote("")
+			out = q.randomQuote("")
 			if out == "" {
 				out = "No quotes in database"
 			}
+		} else if id, err := strconv.Atoi(cmd.Args[0]); err == nil && len(cmd.Args) == 1 {
+			out = q.getQuote(id)
+			if out == "" {
+				out = "Quote not found"
+			}
 		} else {
-			num64, err := strconv.ParseUint(cmd.Args[0], 10, 0)
-			if err != nil {
-				// argument is no integer, so it must be a string specifing a user
-				out = q.getRandomQuote(cmd.Args[0])
-				if out == "" {
-					out = "No quotes from user " + cmd.Args[0]
-				}
-			} else {
-				// argument is integer
-				out = q.getQuote(uint(num64))
-				if out == "" {
-					out = "Quote not found"
-				}
+			text := strings.Join(cmd.Args, " ")
+			out = q.randomQuote(text)
+			if out == "" {
+				out = "No quotes containing " + text
 			}
 		}
 		q.ic.Reply(cmd, out)
 	case "search":
-		results := q.searchQuotes(strings.Join(cmd.Args, " "))
+		results, err := q.searchQuotes(strings.Join(cmd.Args, " "))
+		if err != nil {
+			q.ic.Reply(cmd, "Couldn't search: "+err.Error())
+			return
+		}
 		if len(results) == 0 {
 			q.ic.Reply(cmd, "Didn't find any matching quotes")
+			return
 		}
-
-		for _, quote := range results {
-			q.ic.Reply(cmd, quote)
+		for i, result := range results {
+			if i == max_quote_results {
+				q.ic.Reply(cmd, fmt.Sprintf("... and %d more, be more specific", len(results)-i))
+				break
+			}
+			q.ic.Reply(cmd, result)
 		}
-	case "add":
-		num := q.writeQuote(strings.Join(cmd.Args, " "), time.Now())
-		out := fmt.Sprintf(answers.RandStr("addedQuote"), num)
-		q.ic.Reply(cmd, out)
-	}
-}
-
-// return a channel on which all lines of file <file> are send
-func (q *QuoteDBPlugin) lines(file string) <-chan string {
-	strChan := make(chan string)
-	go func(sc chan<- string) {
-		// close chan
-		defer close(sc)
-
-		q.RLock()
-		defer q.RUnlock()
-
-		f, err := os.Open(file)
+	case "add", "addquote":
+		nick := strings.SplitN(cmd.Source, "!", 2)[0]
+		channel := ""
+		if q.ic.IsChannelName(cmd.Target) {
+			channel = cmd.Target
+		}
+		id, err := q.addQuote(&quote{strings.Join(cmd.Args, " "), nick, channel, time.Now()})
 		if err != nil {
 			log.Println(err)
+			q.ic.Reply(cmd, "Couldn't add quote: "+err.Error())
 			return
 		}
-		defer f.Close()
-
-		// new scanner that splits at line endings
-		fScanner := bufio.NewScanner(f)
-		for fScanner.Scan() {
-			sc <- fScanner.Text()
-		}
-
-		err = fScanner.Err()
+		q.ic.Reply(cmd, fmt.Sprintf(answers.RandStr("addedQuote"), id))
+	case "delquote":
+		id, err := strconv.Atoi(cmd.Args[0])
 		if err != nil {
-			log.Println(err)
+			q.ic.Reply(cmd, q.ic.GetUsage("delquote"))
 			return
 		}
-	}(strChan)
-	return strChan
-}
-
-// get the line <lineno> from file <file>
-// if the line dosn't exist or a error occurs an empty string is returned
-func (q *QuoteDBPlugin) getLine(file string, lineno uint) string {
-	strChan := q.lines(file)
-	var i uint = 0
-	var out string
-	for line := range strChan {
-		if i == lineno {
-			out = line
+		q.ic.Reply(cmd, q.delQuote(cmd, id))
+	}
+}
+
+// Imports the quotes from the old quote file (QuoteDB/file, one
+// "<time> <quote>" per line) into the storage, keeping their numbers. Does
+// nothing if the storage already has quotes.
+func (q *QuoteDBPlugin) migrate() error {
+	file := q.ic.GetStringOption("QuoteDB", "file")
+	if file == "" {
+		return nil
+	}
+	if _, ok, err := q.store.Get("next"); err != nil || ok {
+		return err
+	}
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	timeformat := q.ic.GetStringOption("QuoteDB", "timeformat")
+	id := 0
+	scanner := bufio.NewScanner(f)
+	for ; scanner.Scan(); id++ {
+		fields := strings.SplitN(scanner.Text(), " ", 2)
+		if len(fields) != 2 {
+			continue
+		}
+		t, _ := time.Parse(timeformat, fields[0])
+		if err := q.putQuote(id, &quote{Text: fields[1], Time: t}); err != nil {
+			return err
 		}
-		i++
 	}
-	return out
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if err := q.store.Put("next", strconv.Itoa(id)); err != nil {
+		return err
+	}
+	log.Printf("migrated %d quotes from %s to the storage, the file is ignored from now on", id, file)
+	return nil
 }
 
-// returns the quote number <num>
-// if the quote doesn't exist, returns an empty string
-func (q *QuoteDBPlugin) getQuote(num uint) string {
-	return q.getLine(q.ic.GetStringOption("QuoteDB", "file"), num)
+// Returns quote number id formatted for output, or an empty string if it
+// doesn't exist
+func (q *QuoteDBPlugin) getQuote(id int) string {
+	value, ok, err := q.store.Get("quote/" + strconv.Itoa(id))
+	if err != nil {
+		log.Println(err)
+	}
+	if !ok {
+		return ""
+	}
+	var qu quote
+	if err := json.Unmarshal([]byte(value), &qu); err != nil {
+		log.Println(err)
+		return ""
+	}
+	return q.format(id, &qu)
 }
 
-// returns a random quote from user <user>
-// if <user> is an empty string, returns a random quote from every user
-// if there are no quotes from this user, returns an empty string
-func (q *QuoteDBPlugin) getRandomQuote(user string) string {
-	strChan := q.lines(q.ic.GetStringOption("QuoteDB", "file"))
-	var i uint = 0
-	quotes := make([]uint, 0)
+// Returns e.g. "#12: <mett> hi [foo in #mett, 2006-01-02T15:04]"
+func (q *QuoteDBPlugin) format(id int, qu *quote) string {
+	meta := qu.Time.Format(q.ic.GetStringOption("QuoteDB", "timeformat"))
+	if qu.Channel != "" {
+		meta = qu.Channel + ", " + meta
+	}
+	if qu.Author != "" {
+		meta = qu.Author + " in " + meta
+	}
+	return fmt.Sprintf("#%d: %s [%s]", id, qu.Text, meta)
+}
 
-	for line := range strChan {
-		subs := strings.SplitN(line, " ", 3)
-		if len(subs) >= 2 {
-			// second substring is <user>
-			if strings.Contains(subs[1], user) {
-				quotes = append(quotes, i)
-			}
+// Calls fn for every quote, ordered by id
+func (q *QuoteDBPlugin) quotes(fn func(id int, qu *quote)) error {
+	ids := make([]int, 0)
+	quotes := make(map[int]*quote)
+	err := q.store.Iterate(func(key, value string) bool {
+		if !strings.HasPrefix(key, "quote/") {
+			return true
+		}
+		id, err := strconv.Atoi(key[len("quote/"):])
+		qu := new(quote)
+		if err != nil || json.Unmarshal([]byte(value), qu) != nil {
+			log.Println("skipping invalid quote " + key)
+			return true
 		}
-		i++
+		ids = append(ids, id)
+		quotes[id] = qu
+		return true
+	})
+	if err != nil {
+		return err
 	}
+	sort.Ints(ids)
+	for _, id := range ids {
+		fn(id, quotes[id])
+	}
+	return nil
+}
 
-	if len(quotes) == 0 {
-		// no quotes found
+// Returns a random quote containing text (case insensitive), or any random
+// quote if text is empty. Returns an empty string if there is none.
+func (q *QuoteDBPlugin) randomQuote(text string) string {
+	text = strings.ToLower(text)
+	matches := make([]string, 0)
+	err := q.quotes(func(id int, qu *quote) {
+		if strings.Contains(strings.ToLower(qu.Text), text) {
+			matches = append(matches, q.format(id, qu))
+		}
+	})
+	if err != nil {
+		log.Println(err)
+	}
+	if len(matches) == 0 {
 		return ""
 	}
-
-	randQuote := quotes[rand.Intn(len(quotes))]
-	out := q.getQuote(randQuote)
-	return out
+	return matches[rand.Intn(len(matches))]
 }
 
-// searches for quotes and returns them as a string slice
-// if <pattern> begins and ends with an '/', interprets it as a regular expression
-func (q *QuoteDBPlugin) searchQuotes(pattern string) (results []string) {
-	results = make([]string, 0)
+// searches for quotes and returns them formatted for output
+// if <pattern> begins and ends with an '/', interprets it as a regular
+// expression, otherwise all words of pattern have to appear in the quote
+func (q *QuoteDBPlugin) searchQuotes(pattern string) ([]string, error) {
 	var regex *regexp.Regexp
 	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
 		var err error
 		regex, err = regexp.Compile(pattern[1 : len(pattern)-1]) // trim '/'s
 		if err != nil {
-			results = append(results, "Couldn't search: "+err.Error())
-			return
+			return nil, err
 		}
 	}
-	pattern = strings.ToLower(pattern) // make search case insensitive
+	words := strings.Fields(strings.ToLower(pattern)) // make search case insensitive
 
-	strChan := q.lines(q.ic.GetStringOption("QuoteDB", "file"))
-	var i int = 0
-	for line := range strChan {
-		// if specified, match the regular expression or just check if <line> contains <pattern>
-		if (regex != nil && regex.MatchString(line)) || strings.Contains(strings.ToLower(line), pattern) {
-			results = append(results, strconv.Itoa(i)+" "+line)
+	results := make([]string, 0)
+	err := q.quotes(func(id int, qu *quote) {
+		if regex != nil {
+			if regex.MatchString(qu.Text) {
+				results = append(results, q.format(id, qu))
+			}
+			return
 		}
-		i++
-	}
-	return results
+		text := strings.ToLower(qu.Text + " " + qu.Author)
+		for _, word := range words {
+			if !strings.Contains(text, word) {
+				return
+			}
+		}
+		results = append(results, q.format(id, qu))
+	})
+	return results, err
 }
 
-// writes the line <line> to the file <file>
-// returns an error if any occurs
-func (q *QuoteDBPlugin) writeLine(file, line string) (err error) {
+// Stores qu under the next free id and returns the id
+func (q *QuoteDBPlugin) addQuote(qu *quote) (int, error) {
 	q.Lock()
 	defer q.Unlock()
-
-	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
-	if err != nil {
-		return
+	id := 0
+	if value, ok, err := q.store.Get("next"); err != nil {
+		return 0, err
+	} else if ok {
+		id, _ = strconv.Atoi(value)
 	}
-	defer f.Close()
+	if err := q.putQuote(id, qu); err != nil {
+		return 0, err
+	}
+	return id, q.store.Put("next", strconv.Itoa(id+1))
+}
 
-	_, err = f.WriteString(line + "\n")
+func (q *QuoteDBPlugin) putQuote(id int, qu *quote) error {
+	value, err := json.Marshal(qu)
 	if err != nil {
-		return
+		return err
 	}
-
-	return nil
+	return q.store.Put("quote/"+strconv.Itoa(id), string(value))
 }
 
-// adds a line to the database consisting of the time <t> and the string <quote>
-// returns which number the new quote is
-func (q *QuoteDBPlugin) writeQuote(quote string, t time.Time) uint {
-	line := fmt.Sprintf("%v %v", t.Format(q.ic.GetStringOption("QuoteDB", "timeformat")), quote)
-	err := q.writeLine(q.ic.GetStringOption("QuoteDB", "file"), line)
+// Deletes quote number id if the user sending cmd has added it or has
+// QuoteDB/delaccess, returns the reply. Ids of deleted quotes aren't reused.
+func (q *QuoteDBPlugin) delQuote(cmd *ircclient.IRCCommand, id int) string {
+	key := "quote/" + strconv.Itoa(id)
+	value, ok, err := q.store.Get(key)
 	if err != nil {
 		log.Println(err)
+		return "Couldn't delete quote: " + err.Error()
 	}
-
-	strChan := q.lines(q.ic.GetStringOption("QuoteDB", "file"))
-	var i uint = 0
-	for _ = range strChan {
-		i++
+	if !ok {
+		return "Quote not found"
+	}
+	var qu quote
+	json.Unmarshal([]byte(value), &qu)
+	nick := strings.SplitN(cmd.Source, "!", 2)[0]
+	minaccess, _ := q.ic.GetIntOption("QuoteDB", "delaccess")
+	if (qu.Author == "" || q.ic.CanonNick(qu.Author) != q.ic.CanonNick(nick)) && q.ic.GetAccessLevel(cmd.Source, cmd.Target) < minaccess {
+		return "You are not authorized to do that."
+	}
+	if err := q.store.Delete(key); err != nil {
+		log.Println(err)
+		return "Couldn't delete quote: " + err.Error()
 	}
-	return i - 1 // quotes numbering starts at 0
+	return fmt.Sprintf("Deleted quote #%d", id)
 }
@@ -0,0 +1,254 @@
+package plugins
+
+// Mirrors channels into each other, possibly across networks (see
+// ircclient.BotManager, the plugin has to be registered with its
+// RegisterPlugin() to see all networks). Each option of section Relay is a
+// link between two or more channels, written as network/channel:
+//
+//	[Relay]
+//	mett: eosin/#mett libera/#mett
+//
+// Without networks, just the channels are given. Messages, actions, joins,
+// parts and kicks in one of the channels are sent to the others, prefixed
+// with <nick@network>.
+
+import (
+	"../ircclient"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lines we relayed into a channel within this time are recognized if
+// someone (e.g. another relay bot) sends them back
+const relay_loop_window = 30 * time.Second
+
+// Lines of a message from another chat (see sendBridged()) sent to IRC at
+// most, the rest is cut
+const max_bridge_lines = 5
+
+// A channel on a network
+type relayEndpoint struct {
+	network string
+	channel string
+}
+
+// A line relayed into a channel
+type relayedLine struct {
+	text string
+	sent time.Time
+}
+
+type RelayPlugin struct {
+	// network -> client, see Register()
+	clients map[string]*ircclient.IRCClient
+	// endpoint (network and canonical channel) -> lines recently sent there
+	recent map[relayEndpoint][]relayedLine
+	sync.Mutex
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("relay", func() ircclient.Plugin { return new(RelayPlugin) })
+}
+
+// Called once per network when registered with a BotManager
+func (q *RelayPlugin) Register(cl *ircclient.IRCClient) {
+	q.Lock()
+	defer q.Unlock()
+	if q.clients == nil {
+		q.clients = make(map[string]*ircclient.IRCClient)
+		q.recent = make(map[relayEndpoint][]relayedLine)
+	}
+	q.clients[cl.Network()] = cl
+}
+
+func (q *RelayPlugin) String() string {
+	return "relay"
+}
+
+func (q *RelayPlugin) Info() string {
+	return "mirrors messages between channels, also on different networks"
+}
+
+func (q *RelayPlugin) Usage(cmd string) string {
+	// plugin has no commands
+	return ""
+}
+
+func (q *RelayPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// interface saturation
+}
+
+func (q *RelayPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	q.clients = nil
+}
+
+func (q *RelayPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	q.Lock()
+	ic := q.clients[msg.Network]
+	q.Unlock()
+	if ic == nil || !strings.Contains(msg.Source, "!") {
+		return
+	}
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+	// never relay ourselves, e.g. echoed messages
+	if ic.CanonNick(nick) == ic.CanonNick(ic.GetStringOption("Server", "nick")) {
+		return
+	}
+
+	var line string
+	who := relayNick(nick) + "@" + msg.Network
+	if msg.Network == "" {
+		who = relayNick(nick)
+	}
+	switch msg.Command {
+	case "PRIVMSG":
+		if len(msg.Args) == 0 {
+			return
+		}
+		if command, text, ok := msg.CTCP(); ok {
+			if command != "ACTION" {
+				return
+			}
+			line = "* " + who + " " + text
+		} else {
+			line = "<" + who + "> " + msg.Args[0]
+		}
+	case "JOIN":
+		line = "--> " + who + " joined " + msg.Target
+	case "PART":
+		line = "<-- " + who + " left " + msg.Target
+		if len(msg.Args) > 0 && msg.Args[0] != "" {
+			line += " (" + msg.Args[0] + ")"
+		}
+	case "KICK":
+		if len(msg.Args) == 0 {
+			return
+		}
+		line = "<-- " + who + " kicked " + relayNick(msg.Args[0]) + " from " + msg.Target
+		if len(msg.Args) > 1 && msg.Args[1] != "" {
+			line += " (" + msg.Args[1] + ")"
+		}
+	default:
+		return
+	}
+
+	from := relayEndpoint{msg.Network, ic.CanonChannel(msg.Target)}
+	if msg.Command == "PRIVMSG" && q.looped(from, msg.Args[0]) {
+		return
+	}
+	for _, to := range q.targets(ic, from) {
+		q.Lock()
+		target := q.clients[to.network]
+		q.Unlock()
+		if target == nil {
+			continue
+		}
+		q.send(target, to, line)
+	}
+}
+
+// Returns the channels linked to from
+func (q *RelayPlugin) targets(ic *ircclient.IRCClient, from relayEndpoint) []relayEndpoint {
+	var targets []relayEndpoint
+	for _, link := range ic.GetOptions("Relay") {
+		endpoints := parseRelayLink(ic.GetStringOption("Relay", link))
+		linked := false
+		for _, e := range endpoints {
+			if e.network == from.network && ic.CanonChannel(e.channel) == from.channel {
+				linked = true
+			}
+		}
+		if !linked {
+			continue
+		}
+		for _, e := range endpoints {
+			if e.network != from.network || ic.CanonChannel(e.channel) != from.channel {
+				targets = append(targets, e)
+			}
+		}
+	}
+	return targets
+}
+
+// Sends line to the channel to and remembers it for loop detection
+func (q *RelayPlugin) send(ic *ircclient.IRCClient, to relayEndpoint, line string) {
+	if err := ic.Privmsg(to.channel, line); err != nil {
+		return
+	}
+	key := relayEndpoint{to.network, ic.CanonChannel(to.channel)}
+	now := time.Now()
+	q.Lock()
+	defer q.Unlock()
+	lines := q.recent[key][:0]
+	for _, l := range q.recent[key] {
+		if now.Sub(l.sent) < relay_loop_window {
+			lines = append(lines, l)
+		}
+	}
+	q.recent[key] = append(lines, relayedLine{line, now})
+}
+
+// Returns whether text in the channel from contains a line we relayed there
+// recently, i.e. someone else relays our lines back
+func (q *RelayPlugin) looped(from relayEndpoint, text string) bool {
+	q.Lock()
+	defer q.Unlock()
+	for _, l := range q.recent[from] {
+		if time.Since(l.sent) < relay_loop_window && strings.Contains(text, l.text) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parses the endpoints of a link, "network/#channel" or just "#channel"
+func parseRelayLink(link string) []relayEndpoint {
+	var endpoints []relayEndpoint
+	for _, e := range strings.Fields(link) {
+		if strings.IndexAny(e[:1], "#&+!") < 0 {
+			if kv := strings.SplitN(e, "/", 2); len(kv) == 2 {
+				endpoints = append(endpoints, relayEndpoint{kv[0], kv[1]})
+				continue
+			}
+		}
+		endpoints = append(endpoints, relayEndpoint{"", e})
+	}
+	return endpoints
+}
+
+// Returns nick with a zero-width space after the first character, so the
+// relayed lines don't highlight people with the same nick on the other side
+func relayNick(nick string) string {
+	for i := range nick {
+		if i > 0 {
+			return nick[:i] + "\u200b" + nick[i:]
+		}
+	}
+	return nick
+}
+
+// Sends text, a message from another chat, to channel. Each line becomes a
+// message of its own, prefixed with prefix (e.g. "<nick> "); messages with
+// more than max_bridge_lines lines are cut. Long lines are split by
+// Privmsg().
+func sendBridged(ic *ircclient.IRCClient, channel, prefix, text string) {
+	var lines []string
+	for _, line := range strings.Split(text, "\n") {
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) > max_bridge_lines {
+		more := len(lines) - max_bridge_lines + 1
+		lines = append(lines[:max_bridge_lines-1], fmt.Sprintf("(%d more lines)", more))
+	}
+	for _, line := range lines {
+		if err := ic.Privmsg(channel, prefix+line); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,258 @@
+package plugins
+
+import (
+	"../ircclient"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Pending reminders a single nick may have
+	default_remind_max = 10
+)
+
+// A reminder as kept in the storage, under key "reminder/<id>"
+type reminder struct {
+	// who asked for it, the nick or channel it's sent to and the message
+	Nick string
+	To   string
+	Text string
+	Time time.Time
+}
+
+type RemindPlugin struct {
+	sync.Mutex
+	ic    *ircclient.IRCClient
+	store *ircclient.Store
+	// id -> cancels the scheduled delivery
+	pending map[int]func()
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("remind", func() ircclient.Plugin { return new(RemindPlugin) })
+}
+
+func (q *RemindPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.pending = make(map[int]func())
+
+	if _, err := q.ic.GetIntOption("Remind", "max"); err != nil {
+		log.Printf("added default remind max value of %d to config file", default_remind_max)
+		q.ic.SetIntOption("Remind", "max", default_remind_max)
+	}
+
+	store, err := q.ic.Storage(q.String())
+	if err != nil {
+		log.Println("unable to open reminder storage: " + err.Error())
+		return
+	}
+	q.store = store
+	// reminders that were due while the bot was down are delivered now
+	err = q.store.Iterate(func(key, value string) bool {
+		id, err := strconv.Atoi(strings.TrimPrefix(key, "reminder/"))
+		r := new(reminder)
+		if !strings.HasPrefix(key, "reminder/") || err != nil || json.Unmarshal([]byte(value), r) != nil {
+			return true
+		}
+		q.schedule(id, r)
+		return true
+	})
+	if err != nil {
+		log.Println("unable to load reminders: " + err.Error())
+	}
+
+	q.ic.RegisterCommandHandler("remind", 4, 0, q)
+}
+
+func (q *RemindPlugin) String() string {
+	return "remind"
+}
+
+func (q *RemindPlugin) Info() string {
+	return "reminds users and channels of things at a given time"
+}
+
+func (q *RemindPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "remind":
+		return "remind <me|nick|#channel> <in <duration>|at <time>> <text>: reminds of <text>, e.g. \"remind me in 2h30m tea\" or \"remind #mett at 18:00 mett time\". Durations may use d, h, m and s, times are HH:MM or YYYY-MM-DD HH:MM."
+	}
+	return ""
+}
+
+func (q *RemindPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+}
+
+func (q *RemindPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch cmd.Command {
+	case "remind":
+		nick := strings.SplitN(cmd.Source, "!", 2)[0]
+		when, rest, err := parseRemindTime(cmd.Args[1:], time.Now())
+		if err != nil {
+			q.ic.Reply(cmd, err.Error())
+			return
+		}
+		if len(rest) == 0 {
+			q.ic.Reply(cmd, q.ic.GetUsage("remind"))
+			return
+		}
+		text := strings.Join(rest, " ")
+
+		r := &reminder{Nick: nick, Time: when}
+		target := cmd.Args[0]
+		switch {
+		case q.ic.IsChannelName(target):
+			r.To = target
+			r.Text = "Reminder from " + nick + ": " + text
+		case q.ic.IsChannelName(cmd.Target):
+			// remind me or someone else in this channel
+			if strings.EqualFold(target, "me") {
+				target = nick
+			}
+			r.To = cmd.Target
+			r.Text = target + ": " + text
+			if q.ic.CanonNick(target) != q.ic.CanonNick(nick) {
+				r.Text += " (reminder from " + nick + ")"
+			}
+		default:
+			// in query, only remind the user
+			if !strings.EqualFold(target, "me") && q.ic.CanonNick(target) != q.ic.CanonNick(nick) {
+				q.ic.Reply(cmd, "In private, I can only remind you.")
+				return
+			}
+			r.To = nick
+			r.Text = "Reminder: " + text
+		}
+
+		if _, err := q.add(r); err != nil {
+			q.ic.Reply(cmd, "Couldn't store the reminder: "+err.Error())
+			return
+		}
+		who := cmd.Args[0]
+		if strings.EqualFold(who, "me") {
+			who = "you"
+		}
+		q.ic.Reply(cmd, "Ok, I'll remind "+who+" at "+when.Format("2006-01-02 15:04")+".")
+	}
+}
+
+func (q *RemindPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	for id, cancel := range q.pending {
+		cancel()
+		delete(q.pending, id)
+	}
+}
+
+// Parses "in <duration> ..." or "at [YYYY-MM-DD] HH:MM ..." and returns the
+// time and the remaining arguments
+func parseRemindTime(args []string, now time.Time) (time.Time, []string, error) {
+	if len(args) < 2 {
+		return time.Time{}, nil, errors.New("Say when: in <duration> or at <time>.")
+	}
+	switch strings.ToLower(args[0]) {
+	case "in":
+		d, err := ircclient.ParseDuration(args[1])
+		if err != nil || d <= 0 {
+			return time.Time{}, nil, errors.New("Invalid duration " + args[1] + ", try something like 1d2h30m.")
+		}
+		return now.Add(d), args[2:], nil
+	case "at":
+		if len(args) > 2 {
+			if t, err := time.ParseInLocation("2006-01-02 15:04", args[1]+" "+args[2], now.Location()); err == nil {
+				if !t.After(now) {
+					return time.Time{}, nil, errors.New("That's in the past.")
+				}
+				return t, args[3:], nil
+			}
+		}
+		clock, err := time.Parse("15:04", args[1])
+		if err != nil {
+			return time.Time{}, nil, errors.New("Invalid time " + args[1] + ", try HH:MM or YYYY-MM-DD HH:MM.")
+		}
+		t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+		if !t.After(now) {
+			// tomorrow, then
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, args[2:], nil
+	}
+	return time.Time{}, nil, errors.New("Say when: in <duration> or at <time>.")
+}
+
+// Stores r and schedules its delivery, returns its id
+func (q *RemindPlugin) add(r *reminder) (int, error) {
+	id, err := q.put(r)
+	if err != nil {
+		return 0, err
+	}
+	q.schedule(id, r)
+	return id, nil
+}
+
+// Stores r under the next free id, unless its nick has Remind/max reminders
+// pending already
+func (q *RemindPlugin) put(r *reminder) (int, error) {
+	q.Lock()
+	defer q.Unlock()
+	count := 0
+	err := q.store.Iterate(func(key, value string) bool {
+		var other reminder
+		if strings.HasPrefix(key, "reminder/") && json.Unmarshal([]byte(value), &other) == nil && q.ic.CanonNick(other.Nick) == q.ic.CanonNick(r.Nick) {
+			count++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if max, _ := q.ic.GetIntOption("Remind", "max"); max > 0 && count >= max {
+		return 0, errors.New("you have too many pending reminders")
+	}
+
+	id := 0
+	if value, ok, err := q.store.Get("next"); err != nil {
+		return 0, err
+	} else if ok {
+		id, _ = strconv.Atoi(value)
+	}
+	value, _ := json.Marshal(r)
+	if err := q.store.Put("reminder/"+strconv.Itoa(id), string(value)); err != nil {
+		return 0, err
+	}
+	return id, q.store.Put("next", strconv.Itoa(id+1))
+}
+
+// Schedules the delivery of a stored reminder
+func (q *RemindPlugin) schedule(id int, r *reminder) {
+	q.Lock()
+	defer q.Unlock()
+	q.pending[id] = q.ic.After(r.Time.Sub(time.Now()), func() { q.deliver(id, r) })
+}
+
+// Sends reminder id and deletes it. While disconnected, the line is sent
+// after reconnecting (see SendLine()).
+func (q *RemindPlugin) deliver(id int, r *reminder) {
+	q.Lock()
+	if _, ok := q.pending[id]; !ok {
+		// cancelled meanwhile
+		q.Unlock()
+		return
+	}
+	delete(q.pending, id)
+	q.Unlock()
+
+	if err := q.ic.SendLine("PRIVMSG " + r.To + " :" + r.Text); err != nil {
+		log.Println("unable to send reminder: " + err.Error())
+		return
+	}
+	if err := q.store.Delete("reminder/" + strconv.Itoa(id)); err != nil {
+		log.Println(err)
+	}
+}
@@ -0,0 +1,345 @@
+package plugins
+
+import (
+	"../ircclient"
+	"bufio"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_seen_file       = "seen.db"
+	default_seen_maxentries = 5000
+	// How often changes are written to the seen file
+	seen_save_interval = 5 * time.Minute
+)
+
+type seenEntry struct {
+	nick   string
+	time   time.Time
+	action string // message, join, part, quit or nick
+	text   string
+}
+
+type SeenPlugin struct {
+	sync.Mutex
+	ic *ircclient.IRCClient
+	// canonical nick -> last time the nick was seen
+	entries map[string]*seenEntry
+	dirty   bool
+	quit    chan bool
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("seen", func() ircclient.Plugin { return new(SeenPlugin) })
+}
+
+func (q *SeenPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.entries = make(map[string]*seenEntry)
+	q.quit = make(chan bool)
+
+	if q.ic.GetStringOption("Seen", "file") == "" {
+		log.Println("added default seen file \"" + default_seen_file + "\" to config file")
+		q.ic.SetStringOption("Seen", "file", default_seen_file)
+	}
+	if _, err := q.ic.GetIntOption("Seen", "maxentries"); err != nil {
+		log.Printf("added default seen maxentries value of %d to config file", default_seen_maxentries)
+		q.ic.SetIntOption("Seen", "maxentries", default_seen_maxentries)
+	}
+
+	if err := q.load(); err != nil && !os.IsNotExist(err) {
+		log.Println(err)
+	}
+	go q.saveLoop()
+
+	q.ic.RegisterCommandHandler("seen", 1, 0, q)
+	q.ic.RegisterCommandHandler("forgetme", 0, 0, q)
+}
+
+func (q *SeenPlugin) String() string {
+	return "seen"
+}
+
+func (q *SeenPlugin) Info() string {
+	return "remembers when users were last seen and what they did"
+}
+
+func (q *SeenPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "seen":
+		return "seen <nick>: tells you when <nick> was last seen and what they were doing"
+	case "forgetme":
+		return "forgetme: deletes what the bot knows about you and stops recording your activity"
+	}
+	return ""
+}
+
+func (q *SeenPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+	if nick == "" || q.isMe(nick) {
+		return
+	}
+
+	switch msg.Command {
+	case "PRIVMSG":
+		// only record public messages, private ones are nobody's business
+		if !q.ic.IsChannelName(msg.Target) || len(msg.Args) == 0 {
+			return
+		}
+		q.record(nick, "message", msg.Target+" "+msg.Args[0], msg.Timestamp())
+	case "JOIN":
+		q.record(nick, "join", msg.Target, msg.Timestamp())
+	case "PART":
+		q.record(nick, "part", msg.Target, msg.Timestamp())
+	case "QUIT":
+		// the quit message ends up in the target
+		q.record(nick, "quit", msg.Target, msg.Timestamp())
+	case "NICK":
+		q.record(nick, "nick", msg.Target, msg.Timestamp())
+	}
+}
+
+func (q *SeenPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch cmd.Command {
+	case "seen":
+		nick := cmd.Args[0]
+		if q.isMe(nick) {
+			q.ic.Reply(cmd, "I'm right here.")
+			return
+		}
+		if q.optedOut(nick) {
+			q.ic.Reply(cmd, "I haven't seen "+nick+".")
+			return
+		}
+		q.Lock()
+		e, ok := q.entries[q.ic.CanonNick(nick)]
+		var out string
+		if ok {
+			out = e.String()
+		}
+		q.Unlock()
+		if channels := q.presentIn(nick); len(channels) > 0 {
+			if out == "" {
+				out = nick + " is in " + strings.Join(channels, ", ") + " right now"
+			} else {
+				out += ", and is in " + strings.Join(channels, ", ") + " right now"
+			}
+		}
+		if out == "" {
+			q.ic.Reply(cmd, "I haven't seen "+nick+".")
+			return
+		}
+		q.ic.Reply(cmd, out)
+	case "forgetme":
+		nick := strings.SplitN(cmd.Source, "!", 2)[0]
+		if !q.optedOut(nick) {
+			optout := q.ic.GetStringOption("Seen", "optout")
+			if optout != "" {
+				optout += ","
+			}
+			q.ic.SetStringOption("Seen", "optout", optout+strings.ToLower(nick))
+		}
+		q.Lock()
+		delete(q.entries, q.ic.CanonNick(nick))
+		q.dirty = true
+		q.Unlock()
+		q.ic.Reply(cmd, "Ok, I won't remember seeing you anymore.")
+	}
+}
+
+func (q *SeenPlugin) Unregister() {
+	close(q.quit)
+	if err := q.save(); err != nil {
+		log.Println(err)
+	}
+}
+
+// Returns whether nick is in the comma-separated opt-out list
+func (q *SeenPlugin) optedOut(nick string) bool {
+	for _, n := range strings.Split(q.ic.GetStringOption("Seen", "optout"), ",") {
+		if q.ic.CanonNick(strings.TrimSpace(n)) == q.ic.CanonNick(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+func (q *SeenPlugin) isMe(nick string) bool {
+	return q.ic.CanonNick(nick) == q.ic.CanonNick(q.ic.GetStringOption("Server", "nick"))
+}
+
+// Returns the channels shared with the bot that nick is in right now
+func (q *SeenPlugin) presentIn(nick string) []string {
+	channels := make([]string, 0)
+	for _, channel := range q.ic.JoinedChannels() {
+		if q.ic.IsOnChannel(channel, nick) {
+			channels = append(channels, channel)
+		}
+	}
+	return channels
+}
+
+func (q *SeenPlugin) record(nick, action, text string, t time.Time) {
+	if q.optedOut(nick) {
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	q.entries[q.ic.CanonNick(nick)] = &seenEntry{nick, t, action, text}
+	q.dirty = true
+}
+
+// e.g. "alice was last seen 3h 12m ago in #mett, saying: hi"
+func (e *seenEntry) String() string {
+	ago := "last seen " + since(e.time) + " ago"
+	switch e.action {
+	case "message":
+		parts := strings.SplitN(e.text, " ", 2)
+		if len(parts) < 2 {
+			parts = append(parts, "")
+		}
+		return fmt.Sprintf("%s was %s in %s, saying: %s", e.nick, ago, parts[0], parts[1])
+	case "join":
+		return fmt.Sprintf("%s was %s joining %s", e.nick, ago, e.text)
+	case "part":
+		return fmt.Sprintf("%s was %s leaving %s", e.nick, ago, e.text)
+	case "quit":
+		return fmt.Sprintf("%s was %s quitting (%s)", e.nick, ago, e.text)
+	case "nick":
+		return fmt.Sprintf("%s was %s changing nick to %s", e.nick, ago, e.text)
+	}
+	return fmt.Sprintf("%s was %s", e.nick, ago)
+}
+
+// Returns the time passed since t in a short human-readable form, using the
+// two most significant units, e.g. "2d 5h" or "42s"
+func since(t time.Time) string {
+	d := time.Since(t)
+	if d < time.Second {
+		return "0s"
+	}
+	units := []struct {
+		d    time.Duration
+		name string
+	}{
+		{24 * time.Hour, "d"},
+		{time.Hour, "h"},
+		{time.Minute, "m"},
+		{time.Second, "s"},
+	}
+	parts := make([]string, 0, 2)
+	for _, u := range units {
+		if d >= u.d {
+			parts = append(parts, strconv.Itoa(int(d/u.d))+u.name)
+			d %= u.d
+		} else if len(parts) > 0 {
+			// don't skip units between the two shown
+			break
+		}
+		if len(parts) == 2 {
+			break
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// Reads the seen file. Each line contains the canonical nick, the nick,
+// the unix time, the action and the text, separated by spaces.
+func (q *SeenPlugin) load() error {
+	f, err := os.Open(q.ic.GetStringOption("Seen", "file"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	q.Lock()
+	defer q.Unlock()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), " ", 5)
+		if len(fields) < 4 {
+			continue
+		}
+		sec, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			continue
+		}
+		e := &seenEntry{nick: fields[1], time: time.Unix(sec, 0), action: fields[3]}
+		if len(fields) == 5 {
+			e.text = fields[4]
+		}
+		// older files have plain lowercased nicks
+		q.entries[q.ic.CanonNick(e.nick)] = e
+	}
+	return scanner.Err()
+}
+
+// Writes all entries to the seen file, dropping the oldest ones if there
+// are more than Seen/maxentries
+func (q *SeenPlugin) save() error {
+	q.Lock()
+	defer q.Unlock()
+	if !q.dirty {
+		return nil
+	}
+
+	keys := make([]string, 0, len(q.entries))
+	for key := range q.entries {
+		keys = append(keys, key)
+	}
+	// newest first
+	sort.Slice(keys, func(i, j int) bool {
+		return q.entries[keys[i]].time.After(q.entries[keys[j]].time)
+	})
+	if max, err := q.ic.GetIntOption("Seen", "maxentries"); err == nil && max > 0 && len(keys) > max {
+		for _, key := range keys[max:] {
+			delete(q.entries, key)
+		}
+		keys = keys[:max]
+	}
+
+	file := q.ic.GetStringOption("Seen", "file")
+	f, err := os.Create(file + ".tmp")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	for _, key := range keys {
+		e := q.entries[key]
+		fmt.Fprintf(w, "%s %s %d %s %s\n", key, e.nick, e.time.Unix(), e.action, e.text)
+	}
+	if err := w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(file+".tmp", file); err != nil {
+		return err
+	}
+	q.dirty = false
+	return nil
+}
+
+func (q *SeenPlugin) saveLoop() {
+	ticker := time.NewTicker(seen_save_interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := q.save(); err != nil {
+				log.Println(err)
+			}
+		case <-q.quit:
+			return
+		}
+	}
+}
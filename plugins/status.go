@@ -0,0 +1,54 @@
+package plugins
+
+import (
+	"../ircclient"
+	"fmt"
+	"time"
+)
+
+type StatusPlugin struct {
+	ic *ircclient.IRCClient
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("status", func() ircclient.Plugin { return new(StatusPlugin) })
+}
+
+func (q *StatusPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.ic.RegisterCommandHandler("status", 0, 0, q)
+}
+
+func (q *StatusPlugin) String() string {
+	return "status"
+}
+
+func (q *StatusPlugin) Info() string {
+	return "reports the health of the connection"
+}
+
+func (q *StatusPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "status":
+		return "status: prints uptime, nick, channel count, lag and reconnects of the bot"
+	}
+	return ""
+}
+
+func (q *StatusPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	// empty
+}
+
+func (q *StatusPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	s := q.ic.GetStatus()
+	lag := "unknown"
+	if s.Latency > 0 {
+		lag = s.Latency.String()
+	}
+	q.ic.Reply(cmd, fmt.Sprintf("Up %v as %s on %s in %d channels, lag %s, %d reconnects",
+		s.Uptime-s.Uptime%time.Second, s.Nick, s.Server, s.Channels, lag, s.Reconnects))
+}
+
+func (q *StatusPlugin) Unregister() {
+	// empty
+}
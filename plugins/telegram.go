@@ -0,0 +1,393 @@
+package plugins
+
+// Forwards what is addressed to IRC users to their Telegram chats, through
+// a Telegram bot, and lets them answer from there:
+//
+//	[Telegram]
+//	token: <token of the bot, from @BotFather>
+//
+//	[TelegramUsers]
+//	alice: 123456789
+//
+// Each option of section TelegramUsers maps a nick to the ID of the chat
+// with the bot, which the bot tells when sent /start. Forwarded are channel
+// messages mentioning the nick and private messages to our bot starting
+// with "nick:". Replying to a forwarded message answers where it came
+// from, other messages go where the last answer went (at first, where the
+// first forwarded message came from) and "/msg <target> <text>" sends to a
+// channel or nick. Like the relay plugin, it has to be registered with
+// BotManager.RegisterPlugin().
+
+import (
+	"../ircclient"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	telegram_api = "https://api.telegram.org/bot"
+	// Seconds getUpdates waits for messages
+	telegram_poll_timeout = 30
+	// Wait after a failed request, doubled up to telegram_max_retry
+	telegram_retry     = 5 * time.Second
+	telegram_max_retry = 5 * time.Minute
+	// Forwarded messages remembered per chat for replies
+	max_telegram_origins = 100
+	// Longest message Telegram accepts, in characters
+	max_telegram_message = 4096
+)
+
+// Where a forwarded message came from, answers go there
+type telegramOrigin struct {
+	network string
+	// channel or, for private messages, the sender's nick
+	target string
+}
+
+type telegramMessage struct {
+	MessageID int `json:"message_id"`
+	Chat      struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text           string `json:"text"`
+	ReplyToMessage *struct {
+		MessageID int `json:"message_id"`
+	} `json:"reply_to_message"`
+}
+
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type TelegramPlugin struct {
+	// network -> client, see Register()
+	clients map[string]*ircclient.IRCClient
+	// the client the options are read from, the sections are the same for
+	// all networks
+	conf  *ircclient.IRCClient
+	token string
+	http  *http.Client
+	// chat ID -> message ID -> origin of forwarded messages
+	origins map[int64]map[int]telegramOrigin
+	// message IDs of origins, oldest first, to forget them in order
+	forwarded map[int64][]int
+	// chat ID -> where the last answer went
+	last map[int64]telegramOrigin
+	// stops polling
+	cancel func()
+	sync.Mutex
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("telegram", func() ircclient.Plugin { return new(TelegramPlugin) })
+}
+
+// Called once per network when registered with a BotManager, starts
+// polling on the first call
+func (q *TelegramPlugin) Register(cl *ircclient.IRCClient) {
+	q.Lock()
+	defer q.Unlock()
+	if q.clients != nil {
+		q.clients[cl.Network()] = cl
+		return
+	}
+	q.clients = map[string]*ircclient.IRCClient{cl.Network(): cl}
+	q.conf = cl
+	q.token = cl.GetStringOption("Telegram", "token")
+	if q.token == "" {
+		log.Println("telegram: no token set in section Telegram, not forwarding")
+		return
+	}
+	q.http = &http.Client{Timeout: (telegram_poll_timeout + 30) * time.Second}
+	q.origins = make(map[int64]map[int]telegramOrigin)
+	q.forwarded = make(map[int64][]int)
+	q.last = make(map[int64]telegramOrigin)
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	go q.poll(ctx)
+}
+
+func (q *TelegramPlugin) String() string {
+	return "telegram"
+}
+
+func (q *TelegramPlugin) Info() string {
+	return "forwards highlights to Telegram and answers from there"
+}
+
+func (q *TelegramPlugin) Usage(cmd string) string {
+	// plugin has no commands
+	return ""
+}
+
+func (q *TelegramPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// interface saturation
+}
+
+func (q *TelegramPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.clients = nil
+}
+
+// Forwards highlights and private messages to the users' chats
+func (q *TelegramPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if msg.Command != "PRIVMSG" || len(msg.Args) == 0 || !strings.Contains(msg.Source, "!") {
+		return
+	}
+	q.Lock()
+	ic, running := q.clients[msg.Network], q.cancel != nil
+	q.Unlock()
+	if ic == nil || !running {
+		return
+	}
+	nick, _, _ := ircclient.ParseSource(msg.Source)
+	text := ircclient.StripFormatting(msg.Args[0])
+	if command, params, ok := msg.CTCP(); ok {
+		if command != "ACTION" {
+			return
+		}
+		text = "* " + nick + " " + ircclient.StripFormatting(params)
+	} else {
+		text = "<" + nick + "> " + text
+	}
+
+	private := !ic.IsChannelName(msg.Target)
+	for _, user := range ic.GetOptions("TelegramUsers") {
+		if ic.CanonNick(user) == ic.CanonNick(nick) {
+			continue
+		}
+		chat, err := strconv.ParseInt(ic.GetStringOption("TelegramUsers", user), 10, 64)
+		if err != nil {
+			continue
+		}
+		var origin telegramOrigin
+		header, line := "", text
+		if private {
+			kv := strings.SplitN(msg.Args[0], ":", 2)
+			if len(kv) < 2 || ic.CanonNick(strings.TrimSpace(kv[0])) != ic.CanonNick(user) {
+				continue
+			}
+			origin, header = telegramOrigin{msg.Network, nick}, "["+nick+"]"
+			line = "<" + nick + "> " + strings.TrimSpace(ircclient.StripFormatting(kv[1]))
+		} else if telegramMentions(text, user) {
+			origin, header = telegramOrigin{msg.Network, msg.Target}, "["+msg.Target+"]"
+		} else {
+			continue
+		}
+		if msg.Network != "" {
+			header = header[:len(header)-1] + "@" + msg.Network + "]"
+		}
+		go q.forward(chat, origin, header+" "+line)
+	}
+}
+
+// Returns whether text contains nick as a word of its own
+func telegramMentions(text, nick string) bool {
+	re, err := regexp.Compile(`(?i)(^|[^\w\[\]\\^{}|-])` + regexp.QuoteMeta(nick) + `($|[^\w\[\]\\^{}|-])`)
+	return err == nil && re.MatchString(text)
+}
+
+// Sends text to chat and remembers its origin for replies
+func (q *TelegramPlugin) forward(chat int64, origin telegramOrigin, text string) {
+	if runes := []rune(text); len(runes) > max_telegram_message {
+		text = string(runes[:max_telegram_message-1]) + "…"
+	}
+	var sent telegramMessage
+	request := map[string]interface{}{"chat_id": chat, "text": text, "disable_web_page_preview": true}
+	if err := q.call(context.Background(), "sendMessage", request, &sent); err != nil {
+		log.Println("telegram: unable to forward message: " + err.Error())
+		return
+	}
+	q.Lock()
+	defer q.Unlock()
+	if q.origins == nil {
+		return
+	}
+	if q.origins[chat] == nil {
+		q.origins[chat] = make(map[int]telegramOrigin)
+	}
+	q.origins[chat][sent.MessageID] = origin
+	q.forwarded[chat] = append(q.forwarded[chat], sent.MessageID)
+	if len(q.forwarded[chat]) > max_telegram_origins {
+		delete(q.origins[chat], q.forwarded[chat][0])
+		q.forwarded[chat] = q.forwarded[chat][1:]
+	}
+	if _, ok := q.last[chat]; !ok {
+		q.last[chat] = origin
+	}
+}
+
+// Fetches the messages sent to our bot until ctx is cancelled
+func (q *TelegramPlugin) poll(ctx context.Context) {
+	retry := telegram_retry
+	// -1: only the latest update, to skip what was sent while we were gone
+	offset := int64(-1)
+	timeout := 0
+	for {
+		var updates []telegramUpdate
+		request := map[string]interface{}{"offset": offset, "timeout": timeout, "allowed_updates": []string{"message"}}
+		if err := q.call(ctx, "getUpdates", request, &updates); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("telegram: unable to get updates: " + err.Error())
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+			if retry *= 2; retry > telegram_max_retry {
+				retry = telegram_max_retry
+			}
+			continue
+		}
+		retry = telegram_retry
+		for _, u := range updates {
+			if offset >= 0 && u.Message != nil {
+				q.answer(u.Message)
+			}
+			offset = u.UpdateID + 1
+		}
+		if offset < 0 {
+			offset = 0
+		}
+		timeout = telegram_poll_timeout
+	}
+}
+
+// Sends a message from a user's chat to IRC
+func (q *TelegramPlugin) answer(msg *telegramMessage) {
+	chat := msg.Chat.ID
+	user := ""
+	for _, option := range q.conf.GetOptions("TelegramUsers") {
+		if q.conf.GetStringOption("TelegramUsers", option) == strconv.FormatInt(chat, 10) {
+			user = option
+		}
+	}
+	if user == "" {
+		if strings.HasPrefix(msg.Text, "/start") {
+			go q.reply(chat, "Your chat ID is "+strconv.FormatInt(chat, 10)+", add it to section TelegramUsers of the bot's config file.")
+		}
+		return
+	}
+
+	q.Lock()
+	origin, ok := q.last[chat]
+	if msg.ReplyToMessage != nil {
+		if o, found := q.origins[chat][msg.ReplyToMessage.MessageID]; found {
+			origin, ok = o, true
+		}
+	}
+	text := msg.Text
+	if strings.HasPrefix(text, "/msg ") {
+		kv := strings.SplitN(strings.TrimSpace(strings.TrimPrefix(text, "/msg ")), " ", 2)
+		if len(kv) < 2 {
+			q.Unlock()
+			go q.reply(chat, "Usage: /msg <target> <text>, target is a channel or nick (with @network if there are several)")
+			return
+		}
+		origin, ok = parseTelegramTarget(kv[0]), true
+		text = kv[1]
+	}
+	ic := q.clients[origin.network]
+	if ok && ic != nil {
+		q.last[chat] = origin
+	}
+	q.Unlock()
+
+	switch {
+	case !ok:
+		go q.reply(chat, "Nothing to answer yet, reply to a forwarded message or use /msg <target> <text>.")
+	case ic == nil:
+		go q.reply(chat, "Not connected to network "+origin.network+".")
+	case strings.TrimSpace(text) != "":
+		sendBridged(ic, origin.target, "<"+relayNick(user)+"> ", text)
+	}
+}
+
+// Parses "#channel" or "nick", followed by "@network" with several networks
+func parseTelegramTarget(s string) telegramOrigin {
+	if i := strings.LastIndex(s, "@"); i > 0 {
+		return telegramOrigin{s[i+1:], s[:i]}
+	}
+	return telegramOrigin{"", s}
+}
+
+// Sends a message of our own to chat
+func (q *TelegramPlugin) reply(chat int64, text string) {
+	if err := q.call(context.Background(), "sendMessage", map[string]interface{}{"chat_id": chat, "text": text}, nil); err != nil {
+		log.Println("telegram: unable to send message: " + err.Error())
+	}
+}
+
+// Calls method of the bot API with the parameters in request and decodes
+// the result into result, unless it is nil. Requests that hit the rate
+// limit are retried after the time asked for.
+func (q *TelegramPlugin) call(ctx context.Context, method string, request, result interface{}) error {
+	data, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	for {
+		r, err := http.NewRequestWithContext(ctx, "POST", telegram_api+q.token+"/"+method, bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", "application/json")
+		response, err := q.http.Do(r)
+		if err != nil {
+			// the URL contains the token
+			if e, ok := err.(*url.Error); ok {
+				err = e.Err
+			}
+			return err
+		}
+		content, err := ioutil.ReadAll(io.LimitReader(response.Body, 1<<20))
+		response.Body.Close()
+		if err != nil {
+			return err
+		}
+		var reply struct {
+			OK          bool            `json:"ok"`
+			Result      json.RawMessage `json:"result"`
+			Description string          `json:"description"`
+			Parameters  struct {
+				RetryAfter int `json:"retry_after"`
+			} `json:"parameters"`
+		}
+		if err := json.Unmarshal(content, &reply); err != nil {
+			return errors.New(response.Status)
+		}
+		if reply.OK {
+			if result == nil {
+				return nil
+			}
+			return json.Unmarshal(reply.Result, result)
+		}
+		if response.StatusCode != http.StatusTooManyRequests {
+			return errors.New(reply.Description)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(reply.Parameters.RetryAfter+1) * time.Second):
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package plugins
+
+import (
+	"../ircclient"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+const (
+	// Days after which undelivered memos are dropped
+	default_tell_expiry = 30
+	// Memos that may be waiting for a single nick
+	default_tell_maxmemos = 10
+	// "notice" to send memos to the recipient privately, "channel" to
+	// mention them in the channel they spoke or joined in
+	default_tell_delivery = "notice"
+)
+
+type memo struct {
+	From    string
+	Text    string
+	Channel string `json:",omitempty"`
+	Time    time.Time
+}
+
+type TellPlugin struct {
+	ic *ircclient.IRCClient
+	// canonical nick of the recipient -> JSON list of memos
+	store *ircclient.Store
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("tell", func() ircclient.Plugin { return new(TellPlugin) })
+}
+
+func (q *TellPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+
+	if _, err := q.ic.GetIntOption("Tell", "expiry"); err != nil {
+		log.Printf("added default tell expiry of %d days to config file", default_tell_expiry)
+		q.ic.SetIntOption("Tell", "expiry", default_tell_expiry)
+	}
+	if _, err := q.ic.GetIntOption("Tell", "maxmemos"); err != nil {
+		log.Printf("added default tell maxmemos value of %d to config file", default_tell_maxmemos)
+		q.ic.SetIntOption("Tell", "maxmemos", default_tell_maxmemos)
+	}
+	if q.ic.GetStringOption("Tell", "delivery") == "" {
+		log.Println("added default tell delivery \"" + default_tell_delivery + "\" to config file")
+		q.ic.SetStringOption("Tell", "delivery", default_tell_delivery)
+	}
+
+	store, err := q.ic.Storage(q.String())
+	if err != nil {
+		log.Println("unable to open memo storage: " + err.Error())
+		return
+	}
+	q.store = store
+
+	q.ic.RegisterCommandHandler("tell", 2, 0, q)
+	q.ic.RegisterCommandHandler("memos", 0, 0, q)
+	q.ic.SetReplyMode("memos", ircclient.ReplyModePrivate)
+}
+
+func (q *TellPlugin) String() string {
+	return "tell"
+}
+
+func (q *TellPlugin) Info() string {
+	return "passes on messages to users the next time they are around"
+}
+
+func (q *TellPlugin) Usage(cmd string) string {
+	switch cmd {
+	case "tell":
+		return "tell <nick> <message>: tells <nick> your message the next time they speak or join"
+	case "memos":
+		return "memos: shows the messages waiting for you in private"
+	}
+	return ""
+}
+
+// Delivers the waiting memos when their recipient speaks or joins
+func (q *TellPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if msg.Command != "PRIVMSG" && msg.Command != "JOIN" {
+		return
+	}
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+	if nick == "" || q.isMe(nick) {
+		return
+	}
+	// don't deliver them twice
+	if msg.Command == "PRIVMSG" && len(msg.Args) > 0 && strings.HasPrefix(msg.Args[0], q.ic.Trigger()+"memos") {
+		return
+	}
+	memos, err := q.take(nick)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	channel := ""
+	if q.ic.IsChannelName(msg.Target) && q.ic.GetStringOption("Tell", "delivery") == "channel" {
+		channel = msg.Target
+	}
+	for _, m := range memos {
+		if channel != "" {
+			q.ic.SendLine("PRIVMSG " + channel + " :" + nick + ": " + m.String())
+		} else {
+			q.ic.SendLine("NOTICE " + nick + " :" + m.String())
+		}
+	}
+}
+
+func (q *TellPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	switch cmd.Command {
+	case "tell":
+		to := cmd.Args[0]
+		from := strings.SplitN(cmd.Source, "!", 2)[0]
+		if q.isMe(to) {
+			q.ic.Reply(cmd, "I'm right here.")
+			return
+		}
+		channel := ""
+		if q.ic.IsChannelName(cmd.Target) {
+			channel = cmd.Target
+		}
+		m := &memo{from, strings.Join(cmd.Args[1:], " "), channel, time.Now()}
+		if err := q.add(to, m); err != nil {
+			q.ic.Reply(cmd, "Couldn't store your message: "+err.Error())
+			return
+		}
+		q.ic.Reply(cmd, "Ok, I'll tell "+to+" when they're around.")
+	case "memos":
+		nick := strings.SplitN(cmd.Source, "!", 2)[0]
+		memos, err := q.take(nick)
+		if err != nil {
+			log.Println(err)
+			q.ic.Reply(cmd, "Couldn't read your messages: "+err.Error())
+			return
+		}
+		if len(memos) == 0 {
+			q.ic.Reply(cmd, "There are no messages for you.")
+			return
+		}
+		for _, m := range memos {
+			q.ic.Reply(cmd, m.String())
+		}
+	}
+}
+
+func (q *TellPlugin) Unregister() {
+}
+
+func (q *TellPlugin) isMe(nick string) bool {
+	return q.ic.CanonNick(nick) == q.ic.CanonNick(q.ic.GetStringOption("Server", "nick"))
+}
+
+// e.g. "alice said 2h 5m ago in #mett: don't forget the mett"
+func (m *memo) String() string {
+	where := ""
+	if m.Channel != "" {
+		where = " in " + m.Channel
+	}
+	return fmt.Sprintf("%s said %s ago%s: %s", m.From, since(m.Time), where, m.Text)
+}
+
+// Removes the memos that are older than Tell/expiry days
+func (q *TellPlugin) expire(memos []*memo) []*memo {
+	days, _ := q.ic.GetIntOption("Tell", "expiry")
+	if days <= 0 {
+		return memos
+	}
+	valid := memos[:0]
+	for _, m := range memos {
+		if time.Since(m.Time) < time.Duration(days)*24*time.Hour {
+			valid = append(valid, m)
+		}
+	}
+	return valid
+}
+
+// Queues m for nick. Fails if there are already Tell/maxmemos memos waiting.
+func (q *TellPlugin) add(nick string, m *memo) error {
+	var full bool
+	err := q.store.Update(q.ic.CanonNick(nick), func(value string, ok bool) (string, bool) {
+		var memos []*memo
+		if ok {
+			json.Unmarshal([]byte(value), &memos)
+		}
+		memos = q.expire(memos)
+		if max, _ := q.ic.GetIntOption("Tell", "maxmemos"); max > 0 && len(memos) >= max {
+			full = true
+			return value, ok
+		}
+		b, _ := json.Marshal(append(memos, m))
+		return string(b), true
+	})
+	if err == nil && full {
+		err = fmt.Errorf("%s already has too many messages waiting", nick)
+	}
+	return err
+}
+
+// Removes and returns the memos waiting for nick, oldest first
+func (q *TellPlugin) take(nick string) ([]*memo, error) {
+	key := q.ic.CanonNick(nick)
+	// called for every message, don't write unless there is something
+	if _, ok, err := q.store.Get(key); err != nil || !ok {
+		return nil, err
+	}
+	var memos []*memo
+	err := q.store.Update(key, func(value string, ok bool) (string, bool) {
+		if ok {
+			json.Unmarshal([]byte(value), &memos)
+		}
+		return "", false
+	})
+	return q.expire(memos), err
+}
@@ -21,6 +21,10 @@ type TemperaturPlugin struct {
 	ic *ircclient.IRCClient
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("temperatur", func() ircclient.Plugin { return new(TemperaturPlugin) })
+}
+
 func (q *TemperaturPlugin) String() string {
 	return "temperatur"
 }
@@ -16,6 +16,10 @@ type TopicDiffPlugin struct {
 	topics map[string]string
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("topicdiff", func() ircclient.Plugin { return new(TopicDiffPlugin) })
+}
+
 func (q *TopicDiffPlugin) String() string {
 	return "topicdiff"
 }
@@ -39,7 +43,7 @@ func (q *TopicDiffPlugin) Unregister() {
 }
 
 func (q *TopicDiffPlugin) ProcessLine(msg *ircclient.IRCMessage) {
-	if msg.Command == "332" { // announce of topic during joining of channel
+	if msg.Command == ircclient.RPL_TOPIC { // announce of topic during joining of channel
 		q.topics[msg.Args[0]] = msg.Args[1]
 	} else if msg.Command == "TOPIC" {
 		oldTopic := q.topics[msg.Target]
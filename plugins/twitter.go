@@ -50,6 +50,10 @@ type TwitterPlugin struct {
 	regex *regexp.Regexp
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("twitter", func() ircclient.Plugin { return new(TwitterPlugin) })
+}
+
 func (q *TwitterPlugin) String() string {
 	return "twitter"
 }
@@ -78,7 +82,7 @@ func (q *TwitterPlugin) ProcessLine(msg *ircclient.IRCMessage) {
 		return
 	}
 
-	subs := q.regex.FindStringSubmatch(msg.Args[0])
+	subs := q.regex.FindStringSubmatch(msg.PlainText()[0])
 	if subs == nil {
 		// no url to tweet in message
 		return
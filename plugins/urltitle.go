@@ -0,0 +1,399 @@
+package plugins
+
+import (
+	"../ircclient"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// Bytes of a page read at most while looking for the title
+	default_urltitle_maxsize = 256 << 10
+	// Seconds to wait for a page
+	default_urltitle_timeout = 5
+	// URLs of a single message that are looked at
+	max_urltitle_urls = 3
+	// Messages whose URLs are fetched at the same time, URLs of further
+	// ones are skipped
+	max_urltitle_fetches = 4
+	// Titles are cut off after this many bytes
+	max_urltitle_length = 300
+	// A URL isn't titled again in the same channel within this time, so
+	// bots repeating each other's messages don't loop forever
+	urltitle_repeat = 10 * time.Minute
+	// Prefix of our replies, messages starting with it are ignored
+	urltitle_prefix = "Title: "
+)
+
+var (
+	urltitle_url_regex   = regexp.MustCompile(`(?i)\bhttps?://[^\s<>"]+`)
+	urltitle_title_regex = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	// Not local by net.IP's methods, but not on the internet either: "this
+	// network" and carrier-grade NAT
+	urltitle_blocked_nets = []*net.IPNet{mustParseCIDR("0.0.0.0/8"), mustParseCIDR("100.64.0.0/10")}
+)
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+type URLTitlePlugin struct {
+	sync.Mutex
+	ic     *ircclient.IRCClient
+	client *http.Client
+	// canonical channel + " " + URL -> when it was titled
+	recent map[string]time.Time
+	// one element per message whose URLs are being fetched
+	fetching chan bool
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("urltitle", func() ircclient.Plugin { return new(URLTitlePlugin) })
+}
+
+func (q *URLTitlePlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+	q.recent = make(map[string]time.Time)
+	q.fetching = make(chan bool, max_urltitle_fetches)
+
+	if _, err := q.ic.GetIntOption("URLTitle", "maxsize"); err != nil {
+		log.Printf("added default urltitle maxsize of %d bytes to config file", default_urltitle_maxsize)
+		q.ic.SetIntOption("URLTitle", "maxsize", default_urltitle_maxsize)
+	}
+	timeout, err := q.ic.GetIntOption("URLTitle", "timeout")
+	if err != nil {
+		log.Printf("added default urltitle timeout of %d seconds to config file", default_urltitle_timeout)
+		q.ic.SetIntOption("URLTitle", "timeout", default_urltitle_timeout)
+		timeout = default_urltitle_timeout
+	}
+
+	// No proxy (not even from the environment), checkAddress() would only
+	// see the proxy's address and not the one of the URL
+	dialer := &net.Dialer{Timeout: time.Duration(timeout) * time.Second, Control: q.checkAddress}
+	q.client = &http.Client{
+		Timeout:   time.Duration(timeout) * time.Second,
+		Transport: &http.Transport{DialContext: dialer.DialContext, Proxy: nil},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 5 {
+				return errors.New("too many redirects")
+			}
+			if q.blacklisted(req.URL.Hostname()) {
+				return errors.New("redirected to blacklisted host " + req.URL.Hostname())
+			}
+			return nil
+		},
+	}
+
+	q.ic.RegisterCommandHandler("urltitle", 0, 200, q)
+}
+
+func (q *URLTitlePlugin) String() string {
+	return "urltitle"
+}
+
+func (q *URLTitlePlugin) Info() string {
+	return "shows the titles of URLs posted in channels"
+}
+
+func (q *URLTitlePlugin) Usage(cmd string) string {
+	switch cmd {
+	case "urltitle":
+		return "urltitle [on|off] [#channel]: enables or disables showing the titles of URLs in #channel (or this channel), or tells whether it's enabled"
+	}
+	return ""
+}
+
+func (q *URLTitlePlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	// other bots use NOTICEs, so only look at PRIVMSGs
+	if msg.Command != "PRIVMSG" || !q.ic.IsChannelName(msg.Target) || len(msg.Args) == 0 {
+		return
+	}
+	text := msg.PlainText()[0]
+	nick := strings.SplitN(msg.Source, "!", 2)[0]
+	if !q.enabled(msg.Target) || q.ignored(nick) || strings.HasPrefix(text, urltitle_prefix) || strings.HasPrefix(text, "\x01") {
+		return
+	}
+	if _, ok := msg.Tags["bot"]; ok {
+		// IRCv3 bot mode
+		return
+	}
+	if strings.HasPrefix(text, q.ic.Trigger()) {
+		// commands may contain URLs, e.g. "feed add"
+		return
+	}
+
+	urls := make([]string, 0)
+	for _, u := range urltitle_url_regex.FindAllString(text, max_urltitle_urls) {
+		// trailing punctuation most likely belongs to the sentence
+		u = strings.TrimRight(u, ".,;:!?)'")
+		if !q.seenRecently(msg.Target, u) {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return
+	}
+	// Slow servers would hold up the lines after this one
+	select {
+	case q.fetching <- true:
+	default:
+		log.Printf("too many titles being fetched, skipping %d URLs", len(urls))
+		return
+	}
+	go func() {
+		defer func() { <-q.fetching }()
+		for _, u := range urls {
+			info, err := q.describe(u)
+			if err != nil {
+				log.Printf("unable to fetch title of %s: %v", u, err)
+				continue
+			}
+			if info != "" {
+				q.ic.ReplyMsg(msg, urltitle_prefix+info)
+			}
+		}
+	}()
+}
+
+func (q *URLTitlePlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	channel := cmd.Target
+	args := cmd.Args
+	if len(args) > 0 && q.ic.IsChannelName(args[len(args)-1]) {
+		channel = args[len(args)-1]
+		args = args[:len(args)-1]
+	}
+	if !q.ic.IsChannelName(channel) {
+		q.ic.Reply(cmd, q.ic.GetUsage("urltitle"))
+		return
+	}
+	if len(args) == 0 {
+		if q.enabled(channel) {
+			q.ic.Reply(cmd, "URL titles are shown in "+channel+".")
+		} else {
+			q.ic.Reply(cmd, "URL titles are not shown in "+channel+".")
+		}
+		return
+	}
+	switch strings.ToLower(args[0]) {
+	case "on":
+		q.setEnabled(channel, true)
+	case "off":
+		q.setEnabled(channel, false)
+	default:
+		q.ic.Reply(cmd, q.ic.GetUsage("urltitle"))
+		return
+	}
+	if err := q.ic.SaveConfig(); err != nil {
+		log.Println(err)
+	}
+	if q.enabled(channel) {
+		q.ic.Reply(cmd, "Ok, URL titles are shown in "+channel+".")
+	} else {
+		q.ic.Reply(cmd, "Ok, URL titles are not shown in "+channel+".")
+	}
+}
+
+func (q *URLTitlePlugin) Unregister() {
+}
+
+// Returns the list in option URLTitle/<option>, separated by spaces
+func (q *URLTitlePlugin) list(option string) []string {
+	return strings.Fields(q.ic.GetStringOption("URLTitle", option))
+}
+
+// Channels are enabled unless listed in URLTitle/disabled
+func (q *URLTitlePlugin) enabled(channel string) bool {
+	for _, c := range q.list("disabled") {
+		if q.ic.CanonChannel(c) == q.ic.CanonChannel(channel) {
+			return false
+		}
+	}
+	return true
+}
+
+func (q *URLTitlePlugin) setEnabled(channel string, on bool) {
+	disabled := make([]string, 0)
+	for _, c := range q.list("disabled") {
+		if q.ic.CanonChannel(c) != q.ic.CanonChannel(channel) {
+			disabled = append(disabled, c)
+		}
+	}
+	if !on {
+		disabled = append(disabled, channel)
+	}
+	if len(disabled) == 0 {
+		q.ic.RemoveOption("URLTitle", "disabled")
+		return
+	}
+	q.ic.SetStringOption("URLTitle", "disabled", strings.Join(disabled, " "))
+}
+
+// Nicks in URLTitle/ignore are other bots, we don't answer them
+func (q *URLTitlePlugin) ignored(nick string) bool {
+	for _, n := range q.list("ignore") {
+		if q.ic.CanonNick(n) == q.ic.CanonNick(nick) {
+			return true
+		}
+	}
+	return false
+}
+
+// Hosts in URLTitle/blacklist are never fetched, neither are their
+// subdomains
+func (q *URLTitlePlugin) blacklisted(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, domain := range q.list("blacklist") {
+		domain = strings.ToLower(strings.TrimPrefix(domain, "."))
+		if host == domain || strings.HasSuffix(host, "."+domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns whether u has been titled in channel within urltitle_repeat, and
+// remembers it if not
+func (q *URLTitlePlugin) seenRecently(channel, u string) bool {
+	q.Lock()
+	defer q.Unlock()
+	now := time.Now()
+	for key, t := range q.recent {
+		if now.Sub(t) > urltitle_repeat {
+			delete(q.recent, key)
+		}
+	}
+	key := q.ic.CanonChannel(channel) + " " + u
+	if _, ok := q.recent[key]; ok {
+		return true
+	}
+	q.recent[key] = now
+	return false
+}
+
+// Refuses connections to the local network, so users can't make us probe
+// it. Set URLTitle/allowlocal to "true" to allow them anyway.
+func (q *URLTitlePlugin) checkAddress(network, address string, c syscall.RawConn) error {
+	if q.ic.GetBoolOption("URLTitle", "allowlocal", false) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() || ip.IsMulticast() {
+		return errors.New("refusing to connect to local address " + host)
+	}
+	for _, n := range urltitle_blocked_nets {
+		if n.Contains(ip) {
+			return errors.New("refusing to connect to local address " + host)
+		}
+	}
+	return nil
+}
+
+// Returns the title of the HTML page at u, or its type and size for other
+// content
+func (q *URLTitlePlugin) describe(u string) (string, error) {
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return "", err
+	}
+	if q.blacklisted(parsed.Hostname()) {
+		return "", nil
+	}
+	req, err := http.NewRequest("GET", parsed.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("User-Agent", "MettBot (+https://github.com/notmatti/MettBot)")
+	req.Header.Set("Accept", "text/html,application/xhtml+xml;q=0.9,*/*;q=0.5")
+	resp, err := q.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(resp.Status)
+	}
+
+	mediatype, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediatype != "text/html" && mediatype != "application/xhtml+xml" {
+		if mediatype == "" {
+			mediatype = "unknown type"
+		}
+		if resp.ContentLength >= 0 {
+			return fmt.Sprintf("[%s, %s]", mediatype, formatSize(resp.ContentLength)), nil
+		}
+		return "[" + mediatype + "]", nil
+	}
+
+	maxsize, err := q.ic.GetIntOption("URLTitle", "maxsize")
+	if err != nil || maxsize <= 0 {
+		maxsize = default_urltitle_maxsize
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, int64(maxsize)))
+	if err != nil {
+		return "", err
+	}
+	m := urltitle_title_regex.FindSubmatch(body)
+	if m == nil {
+		return "", nil
+	}
+	title := string(m[1])
+	if !utf8.ValidString(title) || strings.EqualFold(params["charset"], "iso-8859-1") {
+		title = latin1ToUTF8(m[1])
+	}
+	title = strings.Join(strings.Fields(html.UnescapeString(title)), " ")
+	return truncate(title, max_urltitle_length), nil
+}
+
+// e.g. "1.5 MiB"
+func formatSize(n int64) string {
+	switch {
+	case n < 1<<10:
+		return fmt.Sprintf("%d bytes", n)
+	case n < 1<<20:
+		return fmt.Sprintf("%.1f KiB", float64(n)/(1<<10))
+	case n < 1<<30:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	}
+	return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+}
+
+func latin1ToUTF8(b []byte) string {
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes)
+}
+
+// Cuts s after at most n bytes, without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n] + "..."
+}
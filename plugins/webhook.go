@@ -0,0 +1,344 @@
+package plugins
+
+import (
+	"../ircclient"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const (
+	// Put a reverse proxy with TLS in front of it to receive hooks from
+	// the internet
+	default_webhook_listen = "localhost:8090"
+	// Commits listed per push at most
+	max_webhook_commits = 3
+	// Payloads larger than this are rejected
+	max_webhook_size = 1 << 20
+)
+
+// The fields of GitHub and GitLab payloads that are announced. Both put the
+// pushed commits into "commits".
+type webhookPayload struct {
+	// GitHub
+	Action     string
+	Ref        string
+	Compare    string
+	Forced     bool
+	Repository struct {
+		Full_name string
+	}
+	Sender struct {
+		Login string
+	}
+	Issue struct {
+		Number   int
+		Title    string
+		Html_url string
+	}
+	Pull_request struct {
+		Number   int
+		Title    string
+		Html_url string
+		Merged   bool
+	}
+	Release struct {
+		Tag_name string
+		Name     string
+		Html_url string
+	}
+
+	// GitLab
+	User_name string
+	User      struct {
+		Username string
+	}
+	Project struct {
+		Path_with_namespace string
+		Web_url             string
+	}
+	Object_attributes struct {
+		Iid    int
+		Title  string
+		Action string
+		Url    string
+	}
+	Total_commits_count int
+	Tag                 string
+	Name                string
+	Url                 string
+
+	Commits []struct {
+		Id      string
+		Message string
+		Author  struct {
+			Name string
+		}
+	}
+}
+
+type WebhookPlugin struct {
+	ic     *ircclient.IRCClient
+	server *http.Server
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("webhook", func() ircclient.Plugin { return new(WebhookPlugin) })
+}
+
+func (q *WebhookPlugin) Register(cl *ircclient.IRCClient) {
+	q.ic = cl
+
+	if q.ic.GetStringOption("Webhook", "listen") == "" {
+		log.Println("added default webhook listen address \"" + default_webhook_listen + "\" to config file")
+		q.ic.SetStringOption("Webhook", "listen", default_webhook_listen)
+	}
+	if q.ic.GetStringOption("Webhook", "secret") == "" {
+		log.Println("webhook: no secret set in section Webhook, hooks are accepted from anyone")
+	}
+
+	l, err := net.Listen("tcp", q.ic.GetStringOption("Webhook", "listen"))
+	if err != nil {
+		log.Println("unable to listen for webhooks: " + err.Error())
+		return
+	}
+	q.server = &http.Server{Handler: q}
+	go func() {
+		if err := q.server.Serve(l); err != nil && err != http.ErrServerClosed {
+			log.Println("webhook server failed: " + err.Error())
+		}
+	}()
+}
+
+func (q *WebhookPlugin) String() string {
+	return "webhook"
+}
+
+func (q *WebhookPlugin) Info() string {
+	return "announces pushes, issues, pull requests and releases of GitHub and GitLab repositories"
+}
+
+func (q *WebhookPlugin) Usage(cmd string) string {
+	return ""
+}
+
+func (q *WebhookPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+}
+
+func (q *WebhookPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+}
+
+func (q *WebhookPlugin) Unregister() {
+	if q.server != nil {
+		q.server.Close()
+	}
+}
+
+// Receives the hooks. Answers 202 for events that aren't announced, so the
+// hosts don't show them as failed deliveries.
+func (q *WebhookPlugin) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, max_webhook_size+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(body) > max_webhook_size {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		http.Error(w, "invalid payload: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	repo := payload.Repository.Full_name
+	if repo == "" {
+		repo = payload.Project.Path_with_namespace
+	}
+	secret := q.secret(repo)
+
+	var lines []string
+	switch {
+	case r.Header.Get("X-GitHub-Event") != "":
+		if secret != "" && !validGitHubSignature(secret, body, r.Header.Get("X-Hub-Signature-256")) {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		lines = formatGitHubEvent(r.Header.Get("X-GitHub-Event"), &payload)
+	case r.Header.Get("X-Gitlab-Event") != "":
+		// GitLab sends the secret itself
+		if secret != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(r.Header.Get("X-Gitlab-Token"))) != 1 {
+			http.Error(w, "invalid token", http.StatusUnauthorized)
+			return
+		}
+		lines = formatGitLabEvent(r.Header.Get("X-Gitlab-Event"), &payload)
+	default:
+		http.Error(w, "unknown webhook sender", http.StatusBadRequest)
+		return
+	}
+
+	channels := q.channels(repo)
+	if len(channels) == 0 {
+		log.Printf("webhook: no channels configured for repository %q in section WebhookRepos", repo)
+	}
+	for _, channel := range channels {
+		for _, line := range lines {
+			q.ic.SendLine("PRIVMSG " + channel + " :" + line)
+		}
+	}
+	if len(lines) == 0 {
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// Returns the secret for repo from section WebhookSecrets, or the default
+// secret Webhook/secret
+func (q *WebhookPlugin) secret(repo string) string {
+	for _, r := range q.ic.GetOptions("WebhookSecrets") {
+		if strings.EqualFold(r, repo) {
+			return q.ic.GetStringOption("WebhookSecrets", r)
+		}
+	}
+	return q.ic.GetStringOption("Webhook", "secret")
+}
+
+// Returns the channels repo is announced in. Section WebhookRepos maps
+// repositories ("owner/name") to space separated lists of channels.
+func (q *WebhookPlugin) channels(repo string) []string {
+	for _, r := range q.ic.GetOptions("WebhookRepos") {
+		if strings.EqualFold(r, repo) {
+			return strings.Fields(q.ic.GetStringOption("WebhookRepos", r))
+		}
+	}
+	return nil
+}
+
+// Checks GitHub's "sha256=<hex HMAC of the body>"
+func validGitHubSignature(secret string, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	sig, err := hex.DecodeString(signature[len("sha256="):])
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(sig, mac.Sum(nil))
+}
+
+func formatGitHubEvent(event string, p *webhookPayload) []string {
+	repo := ircclient.FormatBold + p.Repository.Full_name + ircclient.FormatBold
+	switch event {
+	case "push":
+		if len(p.Commits) == 0 {
+			// branch or tag created or deleted
+			return nil
+		}
+		verb := "pushed"
+		if p.Forced {
+			verb = "force-pushed"
+		}
+		return formatPush(repo, p.Sender.Login, verb, p.Ref, len(p.Commits), p.Compare, p)
+	case "issues":
+		switch p.Action {
+		case "opened", "closed", "reopened":
+			return []string{fmt.Sprintf("[%s] %s %s issue #%d: %s %s", repo, p.Sender.Login, p.Action, p.Issue.Number, p.Issue.Title, p.Issue.Html_url)}
+		}
+	case "pull_request":
+		action := p.Action
+		if action == "closed" && p.Pull_request.Merged {
+			action = "merged"
+		}
+		switch action {
+		case "opened", "closed", "reopened", "merged":
+			return []string{fmt.Sprintf("[%s] %s %s pull request #%d: %s %s", repo, p.Sender.Login, action, p.Pull_request.Number, p.Pull_request.Title, p.Pull_request.Html_url)}
+		}
+	case "release":
+		if p.Action == "published" {
+			return []string{fmt.Sprintf("[%s] %s released %s %s", repo, p.Sender.Login, releaseName(p.Release.Tag_name, p.Release.Name), p.Release.Html_url)}
+		}
+	}
+	return nil
+}
+
+func formatGitLabEvent(event string, p *webhookPayload) []string {
+	repo := ircclient.FormatBold + p.Project.Path_with_namespace + ircclient.FormatBold
+	a := &p.Object_attributes
+	switch event {
+	case "Push Hook":
+		if p.Total_commits_count == 0 {
+			return nil
+		}
+		return formatPush(repo, p.User_name, "pushed", p.Ref, p.Total_commits_count, p.Project.Web_url+"/-/commits/"+strings.TrimPrefix(p.Ref, "refs/heads/"), p)
+	case "Issue Hook":
+		if verb, ok := gitlabActions[a.Action]; ok {
+			return []string{fmt.Sprintf("[%s] %s %s issue #%d: %s %s", repo, p.User.Username, verb, a.Iid, a.Title, a.Url)}
+		}
+	case "Merge Request Hook":
+		if verb, ok := gitlabActions[a.Action]; ok {
+			return []string{fmt.Sprintf("[%s] %s %s merge request !%d: %s %s", repo, p.User.Username, verb, a.Iid, a.Title, a.Url)}
+		}
+	case "Release Hook":
+		if p.Action == "create" {
+			return []string{fmt.Sprintf("[%s] released %s %s", repo, releaseName(p.Tag, p.Name), p.Url)}
+		}
+	}
+	return nil
+}
+
+var gitlabActions = map[string]string{
+	"open":   "opened",
+	"close":  "closed",
+	"reopen": "reopened",
+	"merge":  "merged",
+}
+
+// e.g. "[mett/bot] alice pushed 2 commits to master: <url>", followed by the
+// commits
+func formatPush(repo, user, verb, ref string, count int, url string, p *webhookPayload) []string {
+	what := "1 commit"
+	if count != 1 {
+		what = fmt.Sprintf("%d commits", count)
+	}
+	branch := strings.TrimPrefix(strings.TrimPrefix(ref, "refs/heads/"), "refs/tags/")
+	lines := []string{fmt.Sprintf("[%s] %s %s %s to %s: %s", repo, user, verb, what, branch, url)}
+	commits := p.Commits
+	if len(commits) > max_webhook_commits {
+		// both list the oldest commit first
+		commits = commits[len(commits)-max_webhook_commits:]
+	}
+	for _, c := range commits {
+		id := c.Id
+		if len(id) > 7 {
+			id = id[:7]
+		}
+		message := strings.SplitN(strings.TrimSpace(c.Message), "\n", 2)[0]
+		lines = append(lines, fmt.Sprintf("  %s %s (%s)", id, message, c.Author.Name))
+	}
+	if count > len(commits) {
+		lines = append(lines, fmt.Sprintf("  ... and %d more", count-len(commits)))
+	}
+	return lines
+}
+
+func releaseName(tag, name string) string {
+	if name == "" || name == tag {
+		return tag
+	}
+	return tag + " (" + name + ")"
+}
@@ -0,0 +1,247 @@
+package plugins
+
+// A minimal websocket client (RFC 6455), enough for the JSON gateways of
+// chat services: messages (fragmented ones included) are read and written
+// whole, pings are answered. Extensions like compression aren't supported.
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+const (
+	// Messages larger than this are rejected
+	max_ws_message = 16 << 20
+	ws_timeout     = 30 * time.Second
+	// Appended to the key of the handshake, see RFC 6455 section 1.3
+	ws_guid = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+)
+
+const (
+	ws_continuation = 0x0
+	ws_text         = 0x1
+	ws_binary       = 0x2
+	ws_close        = 0x8
+	ws_ping         = 0x9
+	ws_pong         = 0xa
+)
+
+// Returned by readMessage() when the server closed the connection
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket closed with code %d %s", e.Code, e.Reason)
+}
+
+type wsConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	// frames are written by several goroutines, e.g. heartbeats
+	writeLock sync.Mutex
+}
+
+// Connects to a ws:// or wss:// URL
+func dialWebsocket(ctx context.Context, rawurl string) (*wsConn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "wss" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, ws_timeout)
+	defer cancel()
+	var conn net.Conn
+	switch u.Scheme {
+	case "wss":
+		d := &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		conn, err = d.DialContext(ctx, "tcp", host)
+	case "ws":
+		var d net.Dialer
+		conn, err = d.DialContext(ctx, "tcp", host)
+	default:
+		return nil, errors.New("not a websocket URL: " + rawurl)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	request := &http.Request{Method: "GET", URL: u, Host: u.Host, Header: http.Header{
+		"Upgrade":               {"websocket"},
+		"Connection":            {"Upgrade"},
+		"Sec-WebSocket-Key":     {key},
+		"Sec-WebSocket-Version": {"13"},
+	}}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	r := bufio.NewReader(conn)
+	response, err := http.ReadResponse(r, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	accept := sha1.Sum([]byte(key + ws_guid))
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, errors.New("websocket handshake failed: " + response.Status)
+	}
+	if response.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		conn.Close()
+		return nil, errors.New("websocket handshake failed: wrong Sec-WebSocket-Accept")
+	}
+	conn.SetDeadline(time.Time{})
+	return &wsConn{conn: conn, r: r}, nil
+}
+
+// Returns the next text or binary message. Control frames are handled on
+// the way.
+func (c *wsConn) readMessage() ([]byte, error) {
+	var message []byte
+	started := false
+	for {
+		fin, opcode, payload, err := c.readFrame()
+		if err != nil {
+			return nil, err
+		}
+		switch opcode {
+		case ws_ping:
+			if err := c.writeFrame(ws_pong, payload); err != nil {
+				return nil, err
+			}
+		case ws_pong:
+		case ws_close:
+			// 1005: no code given
+			e := &wsCloseError{Code: 1005}
+			if len(payload) >= 2 {
+				e.Code, e.Reason = int(binary.BigEndian.Uint16(payload)), string(payload[2:])
+				payload = payload[:2]
+			}
+			// answer with the same code, as the protocol wants it
+			c.writeFrame(ws_close, payload)
+			c.conn.Close()
+			return nil, e
+		case ws_text, ws_binary, ws_continuation:
+			if (opcode == ws_continuation) != started {
+				return nil, errors.New("websocket: unexpected frame")
+			}
+			started = true
+			if len(message)+len(payload) > max_ws_message {
+				return nil, errors.New("websocket: message too large")
+			}
+			message = append(message, payload...)
+			if fin {
+				return message, nil
+			}
+		default:
+			return nil, fmt.Errorf("websocket: unknown opcode %d", opcode)
+		}
+	}
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.r, header[:]); err != nil {
+		return
+	}
+	fin, opcode = header[0]&0x80 != 0, header[0]&0x0f
+	if header[1]&0x80 != 0 {
+		err = errors.New("websocket: masked frame from server")
+		return
+	}
+	length := uint64(header[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.r, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	if length > max_ws_message {
+		err = errors.New("websocket: frame too large")
+		return
+	}
+	payload = make([]byte, length)
+	_, err = io.ReadFull(c.r, payload)
+	return
+}
+
+// Sends data as a text message
+func (c *wsConn) writeMessage(data []byte) error {
+	return c.writeFrame(ws_text, data)
+}
+
+// Writes a single frame, masked as required for clients
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode, 0}
+	switch {
+	case len(payload) < 126:
+		frame[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(len(payload)))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	}
+	frame[1] |= 0x80
+	var mask [4]byte
+	if _, err := rand.Read(mask[:]); err != nil {
+		return err
+	}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(ws_timeout))
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Sends a close frame with code and closes the connection
+func (c *wsConn) close(code int) error {
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	c.writeFrame(ws_close, payload)
+	return c.conn.Close()
+}
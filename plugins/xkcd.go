@@ -146,6 +146,10 @@ type XKCDPlugin struct {
 	mutex sync.Mutex
 }
 
+func init() {
+	ircclient.RegisterPluginFactory("xkcd", func() ircclient.Plugin { return new(XKCDPlugin) })
+}
+
 func (x *XKCDPlugin) Register(cl *ircclient.IRCClient) {
 	x.ic = cl
 
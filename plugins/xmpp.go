@@ -0,0 +1,623 @@
+package plugins
+
+// Bridges XMPP multi-user chats (MUCs) and IRC channels, using an XMPP
+// account of its own:
+//
+//	[XMPP]
+//	jid: mettbot@example.org
+//	password: secret
+//
+//	[XMPPRooms]
+//	mett: mett@conference.example.org libera/#mett
+//
+// The server is found through DNS (SRV records), option server (host:port)
+// overrides it. The connection has to be encrypted with STARTTLS. In the
+// rooms, the bot uses option nick (default "MettBot"). Each option of
+// section XMPPRooms links a room with channels, written as in section
+// Relay. Besides messages, people entering and leaving a room are
+// announced in the channels. Like the relay plugin, it has to be
+// registered with BotManager.RegisterPlugin().
+
+import (
+	"../ircclient"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	default_xmpp_nick = "MettBot"
+	// Wait after losing the connection, doubled up to xmpp_max_retry
+	xmpp_retry     = 5 * time.Second
+	xmpp_max_retry = 5 * time.Minute
+	// A space is sent this often, so idle connections aren't dropped
+	xmpp_keepalive = time.Minute
+	xmpp_timeout   = 30 * time.Second
+)
+
+const (
+	ns_xmpp_tls     = "urn:ietf:params:xml:ns:xmpp-tls"
+	ns_xmpp_sasl    = "urn:ietf:params:xml:ns:xmpp-sasl"
+	ns_xmpp_bind    = "urn:ietf:params:xml:ns:xmpp-bind"
+	ns_xmpp_session = "urn:ietf:params:xml:ns:xmpp-session"
+	ns_xmpp_muc     = "http://jabber.org/protocol/muc"
+)
+
+// Returned by connect() if retrying makes no sense
+var errXMPPAuth = errors.New("authentication failed, check jid and password in section XMPP")
+
+type xmppFeatures struct {
+	StartTLS   *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-tls starttls"`
+	Mechanisms *struct {
+		Mechanism []string `xml:"mechanism"`
+	} `xml:"urn:ietf:params:xml:ns:xmpp-sasl mechanisms"`
+	Bind *struct{} `xml:"urn:ietf:params:xml:ns:xmpp-bind bind"`
+}
+
+// A message, presence or iq, only the parts used here
+type xmppStanza struct {
+	XMLName xml.Name
+	From    string `xml:"from,attr"`
+	Type    string `xml:"type,attr"`
+	ID      string `xml:"id,attr"`
+	Body    string `xml:"body"`
+	// history, resent when joining
+	Delay *struct{} `xml:"urn:xmpp:delay delay"`
+	Ping  *struct{} `xml:"urn:xmpp:ping ping"`
+	MUC   *struct {
+		Item struct {
+			Nick string `xml:"nick,attr"`
+		} `xml:"item"`
+		Status []struct {
+			Code string `xml:"code,attr"`
+		} `xml:"status"`
+	} `xml:"http://jabber.org/protocol/muc#user x"`
+}
+
+// Returns whether the MUC status code is among the stanza's
+func (s *xmppStanza) hasStatus(code string) bool {
+	if s.MUC == nil {
+		return false
+	}
+	for _, st := range s.MUC.Status {
+		if st.Code == code {
+			return true
+		}
+	}
+	return false
+}
+
+// A connection to the server
+type xmppConn struct {
+	conn      net.Conn
+	dec       *xml.Decoder
+	writeLock sync.Mutex
+}
+
+func (c *xmppConn) send(format string, args ...interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(xmpp_timeout))
+	_, err := fmt.Fprintf(c.conn, format, args...)
+	return err
+}
+
+// Opens a new stream on the connection, as needed after STARTTLS and
+// authentication, and returns the features the server offers
+func (c *xmppConn) open(domain string) (*xmppFeatures, error) {
+	c.dec = xml.NewDecoder(c.conn)
+	err := c.send("<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", xmlEscape(domain))
+	if err != nil {
+		return nil, err
+	}
+	for {
+		t, err := c.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		if start, ok := t.(xml.StartElement); ok {
+			if start.Name.Local == "stream" {
+				continue
+			}
+			if start.Name.Local != "features" {
+				return nil, errors.New("expected stream features, got " + start.Name.Local)
+			}
+			var features xmppFeatures
+			return &features, c.dec.DecodeElement(&features, &start)
+		}
+	}
+}
+
+// Returns the next top level element, skipping whitespace
+func (c *xmppConn) next() (*xml.StartElement, error) {
+	for {
+		t, err := c.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch t := t.(type) {
+		case xml.StartElement:
+			return &t, nil
+		case xml.EndElement:
+			if t.Name.Local == "stream" {
+				return nil, io.EOF
+			}
+		}
+	}
+}
+
+// Occupants of a room, see XMPPPlugin.presence()
+type xmppRoom struct {
+	endpoints []relayEndpoint
+	occupants map[string]bool
+	// our own presence has arrived, i.e. the list of occupants is complete
+	joined bool
+}
+
+type XMPPPlugin struct {
+	// network -> client, see Register()
+	clients map[string]*ircclient.IRCClient
+	// the client the options are read from, the sections are the same for
+	// all networks
+	conf *ircclient.IRCClient
+	jid  string
+	nick string
+	// bare room JID (lower case) -> room
+	rooms map[string]*xmppRoom
+	// the current connection, nil while disconnected
+	conn *xmppConn
+	// stops the connection
+	cancel func()
+	sync.Mutex
+}
+
+func init() {
+	ircclient.RegisterPluginFactory("xmpp", func() ircclient.Plugin { return new(XMPPPlugin) })
+}
+
+// Called once per network when registered with a BotManager, connects on
+// the first call
+func (q *XMPPPlugin) Register(cl *ircclient.IRCClient) {
+	q.Lock()
+	defer q.Unlock()
+	if q.clients != nil {
+		q.clients[cl.Network()] = cl
+		return
+	}
+	q.clients = map[string]*ircclient.IRCClient{cl.Network(): cl}
+	q.conf = cl
+	q.jid = cl.GetStringOption("XMPP", "jid")
+	if q.jid == "" || !strings.Contains(q.jid, "@") {
+		log.Println("xmpp: no jid set in section XMPP, not bridging")
+		return
+	}
+	if q.nick = cl.GetStringOption("XMPP", "nick"); q.nick == "" {
+		q.nick = default_xmpp_nick
+	}
+	q.rooms = make(map[string]*xmppRoom)
+	for _, option := range cl.GetOptions("XMPPRooms") {
+		fields := strings.Fields(cl.GetStringOption("XMPPRooms", option))
+		if len(fields) < 2 {
+			log.Println("xmpp: option " + option + " of section XMPPRooms needs a room and channels")
+			continue
+		}
+		room := strings.ToLower(fields[0])
+		if q.rooms[room] == nil {
+			q.rooms[room] = &xmppRoom{}
+		}
+		q.rooms[room].endpoints = append(q.rooms[room].endpoints, parseRelayLink(strings.Join(fields[1:], " "))...)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	go q.run(ctx)
+}
+
+func (q *XMPPPlugin) String() string {
+	return "xmpp"
+}
+
+func (q *XMPPPlugin) Info() string {
+	return "bridges XMPP multi-user chats and IRC channels"
+}
+
+func (q *XMPPPlugin) Usage(cmd string) string {
+	// plugin has no commands
+	return ""
+}
+
+func (q *XMPPPlugin) ProcessCommand(cmd *ircclient.IRCCommand) {
+	// interface saturation
+}
+
+func (q *XMPPPlugin) Unregister() {
+	q.Lock()
+	defer q.Unlock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+	q.clients = nil
+}
+
+// Sends messages of linked channels to their rooms
+func (q *XMPPPlugin) ProcessLine(msg *ircclient.IRCMessage) {
+	if msg.Command != "PRIVMSG" || len(msg.Args) == 0 || !strings.Contains(msg.Source, "!") {
+		return
+	}
+	q.Lock()
+	ic, conn := q.clients[msg.Network], q.conn
+	q.Unlock()
+	if ic == nil || conn == nil || !ic.IsChannelName(msg.Target) {
+		return
+	}
+	nick, _, _ := ircclient.ParseSource(msg.Source)
+	if ic.CanonNick(nick) == ic.CanonNick(ic.GetStringOption("Server", "nick")) {
+		return
+	}
+
+	body := "<" + nick + "> " + ircclient.StripFormatting(msg.Args[0])
+	if command, text, ok := msg.CTCP(); ok {
+		if command != "ACTION" {
+			return
+		}
+		body = "* " + nick + " " + ircclient.StripFormatting(text)
+	}
+	from := relayEndpoint{msg.Network, ic.CanonChannel(msg.Target)}
+	q.Lock()
+	var rooms []string
+	for jid, room := range q.rooms {
+		for _, e := range room.endpoints {
+			if e.network == from.network && ic.CanonChannel(e.channel) == from.channel {
+				rooms = append(rooms, jid)
+				break
+			}
+		}
+	}
+	q.Unlock()
+	for _, room := range rooms {
+		err := conn.send("<message to='%s' type='groupchat' id='%s'><body>%s</body></message>", xmlEscape(room), xmppID(), xmlEscape(body))
+		if err != nil {
+			log.Println("xmpp: unable to send to " + room + ": " + err.Error())
+		}
+	}
+}
+
+// Keeps a connection up until ctx is cancelled
+func (q *XMPPPlugin) run(ctx context.Context) {
+	retry := xmpp_retry
+	for {
+		started := time.Now()
+		err := q.connect(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == errXMPPAuth {
+			log.Println("xmpp: " + err.Error())
+			return
+		}
+		log.Println("xmpp: connection lost: " + err.Error())
+		// a connection that worked for a while doesn't count as failure
+		if time.Since(started) > xmpp_max_retry {
+			retry = xmpp_retry
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(retry):
+		}
+		if retry *= 2; retry > xmpp_max_retry {
+			retry = xmpp_max_retry
+		}
+	}
+}
+
+// Connects, logs in, joins the rooms and processes the stanzas until the
+// connection is lost or ctx is cancelled
+func (q *XMPPPlugin) connect(ctx context.Context) error {
+	domain := q.jid[strings.LastIndex(q.jid, "@")+1:]
+	c, err := q.dial(ctx, domain)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	raw := c.conn
+	go func() {
+		select {
+		case <-ctx.Done():
+			// unblocks the reader, also while logging in
+			raw.Close()
+		case <-done:
+		}
+	}()
+
+	if err := q.login(c, domain); err != nil {
+		return err
+	}
+	c.conn.SetReadDeadline(time.Time{})
+	go func() {
+		ticker := time.NewTicker(xmpp_keepalive)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				c.send(" ")
+			}
+		}
+	}()
+
+	q.Lock()
+	q.conn = c
+	var joins []string
+	for jid, room := range q.rooms {
+		room.occupants, room.joined = make(map[string]bool), false
+		joins = append(joins, jid)
+	}
+	q.Unlock()
+	defer func() {
+		q.Lock()
+		q.conn = nil
+		q.Unlock()
+	}()
+	if err := c.send("<presence/>"); err != nil {
+		return err
+	}
+	for _, room := range joins {
+		// no history, it would be relayed again
+		err := c.send("<presence to='%s/%s'><x xmlns='%s'><history maxstanzas='0'/></x></presence>", xmlEscape(room), xmlEscape(q.nick), ns_xmpp_muc)
+		if err != nil {
+			return err
+		}
+	}
+
+	for {
+		start, err := c.next()
+		if err != nil {
+			return err
+		}
+		if start.Name.Local == "error" {
+			return errors.New("stream error")
+		}
+		var s xmppStanza
+		if err := c.dec.DecodeElement(&s, start); err != nil {
+			return err
+		}
+		switch s.XMLName.Local {
+		case "message":
+			q.message(&s)
+		case "presence":
+			q.presence(&s)
+		case "iq":
+			q.iq(c, &s)
+		}
+	}
+}
+
+// Connects to the server of domain, found with its SRV records unless
+// option server is set
+func (q *XMPPPlugin) dial(ctx context.Context, domain string) (*xmppConn, error) {
+	addrs := []string{net.JoinHostPort(domain, "5222")}
+	if server := q.conf.GetStringOption("XMPP", "server"); server != "" {
+		addrs = []string{server}
+	} else if _, srvs, err := net.DefaultResolver.LookupSRV(ctx, "xmpp-client", "tcp", domain); err == nil && len(srvs) > 0 {
+		addrs = nil
+		for _, srv := range srvs {
+			addrs = append(addrs, net.JoinHostPort(strings.TrimSuffix(srv.Target, "."), strconv.Itoa(int(srv.Port))))
+		}
+	}
+	d := net.Dialer{Timeout: xmpp_timeout}
+	var err error
+	for _, addr := range addrs {
+		var conn net.Conn
+		if conn, err = d.DialContext(ctx, "tcp", addr); err == nil {
+			return &xmppConn{conn: conn}, nil
+		}
+	}
+	return nil, err
+}
+
+// Negotiates TLS, authenticates and binds a resource
+func (q *XMPPPlugin) login(c *xmppConn, domain string) error {
+	// the negotiation must not hang
+	c.conn.SetReadDeadline(time.Now().Add(xmpp_timeout))
+	features, err := c.open(domain)
+	if err != nil {
+		return err
+	}
+	if features.StartTLS == nil {
+		return errors.New("server doesn't offer STARTTLS, not sending the password unencrypted")
+	}
+	if err := c.send("<starttls xmlns='%s'/>", ns_xmpp_tls); err != nil {
+		return err
+	}
+	if start, err := c.next(); err != nil {
+		return err
+	} else if start.Name.Local != "proceed" {
+		return errors.New("STARTTLS failed")
+	}
+	tlsConn := tls.Client(c.conn, &tls.Config{ServerName: domain})
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	c.conn = tlsConn
+	if features, err = c.open(domain); err != nil {
+		return err
+	}
+
+	plain := false
+	if features.Mechanisms != nil {
+		for _, m := range features.Mechanisms.Mechanism {
+			plain = plain || m == "PLAIN"
+		}
+	}
+	if !plain {
+		return errors.New("server doesn't offer SASL PLAIN")
+	}
+	user := q.jid[:strings.LastIndex(q.jid, "@")]
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + user + "\x00" + q.conf.GetStringOption("XMPP", "password")))
+	if err := c.send("<auth xmlns='%s' mechanism='PLAIN'>%s</auth>", ns_xmpp_sasl, credentials); err != nil {
+		return err
+	}
+	if start, err := c.next(); err != nil {
+		return err
+	} else if start.Name.Local != "success" {
+		return errXMPPAuth
+	}
+	if features, err = c.open(domain); err != nil {
+		return err
+	}
+
+	if features.Bind == nil {
+		return errors.New("server doesn't offer resource binding")
+	}
+	if err := c.send("<iq type='set' id='bind'><bind xmlns='%s'><resource>%s</resource></bind></iq>", ns_xmpp_bind, xmppID()); err != nil {
+		return err
+	}
+	start, err := c.next()
+	if err != nil {
+		return err
+	}
+	var bound xmppStanza
+	if err := c.dec.DecodeElement(&bound, start); err != nil {
+		return err
+	}
+	if bound.Type != "result" {
+		return errors.New("resource binding failed")
+	}
+	// only needed by old servers, others ignore it
+	return c.send("<iq type='set' id='session'><session xmlns='%s'/></iq>", ns_xmpp_session)
+}
+
+// Relays group chat messages of linked rooms
+func (q *XMPPPlugin) message(s *xmppStanza) {
+	room, nick := splitXMPPJID(s.From)
+	if s.Type != "groupchat" || s.Body == "" || s.Delay != nil || nick == "" || nick == q.nick {
+		return
+	}
+	q.Lock()
+	r, clients := q.rooms[room], q.clients
+	q.Unlock()
+	if r == nil {
+		return
+	}
+	prefix := "<" + relayNick(nick) + "> "
+	body := s.Body
+	if strings.HasPrefix(body, "/me ") {
+		prefix, body = "* "+relayNick(nick)+" ", body[len("/me "):]
+	}
+	for _, to := range r.endpoints {
+		if ic := clients[to.network]; ic != nil {
+			sendBridged(ic, to.channel, prefix, body)
+		}
+	}
+}
+
+// Keeps track of the occupants of linked rooms and announces who enters
+// and leaves. The occupants present when we join aren't announced.
+func (q *XMPPPlugin) presence(s *xmppStanza) {
+	room, nick := splitXMPPJID(s.From)
+	q.Lock()
+	r := q.rooms[room]
+	line := ""
+	if r != nil && nick != "" {
+		line = r.update(s, room, nick)
+	}
+	clients := q.clients
+	q.Unlock()
+	if line == "" {
+		return
+	}
+	for _, to := range r.endpoints {
+		if ic := clients[to.network]; ic != nil {
+			ic.Privmsg(to.channel, line)
+		}
+	}
+}
+
+// Updates the occupants with the presence s of nick. Returns the line to
+// announce it with, "" if there's nothing to announce.
+func (r *xmppRoom) update(s *xmppStanza, room, nick string) string {
+	if s.Type == "error" {
+		log.Println("xmpp: unable to join " + room + " as " + nick)
+		return ""
+	}
+	// 110: our own presence, sent last when joining
+	if s.hasStatus("110") {
+		r.joined = s.Type != "unavailable"
+		return ""
+	}
+
+	var line string
+	switch {
+	case s.Type == "unavailable" && s.hasStatus("303"):
+		// nick change, followed by the presence with the new nick
+		delete(r.occupants, nick)
+		r.occupants[s.MUC.Item.Nick] = true
+		line = "*** " + relayNick(nick) + " is now known as " + relayNick(s.MUC.Item.Nick)
+	case s.Type == "unavailable":
+		if !r.occupants[nick] {
+			return ""
+		}
+		delete(r.occupants, nick)
+		line = "<-- " + relayNick(nick) + " left " + room
+	case s.Type == "":
+		// also sent for status changes
+		if r.occupants[nick] {
+			return ""
+		}
+		r.occupants[nick] = true
+		line = "--> " + relayNick(nick) + " joined " + room
+	}
+	if !r.joined {
+		return ""
+	}
+	return line
+}
+
+// Answers pings, other requests are refused as the protocol demands
+func (q *XMPPPlugin) iq(c *xmppConn, s *xmppStanza) {
+	if s.Type != "get" && s.Type != "set" {
+		return
+	}
+	if s.Ping != nil {
+		c.send("<iq type='result' to='%s' id='%s'/>", xmlEscape(s.From), xmlEscape(s.ID))
+		return
+	}
+	c.send("<iq type='error' to='%s' id='%s'><error type='cancel'><service-unavailable xmlns='urn:ietf:params:xml:ns:xmpp-stanzas'/></error></iq>", xmlEscape(s.From), xmlEscape(s.ID))
+}
+
+// Splits room@service/nick into the bare JID (lower case) and the resource
+func splitXMPPJID(jid string) (bare, resource string) {
+	if i := strings.IndexByte(jid, '/'); i >= 0 {
+		return strings.ToLower(jid[:i]), jid[i+1:]
+	}
+	return strings.ToLower(jid), ""
+}
+
+// Returns a random ID for stanzas
+func xmppID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}